@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"io"
 	"os"
@@ -9,6 +10,7 @@ import (
 
 	"github.com/canonical/ubuntu-image/internal/commands"
 	"github.com/canonical/ubuntu-image/internal/helper"
+	"github.com/canonical/ubuntu-image/internal/imagedefinition"
 	"github.com/canonical/ubuntu-image/internal/statemachine"
 )
 
@@ -18,7 +20,10 @@ var Version string = ""
 
 // helper variables for unit testing
 var osExit = os.Exit
+var osMkdirTemp = os.MkdirTemp
 var captureStd = helper.CaptureStd
+var statemachineValidateImageDefinition = statemachine.ValidateImageDefinition
+var jsonMarshalIndent = json.MarshalIndent
 
 var stateMachineLongDesc = `Options for controlling the internal state machine.
 Other than -w, these options are mutually exclusive. When -u or -t is given,
@@ -68,23 +73,59 @@ func executeStateMachine(sm statemachine.SmInterface) error {
 	return nil
 }
 
-// unhidePackOpts make pack options visible in help if the pack command is used
-// This should be removed when the pack command is made visible to everyone
-func unhidePackOpts(parser *flags.Parser) {
-	// Save given options before removing them temporarily
-	// otherwise the help will be displayed twice
-	opts := parser.Options
-	parser.Options = 0
-	defer func() { parser.Options = opts }()
-	// parse once to determine the active command
-	// we do not care about error here since we will reparse again
-	_, _ = parser.Parse()
-
-	if parser.Active != nil {
-		if parser.Active.Name == "pack" {
-			parser.Active.Hidden = false
-		}
+// verifyReproducible builds the image a second time in a temporary output
+// directory and checks that its artifacts are identical to the ones of the
+// first build, which were written in commonOpts.OutputDir
+func verifyReproducible(imageType string, commonOpts *commands.CommonOpts, ubuntuImageCommand *commands.UbuntuImageCommand) error {
+	rebuildDir, err := osMkdirTemp("", "ubuntu-image-rebuild-")
+	if err != nil {
+		return fmt.Errorf("Error creating the rebuild directory: %s", err.Error())
+	}
+	defer os.RemoveAll(rebuildDir)
+
+	// the second build uses a temporary workdir and does not report
+	// its progress as JSON
+	rebuildOpts := *commonOpts
+	rebuildOpts.OutputDir = rebuildDir
+	rebuildOpts.ProgressFormat = "text"
+	rebuildOpts.ProgressFile = ""
+	sm, err := initStateMachine(imageType, &rebuildOpts, &commands.StateMachineOpts{}, ubuntuImageCommand)
+	if err != nil {
+		return err
+	}
+	if err := executeStateMachine(sm); err != nil {
+		return fmt.Errorf("Error rebuilding the image: %s", err.Error())
+	}
+	return statemachine.CompareArtifacts(commonOpts.OutputDir, rebuildDir)
+}
+
+// validateImageDefinition prints the problems found in the image definition
+// given to the validate command, and fails if there are any
+func validateImageDefinition(validateCommand *commands.ValidateCommand) error {
+	imageDefinition := validateCommand.ValidateArgsPassed.ImageDefinition
+	validationErrors, err := statemachineValidateImageDefinition(imageDefinition,
+		validateCommand.ValidateOptsPassed.Set, validateCommand.ValidateOptsPassed.GadgetYaml)
+	if err != nil {
+		return err
+	}
+	for _, validationError := range validationErrors {
+		fmt.Println(validationError.Error())
+	}
+	if len(validationErrors) > 0 {
+		return fmt.Errorf("%d problems found in image definition \"%s\"", len(validationErrors), imageDefinition)
+	}
+	fmt.Printf("Image definition \"%s\" is valid\n", imageDefinition)
+	return nil
+}
+
+// printSchema prints the JSON schema of image definition files
+func printSchema() error {
+	schema, err := jsonMarshalIndent(imagedefinition.Schema(), "", "  ")
+	if err != nil {
+		return fmt.Errorf("Error generating the image definition schema: %s", err.Error())
 	}
+	fmt.Println(string(schema))
+	return nil
 }
 
 func main() {
@@ -125,8 +166,6 @@ func main() {
 	}
 	defer restoreStderr()
 
-	unhidePackOpts(parser)
-
 	// Parse the options provided and handle specific errors
 	if _, err := parser.Parse(); err != nil {
 		if e, ok := err.(*flags.Error); ok {
@@ -172,12 +211,14 @@ func main() {
 	restoreStdout()
 	restoreStderr()
 
+	// we expect Version to be supplied at build time or fetched from the snap environment
+	if Version == "" {
+		Version = os.Getenv("SNAP_VERSION")
+	}
+	statemachine.UbuntuImageVersion = Version
+
 	// in case user only requested version number, print and exit
 	if commonOpts.Version {
-		// we expect Version to be supplied at build time or fetched from the snap environment
-		if Version == "" {
-			Version = os.Getenv("SNAP_VERSION")
-		}
 		fmt.Printf("ubuntu-image %s\n", Version)
 		osExit(0)
 		return
@@ -188,6 +229,22 @@ func main() {
 		imageType = parser.Command.Active.Name
 	}
 
+	// validating an image definition or printing its schema does not build anything
+	switch imageType {
+	case "validate":
+		if err := validateImageDefinition(&ubuntuImageCommand.Validate); err != nil {
+			fmt.Printf("Error: %s\n", err.Error())
+			osExit(1)
+		}
+		return
+	case "schema":
+		if err := printSchema(); err != nil {
+			fmt.Printf("Error: %s\n", err.Error())
+			osExit(1)
+		}
+		return
+	}
+
 	// init the state machine
 	sm, err := initStateMachine(imageType, commonOpts, stateMachineOpts, ubuntuImageCommand)
 	if err != nil {
@@ -203,4 +260,13 @@ func main() {
 		osExit(1)
 		return
 	}
+
+	// the output directory of the first build has been resolved by now
+	if commonOpts.VerifyReproducible {
+		if err := verifyReproducible(imageType, commonOpts, ubuntuImageCommand); err != nil {
+			fmt.Printf("Error: %s\n", err.Error())
+			osExit(1)
+			return
+		}
+	}
 }
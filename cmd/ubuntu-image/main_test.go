@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/json"
 	"errors"
 	"flag"
 	"io"
@@ -11,6 +12,8 @@ import (
 
 	"github.com/canonical/ubuntu-image/internal/commands"
 	"github.com/canonical/ubuntu-image/internal/helper"
+	"github.com/canonical/ubuntu-image/internal/imagedefinition"
+	"github.com/canonical/ubuntu-image/internal/statemachine"
 )
 
 var (
@@ -117,7 +120,7 @@ func TestInvalidCommands(t *testing.T) {
 		flags         []string
 		expectedError string
 	}{
-		{"invalid_command", []string{"test"}, nil, "Unknown command `test'. Please specify one command of: classic or snap"},
+		{"invalid_command", []string{"test"}, nil, "Unknown command `test'. Please specify one command of: classic, pack, schema, snap or validate"},
 		{"no_model_assertion", []string{"snap"}, nil, "the required argument `model_assertion` was not provided"},
 		{"no_gadget_tree", []string{"classic"}, nil, "the required argument `image_definition` was not provided"},
 		{"invalid_flag", []string{"classic"}, []string{"--nonexistent"}, "unknown flag `nonexistent'"},
@@ -125,6 +128,7 @@ func TestInvalidCommands(t *testing.T) {
 		{"invalid_sector_size", []string{"snap"}, []string{"--sector_size=123"}, "unknown flag `sector_size'"},
 		{"missing_one_flag", []string{"pack"}, []string{"--artifact-type=raw"}, "the required flags `--gadget-dir' and `--rootfs-dir' were not specified"},
 		{"missing_flags", []string{"pack"}, []string{"--artifact-type=raw", "--gadget-dir=./test"}, "the required flag `--rootfs-dir' was not specified"},
+		{"invalid_artifact_type", []string{"pack"}, []string{"--artifact-type=iso", "--gadget-dir=./test", "--rootfs-dir=./test"}, "Invalid value `iso' for option `--artifact-type'"},
 	}
 	for _, tc := range testCases {
 		tc := tc // capture range variable for parallel execution
@@ -342,3 +346,103 @@ func TestExecuteStateMachine(t *testing.T) {
 		})
 	}
 }
+
+// TestFailedVerifyReproducible tests the failures of the second build of --verify-reproducible
+func TestFailedVerifyReproducible(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	commonOpts := &commands.CommonOpts{OutputDir: t.TempDir()}
+
+	osMkdirTemp = func(string, string) (string, error) { return "", errors.New("Test Error") }
+	t.Cleanup(func() { osMkdirTemp = os.MkdirTemp })
+	err := verifyReproducible("snap", commonOpts, &commands.UbuntuImageCommand{})
+	asserter.AssertErrContains(err, "Error creating the rebuild directory")
+	osMkdirTemp = os.MkdirTemp
+
+	err = verifyReproducible("unknown", commonOpts, &commands.UbuntuImageCommand{})
+	asserter.AssertErrContains(err, "unsupported command")
+
+	// the options of the first build are validated again
+	commonOpts.Quiet = true
+	commonOpts.Debug = true
+	err = verifyReproducible("snap", commonOpts, &commands.UbuntuImageCommand{})
+	asserter.AssertErrContains(err, "Error rebuilding the image")
+}
+
+// TestValidateImageDefinition tests that the validate command prints the
+// problems found in the image definition and fails when there are any
+func TestValidateImageDefinition(t *testing.T) {
+	testCases := []struct {
+		name             string
+		validationErrors []statemachine.ValidationError
+		validationErr    error
+		expectedExit     int
+	}{
+		{"valid", nil, nil, 0},
+		{"invalid", []statemachine.ValidationError{{File: "image.yaml", Line: 3, Message: "series is required"}}, nil, 1},
+		{"unreadable", nil, errors.New("Test Error"), 1},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			oldOsExit := osExit
+			t.Cleanup(func() {
+				osExit = oldOsExit
+			})
+			got := 0
+			osExit = func(code int) {
+				got = code
+			}
+
+			var gotArgs []string
+			statemachineValidateImageDefinition = func(imageDefinition string, set []string, gadgetYaml string) ([]statemachine.ValidationError, error) {
+				gotArgs = append([]string{imageDefinition, gadgetYaml}, set...)
+				return tc.validationErrors, tc.validationErr
+			}
+			t.Cleanup(func() { statemachineValidateImageDefinition = statemachine.ValidateImageDefinition })
+
+			flag.CommandLine = flag.NewFlagSet(tc.name, flag.ExitOnError)
+			os.Args = []string{tc.name, "validate", "image.yaml", "--gadget-yaml", "gadget.yaml", "--set", "SERIES=jammy"}
+			main()
+			if got != tc.expectedExit {
+				t.Errorf("Expected exit code: %d, got: %d", tc.expectedExit, got)
+			}
+			asserter := helper.Asserter{T: t}
+			asserter.AssertEqual([]string{"image.yaml", "gadget.yaml", "SERIES=jammy"}, gotArgs)
+		})
+	}
+}
+
+// TestSchema tests that the schema command prints the schema of image definitions
+func TestSchema(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	oldOsExit := osExit
+	t.Cleanup(func() {
+		osExit = oldOsExit
+	})
+	got := 0
+	osExit = func(code int) {
+		got = code
+	}
+
+	stdout, restoreStdout, err := helper.CaptureStd(&os.Stdout)
+	asserter.AssertErrNil(err, true)
+	flag.CommandLine = flag.NewFlagSet("schema", flag.ExitOnError)
+	os.Args = []string{"schema", "schema"}
+	main()
+	restoreStdout()
+	asserter.AssertEqual(0, got)
+	output, err := io.ReadAll(stdout)
+	asserter.AssertErrNil(err, true)
+	var schema map[string]interface{}
+	err = json.Unmarshal(output, &schema)
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual(imagedefinition.SchemaID, schema["$id"])
+
+	jsonMarshalIndent = func(interface{}, string, string) ([]byte, error) {
+		return nil, errors.New("Test Error")
+	}
+	t.Cleanup(func() { jsonMarshalIndent = json.MarshalIndent })
+	flag.CommandLine = flag.NewFlagSet("schema", flag.ExitOnError)
+	os.Args = []string{"schema", "schema"}
+	main()
+	asserter.AssertEqual(1, got)
+}
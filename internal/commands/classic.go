@@ -7,7 +7,12 @@ type ClassicArgs struct {
 
 // ClassicOpts holds all flags that are specific to the classic command
 type ClassicOpts struct {
-	AptParams []string `long:"apt-params" description:"Any additional APT specific configuration needed for the image build."` // TODO: is this used?
+	AptParams []string `long:"apt-params" description:"Set an apt option for the apt commands of the build. It takes precedence over the apt section of the image definition." value-name:"NAME=VALUE"`
+	Offline   bool     `long:"offline" description:"Build the image without network access. The archive, seeds, gadget, snaps and PPA signing keys are all taken from local files, and the build fails before starting if any of them is missing."`
+	MirrorDir string   `long:"mirror-dir" description:"Local archive mirror to use instead of the mirror of the image definition. Requires --offline." value-name:"DIRECTORY"`
+	SnapsDir  string   `long:"snaps-dir" description:"Directory containing the <name>_<revision>.snap and .assert files of the snaps to install, as downloaded by \"snap download\". Requires --offline." value-name:"DIRECTORY"`
+	KeysDir   string   `long:"keys-dir" description:"Directory containing the signing keys of the extra PPAs, named after their fingerprint with a .gpg or .asc extension. Requires --offline." value-name:"DIRECTORY"`
+	Set       []string `long:"set" description:"Set the value of a variable referenced as ${KEY} in the image definition. It takes precedence over the environment variable of the same name." value-name:"KEY=VALUE"`
 }
 
 type ClassicCommand struct {
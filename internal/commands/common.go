@@ -4,16 +4,22 @@ package commands
 
 // CommonOpts stores the options that are common to all image types
 type CommonOpts struct {
-	Debug      bool   `long:"debug" description:"Enable debugging output"`
-	Verbose    bool   `short:"v" long:"verbose" description:"Enable verbose output"`
-	Quiet      bool   `short:"q" long:"quiet" description:"Turn off all output"`
-	Size       string `short:"i" long:"image-size" description:"The suggested size of the generated disk image file. If this size is smaller than the minimum calculated size of the image a warning will be issued and --image-size will be ignored. The value is the size in bytes, with allowable suffixes \"M\" for MiB and \"G\" for GiB. Use an extended syntax to define the suggested size for the disk images generated by a multi-volume gadget.yaml spec" value-name:"SIZE"`
-	DiskInfo   string `long:"disk-info" description:"File to be used as .disk/info on the image's rootfs. This file can contain useful information about the target image, like image identification data, system name, build timestamp etc." value-name:"DISK-INFO-CONTENTS"`
-	OutputDir  string `short:"O" long:"output-dir" description:"The directory in which to put generated disk image files. For snap builds, the disk image files themselves will be named <volume>.img inside this directory, where <volume> is the volume name taken from the gadget.yaml file. For classic builds, the disk image files themselves will be named based on the image definition inside this directory. The output dir will default to the value of --workdir if --workdir is specified and --output-dir is not. If neither --output-dir or --workdir is used, the images will be placed in the current working directory." value-name:"DIRECTORY"`
-	Version    bool   `long:"version" description:"Print the version number of ubuntu-image and exit"`
-	Channel    string `short:"c" long:"channel" description:"The default snap channel to use" value-name:"CHANNEL"`
-	SectorSize string `long:"sector-size" description:"Sector size to use when creating the disk image. Only 512 and 4k sector sizes are supported." choice:"512" choice:"4096" value-name:"SECTOR-SIZE" default:"512"`
-	Validation string `long:"validation" description:"Control whether validations should be ignored or enforced" choice:"ignore" choice:"enforce"`
+	Debug              bool     `long:"debug" description:"Enable debugging output"`
+	Verbose            bool     `short:"v" long:"verbose" description:"Enable verbose output"`
+	Quiet              bool     `short:"q" long:"quiet" description:"Turn off all output"`
+	Size               string   `short:"i" long:"image-size" description:"The suggested size of the generated disk image file. If this size is smaller than the minimum calculated size of the image a warning will be issued and --image-size will be ignored. The value is the size in bytes, with allowable suffixes \"M\" for MiB and \"G\" for GiB. Use an extended syntax to define the suggested size for the disk images generated by a multi-volume gadget.yaml spec" value-name:"SIZE"`
+	DiskInfo           string   `long:"disk-info" description:"File to be used as .disk/info on the image's rootfs. This file can contain useful information about the target image, like image identification data, system name, build timestamp etc." value-name:"DISK-INFO-CONTENTS"`
+	OutputDir          string   `short:"O" long:"output-dir" description:"The directory in which to put generated disk image files. For snap builds, the disk image files themselves will be named <volume>.img inside this directory, where <volume> is the volume name taken from the gadget.yaml file. For classic builds, the disk image files themselves will be named based on the image definition inside this directory. The output dir will default to the value of --workdir if --workdir is specified and --output-dir is not. If neither --output-dir or --workdir is used, the images will be placed in the current working directory." value-name:"DIRECTORY"`
+	Version            bool     `long:"version" description:"Print the version number of ubuntu-image and exit"`
+	Channel            string   `short:"c" long:"channel" description:"The default snap channel to use" value-name:"CHANNEL"`
+	SectorSize         string   `long:"sector-size" description:"Sector size to use when creating the disk image. Only 512 and 4k sector sizes are supported." choice:"512" choice:"4096" value-name:"SECTOR-SIZE" default:"512"`
+	Validation         string   `long:"validation" description:"Control whether validations should be ignored or enforced" choice:"ignore" choice:"enforce"`
+	ProgressFormat     string   `long:"progress-format" description:"Format of the progress of the build. With json, the progress is reported as a stream of JSON events, one per line, describing the states, the output of the commands they run, the warnings and the generated artifacts" choice:"text" choice:"json" value-name:"FORMAT" default:"text"`
+	ProgressFile       string   `long:"progress-file" description:"File in which to write the JSON progress events instead of the standard output. Use /dev/fd/N to write them to an open file descriptor" value-name:"FILE"`
+	Reproducible       bool     `long:"reproducible" description:"Build the image reproducibly. The time set in the SOURCE_DATE_EPOCH environment variable is used for the timestamps of the files and the artifacts, the disk IDs, partition GUIDs and filesystem UUIDs are derived from a seed and the entries of the tarballs are sorted"`
+	ReproducibleSeed   string   `long:"reproducible-seed" description:"The seed from which the disk IDs, partition GUIDs and filesystem UUIDs of reproducible builds are derived. Defaults to the value of SOURCE_DATE_EPOCH" value-name:"SEED"`
+	VerifyReproducible bool     `long:"verify-reproducible" description:"Build the image reproducibly twice and fail if the artifacts of both builds differ. Implies --reproducible"`
+	HooksDirectories   []string `long:"hooks-dir" description:"Directory of hook scripts run before and after the states of the build. The executables named pre-STATE and post-STATE, and the ones in the pre-STATE.d and post-STATE.d directories, are run before and after STATE. Can be given several times" value-name:"DIRECTORY"`
 }
 
 // StateMachineOpts stores the options that are related to the state machine
@@ -22,11 +28,14 @@ type StateMachineOpts struct {
 	Until   string `short:"u" long:"until" description:"Run the state machine until the given STEP, non-inclusively. STEP must be the name of the step." value-name:"STEP" default:""`
 	Thru    string `short:"t" long:"thru" description:"Run the state machine through the given STEP, inclusively. STEP must be the name of the step." value-name:"STEP" default:""`
 	Resume  bool   `short:"r" long:"resume" description:"Continue the state machine from the previously saved state. It is an error if there is no previous state."`
+	DryRun  bool   `long:"dry-run" description:"Only run the states needed to plan the build, then print the plan: the states of the build, the packages and snaps of the image, the layout of the gadget volumes and the artifacts. With --progress-format=json, the plan is reported as a plan event."`
 }
 
 // UbuntuImageCommand is needed for the parser to store positional arguments and flags
 type UbuntuImageCommand struct {
-	Snap    SnapCommand    `command:"snap"`
-	Classic ClassicCommand `command:"classic"`
-	Pack    PackCommand    `command:"pack" hidden:"true"`
+	Snap     SnapCommand     `command:"snap"`
+	Classic  ClassicCommand  `command:"classic"`
+	Pack     PackCommand     `command:"pack"`
+	Validate ValidateCommand `command:"validate"`
+	Schema   SchemaCommand   `command:"schema"`
 }
@@ -2,9 +2,14 @@ package commands
 
 // PackOpts holds all flags that are specific to the pack command
 type PackOpts struct {
-	ArtifactType string `long:"artifact-type" description:"Type of the resulting disk image file." required:"true" default:"raw" choice:"raw"`
-	GadgetDir    string `long:"gadget-dir" description:"Directory containing the gadget tree. The gadget.yaml file is expected to be in a meta subdirectory." required:"true"`
-	RootfsDir    string `long:"rootfs-dir" description:"Directory containing the rootfs" required:"true"`
+	ArtifactType       string `long:"artifact-type" description:"Type of the resulting disk image file." required:"true" default:"raw" choice:"raw" choice:"qcow2" choice:"vmdk" choice:"vhd" choice:"vhdx"`
+	GadgetDir          string `long:"gadget-dir" description:"Directory containing the gadget tree. The gadget.yaml file is expected to be in a meta subdirectory." required:"true"`
+	RootfsDir          string `long:"rootfs-dir" description:"Directory containing the rootfs" required:"true"`
+	ManifestName       string `long:"manifest" description:"Name of the manifest of the packages installed in the rootfs to generate in the output directory" value-name:"FILENAME"`
+	FilelistName       string `long:"filelist" description:"Name of the list of the files in the rootfs to generate in the output directory" value-name:"FILENAME"`
+	SignKey            string `long:"sign-key" description:"Sign the artifacts with this local key file, writing a detached signature of each of them and a signed SHA256SUMS file to the output directory" value-name:"KEY-FILE"`
+	SignMethod         string `long:"sign-method" description:"The tool used to sign the artifacts" choice:"gpg" choice:"minisign" choice:"cosign" default:"gpg"`
+	SignPassphraseFile string `long:"sign-passphrase-file" description:"File containing the passphrase of the signing key" value-name:"FILENAME"`
 }
 
 type PackCommand struct {
@@ -0,0 +1,5 @@
+package commands
+
+// SchemaCommand prints the JSON schema of image definition files. It takes
+// no argument
+type SchemaCommand struct{}
@@ -15,6 +15,13 @@ type SnapOpts struct {
 	Snaps                     []string       `long:"snap" description:"Install extra snaps. These are passed through to \"snap prepare-image\". The snap argument can include additional information about the channel and/or risk with the following syntax: <snap>=<channel|risk>" value-name:"SNAP"`
 	CloudInit                 string         `long:"cloud-init" description:"cloud-config data to be copied to the image" value-name:"USER-DATA-FILE"`
 	Revisions                 map[string]int `long:"revision" description:"The revision of a specific snap to install in the image." value-name:"REVISION"`
+	SBOM                      string         `long:"sbom" description:"Write a software bill of materials listing the snaps of the image to this file in the output directory" value-name:"FILENAME"`
+	SBOMFormat                string         `long:"sbom-format" description:"The format of the software bill of materials" choice:"spdx" choice:"cyclonedx" default:"spdx"`
+	SignKey                   string         `long:"sign-key" description:"Sign the artifacts with this local key file, writing a detached signature of each of them and a signed SHA256SUMS file to the output directory" value-name:"KEY-FILE"`
+	SignMethod                string         `long:"sign-method" description:"The tool used to sign the artifacts" choice:"gpg" choice:"minisign" choice:"cosign" default:"gpg"`
+	SignPassphraseFile        string         `long:"sign-passphrase-file" description:"File containing the passphrase of the signing key" value-name:"FILENAME"`
+	StoreURL                  string         `long:"store-url" description:"Pull the snaps from the snap store, or snap store proxy, at this URL" value-name:"URL"`
+	StoreAuthFile             string         `long:"store-auth-file" description:"File containing the credentials to the snap store, as exported by \"snapcraft export-login\"" value-name:"FILENAME"`
 }
 
 type SnapCommand struct {
@@ -0,0 +1,17 @@
+package commands
+
+// ValidateArgs holds the arguments of the validate command
+type ValidateArgs struct {
+	ImageDefinition string `positional-arg-name:"image_definition" description:"The image definition file to validate."`
+}
+
+// ValidateOpts holds all flags that are specific to the validate command
+type ValidateOpts struct {
+	Set        []string `long:"set" description:"Set the value of a variable referenced as ${KEY} in the image definition. It takes precedence over the environment variable of the same name." value-name:"KEY=VALUE"`
+	GadgetYaml string   `long:"gadget-yaml" description:"The gadget.yaml to validate. Defaults to the gadget.yaml of the gadget directory of the image definition, when it is a local directory" value-name:"FILENAME"`
+}
+
+type ValidateCommand struct {
+	ValidateArgsPassed ValidateArgs `positional-args:"true" required:"true"`
+	ValidateOptsPassed ValidateOpts
+}
@@ -0,0 +1,74 @@
+// Package diskimage converts the raw disk images created by ubuntu-image
+// to the disk image formats used by virtual machines. The raw images are
+// streamed, and clusters or grains containing only zeros are not allocated
+// in the formats that support sparse images.
+package diskimage
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// sectorSize is the size of a sector in all of the supported formats
+const sectorSize = 512
+
+// osCreate and osOpen can be mocked in tests
+var osCreate = os.Create
+var osOpen = os.Open
+
+// convertFile opens the raw image at src, creates dest and calls convert
+// with both files and the size of the raw image
+func convertFile(src, dest string, convert func(raw io.ReaderAt, size int64, out *os.File) error) (err error) {
+	raw, err := osOpen(src)
+	if err != nil {
+		return fmt.Errorf("Error opening raw image: %s", err.Error())
+	}
+	defer raw.Close()
+
+	rawInfo, err := raw.Stat()
+	if err != nil {
+		return fmt.Errorf("Error getting size of raw image: %s", err.Error())
+	}
+
+	out, err := osCreate(dest)
+	if err != nil {
+		return fmt.Errorf("Error creating disk image: %s", err.Error())
+	}
+	defer func() {
+		if tmpErr := out.Close(); tmpErr != nil && err == nil {
+			err = fmt.Errorf("Error closing disk image: %s", tmpErr.Error())
+		}
+	}()
+
+	return convert(raw, rawInfo.Size(), out)
+}
+
+// readChunk reads the chunk of the raw image at offset into buf. The chunk
+// may be cut short by the end of the raw image, in which case the rest of
+// buf is zeroed
+func readChunk(raw io.ReaderAt, offset int64, buf []byte) error {
+	n, err := raw.ReadAt(buf, offset)
+	if err != nil && err != io.EOF {
+		return fmt.Errorf("Error reading raw image at offset %d: %s", offset, err.Error())
+	}
+	for i := n; i < len(buf); i++ {
+		buf[i] = 0
+	}
+	return nil
+}
+
+// isZero checks whether buf only contains zeros
+func isZero(buf []byte) bool {
+	for _, b := range buf {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// divRoundUp divides n by d, rounding up
+func divRoundUp(n, d int64) int64 {
+	return (n + d - 1) / d
+}
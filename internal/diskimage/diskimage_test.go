@@ -0,0 +1,547 @@
+package diskimage
+
+import (
+	"bytes"
+	"compress/flate"
+	cryptorand "crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/canonical/ubuntu-image/internal/helper"
+)
+
+// chunkSize is the size of the chunks the raw images are compared in. It
+// matches both the qcow2 cluster size and the VMDK grain size
+const chunkSize = 1 << 16
+
+// testImageSize spans two qcow2 L2 tables and does not end on a sector
+// boundary
+const testImageSize = 513<<20 + 1000
+
+// createRawImage creates a sparse raw image filled with random data,
+// compressible data and data crossing the end of the image. It returns the
+// chunks that hold data
+func createRawImage(t *testing.T, path string) map[int64][]byte {
+	t.Helper()
+	asserter := helper.Asserter{T: t}
+	randomData := make([]byte, chunkSize)
+	rand.New(rand.NewSource(42)).Read(randomData)
+	textData := []byte(strings.Repeat("ubuntu-image ", chunkSize/13+1))[:chunkSize]
+	halfChunk := make([]byte, chunkSize)
+	copy(halfChunk[chunkSize/2:], randomData[:100])
+
+	chunks := map[int64][]byte{
+		0:                         randomData,
+		2:                         textData,
+		3:                         halfChunk,
+		(512 << 20) / chunkSize:   textData,
+		testImageSize / chunkSize: textData[:testImageSize%chunkSize],
+	}
+
+	raw, err := os.Create(path)
+	asserter.AssertErrNil(err, true)
+	defer raw.Close()
+	err = raw.Truncate(testImageSize)
+	asserter.AssertErrNil(err, true)
+	for index, data := range chunks {
+		_, err = raw.WriteAt(data, index*chunkSize)
+		asserter.AssertErrNil(err, true)
+	}
+	return chunks
+}
+
+// assertChunks checks that the data read back from a converted image
+// matches the chunks of the raw image
+func assertChunks(t *testing.T, want map[int64][]byte, got map[int64][]byte) {
+	t.Helper()
+	for index, data := range want {
+		padded := make([]byte, chunkSize)
+		copy(padded, data)
+		if !bytes.Equal(padded, got[index]) {
+			t.Errorf("chunk %d does not match the raw image", index)
+		}
+	}
+	for index, data := range got {
+		if _, found := want[index]; !found && !isZero(data) {
+			t.Errorf("chunk %d holds data not found in the raw image", index)
+		}
+	}
+}
+
+// readQcow2 reads back the allocated clusters of a qcow2 image and checks
+// that the refcounts stored in it match the clusters actually used
+func readQcow2(t *testing.T, path string) (uint32, uint64, map[int64][]byte) {
+	t.Helper()
+	asserter := helper.Asserter{T: t}
+	image, err := os.ReadFile(path)
+	asserter.AssertErrNil(err, true)
+
+	be := binary.BigEndian
+	asserter.AssertEqual(uint32(qcow2Magic), be.Uint32(image[0:]))
+	version := be.Uint32(image[4:])
+	asserter.AssertEqual(uint32(qcow2ClusterBits), be.Uint32(image[20:]))
+	size := be.Uint64(image[24:])
+	l1Size := int64(be.Uint32(image[36:]))
+	l1Offset := int64(be.Uint64(image[40:]))
+	refcountTableOffset := int64(be.Uint64(image[48:]))
+	refcountTableClusters := int64(be.Uint32(image[56:]))
+
+	refcounts := make(map[int64]uint16)
+	addRef := func(offset, length int64) {
+		for c := offset / qcow2ClusterSize; c <= (offset+length-1)/qcow2ClusterSize; c++ {
+			refcounts[c]++
+		}
+	}
+	addRef(0, qcow2ClusterSize)
+	addRef(l1Offset, divRoundUp(l1Size*8, qcow2ClusterSize)*qcow2ClusterSize)
+	addRef(refcountTableOffset, refcountTableClusters*qcow2ClusterSize)
+
+	const offsetMask = 0x00fffffffffffe00
+	chunks := make(map[int64][]byte)
+	for i := int64(0); i < l1Size; i++ {
+		l1Entry := be.Uint64(image[l1Offset+i*8:])
+		if l1Entry == 0 {
+			continue
+		}
+		asserter.AssertEqual(qcow2FlagCopied, l1Entry&qcow2FlagCopied)
+		l2Offset := int64(l1Entry & offsetMask)
+		addRef(l2Offset, qcow2ClusterSize)
+		for j := int64(0); j < qcow2L2Entries; j++ {
+			l2Entry := be.Uint64(image[l2Offset+j*8:])
+			if l2Entry == 0 {
+				continue
+			}
+			index := i*qcow2L2Entries + j
+			if l2Entry&qcow2FlagCompressed != 0 {
+				offset := int64(l2Entry & (1<<qcow2CompressedSectorsShift - 1))
+				sectors := int64(l2Entry>>qcow2CompressedSectorsShift) & 0xff
+				end := (offset/sectorSize + sectors + 1) * sectorSize
+				if end > int64(len(image)) {
+					end = int64(len(image))
+				}
+				addRef(offset, end-offset)
+				data := make([]byte, qcow2ClusterSize)
+				_, err := io.ReadFull(flate.NewReader(bytes.NewReader(image[offset:end])), data)
+				asserter.AssertErrNil(err, true)
+				chunks[index] = data
+			} else {
+				asserter.AssertEqual(qcow2FlagCopied, l2Entry&qcow2FlagCopied)
+				offset := int64(l2Entry & offsetMask)
+				addRef(offset, qcow2ClusterSize)
+				chunks[index] = image[offset : offset+qcow2ClusterSize]
+			}
+		}
+	}
+
+	for i := int64(0); i < refcountTableClusters*qcow2ClusterSize/8; i++ {
+		blockOffset := int64(be.Uint64(image[refcountTableOffset+i*8:]))
+		if blockOffset == 0 {
+			continue
+		}
+		addRef(blockOffset, qcow2ClusterSize)
+	}
+	for cluster := int64(0); cluster < int64(len(image))/qcow2ClusterSize; cluster++ {
+		blockOffset := int64(be.Uint64(image[refcountTableOffset+cluster/qcow2RefcountsPerBlock*8:]))
+		stored := be.Uint16(image[blockOffset+cluster%qcow2RefcountsPerBlock*2:])
+		if stored != refcounts[cluster] {
+			t.Errorf("cluster %d has refcount %d instead of %d", cluster, stored, refcounts[cluster])
+		}
+	}
+	return version, size, chunks
+}
+
+// TestConvertToQcow2 tests that the data of the raw image can be read back
+// from the qcow2 image for every combination of options
+func TestConvertToQcow2(t *testing.T) {
+	testCases := []struct {
+		name            string
+		opts            Qcow2Options
+		expectedVersion uint32
+	}{
+		{"default", Qcow2Options{}, 2},
+		{"compressed_compat_0.10", Qcow2Options{Compress: true, Compat: "0.10"}, 2},
+		{"compressed_compat_1.1", Qcow2Options{Compress: true, Compat: "1.1"}, 3},
+		{"uncompressed_compat_1.1", Qcow2Options{Compress: false, Compat: "1.1"}, 3},
+	}
+	for _, tc := range testCases {
+		t.Run("test_convert_to_qcow2_"+tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			workDir := filepath.Join("/tmp", "ubuntu-image-"+uuid.NewString())
+			err := os.Mkdir(workDir, 0755)
+			asserter.AssertErrNil(err, true)
+			defer os.RemoveAll(workDir)
+
+			rawPath := filepath.Join(workDir, "pc.img")
+			chunks := createRawImage(t, rawPath)
+			qcow2Path := filepath.Join(workDir, "pc.qcow2")
+			err = ConvertToQcow2(rawPath, qcow2Path, tc.opts)
+			asserter.AssertErrNil(err, true)
+
+			version, size, got := readQcow2(t, qcow2Path)
+			asserter.AssertEqual(tc.expectedVersion, version)
+			asserter.AssertEqual(uint64(testImageSize), size)
+			assertChunks(t, chunks, got)
+
+			// zero clusters are not allocated, so the image stays small
+			info, err := os.Stat(qcow2Path)
+			asserter.AssertErrNil(err, true)
+			if info.Size() > 16*qcow2ClusterSize {
+				t.Errorf("qcow2 image is %d bytes, zero clusters were allocated", info.Size())
+			}
+		})
+	}
+}
+
+// TestConvertToQcow2Compression tests that compressible clusters are
+// compressed only when compression is enabled
+func TestConvertToQcow2Compression(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	workDir := filepath.Join("/tmp", "ubuntu-image-"+uuid.NewString())
+	err := os.Mkdir(workDir, 0755)
+	asserter.AssertErrNil(err, true)
+	defer os.RemoveAll(workDir)
+
+	rawPath := filepath.Join(workDir, "pc.img")
+	createRawImage(t, rawPath)
+	sizes := make(map[bool]int64)
+	for _, compress := range []bool{true, false} {
+		qcow2Path := filepath.Join(workDir, fmt.Sprintf("pc-%t.qcow2", compress))
+		err = ConvertToQcow2(rawPath, qcow2Path, Qcow2Options{Compress: compress})
+		asserter.AssertErrNil(err, true)
+		info, err := os.Stat(qcow2Path)
+		asserter.AssertErrNil(err, true)
+		sizes[compress] = info.Size()
+	}
+	if sizes[true] >= sizes[false] {
+		t.Errorf("compressed image (%d bytes) is not smaller than the uncompressed one (%d bytes)",
+			sizes[true], sizes[false])
+	}
+}
+
+// TestQcow2Compress tests that clusters are deflated with back-references,
+// not only Huffman coding, in a stream that inflates to the cluster
+func TestQcow2Compress(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	text := "the quick brown fox jumps over the lazy dog "
+	cluster := []byte(strings.Repeat(text, qcow2ClusterSize/len(text)+1)[:qcow2ClusterSize])
+	w := &qcow2Writer{}
+	compressed, err := w.compress(cluster)
+	asserter.AssertErrNil(err, true)
+	// every piece of the size of the window holds the text many times
+	if len(compressed) > qcow2ClusterSize/qcow2DeflateWindow*256 {
+		t.Errorf("cluster of repeated text is compressed to %d bytes", len(compressed))
+	}
+	data, err := io.ReadAll(flate.NewReader(bytes.NewReader(compressed)))
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual(cluster, data)
+}
+
+// TestConvertToVMDK tests that the data of the raw image can be read back
+// from the VMDK image
+func TestConvertToVMDK(t *testing.T) {
+	t.Run("test_convert_to_vmdk", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		workDir := filepath.Join("/tmp", "ubuntu-image-"+uuid.NewString())
+		err := os.Mkdir(workDir, 0755)
+		asserter.AssertErrNil(err, true)
+		defer os.RemoveAll(workDir)
+
+		rawPath := filepath.Join(workDir, "pc.img")
+		chunks := createRawImage(t, rawPath)
+		vmdkPath := filepath.Join(workDir, "pc.vmdk")
+		err = ConvertToVMDK(rawPath, vmdkPath, VMDKOptions{})
+		asserter.AssertErrNil(err, true)
+
+		image, err := os.ReadFile(vmdkPath)
+		asserter.AssertErrNil(err, true)
+		le := binary.LittleEndian
+		asserter.AssertEqual(uint32(vmdkMagic), le.Uint32(image[0:]))
+		capacity := int64(le.Uint64(image[12:]))
+		asserter.AssertEqual(divRoundUp(testImageSize, sectorSize), capacity)
+		grainSectors := int64(le.Uint64(image[20:]))
+		asserter.AssertEqual(int64(vmdkGrainSectors), grainSectors)
+		descriptorOffset := int64(le.Uint64(image[28:]))
+		gdOffset := int64(le.Uint64(image[56:]))
+
+		descriptor := string(image[descriptorOffset*sectorSize : gdOffset*sectorSize])
+		for _, line := range []string{
+			`createType="monolithicSparse"`,
+			fmt.Sprintf(`RW %d SPARSE "pc.vmdk"`, capacity),
+		} {
+			if !strings.Contains(descriptor, line) {
+				t.Errorf("descriptor does not contain %s:\n%s", line, descriptor)
+			}
+		}
+
+		got := make(map[int64][]byte)
+		grains := divRoundUp(capacity, grainSectors)
+		for grain := int64(0); grain < grains; grain++ {
+			gtOffset := int64(le.Uint32(image[gdOffset*sectorSize+grain/vmdkGTEsPerGT*4:]))
+			sector := int64(le.Uint32(image[gtOffset*sectorSize+grain%vmdkGTEsPerGT*4:]))
+			if sector == 0 {
+				continue
+			}
+			got[grain] = image[sector*sectorSize : sector*sectorSize+vmdkGrainSize]
+		}
+		assertChunks(t, chunks, got)
+	})
+}
+
+// TestConvertToVHD tests that the VHD image holds the raw data followed by
+// a valid footer
+func TestConvertToVHD(t *testing.T) {
+	t.Run("test_convert_to_vhd", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		workDir := filepath.Join("/tmp", "ubuntu-image-"+uuid.NewString())
+		err := os.Mkdir(workDir, 0755)
+		asserter.AssertErrNil(err, true)
+		defer os.RemoveAll(workDir)
+
+		rawPath := filepath.Join(workDir, "pc.img")
+		chunks := createRawImage(t, rawPath)
+		vhdPath := filepath.Join(workDir, "pc.vhd")
+		err = ConvertToVHD(rawPath, vhdPath, VHDOptions{})
+		asserter.AssertErrNil(err, true)
+
+		image, err := os.ReadFile(vhdPath)
+		asserter.AssertErrNil(err, true)
+		paddedSize := divRoundUp(testImageSize, sectorSize) * sectorSize
+		asserter.AssertEqual(paddedSize+vhdFooterSize, int64(len(image)))
+
+		footer := image[paddedSize:]
+		be := binary.BigEndian
+		asserter.AssertEqual("conectix", string(footer[:8]))
+		asserter.AssertEqual(uint64(paddedSize), be.Uint64(footer[48:]))
+		asserter.AssertEqual(uint32(vhdDiskFixed), be.Uint32(footer[60:]))
+		asserter.AssertEqual(vhdChecksum(footer), be.Uint32(footer[64:]))
+
+		got := make(map[int64][]byte)
+		for offset := int64(0); offset < paddedSize; offset += chunkSize {
+			end := offset + chunkSize
+			data := make([]byte, chunkSize)
+			if end > paddedSize {
+				end = paddedSize
+			}
+			copy(data, image[offset:end])
+			got[offset/chunkSize] = data
+		}
+		assertChunks(t, chunks, got)
+	})
+}
+
+// readVHDX checks the headers and the region table of a VHDX image, and
+// reads back the size of the virtual disk and its data through the BAT
+func readVHDX(t *testing.T, path string) (uint64, map[int64][]byte) {
+	t.Helper()
+	asserter := helper.Asserter{T: t}
+	image, err := os.ReadFile(path)
+	asserter.AssertErrNil(err, true)
+	le := binary.LittleEndian
+	asserter.AssertEqual("vhdxfile", string(image[:8]))
+
+	// the checksums are computed with the checksum field set to zero
+	checksum := func(data []byte) uint32 {
+		data = append([]byte{}, data...)
+		le.PutUint32(data[4:], 0)
+		return crc32.Checksum(data, vhdxCRC32C)
+	}
+	for i, offset := range []int64{vhdxHeader1Offset, vhdxHeader2Offset} {
+		header := image[offset : offset+vhdxHeaderSize]
+		asserter.AssertEqual("head", string(header[:4]))
+		asserter.AssertEqual(checksum(header), le.Uint32(header[4:]))
+		asserter.AssertEqual(uint64(i), le.Uint64(header[8:]))
+		asserter.AssertEqual(make([]byte, 16), header[48:64])
+		asserter.AssertEqual(uint16(vhdxVersion), le.Uint16(header[66:]))
+	}
+
+	regions := make(map[[16]byte][]byte)
+	for _, offset := range []int64{vhdxRegionTable1Offset, vhdxRegionTable2Offset} {
+		table := image[offset : offset+vhdxRegionTableSize]
+		asserter.AssertEqual("regi", string(table[:4]))
+		asserter.AssertEqual(checksum(table), le.Uint32(table[4:]))
+		for i := 0; i < int(le.Uint32(table[8:])); i++ {
+			entry := table[16+32*i:]
+			var guid [16]byte
+			copy(guid[:], entry[:16])
+			regionOffset := le.Uint64(entry[16:])
+			if regionOffset%vhdxAlignment != 0 || le.Uint32(entry[24:])%vhdxAlignment != 0 {
+				t.Errorf("region %x is not aligned to 1 MiB", guid)
+			}
+			regions[guid] = image[regionOffset : regionOffset+uint64(le.Uint32(entry[24:]))]
+		}
+	}
+
+	metadata := regions[vhdxMetadataGUID]
+	asserter.AssertEqual("metadata", string(metadata[:8]))
+	items := make(map[[16]byte][]byte)
+	for i := 0; i < int(le.Uint16(metadata[10:])); i++ {
+		entry := metadata[32+32*i:]
+		var guid [16]byte
+		copy(guid[:], entry[:16])
+		itemOffset := le.Uint32(entry[16:])
+		items[guid] = metadata[itemOffset : itemOffset+le.Uint32(entry[20:])]
+	}
+	blockSize := int64(le.Uint32(items[vhdxFileParametersGUID]))
+	asserter.AssertEqual(uint32(sectorSize), le.Uint32(items[vhdxLogicalSectorSizeGUID]))
+	diskSize := le.Uint64(items[vhdxVirtualDiskSizeGUID])
+
+	bat := regions[vhdxBATGUID]
+	chunkRatio := (int64(1) << 23) * sectorSize / blockSize
+	got := make(map[int64][]byte)
+	for offset := int64(0); offset < int64(diskSize); offset += chunkSize {
+		block := offset / blockSize
+		entry := le.Uint64(bat[8*(block+block/chunkRatio):])
+		asserter.AssertEqual(uint64(vhdxPayloadBlockFullyPresent), entry&7)
+		dataOffset := int64(entry&^(vhdxAlignment-1)) + offset%blockSize
+		got[offset/chunkSize] = image[dataOffset : dataOffset+chunkSize]
+	}
+	return diskSize, got
+}
+
+// TestConvertToVHDX tests that the data of the raw image can be read back
+// from the VHDX image
+func TestConvertToVHDX(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	workDir := t.TempDir()
+	rawPath := filepath.Join(workDir, "pc.img")
+	chunks := createRawImage(t, rawPath)
+	vhdxPath := filepath.Join(workDir, "pc.vhdx")
+	err := ConvertToVHDX(rawPath, vhdxPath, VHDXOptions{})
+	asserter.AssertErrNil(err, true)
+
+	diskSize, got := readVHDX(t, vhdxPath)
+	asserter.AssertEqual(uint64(divRoundUp(testImageSize, sectorSize)*sectorSize), diskSize)
+	assertChunks(t, chunks, got)
+}
+
+// TestVHDGeometry tests the CHS geometry computed for some disk sizes
+func TestVHDGeometry(t *testing.T) {
+	testCases := []struct {
+		name            string
+		size            int64
+		cylinders       uint16
+		heads           uint8
+		sectorsPerTrack uint8
+	}{
+		{"small", 10 << 20, 301, 4, 17},
+		{"medium", 4 << 30, 8322, 16, 63},
+		{"too_large", 4 << 40, 65535, 16, 255},
+	}
+	for _, tc := range testCases {
+		t.Run("test_vhd_geometry_"+tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			cylinders, heads, sectorsPerTrack := vhdGeometry(tc.size)
+			asserter.AssertEqual(tc.cylinders, cylinders)
+			asserter.AssertEqual(tc.heads, heads)
+			asserter.AssertEqual(tc.sectorsPerTrack, sectorsPerTrack)
+		})
+	}
+}
+
+// TestFailedConvert tests the failures shared by all of the formats
+func TestFailedConvert(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	workDir := filepath.Join("/tmp", "ubuntu-image-"+uuid.NewString())
+	err := os.Mkdir(workDir, 0755)
+	asserter.AssertErrNil(err, true)
+	defer os.RemoveAll(workDir)
+
+	rawPath := filepath.Join(workDir, "pc.img")
+	err = os.WriteFile(rawPath, []byte("data"), 0644)
+	asserter.AssertErrNil(err, true)
+
+	err = ConvertToQcow2(filepath.Join(workDir, "missing.img"), filepath.Join(workDir, "pc.qcow2"), Qcow2Options{})
+	asserter.AssertErrContains(err, "Error opening raw image")
+
+	err = ConvertToVMDK(rawPath, filepath.Join(workDir, "missing", "pc.vmdk"), VMDKOptions{})
+	asserter.AssertErrContains(err, "Error creating disk image")
+
+	err = ConvertToQcow2(rawPath, filepath.Join(workDir, "pc.qcow2"), Qcow2Options{Compat: "2.0"})
+	asserter.AssertErrContains(err, "Unsupported qcow2 compat level")
+
+	randRead = func([]byte) (int, error) { return 0, fmt.Errorf("Test Error") }
+	defer func() { randRead = cryptorand.Read }()
+	err = ConvertToVHD(rawPath, filepath.Join(workDir, "pc.vhd"), VHDOptions{})
+	asserter.AssertErrContains(err, "Error generating unique id")
+	err = ConvertToVHDX(rawPath, filepath.Join(workDir, "pc.vhdx"), VHDXOptions{})
+	asserter.AssertErrContains(err, "Error generating unique id")
+	err = ConvertToVMDK(rawPath, filepath.Join(workDir, "pc.vmdk"), VMDKOptions{})
+	asserter.AssertErrContains(err, "Error generating content id")
+
+	err = ConvertToVHD(rawPath, filepath.Join(workDir, "pc.vhd"), VHDOptions{UniqueID: []byte("short")})
+	asserter.AssertErrContains(err, "unique id must be 16 bytes long")
+	err = ConvertToVHDX(rawPath, filepath.Join(workDir, "pc.vhdx"), VHDXOptions{UniqueID: []byte("short")})
+	asserter.AssertErrContains(err, "unique id must be 16 bytes long")
+}
+
+// TestDeterministicConvert tests that the images converted with fixed ids
+// and timestamps are identical
+func TestDeterministicConvert(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	workDir := t.TempDir()
+	rawPath := filepath.Join(workDir, "pc.img")
+	createRawImage(t, rawPath)
+
+	// random ids must not be used
+	randRead = func([]byte) (int, error) { return 0, fmt.Errorf("Test Error") }
+	defer func() { randRead = cryptorand.Read }()
+
+	timestamp := time.Date(2023, time.October, 16, 0, 0, 0, 0, time.UTC)
+	vhdOpts := VHDOptions{Timestamp: timestamp, UniqueID: []byte("0123456789abcdef")}
+	vmdkOpts := VMDKOptions{ContentID: 0x12345678}
+	var images [][]byte
+	for _, name := range []string{"first", "second"} {
+		vhdPath := filepath.Join(workDir, name+".vhd")
+		err := ConvertToVHD(rawPath, vhdPath, vhdOpts)
+		asserter.AssertErrNil(err, true)
+		vhdImage, err := os.ReadFile(vhdPath)
+		asserter.AssertErrNil(err, true)
+		images = append(images, vhdImage)
+
+		// the name of the image is recorded in the descriptor
+		vmdkPath := filepath.Join(workDir, name, "pc.vmdk")
+		err = os.Mkdir(filepath.Dir(vmdkPath), 0755)
+		asserter.AssertErrNil(err, true)
+		err = ConvertToVMDK(rawPath, vmdkPath, vmdkOpts)
+		asserter.AssertErrNil(err, true)
+		vmdkImage, err := os.ReadFile(vmdkPath)
+		asserter.AssertErrNil(err, true)
+		images = append(images, vmdkImage)
+	}
+	if !bytes.Equal(images[0], images[2]) {
+		t.Errorf("VHD images differ")
+	}
+	if !bytes.Equal(images[1], images[3]) {
+		t.Errorf("VMDK images differ")
+	}
+
+	footer := images[0][len(images[0])-vhdFooterSize:]
+	asserter.AssertEqual(uint32(timestamp.Sub(vhdEpoch)/time.Second), binary.BigEndian.Uint32(footer[24:]))
+	asserter.AssertEqual("0123456789abcdef", string(footer[68:84]))
+	if !bytes.Contains(images[1], []byte("CID=12345678")) {
+		t.Errorf("VMDK descriptor does not contain the content id")
+	}
+
+	var vhdxImages [][]byte
+	for _, name := range []string{"first", "second"} {
+		vhdxPath := filepath.Join(workDir, name+".vhdx")
+		err := ConvertToVHDX(rawPath, vhdxPath, VHDXOptions{UniqueID: []byte("0123456789abcdef")})
+		asserter.AssertErrNil(err, true)
+		vhdxImage, err := os.ReadFile(vhdxPath)
+		asserter.AssertErrNil(err, true)
+		vhdxImages = append(vhdxImages, vhdxImage)
+	}
+	if !bytes.Equal(vhdxImages[0], vhdxImages[1]) {
+		t.Errorf("VHDX images differ")
+	}
+}
@@ -0,0 +1,341 @@
+package diskimage
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Supported qcow2 compatibility levels, named after the matching qemu-img
+// compat option
+const (
+	Qcow2Compat010 = "0.10"
+	Qcow2Compat11  = "1.1"
+)
+
+const (
+	qcow2Magic             = 0x514649fb // "QFI\xfb"
+	qcow2ClusterBits       = 16
+	qcow2ClusterSize       = 1 << qcow2ClusterBits
+	qcow2L2Entries         = qcow2ClusterSize / 8
+	qcow2RefcountOrder     = 4 // 16 bit refcounts, the only width version 2 knows
+	qcow2RefcountsPerBlock = qcow2ClusterSize / 2
+	qcow2V3HeaderLength    = 104
+	// the window qemu inflates compressed clusters with
+	qcow2DeflateWindow = 1 << 12
+
+	qcow2FlagCopied     = uint64(1) << 63
+	qcow2FlagCompressed = uint64(1) << 62
+	// compressed cluster descriptors store the number of additional sectors
+	// used by the compressed data from this bit onwards
+	qcow2CompressedSectorsShift = 62 - (qcow2ClusterBits - 8)
+)
+
+// Qcow2Options holds the options used to write qcow2 images
+type Qcow2Options struct {
+	// Compress compresses every cluster for which compression saves space
+	Compress bool
+	// Compat is the compatibility level of the image, either 0.10 or 1.1.
+	// An empty string selects 0.10
+	Compat string
+}
+
+// qcow2Writer keeps track of the metadata of a qcow2 image while the
+// clusters of the raw image are written to it
+type qcow2Writer struct {
+	out     *os.File
+	opts    Qcow2Options
+	version uint32
+	size    int64
+
+	l1        []uint64
+	l2        [][]uint64
+	refcounts []uint16
+	// offset is the first free byte in the image. Compressed clusters are
+	// packed, every other allocation is aligned to the cluster size
+	offset int64
+
+	compressor *flate.Writer
+	compressed bytes.Buffer
+}
+
+// ConvertToQcow2 converts the raw image at src to a qcow2 image at dest.
+// Clusters containing only zeros are left unallocated
+func ConvertToQcow2(src, dest string, opts Qcow2Options) error {
+	version, err := qcow2Version(opts.Compat)
+	if err != nil {
+		return err
+	}
+	return convertFile(src, dest, func(raw io.ReaderAt, size int64, out *os.File) error {
+		w := &qcow2Writer{
+			out:     out,
+			opts:    opts,
+			version: version,
+			size:    size,
+		}
+		if err := w.write(raw); err != nil {
+			return fmt.Errorf("Error writing qcow2 image: %s", err.Error())
+		}
+		return nil
+	})
+}
+
+// qcow2Version returns the qcow2 version matching a compat level
+func qcow2Version(compat string) (uint32, error) {
+	switch compat {
+	case "", Qcow2Compat010:
+		return 2, nil
+	case Qcow2Compat11:
+		return 3, nil
+	default:
+		return 0, fmt.Errorf("Unsupported qcow2 compat level \"%s\". Supported levels are %s and %s",
+			compat, Qcow2Compat010, Qcow2Compat11)
+	}
+}
+
+// write lays out the image as the header, the L1 table, the data clusters,
+// the L2 tables and finally the refcount structures. Only the header and the
+// L1 table are written out of order, once everything else is known
+func (w *qcow2Writer) write(raw io.ReaderAt) error {
+	l1Size := divRoundUp(w.size, qcow2ClusterSize*qcow2L2Entries)
+	w.l1 = make([]uint64, l1Size)
+	w.l2 = make([][]uint64, l1Size)
+	l1Clusters := divRoundUp(l1Size*8, qcow2ClusterSize)
+	if l1Clusters == 0 {
+		l1Clusters = 1
+	}
+
+	w.allocCluster() // header
+	l1Offset := w.allocCluster()
+	for i := int64(1); i < l1Clusters; i++ {
+		w.allocCluster()
+	}
+
+	if err := w.writeData(raw); err != nil {
+		return err
+	}
+	if err := w.writeL2Tables(); err != nil {
+		return err
+	}
+	refcountTableOffset, refcountTableClusters, err := w.writeRefcounts()
+	if err != nil {
+		return err
+	}
+
+	l1 := make([]byte, l1Clusters*qcow2ClusterSize)
+	for i, entry := range w.l1 {
+		binary.BigEndian.PutUint64(l1[i*8:], entry)
+	}
+	if _, err := w.out.WriteAt(l1, l1Offset); err != nil {
+		return err
+	}
+
+	header := w.header(l1Offset, refcountTableOffset, refcountTableClusters)
+	_, err = w.out.WriteAt(header, 0)
+	return err
+}
+
+// writeData streams the clusters of the raw image to the qcow2 image
+func (w *qcow2Writer) writeData(raw io.ReaderAt) error {
+	buf := make([]byte, qcow2ClusterSize)
+	for cluster := int64(0); cluster*qcow2ClusterSize < w.size; cluster++ {
+		if err := readChunk(raw, cluster*qcow2ClusterSize, buf); err != nil {
+			return err
+		}
+		if isZero(buf) {
+			continue
+		}
+		entry, err := w.writeCluster(buf)
+		if err != nil {
+			return err
+		}
+		l1Index := cluster / qcow2L2Entries
+		if w.l2[l1Index] == nil {
+			w.l2[l1Index] = make([]uint64, qcow2L2Entries)
+		}
+		w.l2[l1Index][cluster%qcow2L2Entries] = entry
+	}
+	return nil
+}
+
+// writeCluster writes a single cluster of data and returns its L2 entry
+func (w *qcow2Writer) writeCluster(buf []byte) (uint64, error) {
+	if w.opts.Compress {
+		compressed, err := w.compress(buf)
+		if err != nil {
+			return 0, err
+		}
+		if compressed != nil {
+			offset := w.offset
+			if _, err := w.out.WriteAt(compressed, offset); err != nil {
+				return 0, err
+			}
+			length := int64(len(compressed))
+			w.addRef(offset, length)
+			w.offset += length
+			extraSectors := uint64((offset+length-1)/sectorSize - offset/sectorSize)
+			return qcow2FlagCompressed | extraSectors<<qcow2CompressedSectorsShift | uint64(offset), nil
+		}
+	}
+	offset := w.allocCluster()
+	if _, err := w.out.WriteAt(buf, offset); err != nil {
+		return 0, err
+	}
+	return qcow2FlagCopied | uint64(offset), nil
+}
+
+// compress deflates a cluster, or returns nil if that does not save space.
+// qemu inflates clusters with a 4KiB window, which compress/flate does not
+// support. The cluster is deflated in pieces of the size of the window
+// instead, each by a compressor starting without history, so that no
+// back-reference reaches further than the window. The pieces end with a
+// sync flush and are followed by an empty final block, which makes them a
+// single deflate stream
+func (w *qcow2Writer) compress(buf []byte) ([]byte, error) {
+	w.compressed.Reset()
+	if w.compressor == nil {
+		compressor, err := flate.NewWriter(&w.compressed, flate.DefaultCompression)
+		if err != nil {
+			return nil, err
+		}
+		w.compressor = compressor
+	}
+	for start := 0; start < len(buf); start += qcow2DeflateWindow {
+		end := start + qcow2DeflateWindow
+		if end > len(buf) {
+			end = len(buf)
+		}
+		w.compressor.Reset(&w.compressed)
+		if _, err := w.compressor.Write(buf[start:end]); err != nil {
+			return nil, err
+		}
+		if err := w.compressor.Flush(); err != nil {
+			return nil, err
+		}
+	}
+	w.compressor.Reset(&w.compressed)
+	if err := w.compressor.Close(); err != nil {
+		return nil, err
+	}
+	if w.compressed.Len() >= len(buf) {
+		return nil, nil
+	}
+	return w.compressed.Bytes(), nil
+}
+
+// writeL2Tables writes every L2 table that maps at least one cluster and
+// points the L1 table at it
+func (w *qcow2Writer) writeL2Tables() error {
+	table := make([]byte, qcow2ClusterSize)
+	for i, entries := range w.l2 {
+		if entries == nil {
+			continue
+		}
+		for j, entry := range entries {
+			binary.BigEndian.PutUint64(table[j*8:], entry)
+		}
+		offset := w.allocCluster()
+		if _, err := w.out.WriteAt(table, offset); err != nil {
+			return err
+		}
+		w.l1[i] = qcow2FlagCopied | uint64(offset)
+	}
+	return nil
+}
+
+// writeRefcounts writes the refcount table followed by the refcount blocks
+// at the end of the image. The refcount structures count themselves, so
+// their size is computed until it no longer changes
+func (w *qcow2Writer) writeRefcounts() (int64, int64, error) {
+	usedClusters := divRoundUp(w.offset, qcow2ClusterSize)
+	var blocks, tableClusters int64
+	for {
+		total := usedClusters + tableClusters + blocks
+		newBlocks := divRoundUp(total, qcow2RefcountsPerBlock)
+		newTableClusters := divRoundUp(newBlocks*8, qcow2ClusterSize)
+		if newBlocks == blocks && newTableClusters == tableClusters {
+			break
+		}
+		blocks, tableClusters = newBlocks, newTableClusters
+	}
+
+	tableOffset := w.allocCluster()
+	for i := int64(1); i < tableClusters; i++ {
+		w.allocCluster()
+	}
+	blocksOffset := w.offset
+	for i := int64(0); i < blocks; i++ {
+		w.allocCluster()
+	}
+	w.growRefcounts(blocks * qcow2RefcountsPerBlock)
+
+	block := make([]byte, qcow2ClusterSize)
+	for i := int64(0); i < blocks; i++ {
+		refcounts := w.refcounts[i*qcow2RefcountsPerBlock : (i+1)*qcow2RefcountsPerBlock]
+		for j, refcount := range refcounts {
+			binary.BigEndian.PutUint16(block[j*2:], refcount)
+		}
+		if _, err := w.out.WriteAt(block, blocksOffset+i*qcow2ClusterSize); err != nil {
+			return 0, 0, err
+		}
+	}
+
+	table := make([]byte, tableClusters*qcow2ClusterSize)
+	for i := int64(0); i < blocks; i++ {
+		binary.BigEndian.PutUint64(table[i*8:], uint64(blocksOffset+i*qcow2ClusterSize))
+	}
+	if _, err := w.out.WriteAt(table, tableOffset); err != nil {
+		return 0, 0, err
+	}
+	return tableOffset, tableClusters, nil
+}
+
+// header returns the qcow2 header, padded to a full cluster so that no
+// header extension is found after it
+func (w *qcow2Writer) header(l1Offset, refcountTableOffset, refcountTableClusters int64) []byte {
+	header := make([]byte, qcow2ClusterSize)
+	binary.BigEndian.PutUint32(header[0:], qcow2Magic)
+	binary.BigEndian.PutUint32(header[4:], w.version)
+	// no backing file
+	binary.BigEndian.PutUint32(header[20:], qcow2ClusterBits)
+	binary.BigEndian.PutUint64(header[24:], uint64(w.size))
+	// no encryption
+	binary.BigEndian.PutUint32(header[36:], uint32(len(w.l1)))
+	binary.BigEndian.PutUint64(header[40:], uint64(l1Offset))
+	binary.BigEndian.PutUint64(header[48:], uint64(refcountTableOffset))
+	binary.BigEndian.PutUint32(header[56:], uint32(refcountTableClusters))
+	// no snapshots
+	if w.version >= 3 {
+		// no incompatible, compatible or autoclear features
+		binary.BigEndian.PutUint32(header[96:], qcow2RefcountOrder)
+		binary.BigEndian.PutUint32(header[100:], qcow2V3HeaderLength)
+	}
+	return header
+}
+
+// allocCluster allocates a cluster after all of the data written so far
+func (w *qcow2Writer) allocCluster() int64 {
+	offset := divRoundUp(w.offset, qcow2ClusterSize) * qcow2ClusterSize
+	w.offset = offset + qcow2ClusterSize
+	w.addRef(offset, qcow2ClusterSize)
+	return offset
+}
+
+// addRef increments the refcount of every cluster in the given byte range
+func (w *qcow2Writer) addRef(offset, length int64) {
+	last := (offset + length - 1) / qcow2ClusterSize
+	w.growRefcounts(last + 1)
+	for cluster := offset / qcow2ClusterSize; cluster <= last; cluster++ {
+		w.refcounts[cluster]++
+	}
+}
+
+// growRefcounts makes sure refcounts are tracked for n clusters
+func (w *qcow2Writer) growRefcounts(n int64) {
+	if int64(len(w.refcounts)) < n {
+		w.refcounts = append(w.refcounts, make([]uint16, n-int64(len(w.refcounts)))...)
+	}
+}
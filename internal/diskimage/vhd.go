@@ -0,0 +1,160 @@
+package diskimage
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+const (
+	vhdChunkSize   = 1 << 16
+	vhdFooterSize  = 512
+	vhdVersion     = 0x00010000
+	vhdDiskFixed   = 2
+	vhdFeatureBase = 2 // the reserved bit that must always be set
+)
+
+// vhdEpoch is the reference of the timestamp stored in the footer
+var vhdEpoch = time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// timeNow and randRead can be mocked in tests
+var timeNow = time.Now
+var randRead = rand.Read
+
+// VHDOptions are the options used to create VHD images
+type VHDOptions struct {
+	// Timestamp is the creation time recorded in the footer.
+	// The zero value selects the current time
+	Timestamp time.Time
+	// UniqueID is the 16 bytes identifier of the image.
+	// A random identifier is generated when it is empty
+	UniqueID []byte
+}
+
+// ConvertToVHD converts the raw image at src to a fixed VHD image at dest.
+// A fixed VHD is the raw data padded to a whole number of sectors followed
+// by a footer. Chunks containing only zeros are not written so that dest
+// stays a sparse file on the host
+func ConvertToVHD(src, dest string, opts VHDOptions) error {
+	return convertFile(src, dest, func(raw io.ReaderAt, size int64, out *os.File) error {
+		if err := writeVHD(raw, size, out, opts); err != nil {
+			return fmt.Errorf("Error writing VHD image: %s", err.Error())
+		}
+		return nil
+	})
+}
+
+// writeVHD copies the data of the raw image and appends the VHD footer
+func writeVHD(raw io.ReaderAt, size int64, out *os.File, opts VHDOptions) error {
+	buf := make([]byte, vhdChunkSize)
+	for offset := int64(0); offset < size; offset += vhdChunkSize {
+		if err := readChunk(raw, offset, buf); err != nil {
+			return err
+		}
+		if isZero(buf) {
+			continue
+		}
+		chunk := buf
+		if offset+vhdChunkSize > size {
+			chunk = buf[:size-offset]
+		}
+		if _, err := out.WriteAt(chunk, offset); err != nil {
+			return err
+		}
+	}
+
+	paddedSize := divRoundUp(size, sectorSize) * sectorSize
+	footer, err := vhdFooter(paddedSize, opts)
+	if err != nil {
+		return err
+	}
+	_, err = out.WriteAt(footer, paddedSize)
+	return err
+}
+
+// vhdFooter returns the footer of a fixed VHD image of the given size
+func vhdFooter(size int64, opts VHDOptions) ([]byte, error) {
+	timestamp := opts.Timestamp
+	if timestamp.IsZero() {
+		timestamp = timeNow()
+	}
+	footer := make([]byte, vhdFooterSize)
+	copy(footer[0:], "conectix")
+	binary.BigEndian.PutUint32(footer[8:], vhdFeatureBase)
+	binary.BigEndian.PutUint32(footer[12:], vhdVersion)
+	// fixed disks have no dynamic header
+	binary.BigEndian.PutUint64(footer[16:], ^uint64(0))
+	binary.BigEndian.PutUint32(footer[24:], uint32(timestamp.Sub(vhdEpoch)/time.Second))
+	// qemu and the tools derived from it only trust the size field over the
+	// disk geometry for a known set of creators, qemu-img being one of them
+	copy(footer[28:], "qem2")
+	binary.BigEndian.PutUint32(footer[32:], vhdVersion)
+	copy(footer[36:], "Wi2k")
+	binary.BigEndian.PutUint64(footer[40:], uint64(size))
+	binary.BigEndian.PutUint64(footer[48:], uint64(size))
+	cylinders, heads, sectorsPerTrack := vhdGeometry(size)
+	binary.BigEndian.PutUint16(footer[56:], cylinders)
+	footer[58] = heads
+	footer[59] = sectorsPerTrack
+	binary.BigEndian.PutUint32(footer[60:], vhdDiskFixed)
+	if len(opts.UniqueID) != 0 {
+		if len(opts.UniqueID) != 16 {
+			return nil, fmt.Errorf("unique id must be 16 bytes long, got %d", len(opts.UniqueID))
+		}
+		copy(footer[68:84], opts.UniqueID)
+	} else if _, err := randRead(footer[68:84]); err != nil {
+		return nil, fmt.Errorf("Error generating unique id: %s", err.Error())
+	}
+	binary.BigEndian.PutUint32(footer[64:], vhdChecksum(footer))
+	return footer, nil
+}
+
+// vhdChecksum is the one's complement of the sum of all the bytes of the
+// footer, not counting the checksum field itself
+func vhdChecksum(footer []byte) uint32 {
+	var sum uint32
+	for i, b := range footer {
+		if i >= 64 && i < 68 {
+			continue
+		}
+		sum += uint32(b)
+	}
+	return ^sum
+}
+
+// vhdGeometry computes the CHS geometry of a disk with the algorithm
+// described in the VHD specification
+func vhdGeometry(size int64) (uint16, uint8, uint8) {
+	totalSectors := size / sectorSize
+	if totalSectors > 65535*16*255 {
+		totalSectors = 65535 * 16 * 255
+	}
+
+	var sectorsPerTrack, heads, cylinderTimesHeads int64
+	if totalSectors >= 65535*16*63 {
+		sectorsPerTrack = 255
+		heads = 16
+		cylinderTimesHeads = totalSectors / sectorsPerTrack
+	} else {
+		sectorsPerTrack = 17
+		cylinderTimesHeads = totalSectors / sectorsPerTrack
+		heads = (cylinderTimesHeads + 1023) / 1024
+		if heads < 4 {
+			heads = 4
+		}
+		if cylinderTimesHeads >= heads*1024 || heads > 16 {
+			sectorsPerTrack = 31
+			heads = 16
+			cylinderTimesHeads = totalSectors / sectorsPerTrack
+		}
+		if cylinderTimesHeads >= heads*1024 {
+			sectorsPerTrack = 63
+			heads = 16
+			cylinderTimesHeads = totalSectors / sectorsPerTrack
+		}
+	}
+	return uint16(cylinderTimesHeads / heads), uint8(heads), uint8(sectorsPerTrack)
+}
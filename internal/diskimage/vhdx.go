@@ -0,0 +1,261 @@
+package diskimage
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"unicode/utf16"
+)
+
+const (
+	vhdxChunkSize       = 1 << 16
+	vhdxAlignment       = 1 << 20 // regions and payload blocks are aligned to 1 MiB
+	vhdxBlockSize       = 32 << 20
+	vhdxChunkRatio      = (1 << 23) * sectorSize / vhdxBlockSize // payload blocks per sector bitmap block
+	vhdxHeaderSize      = 4 << 10
+	vhdxRegionTableSize = 64 << 10
+	vhdxVersion         = 1
+
+	// the structures of the image are laid out like qemu-img does
+	vhdxHeader1Offset      = 64 << 10
+	vhdxHeader2Offset      = 128 << 10
+	vhdxRegionTable1Offset = 192 << 10
+	vhdxRegionTable2Offset = 256 << 10
+	vhdxLogOffset          = 1 << 20
+	vhdxLogLength          = 1 << 20
+	vhdxMetadataOffset     = 2 << 20
+	vhdxMetadataLength     = 1 << 20
+	vhdxBATOffset          = 3 << 20
+	// the metadata items follow the metadata table, which takes 64 KiB
+	vhdxMetadataItemsOffset = 64 << 10
+
+	vhdxPayloadBlockFullyPresent = 6
+	vhdxLeaveBlocksAllocated     = 1
+	vhdxMetadataIsVirtualDisk    = 2
+	vhdxMetadataIsRequired       = 4
+)
+
+// the GUIDs identifying the regions and the metadata items
+var (
+	vhdxBATGUID                = vhdxGUID(0x2dc27766, 0xf623, 0x4200, 0x9d64115e9bfd4a08)
+	vhdxMetadataGUID           = vhdxGUID(0x8b7ca206, 0x4790, 0x4b9a, 0xb8fe575f050f886e)
+	vhdxFileParametersGUID     = vhdxGUID(0xcaa16737, 0xfa36, 0x4d43, 0xb3b633f0aa44e76b)
+	vhdxVirtualDiskSizeGUID    = vhdxGUID(0x2fa54224, 0xcd1b, 0x4876, 0xb2115dbed83bf4b8)
+	vhdxVirtualDiskIDGUID      = vhdxGUID(0xbeca12ab, 0xb2e6, 0x4523, 0x93efc309e000c746)
+	vhdxLogicalSectorSizeGUID  = vhdxGUID(0x8141bf1d, 0xa96f, 0x4709, 0xba47f233a8faab5f)
+	vhdxPhysicalSectorSizeGUID = vhdxGUID(0xcda348c7, 0x445d, 0x4471, 0x9cc9e9885251c556)
+)
+
+// vhdxCRC32C is the table of the CRC-32C checksums of the headers and the
+// region tables
+var vhdxCRC32C = crc32.MakeTable(crc32.Castagnoli)
+
+// VHDXOptions are the options used to create VHDX images
+type VHDXOptions struct {
+	// UniqueID is the 16 bytes identifier of the virtual disk, also used
+	// to identify the writes to the image. Random identifiers are
+	// generated when it is empty
+	UniqueID []byte
+}
+
+// ConvertToVHDX converts the raw image at src to a fixed VHDX image at dest.
+// The payload blocks of a fixed VHDX follow each other in the same order as
+// in the raw image, after the metadata of the image. Chunks containing only
+// zeros are not written so that dest stays a sparse file on the host
+func ConvertToVHDX(src, dest string, opts VHDXOptions) error {
+	return convertFile(src, dest, func(raw io.ReaderAt, size int64, out *os.File) error {
+		if err := writeVHDX(raw, size, out, opts); err != nil {
+			return fmt.Errorf("Error writing VHDX image: %s", err.Error())
+		}
+		return nil
+	})
+}
+
+// writeVHDX writes the metadata of the image and copies the data of the raw
+// image to its payload blocks
+func writeVHDX(raw io.ReaderAt, size int64, out *os.File, opts VHDXOptions) error {
+	fileWriteID, dataWriteID, diskID, err := vhdxIDs(opts)
+	if err != nil {
+		return err
+	}
+
+	diskSize := divRoundUp(size, sectorSize) * sectorSize
+	blocks := divRoundUp(diskSize, vhdxBlockSize)
+	bat := vhdxBAT(blocks)
+	dataOffset := vhdxBATOffset + int64(len(bat))
+
+	buf := make([]byte, vhdxChunkSize)
+	for offset := int64(0); offset < size; offset += vhdxChunkSize {
+		if err := readChunk(raw, offset, buf); err != nil {
+			return err
+		}
+		if isZero(buf) {
+			continue
+		}
+		chunk := buf
+		if offset+vhdxChunkSize > size {
+			chunk = buf[:size-offset]
+		}
+		if _, err := out.WriteAt(chunk, dataOffset+offset); err != nil {
+			return err
+		}
+	}
+
+	regionTable := vhdxRegionTable(int64(len(bat)))
+	structures := []struct {
+		data   []byte
+		offset int64
+	}{
+		{vhdxFileIdentifier(), 0},
+		{vhdxHeader(0, fileWriteID, dataWriteID), vhdxHeader1Offset},
+		{vhdxHeader(1, fileWriteID, dataWriteID), vhdxHeader2Offset},
+		{regionTable, vhdxRegionTable1Offset},
+		{regionTable, vhdxRegionTable2Offset},
+		{vhdxMetadata(diskSize, diskID), vhdxMetadataOffset},
+		{bat, vhdxBATOffset},
+	}
+	for _, structure := range structures {
+		if _, err := out.WriteAt(structure.data, structure.offset); err != nil {
+			return err
+		}
+	}
+	// the last payload block is allocated in full
+	return out.Truncate(dataOffset + blocks*vhdxBlockSize)
+}
+
+// vhdxIDs returns the identifiers of the writes to the file and to the data
+// of the image, and of the virtual disk
+func vhdxIDs(opts VHDXOptions) ([]byte, []byte, []byte, error) {
+	if len(opts.UniqueID) != 0 {
+		if len(opts.UniqueID) != 16 {
+			return nil, nil, nil, fmt.Errorf("unique id must be 16 bytes long, got %d", len(opts.UniqueID))
+		}
+		return opts.UniqueID, opts.UniqueID, opts.UniqueID, nil
+	}
+	ids := make([]byte, 48)
+	if _, err := randRead(ids); err != nil {
+		return nil, nil, nil, fmt.Errorf("Error generating unique id: %s", err.Error())
+	}
+	return ids[:16], ids[16:32], ids[32:], nil
+}
+
+// vhdxFileIdentifier returns the file type identifier starting the image
+func vhdxFileIdentifier() []byte {
+	identifier := make([]byte, 8+512)
+	copy(identifier[0:], "vhdxfile")
+	for i, c := range utf16.Encode([]rune("ubuntu-image")) {
+		binary.LittleEndian.PutUint16(identifier[8+2*i:], c)
+	}
+	return identifier
+}
+
+// vhdxHeader returns one of the two copies of the header of the image. The
+// copy with the highest sequence number is the current one
+func vhdxHeader(sequenceNumber uint64, fileWriteID, dataWriteID []byte) []byte {
+	le := binary.LittleEndian
+	header := make([]byte, vhdxHeaderSize)
+	copy(header[0:], "head")
+	le.PutUint64(header[8:], sequenceNumber)
+	copy(header[16:32], fileWriteID)
+	copy(header[32:48], dataWriteID)
+	// the log GUID is left zero as there is no log entry to replay
+	le.PutUint16(header[66:], vhdxVersion)
+	le.PutUint32(header[68:], vhdxLogLength)
+	le.PutUint64(header[72:], vhdxLogOffset)
+	le.PutUint32(header[4:], crc32.Checksum(header, vhdxCRC32C))
+	return header
+}
+
+// vhdxRegionTable returns the region table locating the BAT and the
+// metadata region
+func vhdxRegionTable(batLength int64) []byte {
+	le := binary.LittleEndian
+	table := make([]byte, vhdxRegionTableSize)
+	copy(table[0:], "regi")
+	regions := []struct {
+		guid   [16]byte
+		offset int64
+		length int64
+	}{
+		{vhdxBATGUID, vhdxBATOffset, batLength},
+		{vhdxMetadataGUID, vhdxMetadataOffset, vhdxMetadataLength},
+	}
+	le.PutUint32(table[8:], uint32(len(regions)))
+	for i, region := range regions {
+		entry := table[16+32*i:]
+		copy(entry[0:16], region.guid[:])
+		le.PutUint64(entry[16:], uint64(region.offset))
+		le.PutUint32(entry[24:], uint32(region.length))
+		// both regions are required to read the image
+		le.PutUint32(entry[28:], 1)
+	}
+	le.PutUint32(table[4:], crc32.Checksum(table, vhdxCRC32C))
+	return table
+}
+
+// vhdxMetadata returns the metadata region, describing the virtual disk
+func vhdxMetadata(diskSize int64, diskID []byte) []byte {
+	le := binary.LittleEndian
+	fileParameters := make([]byte, 8)
+	le.PutUint32(fileParameters[0:], vhdxBlockSize)
+	le.PutUint32(fileParameters[4:], vhdxLeaveBlocksAllocated)
+	virtualDiskSize := make([]byte, 8)
+	le.PutUint64(virtualDiskSize, uint64(diskSize))
+	sectorSizeItem := make([]byte, 4)
+	le.PutUint32(sectorSizeItem, sectorSize)
+
+	items := []struct {
+		guid  [16]byte
+		data  []byte
+		flags uint32
+	}{
+		{vhdxFileParametersGUID, fileParameters, vhdxMetadataIsRequired},
+		{vhdxVirtualDiskSizeGUID, virtualDiskSize, vhdxMetadataIsVirtualDisk | vhdxMetadataIsRequired},
+		{vhdxVirtualDiskIDGUID, diskID, vhdxMetadataIsVirtualDisk | vhdxMetadataIsRequired},
+		{vhdxLogicalSectorSizeGUID, sectorSizeItem, vhdxMetadataIsVirtualDisk | vhdxMetadataIsRequired},
+		{vhdxPhysicalSectorSizeGUID, sectorSizeItem, vhdxMetadataIsVirtualDisk | vhdxMetadataIsRequired},
+	}
+	metadata := make([]byte, vhdxMetadataItemsOffset)
+	copy(metadata[0:], "metadata")
+	le.PutUint16(metadata[10:], uint16(len(items)))
+	for i, item := range items {
+		entry := metadata[32+32*i:]
+		copy(entry[0:16], item.guid[:])
+		le.PutUint32(entry[16:], uint32(len(metadata)))
+		le.PutUint32(entry[20:], uint32(len(item.data)))
+		le.PutUint32(entry[24:], item.flags)
+		metadata = append(metadata, item.data...)
+	}
+	return metadata
+}
+
+// vhdxBAT returns the block allocation table of a fixed image with the given
+// number of payload blocks, padded to a whole number of MiB. The entries of
+// the payload blocks of each chunk are followed by the entry of the sector
+// bitmap block of the chunk, which is only present in differencing images
+func vhdxBAT(blocks int64) []byte {
+	entries := blocks + (blocks-1)/vhdxChunkRatio
+	bat := make([]byte, divRoundUp(entries*8, vhdxAlignment)*vhdxAlignment)
+	dataOffset := vhdxBATOffset + int64(len(bat))
+	for block := int64(0); block < blocks; block++ {
+		index := block + block/vhdxChunkRatio
+		// the offset of the block is a multiple of 1 MiB, its lower bits
+		// hold the state of the block
+		fileOffset := dataOffset + block*vhdxBlockSize
+		binary.LittleEndian.PutUint64(bat[8*index:], uint64(fileOffset)|vhdxPayloadBlockFullyPresent)
+	}
+	return bat
+}
+
+// vhdxGUID returns the on-disk representation of a GUID, whose first three
+// fields are little endian
+func vhdxGUID(data1 uint32, data2, data3 uint16, data4 uint64) [16]byte {
+	var guid [16]byte
+	binary.LittleEndian.PutUint32(guid[0:], data1)
+	binary.LittleEndian.PutUint16(guid[4:], data2)
+	binary.LittleEndian.PutUint16(guid[6:], data3)
+	binary.BigEndian.PutUint64(guid[8:], data4)
+	return guid
+}
@@ -0,0 +1,148 @@
+package diskimage
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+const (
+	vmdkMagic             = 0x564d444b // "KDMV"
+	vmdkVersion           = 1
+	vmdkFlagValidNewline  = 1
+	vmdkGrainSectors      = 128
+	vmdkGrainSize         = vmdkGrainSectors * sectorSize
+	vmdkGTEsPerGT         = 512
+	vmdkGTSectors         = vmdkGTEsPerGT * 4 / sectorSize
+	vmdkDescriptorOffset  = 1
+	vmdkDescriptorSectors = 20
+	vmdkMaxCylinders      = 65535
+)
+
+// vmdkDescriptorTemplate is the descriptor embedded in monolithicSparse
+// images. It describes a single sparse extent, the image itself
+const vmdkDescriptorTemplate = `# Disk DescriptorFile
+version=1
+CID=%08x
+parentCID=ffffffff
+createType="monolithicSparse"
+
+# Extent description
+RW %d SPARSE "%s"
+
+# The Disk Data Base
+#DDB
+
+ddb.virtualHWVersion = "4"
+ddb.geometry.cylinders = "%d"
+ddb.geometry.heads = "16"
+ddb.geometry.sectors = "63"
+ddb.adapterType = "ide"
+`
+
+// VMDKOptions are the options used to create VMDK images
+type VMDKOptions struct {
+	// ContentID identifies the content of the image in its descriptor.
+	// A random identifier is generated when it is zero
+	ContentID uint32
+}
+
+// ConvertToVMDK converts the raw image at src to a monolithicSparse VMDK
+// image at dest. Grains containing only zeros are left unallocated
+func ConvertToVMDK(src, dest string, opts VMDKOptions) error {
+	return convertFile(src, dest, func(raw io.ReaderAt, size int64, out *os.File) error {
+		if err := writeVMDK(raw, size, out, filepath.Base(dest), opts); err != nil {
+			return fmt.Errorf("Error writing VMDK image: %s", err.Error())
+		}
+		return nil
+	})
+}
+
+// writeVMDK lays out the image as the header, the embedded descriptor, the
+// grain directory, the grain tables and then the grains. The grain tables
+// are all preallocated and written once every grain has been placed
+func writeVMDK(raw io.ReaderAt, size int64, out *os.File, name string, opts VMDKOptions) error {
+	capacity := divRoundUp(size, sectorSize)
+	grains := divRoundUp(capacity, vmdkGrainSectors)
+	grainTables := divRoundUp(grains, vmdkGTEsPerGT)
+	gdOffset := int64(vmdkDescriptorOffset + vmdkDescriptorSectors)
+	gdSectors := divRoundUp(grainTables*4, sectorSize)
+	gtOffset := gdOffset + gdSectors
+	overHead := divRoundUp(gtOffset+grainTables*vmdkGTSectors, vmdkGrainSectors) * vmdkGrainSectors
+
+	gt := make([]uint32, grainTables*vmdkGTEsPerGT)
+	nextSector := overHead
+	buf := make([]byte, vmdkGrainSize)
+	for grain := int64(0); grain < grains; grain++ {
+		if err := readChunk(raw, grain*vmdkGrainSize, buf); err != nil {
+			return err
+		}
+		if isZero(buf) {
+			continue
+		}
+		if nextSector > int64(^uint32(0)) {
+			return fmt.Errorf("image is too large for the VMDK format")
+		}
+		if _, err := out.WriteAt(buf, nextSector*sectorSize); err != nil {
+			return err
+		}
+		gt[grain] = uint32(nextSector)
+		nextSector += vmdkGrainSectors
+	}
+	if err := out.Truncate(nextSector * sectorSize); err != nil {
+		return err
+	}
+
+	metadata := make([]byte, gtOffset*sectorSize+grainTables*vmdkGTSectors*sectorSize)
+	putVMDKHeader(metadata, capacity, gdOffset, overHead)
+
+	cid := opts.ContentID
+	if cid == 0 {
+		randomCID := make([]byte, 4)
+		if _, err := randRead(randomCID); err != nil {
+			return fmt.Errorf("Error generating content id: %s", err.Error())
+		}
+		cid = binary.LittleEndian.Uint32(randomCID)
+	}
+	cylinders := capacity / (16 * 63)
+	if cylinders > vmdkMaxCylinders {
+		cylinders = vmdkMaxCylinders
+	}
+	descriptor := fmt.Sprintf(vmdkDescriptorTemplate,
+		cid, capacity, name, cylinders)
+	copy(metadata[vmdkDescriptorOffset*sectorSize:], descriptor)
+
+	for i := int64(0); i < grainTables; i++ {
+		binary.LittleEndian.PutUint32(metadata[gdOffset*sectorSize+i*4:],
+			uint32(gtOffset+i*vmdkGTSectors))
+	}
+	for i, entry := range gt {
+		binary.LittleEndian.PutUint32(metadata[gtOffset*sectorSize+int64(i)*4:], entry)
+	}
+	_, err := out.WriteAt(metadata, 0)
+	return err
+}
+
+// putVMDKHeader fills in the SparseExtentHeader at the start of buf
+func putVMDKHeader(buf []byte, capacity, gdOffset, overHead int64) {
+	binary.LittleEndian.PutUint32(buf[0:], vmdkMagic)
+	binary.LittleEndian.PutUint32(buf[4:], vmdkVersion)
+	binary.LittleEndian.PutUint32(buf[8:], vmdkFlagValidNewline)
+	binary.LittleEndian.PutUint64(buf[12:], uint64(capacity))
+	binary.LittleEndian.PutUint64(buf[20:], vmdkGrainSectors)
+	binary.LittleEndian.PutUint64(buf[28:], vmdkDescriptorOffset)
+	binary.LittleEndian.PutUint64(buf[36:], vmdkDescriptorSectors)
+	binary.LittleEndian.PutUint32(buf[44:], vmdkGTEsPerGT)
+	// no redundant grain directory
+	binary.LittleEndian.PutUint64(buf[56:], uint64(gdOffset))
+	binary.LittleEndian.PutUint64(buf[64:], uint64(overHead))
+	// the newline detection characters, used to catch files transferred in
+	// text mode
+	buf[73] = '\n'
+	buf[74] = ' '
+	buf[75] = '\r'
+	buf[76] = '\n'
+	// no compression
+}
@@ -9,7 +9,9 @@ import (
 	"os/exec"
 	"path/filepath"
 	"reflect"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/invopop/jsonschema"
 	"github.com/snapcore/snapd/gadget/quantity"
@@ -58,18 +60,6 @@ func InitCommonOpts() (*commands.CommonOpts, *commands.StateMachineOpts) {
 	return commonOpts, new(commands.StateMachineOpts)
 }
 
-// RunScript runs scripts from disk. Currently only used for hooks
-func RunScript(hookScript string) error {
-	hookScriptCmd := exec.Command(hookScript)
-	hookScriptCmd.Env = os.Environ()
-	hookScriptCmd.Stdout = os.Stdout
-	hookScriptCmd.Stderr = os.Stderr
-	if err := hookScriptCmd.Run(); err != nil {
-		return fmt.Errorf("Error running hook script %s: %s", hookScript, err.Error())
-	}
-	return nil
-}
-
 // SaveCWD gets the current working directory and returns a function to go back to it
 func SaveCWD() func() {
 	wd, _ := os.Getwd()
@@ -115,6 +105,10 @@ func SetDefaults(needsDefaults interface{}) error {
 	elem := value.Elem()
 	for i := 0; i < elem.NumField(); i++ {
 		field := elem.Field(i)
+		// a pointer to a slice is handled like the slice
+		if field.Kind() == reflect.Ptr && field.Type().Elem().Kind() == reflect.Slice && !field.IsNil() {
+			field = field.Elem()
+		}
 		// if we're dealing with a slice of pointers to structs,
 		// iterate through it and set the defaults for each struct pointer
 		if field.Type().Kind() == reflect.Slice &&
@@ -126,6 +120,16 @@ func SetDefaults(needsDefaults interface{}) error {
 					return err
 				}
 			}
+		} else if field.Type().Kind() == reflect.Slice &&
+			field.Type().Elem().Kind() == reflect.Struct {
+			// the same goes for a slice of structs, whose elements
+			// are addressable
+			for i := 0; i < field.Len(); i++ {
+				err := SetDefaults(field.Index(i).Addr().Interface())
+				if err != nil {
+					return err
+				}
+			}
 		} else if field.Type().Kind() == reflect.Ptr {
 			// if it's a pointer to a struct, look for default types
 			if field.Elem().Kind() == reflect.Struct {
@@ -170,6 +174,14 @@ func SetDefaults(needsDefaults interface{}) error {
 					field.Set(reflect.ValueOf(defaultValues))
 				case reflect.Bool:
 					return fmt.Errorf("Setting default value of a boolean not supported. Use a pointer to boolean instead.")
+				case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+					// base 0 so that permissions can be given in octal
+					uintValue, err := strconv.ParseUint(defaultValue, 0, field.Type().Bits())
+					if err != nil {
+						return fmt.Errorf("Error parsing default value \"%s\": %s",
+							defaultValue, err.Error())
+					}
+					field.SetUint(uintValue)
 				default:
 					return fmt.Errorf("Setting default value of type %s not supported",
 						varType)
@@ -193,12 +205,19 @@ func CheckEmptyFields(Interface interface{}, result *gojsonschema.Result, schema
 	elem := value.Elem()
 	for i := 0; i < elem.NumField(); i++ {
 		field := elem.Field(i)
+		// a pointer to a slice is checked like the slice
+		if field.Kind() == reflect.Ptr && field.Type().Elem().Kind() == reflect.Slice && !field.IsNil() {
+			field = field.Elem()
+		}
 		// if we're dealing with a slice, iterate through
 		// it and search for missing required fields in each
 		// element of the slice
 		if field.Type().Kind() == reflect.Slice {
 			for i := 0; i < field.Cap(); i++ {
 				sliceElem := field.Index(i)
+				if sliceElem.Kind() == reflect.Struct {
+					sliceElem = sliceElem.Addr()
+				}
 				if sliceElem.Kind() == reflect.Ptr && sliceElem.Elem().Kind() == reflect.Struct {
 					err := CheckEmptyFields(sliceElem.Interface(), result, schema)
 					if err != nil {
@@ -308,8 +327,10 @@ func SafeQuantitySubtraction(orig, subtract quantity.Size) quantity.Size {
 
 // CreateTarArchive places all of the files from a source directory into a tar.
 // Currently supported are uncompressed tar archives and the following
-// compression types: zip, gzip, xz bzip2, zstd
-func CreateTarArchive(src, dest, compression string, verbose, debug bool) error {
+// compression types: zip, gzip, xz bzip2, zstd. When sourceDateEpoch is not
+// nil, the archive is reproducible: the entries are sorted by name, keep their
+// numeric owners and their modification times are clamped to sourceDateEpoch
+func CreateTarArchive(src, dest, compression string, verbose, debug bool, sourceDateEpoch *time.Time) error {
 	tarCommand := *exec.Command(
 		"tar",
 		"--directory",
@@ -324,6 +345,16 @@ func CreateTarArchive(src, dest, compression string, verbose, debug bool) error
 	if debug {
 		tarCommand.Args = append(tarCommand.Args, "--verbose")
 	}
+	if sourceDateEpoch != nil {
+		tarCommand.Args = append(tarCommand.Args,
+			"--sort=name",
+			"--mtime=@"+strconv.FormatInt(sourceDateEpoch.Unix(), 10),
+			"--clamp-mtime",
+			// the names of the owners would be looked up on the host
+			"--numeric-owner",
+			"--pax-option=exthdr.name=%d/PaxHeaders/%f,delete=atime,delete=ctime",
+		)
+	}
 	// set up any compression arguments
 	switch compression {
 	case "uncompressed":
@@ -331,7 +362,12 @@ func CreateTarArchive(src, dest, compression string, verbose, debug bool) error
 	case "bzip2":
 		tarCommand.Args = append(tarCommand.Args, "--bzip2")
 	case "gzip":
-		tarCommand.Args = append(tarCommand.Args, "--gzip")
+		if sourceDateEpoch != nil {
+			// gzip stores the time of the compression in its header
+			tarCommand.Args = append(tarCommand.Args, "--use-compress-program=gzip --no-name")
+		} else {
+			tarCommand.Args = append(tarCommand.Args, "--gzip")
+		}
 	case "xz":
 		tarCommand.Args = append(tarCommand.Args, "--xz")
 	case "zstd":
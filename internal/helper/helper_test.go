@@ -155,6 +155,20 @@ type S7 struct {
 	A bool `default:"true"`
 }
 
+type S8 struct {
+	A uint32 `default:"0755"`
+	B uint64 `default:"42"`
+}
+
+type S9 struct {
+	A uint8 `default:"256"`
+}
+
+type S10 struct {
+	A *[]S3
+	B []S3
+}
+
 func TestSetDefaults(t *testing.T) {
 	type args struct {
 		needsDefaults interface{}
@@ -235,6 +249,43 @@ func TestSetDefaults(t *testing.T) {
 				D: BoolPtr(true),
 			},
 		},
+		{
+			name: "set default on struct with unsigned integers",
+			args: args{
+				needsDefaults: &S8{},
+			},
+			want: &S8{
+				A: 0755,
+				B: 42,
+			},
+		},
+		{
+			name: "set default on struct with slices of structs",
+			args: args{
+				needsDefaults: &S10{
+					A: &[]S3{{}, {A: "non-empty-A-value"}},
+					B: []S3{{}},
+				},
+			},
+			want: &S10{
+				A: &[]S3{{A: "defaults3value"}, {A: "non-empty-A-value"}},
+				B: []S3{{A: "defaults3value"}},
+			},
+		},
+		{
+			name: "set default on struct with nil pointer to slice",
+			args: args{
+				needsDefaults: &S10{},
+			},
+			want: &S10{},
+		},
+		{
+			name: "fail to set default on unsigned integer out of range",
+			args: args{
+				needsDefaults: &S9{},
+			},
+			expectedError: "Error parsing default value \"256\"",
+		},
 		{
 			name: "fail to set default on struct with unsuported type",
 			args: args{
@@ -336,3 +387,31 @@ func TestCheckEmptyFields(t *testing.T) {
 		})
 	}
 }
+
+// TestCheckEmptyFieldsPointerToSlice tests that the structs of pointers to
+// slices of structs are checked
+func TestCheckEmptyFieldsPointerToSlice(t *testing.T) {
+	type testItem struct {
+		A string `yaml:"a" json:"fieldA"`
+	}
+	type testStruct struct {
+		Items *[]testItem `yaml:"items" json:"Items,omitempty"`
+	}
+	var jsonReflector jsonschema.Reflector
+	schema := jsonReflector.Reflect(&testStruct{})
+
+	result := new(gojsonschema.Result)
+	err := CheckEmptyFields(&testStruct{Items: &[]testItem{{A: "foo"}, {}}}, result, schema)
+	asserter := Asserter{T: t}
+	asserter.AssertErrNil(err, true)
+	if result.Valid() {
+		t.Error("CheckEmptyFields did NOT add errors when it should have")
+	}
+
+	result = new(gojsonschema.Result)
+	err = CheckEmptyFields(&testStruct{}, result, schema)
+	asserter.AssertErrNil(err, true)
+	if !result.Valid() {
+		t.Error("CheckEmptyFields added errors when it should not have")
+	}
+}
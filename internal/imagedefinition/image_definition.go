@@ -9,6 +9,7 @@ import (
 	"strings"
 
 	"github.com/xeipuuv/gojsonschema"
+	"gopkg.in/yaml.v2"
 )
 
 // ImageDefinition is the parent struct for the data
@@ -26,15 +27,38 @@ type ImageDefinition struct {
 	Customization  *Customization `yaml:"customization"   json:"Customization,omitempty"`
 	Artifacts      *Artifact      `yaml:"artifacts"       json:"Artifacts"`
 	Class          string         `yaml:"class"           json:"Class"                    jsonschema:"enum=preinstalled,enum=cloud,enum=installer"`
+	Signing        *Signing       `yaml:"signing"         json:"Signing,omitempty"`
+	Hooks          []string       `yaml:"hooks"           json:"Hooks,omitempty"`
+	Store          *Store         `yaml:"store"           json:"Store,omitempty"`
+	SchemaID       string         `yaml:"$schema"         json:"SchemaID,omitempty"`
 }
 
 // Gadget defines the gadget section of the image definition file
 type Gadget struct {
-	Ref          string `yaml:"ref"    json:"Ref,omitempty"`
-	GadgetTarget string `yaml:"target" json:"GadgetTarget,omitempty"`
-	GadgetBranch string `yaml:"branch" json:"GadgetBranch,omitempty"`
-	GadgetType   string `yaml:"type"   json:"GadgetType"             jsonschema:"enum=git,enum=directory,enum=prebuilt"`
-	GadgetURL    string `yaml:"url"    json:"GadgetURL,omitempty"    jsonschema:"type=string,format=uri"`
+	Ref          string      `yaml:"ref"        json:"Ref,omitempty"`
+	GadgetTarget string      `yaml:"target"     json:"GadgetTarget,omitempty"`
+	GadgetBranch string      `yaml:"branch"     json:"GadgetBranch,omitempty"`
+	GadgetType   string      `yaml:"type"       json:"GadgetType"             jsonschema:"enum=git,enum=directory,enum=prebuilt"`
+	GadgetURL    string      `yaml:"url"        json:"GadgetURL,omitempty"    jsonschema:"type=string,format=uri"`
+	Submodules   bool        `yaml:"submodules" json:"Submodules,omitempty"`
+	Auth         *GadgetAuth `yaml:"auth"       json:"Auth,omitempty"`
+}
+
+// GadgetAuth defines the local files used to authenticate to private git
+// repositories, either with an SSH key or with a token over HTTPS
+type GadgetAuth struct {
+	SSHKey         string `yaml:"ssh-key"         json:"SSHKey,omitempty"         jsonschema:"oneof_required=SSHKey"`
+	PassphraseFile string `yaml:"passphrase-file" json:"PassphraseFile,omitempty"`
+	TokenFile      string `yaml:"token-file"      json:"TokenFile,omitempty"      jsonschema:"oneof_required=TokenFile"`
+	Username       string `yaml:"username"        json:"Username,omitempty"`
+}
+
+// Store defines the snap store, or the snap store proxy, the snaps are
+// pulled from
+type Store struct {
+	StoreURL string `yaml:"url"       json:"StoreURL,omitempty" jsonschema:"type=string,format=uri"`
+	StoreID  string `yaml:"id"        json:"StoreID,omitempty"`
+	AuthFile string `yaml:"auth-file" json:"AuthFile,omitempty"`
 }
 
 // Rootfs defines the rootfs section of the image definition file
@@ -47,6 +71,25 @@ type Rootfs struct {
 	Seed         *Seed    `yaml:"seed"          json:"Seed,omitempty"         jsonschema:"oneof_required=Seed"`
 	Tarball      *Tarball `yaml:"tarball"       json:"Tarball,omitempty"      jsonschema:"oneof_required=Tarball"`
 	ArchiveTasks []string `yaml:"archive-tasks" json:"ArchiveTasks,omitempty" jsonschema:"oneof_required=ArchiveTasks"`
+	Apt          *Apt     `yaml:"apt"           json:"Apt,omitempty"`
+}
+
+// Apt defines the configuration of apt used to build the rootfs, which
+// is removed from the rootfs of the image unless keep-enabled is set
+type Apt struct {
+	Proxy             string            `yaml:"proxy"              json:"Proxy,omitempty"             jsonschema:"type=string,format=uri"`
+	Retries           int               `yaml:"retries"            json:"Retries,omitempty"           jsonschema:"type=integer,minimum=0"`
+	InstallRecommends *bool             `yaml:"install-recommends" json:"InstallRecommends,omitempty" default:"true"`
+	Options           map[string]string `yaml:"options"            json:"Options,omitempty"`
+	Preferences       []*AptPreference  `yaml:"preferences"        json:"Preferences,omitempty"`
+	KeepEnabled       *bool             `yaml:"keep-enabled"       json:"KeepEnabled"                 default:"false"`
+}
+
+// AptPreference contains an apt preference pinning packages to a priority
+type AptPreference struct {
+	Package     string `yaml:"package"      json:"Package"`
+	Pin         string `yaml:"pin"          json:"Pin"`
+	PinPriority int    `yaml:"pin-priority" json:"PinPriority" jsonschema:"type=integer"`
 }
 
 // Seed defines the seed section of rootfs, which is used to
@@ -63,7 +106,8 @@ type Seed struct {
 type Tarball struct {
 	TarballURL string `yaml:"url"       json:"TarballURL"          jsonschema:"type=string,format=uri"`
 	GPG        string `yaml:"gpg"       json:"GPG,omitempty"       jsonschema:"type=string,format=uri"`
-	SHA256sum  string `yaml:"sha256sum" json:"SHA256sum,omitempty" jsonschema:"minLength=64,maxLength=64"`
+	Keyring    string `yaml:"keyring"   json:"Keyring,omitempty"`
+	SHA256sum  string `yaml:"sha256sum" json:"SHA256sum,omitempty" jsonschema:"pattern=^[0-9a-fA-F]{64}$"`
 }
 
 // Customization defines the customization section of the image definition file.
@@ -115,12 +159,43 @@ type Snap struct {
 
 // Manual provides manual customization options
 type Manual struct {
-	MakeDirs  []*MakeDirs  `yaml:"make-dirs"  json:"MakeDirs,omitempty"`
-	CopyFile  []*CopyFile  `yaml:"copy-file"  json:"CopyFile,omitempty"`
-	Execute   []*Execute   `yaml:"execute"    json:"Execute,omitempty"`
-	TouchFile []*TouchFile `yaml:"touch-file" json:"TouchFile,omitempty"`
-	AddGroup  []*AddGroup  `yaml:"add-group"  json:"AddGroup,omitempty"`
-	AddUser   []*AddUser   `yaml:"add-user"   json:"AddUser,omitempty"`
+	MakeDirs   []*MakeDirs   `yaml:"make-dirs"   json:"MakeDirs,omitempty"`
+	CopyFile   []*CopyFile   `yaml:"copy-file"   json:"CopyFile,omitempty"`
+	CopyTree   []*CopyTree   `yaml:"copy-tree"   json:"CopyTree,omitempty"`
+	WriteFile  []*WriteFile  `yaml:"write-file"  json:"WriteFile,omitempty"`
+	Symlink    []*Symlink    `yaml:"symlink"     json:"Symlink,omitempty"`
+	Chmod      []*Chmod      `yaml:"chmod"       json:"Chmod,omitempty"`
+	Chown      []*Chown      `yaml:"chown"       json:"Chown,omitempty"`
+	RemovePath []*RemovePath `yaml:"remove-path" json:"RemovePath,omitempty"`
+	Execute    []*Execute    `yaml:"execute"     json:"Execute,omitempty"`
+	TouchFile  []*TouchFile  `yaml:"touch-file"  json:"TouchFile,omitempty"`
+	AddGroup   []*AddGroup   `yaml:"add-group"   json:"AddGroup,omitempty"`
+	AddUser    []*AddUser    `yaml:"add-user"    json:"AddUser,omitempty"`
+	// Order lists the keys of the customizations in the order they
+	// appear in the image definition, which is the order they run in
+	Order []string `yaml:"-" json:"Order,omitempty"`
+}
+
+// UnmarshalYAML decodes the manual customizations and records the
+// order in which they appear in the image definition
+func (manual *Manual) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	// decode to a type without this method to avoid recursing
+	type plainManual Manual
+	if err := unmarshal((*plainManual)(manual)); err != nil {
+		return err
+	}
+
+	var keys yaml.MapSlice
+	if err := unmarshal(&keys); err != nil {
+		return err
+	}
+	manual.Order = nil
+	for _, item := range keys {
+		if key, ok := item.Key.(string); ok {
+			manual.Order = append(manual.Order, key)
+		}
+	}
+	return nil
 }
 
 // Fstab defines the information that gets rendered into an fstab
@@ -135,19 +210,72 @@ type Fstab struct {
 
 // MakeDirs allows users to copy files into the rootfs of an image
 type MakeDirs struct {
-	Path        string `yaml:"path" json:"Path"`
-	Permissions uint32 `yaml:"permissions"      json:"Permissions" default:"0755"`
+	Path        string `yaml:"path"        json:"Path"`
+	Permissions uint32 `yaml:"permissions" json:"Permissions"     default:"0755"`
+	Owner       string `yaml:"owner"       json:"Owner,omitempty"`
 }
 
 // CopyFile allows users to copy files into the rootfs of an image
 type CopyFile struct {
+	Dest        string `yaml:"destination" json:"Dest"`
+	Source      string `yaml:"source"      json:"Source"`
+	Permissions uint32 `yaml:"permissions" json:"Permissions,omitempty"`
+	Owner       string `yaml:"owner"       json:"Owner,omitempty"`
+}
+
+// CopyTree allows users to copy the contents of a directory into the rootfs of an image
+type CopyTree struct {
 	Dest   string `yaml:"destination" json:"Dest"`
 	Source string `yaml:"source"      json:"Source"`
+	Owner  string `yaml:"owner"       json:"Owner,omitempty"`
+}
+
+// WriteFile allows users to write a file with inline content in the rootfs of an image.
+// The content can be a text/template rendered with the image definition
+type WriteFile struct {
+	Path        string `yaml:"path"        json:"Path"`
+	Content     string `yaml:"content"     json:"Content"`
+	Template    bool   `yaml:"template"    json:"Template,omitempty"`
+	Permissions uint32 `yaml:"permissions" json:"Permissions"     default:"0644"`
+	Owner       string `yaml:"owner"       json:"Owner,omitempty"`
+}
+
+// Symlink allows users to create a symbolic link in the rootfs of an image
+type Symlink struct {
+	Path   string `yaml:"path"   json:"Path"`
+	Target string `yaml:"target" json:"Target"`
+}
+
+// Chmod allows users to change the permissions of a path in the rootfs of an image
+type Chmod struct {
+	Path        string `yaml:"path"        json:"Path"`
+	Permissions uint32 `yaml:"permissions" json:"Permissions"`
+}
+
+// Chown allows users to change the owner of a path in the rootfs of an image.
+// The owner is given as user[:group], with names or numeric ids
+type Chown struct {
+	Path      string `yaml:"path"      json:"Path"`
+	Owner     string `yaml:"owner"     json:"Owner"`
+	Recursive bool   `yaml:"recursive" json:"Recursive,omitempty"`
 }
 
-// Execute allows users to execute a script in the rootfs of an image
+// RemovePath allows users to remove a path from the rootfs of an image
+type RemovePath struct {
+	Path      string `yaml:"path"      json:"Path"`
+	Recursive bool   `yaml:"recursive" json:"Recursive,omitempty"`
+}
+
+// Execute allows users to execute a script in the rootfs of an image.
+// The script runs in a plain chroot by default, or in private mount,
+// PID and network namespaces with the nspawn and unshare sandboxes
 type Execute struct {
-	ExecutePath string `yaml:"path" json:"ExecutePath"`
+	ExecutePath string            `yaml:"path"        json:"ExecutePath"`
+	Args        []string          `yaml:"args"        json:"Args,omitempty"`
+	Env         map[string]string `yaml:"env"         json:"Env,omitempty"`
+	WorkingDir  string            `yaml:"working-dir" json:"WorkingDir,omitempty"`
+	Timeout     string            `yaml:"timeout"     json:"Timeout,omitempty"     jsonschema:"pattern=^([0-9]+(\\.[0-9]+)?(ns|us|ms|s|m|h))+$"`
+	Sandbox     string            `yaml:"sandbox"     json:"Sandbox,omitempty"     jsonschema:"enum=chroot,enum=nspawn,enum=unshare" default:"chroot"`
 }
 
 // TouchFile allows users to touch a file in the rootfs of an image
@@ -163,8 +291,17 @@ type AddGroup struct {
 
 // AddUser allows users to add a user in the image that is being built
 type AddUser struct {
-	UserName string `yaml:"name" json:"UserName"`
-	UserID   string `yaml:"id"   json:"UserID,omitempty"`
+	UserName       string   `yaml:"name"            json:"UserName"`
+	UserID         string   `yaml:"id"              json:"UserID,omitempty"`
+	Password       string   `yaml:"password"        json:"Password,omitempty"       jsonschema:"pattern=^[^:\\n]+$"`
+	ExpirePassword *bool    `yaml:"expire-password" json:"ExpirePassword,omitempty"`
+	PrimaryGroup   string   `yaml:"primary-group"   json:"PrimaryGroup,omitempty"`
+	Groups         []string `yaml:"groups"          json:"Groups,omitempty"`
+	Shell          string   `yaml:"shell"           json:"Shell,omitempty"`
+	Home           string   `yaml:"home"            json:"Home,omitempty"`
+	CreateHome     *bool    `yaml:"create-home"     json:"CreateHome,omitempty"`
+	AuthorizedKeys []string `yaml:"authorized-keys" json:"AuthorizedKeys,omitempty"`
+	Sudo           string   `yaml:"sudo"            json:"Sudo,omitempty"           jsonschema:"pattern=^[^\\n]+$"`
 }
 
 // Artifact contains information about the files that are created
@@ -177,13 +314,15 @@ type Artifact struct {
 	Filelist  *Filelist  `yaml:"filelist"       json:"Filelist,omitempty"  is_disk:"false"`
 	Changelog *Changelog `yaml:"changelog"      json:"Changelog,omitempty" is_disk:"false"`
 	RootfsTar *RootfsTar `yaml:"rootfs-tarball" json:"RootfsTar,omitempty" is_disk:"false"`
+	Report    *Report    `yaml:"report"         json:"Report,omitempty"    is_disk:"false"`
+	SBOM      *SBOM      `yaml:"sbom"           json:"SBOM,omitempty"      is_disk:"false"`
 }
 
 // Img specifies the name of the resulting .img file.
 // If left emtpy no .img file will be created
 type Img struct {
 	ImgName   string `yaml:"name"   json:"ImgName"`
-	ImgVolume string `yaml:"volume" json:"ImgVolume"`
+	ImgVolume string `yaml:"volume" json:"ImgVolume,omitempty"`
 }
 
 // Iso specifies the name of the resulting .iso file
@@ -191,21 +330,25 @@ type Img struct {
 // If left emtpy no .iso file will be created
 type Iso struct {
 	IsoName   string `yaml:"name"            json:"IsoName"`
-	IsoVolume string `yaml:"volume"          json:"IsoVolume"`
+	IsoVolume string `yaml:"volume"          json:"IsoVolume,omitempty"`
 	Command   string `yaml:"xorriso-command" json:"Command,omitempty"`
 }
 
 // Qcow2 specifies the name of the resulting .qcow2 file
 // If left emtpy no .qcow2 file will be created
 type Qcow2 struct {
-	Qcow2Name   string `yaml:"name"   json:"Qcow2Name"`
-	Qcow2Volume string `yaml:"volume" json:"Qcow2Volume"`
+	Qcow2Name   string `yaml:"name"        json:"Qcow2Name"`
+	Qcow2Volume string `yaml:"volume"      json:"Qcow2Volume,omitempty"`
+	Compression *bool  `yaml:"compression" json:"Compression,omitempty" default:"true"`
+	Compat      string `yaml:"compat"      json:"Compat,omitempty"      jsonschema:"enum=0.10,enum=1.1" default:"0.10"`
 }
 
-// Manifest specifies the name of the manifest file.
+// Manifest specifies the name of the manifest file, and whether the snaps
+// seeded in the image are listed after the packages.
 // If left emtpy no manifest file will be created
 type Manifest struct {
-	ManifestName string `yaml:"name" json:"ManifestName"`
+	ManifestName string `yaml:"name"  json:"ManifestName"`
+	Snaps        *bool  `yaml:"snaps" json:"Snaps,omitempty" default:"false"`
 }
 
 // Filelist specifies the name of the filelist file.
@@ -214,10 +357,13 @@ type Filelist struct {
 	FilelistName string `yaml:"name" json:"FilelistName"`
 }
 
-// Changelog specifies the name of the changelog file.
+// Changelog specifies the name of the changelog file, and the package
+// manifest of a previous build, or a directory of previous builds, that
+// the packages and snaps of the image are compared with.
 // If left emtpy no changelog file will be created
 type Changelog struct {
-	ChangelogName string `yaml:"name" json:"ChangelogName"`
+	ChangelogName string `yaml:"name"     json:"ChangelogName"`
+	Previous      string `yaml:"previous" json:"Previous,omitempty"`
 }
 
 // RootfsTar specifies the name of a tarball to create from the
@@ -227,6 +373,28 @@ type RootfsTar struct {
 	Compression   string `yaml:"compression" json:"Compression"   jsonschema:"enum=uncompressed,enum=bzip2,enum=gzip,enum=xz,enum=zstd" default:"uncompressed"`
 }
 
+// Report specifies the name of the build report and its format.
+// If left emtpy no report will be created
+type Report struct {
+	ReportName string `yaml:"name"   json:"ReportName"`
+	Format     string `yaml:"format" json:"Format"     jsonschema:"enum=json,enum=yaml" default:"json"`
+}
+
+// SBOM specifies the name of the software bill of materials and its format.
+// If left emtpy no SBOM will be created
+type SBOM struct {
+	SBOMName string `yaml:"name"   json:"SBOMName"`
+	Format   string `yaml:"format" json:"Format"   jsonschema:"enum=spdx,enum=cyclonedx" default:"spdx"`
+}
+
+// Signing specifies the local key used to sign the artifacts. If left
+// empty the artifacts are not signed
+type Signing struct {
+	Method         string `yaml:"method"          json:"Method"                   jsonschema:"enum=gpg,enum=minisign,enum=cosign" default:"gpg"`
+	Key            string `yaml:"key"             json:"Key"`
+	PassphraseFile string `yaml:"passphrase-file" json:"PassphraseFile,omitempty"`
+}
+
 // NewMissingURLError fails the image definition parsing when a dict
 // requires a URL conditionally based on the value of other keys
 // in the dict but does not have one included
@@ -316,40 +484,54 @@ func (imageDef ImageDefinition) securityMirror() string {
 // /etc/apt/sources.list in the chroot based on the value of "pocket"
 // in the rootfs section of the image definition
 func (imageDef ImageDefinition) GeneratePocketList() []string {
+	return imageDef.pocketList(imageDef.Rootfs.Mirror, imageDef.securityMirror())
+}
+
+// GenerateLocalPocketList returns the same sources as GeneratePocketList,
+// with every pocket, including the security one, read from the given
+// mirror. It is used by offline builds, which take all the pockets from a
+// local mirror
+func (imageDef ImageDefinition) GenerateLocalPocketList(mirror string) []string {
+	return imageDef.pocketList(mirror, mirror)
+}
+
+// pocketList returns the sources of the pockets read from mirror, the
+// security pocket being read from securityMirror
+func (imageDef ImageDefinition) pocketList(mirror string, securityMirror string) []string {
 	pocketMap := map[string][]string{
 		"release": {},
 		"security": {
 			fmt.Sprintf("deb %s %s-security %s\n",
-				imageDef.securityMirror(),
+				securityMirror,
 				imageDef.Series,
 				strings.Join(imageDef.Rootfs.Components, " "),
 			),
 		},
 		"updates": {
 			fmt.Sprintf("deb %s %s-updates %s\n",
-				imageDef.Rootfs.Mirror,
+				mirror,
 				imageDef.Series,
 				strings.Join(imageDef.Rootfs.Components, " "),
 			),
 			fmt.Sprintf("deb %s %s-security %s\n",
-				imageDef.securityMirror(),
+				securityMirror,
 				imageDef.Series,
 				strings.Join(imageDef.Rootfs.Components, " "),
 			),
 		},
 		"proposed": {
 			fmt.Sprintf("deb %s %s-updates %s\n",
-				imageDef.Rootfs.Mirror,
+				mirror,
 				imageDef.Series,
 				strings.Join(imageDef.Rootfs.Components, " "),
 			),
 			fmt.Sprintf("deb %s %s-security %s\n",
-				imageDef.securityMirror(),
+				securityMirror,
 				imageDef.Series,
 				strings.Join(imageDef.Rootfs.Components, " "),
 			),
 			fmt.Sprintf("deb %s %s-proposed %s\n",
-				imageDef.Rootfs.Mirror,
+				mirror,
 				imageDef.Series,
 				strings.Join(imageDef.Rootfs.Components, " "),
 			),
@@ -4,7 +4,9 @@ import (
 	"strings"
 	"testing"
 
+	"github.com/invopop/jsonschema"
 	"github.com/xeipuuv/gojsonschema"
+	yamlv3 "gopkg.in/yaml.v3"
 
 	"github.com/canonical/ubuntu-image/internal/helper"
 )
@@ -92,6 +94,26 @@ func TestGeneratePocketList(t *testing.T) {
 	}
 }
 
+// TestGenerateLocalPocketList tests that every pocket, including the
+// security one, is read from the local mirror
+func TestGenerateLocalPocketList(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	imageDef := ImageDefinition{
+		Architecture: "amd64",
+		Series:       "jammy",
+		Rootfs: &Rootfs{
+			Pocket:     "updates",
+			Components: []string{"main"},
+			Mirror:     "http://archive.ubuntu.com/ubuntu/",
+		},
+	}
+	expected := []string{
+		"deb file:///mirror jammy-updates main\n",
+		"deb file:///mirror jammy-security main\n",
+	}
+	asserter.AssertEqual(expected, imageDef.GenerateLocalPocketList("file:///mirror"))
+}
+
 // TestCustomErrors tests the custom json schema errors that we define
 func TestCustomErrors(t *testing.T) {
 	t.Run("test_custom_errors", func(t *testing.T) {
@@ -159,6 +181,9 @@ func TestImageDefinition_SetDefaults(t *testing.T) {
 			Rootfs: &Rootfs{
 				Seed:    &Seed{},
 				Tarball: &Tarball{},
+				Apt: &Apt{
+					Preferences: []*AptPreference{{}},
+				},
 			},
 			Customization: &Customization{
 				Installer:     &Installer{},
@@ -182,3 +207,122 @@ func TestImageDefinition_SetDefaults(t *testing.T) {
 		asserter.AssertErrNil(err, true)
 	})
 }
+
+// TestSchema tests that the exported schema describes image definition files,
+// with their YAML keys, the default values and the version they target
+func TestSchema(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	schema := Schema()
+	asserter.AssertEqual(SchemaID, string(schema.ID))
+
+	// the version is also the only value image definitions can declare
+	version, _ := schema.Definitions["ImageDefinition"].Properties.Get("$schema")
+	asserter.AssertEqual([]interface{}{SchemaID}, version.(*jsonschema.Schema).Enum)
+
+	rootfs := schema.Definitions["Rootfs"]
+	asserter.AssertEqual([]string{"components", "archive", "flavor", "mirror", "pocket", "seed", "tarball",
+		"archive-tasks", "apt"}, rootfs.Properties.Keys())
+	pocket, _ := rootfs.Properties.Get("pocket")
+	asserter.AssertEqual("release", pocket.(*jsonschema.Schema).Default)
+	asserter.AssertEqual([]string{"seed"}, rootfs.OneOf[0].Required)
+	// fields with a default value are not required
+	asserter.AssertEqual([]string(nil), rootfs.Required)
+	asserter.AssertEqual([]string{"urls", "names"}, schema.Definitions["Seed"].Required)
+	vcs, _ := schema.Definitions["Seed"].Properties.Get("vcs")
+	asserter.AssertEqual(true, vcs.(*jsonschema.Schema).Default)
+	permissions, _ := schema.Definitions["MakeDirs"].Properties.Get("permissions")
+	asserter.AssertEqual(uint64(0755), permissions.(*jsonschema.Schema).Default)
+	// fields that are not read from image definition files are left out
+	if _, found := schema.Definitions["Manual"].Properties.Get("Order"); found {
+		t.Errorf("Expected the order of the manual customizations to be left out of the schema")
+	}
+}
+
+// TestValidationSchema tests that the schema image definitions are validated
+// against holds the constraints of the exported schema, with the JSON names
+// of the fields
+func TestValidationSchema(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	schema := ValidationSchema()
+	asserter.AssertEqual(SchemaID, string(schema.ID))
+
+	version, _ := schema.Definitions["ImageDefinition"].Properties.Get("SchemaID")
+	asserter.AssertEqual([]interface{}{SchemaID}, version.(*jsonschema.Schema).Enum)
+	rootfs := schema.Definitions["Rootfs"]
+	pocket, _ := rootfs.Properties.Get("Pocket")
+	asserter.AssertEqual("release", pocket.(*jsonschema.Schema).Default)
+	asserter.AssertEqual([]string(nil), rootfs.Required)
+	asserter.AssertEqual([]string{"SeedURLs", "Names"}, schema.Definitions["Seed"].Required)
+}
+
+// TestSchemaValidation tests that image definition files are validated by
+// the exported schema
+func TestSchemaValidation(t *testing.T) {
+	validDefinition := `
+$schema: ` + SchemaID + `
+include:
+  - base.yaml
+name: ubuntu-server-amd64
+display-name: Ubuntu Server amd64
+architecture: amd64
+series: jammy
+class: preinstalled
+gadget:
+  url: "https://github.com/snapcore/pc-gadget.git"
+  type: git
+rootfs:
+  seed:
+    urls:
+      - "git://git.launchpad.net/~ubuntu-core-dev/ubuntu-seeds/+git/"
+    names:
+      - server
+customization:
+  manual:
+    make-dirs:
+      - path: /etc/example
+artifacts:
+  img:
+    - name: pc-amd64.img
+`
+	testCases := []struct {
+		name          string
+		replace       string
+		with          string
+		expectedError string
+	}{
+		{"valid", "", "", ""},
+		{"bad_class", "class: preinstalled", "class: bogus", "class must be one of the following"},
+		{"missing_name", "name: ubuntu-server-amd64", "", "name is required"},
+		{"other_version", "image-definition/v1", "image-definition/v0", "$schema must be one of the following"},
+		{"json_name", "display-name:", "DisplayName:", "Additional property DisplayName is not allowed"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			definition := validDefinition
+			if tc.replace != "" {
+				definition = strings.Replace(definition, tc.replace, tc.with, 1)
+			}
+			var document interface{}
+			if err := yamlv3.Unmarshal([]byte(definition), &document); err != nil {
+				t.Fatalf("Error parsing the image definition: %s", err.Error())
+			}
+			result, err := gojsonschema.Validate(gojsonschema.NewGoLoader(Schema()), gojsonschema.NewGoLoader(document))
+			if err != nil {
+				t.Fatalf("Error validating the image definition: %s", err.Error())
+			}
+			if tc.expectedError == "" {
+				if !result.Valid() {
+					t.Errorf("Expected the image definition to be valid, got %v", result.Errors())
+				}
+				return
+			}
+			found := false
+			for _, resultError := range result.Errors() {
+				found = found || strings.Contains(resultError.String(), tc.expectedError)
+			}
+			if !found {
+				t.Errorf("Expected an error containing %q, got %v", tc.expectedError, result.Errors())
+			}
+		})
+	}
+}
@@ -0,0 +1,201 @@
+package imagedefinition
+
+import (
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/invopop/jsonschema"
+)
+
+// SchemaID identifies the version of the schema of image definition files.
+// It changes when image definitions valid for a previous version may no
+// longer be valid. An image definition declares the version it targets
+// by setting it as its $schema
+const SchemaID = "https://github.com/canonical/ubuntu-image/schemas/image-definition/v1"
+
+// Schema returns the JSON schema of image definition files. It is reflected
+// from the ImageDefinition struct, with the YAML names of the keys and the
+// default values of the fields that are not set
+func Schema() *jsonschema.Schema {
+	schema, structTypes := reflectSchema()
+	for name, definition := range schema.Definitions {
+		if structType, found := structTypes[name]; found {
+			toYAMLDefinition(definition, structType)
+		}
+	}
+
+	// the jsonschema version used does not call JSONSchemaExtend itself
+	if root, found := schema.Definitions["ImageDefinition"]; found {
+		ImageDefinition{}.JSONSchemaExtend(root)
+	}
+	return schema
+}
+
+// ValidationSchema returns the schema decoded image definitions are validated
+// against. It holds the constraints of Schema, but its keys are the JSON
+// names of the fields of the image definition structs, which are the ones
+// named by the validation errors
+func ValidationSchema() *jsonschema.Schema {
+	schema, _ := reflectSchema()
+	return schema
+}
+
+// reflectSchema reflects the schema of the ImageDefinition struct, keyed by
+// the JSON names of its fields, and sets the defaults given in the default
+// tags. It also returns the struct types of the definitions, by name
+func reflectSchema() (*jsonschema.Schema, map[string]reflect.Type) {
+	var jsonReflector jsonschema.Reflector
+	schema := jsonReflector.Reflect(&ImageDefinition{})
+	schema.ID = jsonschema.ID(SchemaID)
+
+	structTypes := make(map[string]reflect.Type)
+	collectStructTypes(reflect.TypeOf(ImageDefinition{}), structTypes)
+	for name, definition := range schema.Definitions {
+		if structType, found := structTypes[name]; found {
+			setDefaults(definition, structType)
+		}
+	}
+
+	// the version is the only value image definitions can declare
+	if root, found := schema.Definitions["ImageDefinition"]; found && root.Properties != nil {
+		if property, found := root.Properties.Get("SchemaID"); found {
+			property.(*jsonschema.Schema).Enum = []interface{}{SchemaID}
+		}
+	}
+	return schema, structTypes
+}
+
+// JSONSchemaExtend adds the keys merged away before image definitions are
+// decoded
+func (ImageDefinition) JSONSchemaExtend(schema *jsonschema.Schema) {
+	schema.Properties.Set("extends", &jsonschema.Schema{
+		Type:        "string",
+		Description: "Image definition file this image definition is merged into",
+	})
+	schema.Properties.Set("include", &jsonschema.Schema{
+		Type:        "array",
+		Items:       &jsonschema.Schema{Type: "string"},
+		Description: "Image definition files merged, in order, before this image definition",
+	})
+}
+
+// collectStructTypes finds the struct types of the fields of a type, by name
+func collectStructTypes(fieldType reflect.Type, structTypes map[string]reflect.Type) {
+	for fieldType.Kind() == reflect.Ptr || fieldType.Kind() == reflect.Slice || fieldType.Kind() == reflect.Map {
+		fieldType = fieldType.Elem()
+	}
+	if fieldType.Kind() != reflect.Struct {
+		return
+	}
+	if _, found := structTypes[fieldType.Name()]; found {
+		return
+	}
+	structTypes[fieldType.Name()] = fieldType
+	for i := 0; i < fieldType.NumField(); i++ {
+		collectStructTypes(fieldType.Field(i).Type, structTypes)
+	}
+}
+
+// setDefaults sets the defaults given in the default tags on the properties
+// of the definition of a struct. The defaults are set before image
+// definitions are validated, so the fields that have one are not required
+func setDefaults(definition *jsonschema.Schema, structType reflect.Type) {
+	if definition.Properties == nil {
+		return
+	}
+	for i := 0; i < structType.NumField(); i++ {
+		field := structType.Field(i)
+		jsonName := strings.Split(field.Tag.Get("json"), ",")[0]
+		property, found := definition.Properties.Get(jsonName)
+		if jsonName == "" || !found {
+			continue
+		}
+		if defaultValue, hasDefault := field.Tag.Lookup("default"); hasDefault {
+			property.(*jsonschema.Schema).Default = typedDefault(field.Type, defaultValue)
+			definition.Required = removeRequired(definition.Required, jsonName)
+		}
+	}
+}
+
+// toYAMLDefinition renames the properties of the definition of a struct from
+// their JSON names to their YAML names and removes the ones that are not read
+// from YAML
+func toYAMLDefinition(definition *jsonschema.Schema, structType reflect.Type) {
+	if definition.Properties == nil {
+		return
+	}
+	yamlNames := make(map[string]string)
+	for i := 0; i < structType.NumField(); i++ {
+		field := structType.Field(i)
+		jsonName := strings.Split(field.Tag.Get("json"), ",")[0]
+		yamlName := strings.Split(field.Tag.Get("yaml"), ",")[0]
+		if _, found := definition.Properties.Get(jsonName); jsonName == "" || !found {
+			continue
+		}
+		if yamlName == "-" {
+			definition.Properties.Delete(jsonName)
+			continue
+		}
+		yamlNames[jsonName] = yamlName
+	}
+
+	// deleting and setting every key in order keeps the order of the
+	// properties. The keys are copied as deleting a key modifies them
+	for _, jsonName := range append([]string{}, definition.Properties.Keys()...) {
+		property, _ := definition.Properties.Get(jsonName)
+		definition.Properties.Delete(jsonName)
+		definition.Properties.Set(yamlNames[jsonName], property)
+	}
+	renameRequired(definition, yamlNames)
+}
+
+// removeRequired removes a property from a list of required properties
+func removeRequired(required []string, name string) []string {
+	var kept []string
+	for _, requiredName := range required {
+		if requiredName != name {
+			kept = append(kept, requiredName)
+		}
+	}
+	return kept
+}
+
+// renameRequired renames the required properties of a definition, including
+// the ones of its oneOf, anyOf and allOf alternatives
+func renameRequired(definition *jsonschema.Schema, yamlNames map[string]string) {
+	for i, jsonName := range definition.Required {
+		if yamlName, found := yamlNames[jsonName]; found {
+			definition.Required[i] = yamlName
+		}
+	}
+	for _, alternatives := range [][]*jsonschema.Schema{definition.OneOf, definition.AnyOf, definition.AllOf} {
+		for _, alternative := range alternatives {
+			renameRequired(alternative, yamlNames)
+		}
+	}
+}
+
+// typedDefault converts the value of a default tag to the type of its
+// field, the way helper.SetDefaults does
+func typedDefault(fieldType reflect.Type, defaultValue string) interface{} {
+	if fieldType.Kind() == reflect.Ptr {
+		fieldType = fieldType.Elem()
+	}
+	switch fieldType.Kind() {
+	case reflect.Bool:
+		return defaultValue == "true"
+	case reflect.Slice:
+		return strings.Split(defaultValue, ",")
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		// base 0 so that permissions can be given in octal
+		if uintValue, err := strconv.ParseUint(defaultValue, 0, fieldType.Bits()); err == nil {
+			return uintValue
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if intValue, err := strconv.ParseInt(defaultValue, 0, fieldType.Bits()); err == nil {
+			return intValue
+		}
+	}
+	return defaultValue
+}
@@ -0,0 +1,154 @@
+package statemachine
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/canonical/ubuntu-image/internal/imagedefinition"
+)
+
+// paths of the apt configuration of the image definition, relative to the
+// root of the chroot
+var aptConfigFile = filepath.Join("etc", "apt", "apt.conf.d", "90ubuntu-image")
+var aptPreferencesFile = filepath.Join("etc", "apt", "preferences.d", "ubuntu-image")
+
+// aptConfigOptions returns the apt options of the apt section of the image
+// definition, as NAME=VALUE
+func aptConfigOptions(apt *imagedefinition.Apt) []string {
+	if apt == nil {
+		return nil
+	}
+	var options []string
+	if apt.Proxy != "" {
+		options = append(options,
+			"Acquire::http::Proxy="+apt.Proxy,
+			"Acquire::https::Proxy="+apt.Proxy,
+		)
+	}
+	if apt.Retries > 0 {
+		options = append(options, "Acquire::Retries="+strconv.Itoa(apt.Retries))
+	}
+	if apt.InstallRecommends != nil {
+		options = append(options, "APT::Install-Recommends="+strconv.FormatBool(*apt.InstallRecommends))
+	}
+	// sort the options so that the configuration is reproducible
+	names := make([]string, 0, len(apt.Options))
+	for name := range apt.Options {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		options = append(options, name+"="+apt.Options[name])
+	}
+	return options
+}
+
+// aptOptions returns the options apt is run with during the build: the ones
+// of the image definition followed by the ones of --apt-params, which take
+// precedence over them
+func (classicStateMachine *ClassicStateMachine) aptOptions() []string {
+	var options []string
+	if classicStateMachine.ImageDef.Rootfs != nil {
+		options = aptConfigOptions(classicStateMachine.ImageDef.Rootfs.Apt)
+	}
+	return append(options, classicStateMachine.Opts.AptParams...)
+}
+
+// validateAptParams checks that the values of --apt-params are apt options
+func validateAptParams(aptParams []string) error {
+	for _, aptParam := range aptParams {
+		nameValue := strings.SplitN(aptParam, "=", 2)
+		if len(nameValue) != 2 || nameValue[0] == "" || strings.ContainsAny(nameValue[0], " \t") {
+			return fmt.Errorf("Invalid --apt-params \"%s\": it must be NAME=VALUE, "+
+				"as given to the --option of apt", aptParam)
+		}
+	}
+	return nil
+}
+
+// writeAptConfig writes the apt configuration and preferences of the image
+// definition under rootDir, where apt running in a chroot finds them
+func writeAptConfig(rootDir string, apt *imagedefinition.Apt) error {
+	configPath := filepath.Join(rootDir, aptConfigFile)
+	if err := osMkdirAll(filepath.Dir(configPath), 0755); err != nil {
+		return fmt.Errorf("Error creating apt configuration directory: %s", err.Error())
+	}
+	var config strings.Builder
+	config.WriteString("// apt configuration of the image definition, written by ubuntu-image\n")
+	for _, option := range aptConfigOptions(apt) {
+		nameValue := strings.SplitN(option, "=", 2)
+		fmt.Fprintf(&config, "%s \"%s\";\n", nameValue[0], nameValue[1])
+	}
+	if err := osWriteFile(configPath, []byte(config.String()), 0644); err != nil {
+		return fmt.Errorf("Error writing apt configuration %s: %s", configPath, err.Error())
+	}
+
+	if len(apt.Preferences) == 0 {
+		return nil
+	}
+	preferencesPath := filepath.Join(rootDir, aptPreferencesFile)
+	if err := osMkdirAll(filepath.Dir(preferencesPath), 0755); err != nil {
+		return fmt.Errorf("Error creating apt preferences directory: %s", err.Error())
+	}
+	stanzas := make([]string, 0, len(apt.Preferences))
+	for _, preference := range apt.Preferences {
+		stanzas = append(stanzas, fmt.Sprintf("Package: %s\nPin: %s\nPin-Priority: %d\n",
+			preference.Package, preference.Pin, preference.PinPriority))
+	}
+	if err := osWriteFile(preferencesPath, []byte(strings.Join(stanzas, "\n")), 0644); err != nil {
+		return fmt.Errorf("Error writing apt preferences %s: %s", preferencesPath, err.Error())
+	}
+	return nil
+}
+
+// removeAptConfig removes the apt configuration and preferences written by
+// writeAptConfig from rootDir
+func removeAptConfig(rootDir string) error {
+	for _, aptFile := range []string{aptConfigFile, aptPreferencesFile} {
+		aptPath := filepath.Join(rootDir, aptFile)
+		if err := osRemove(aptPath); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("Error removing %s: %s", aptPath, err.Error())
+		}
+	}
+	return nil
+}
+
+// keepAptConfig returns whether the apt configuration of the image
+// definition stays in the rootfs of the image
+func keepAptConfig(apt *imagedefinition.Apt) bool {
+	return apt.KeepEnabled != nil && *apt.KeepEnabled
+}
+
+// aptConfigStates returns the state writing the apt configuration of the
+// image definition in the chroot, if it has one
+func (classicStateMachine *ClassicStateMachine) aptConfigStates() []stateFunc {
+	if classicStateMachine.ImageDef.Rootfs.Apt == nil {
+		return nil
+	}
+	return []stateFunc{{"configure_apt", (*StateMachine).configureApt}}
+}
+
+// configureApt writes the apt configuration of the image definition in the
+// chroot, so that it applies to every apt command run in it
+func (stateMachine *StateMachine) configureApt() error {
+	classicStateMachine := stateMachine.parent.(*ClassicStateMachine)
+	return writeAptConfig(stateMachine.tempDirs.chroot, classicStateMachine.ImageDef.Rootfs.Apt)
+}
+
+// cleanAptConfig removes the apt configuration of the image definition from
+// the chroot, unless it is kept enabled in the image
+func (stateMachine *StateMachine) cleanAptConfig() error {
+	classicStateMachine := stateMachine.parent.(*ClassicStateMachine)
+	apt := classicStateMachine.ImageDef.Rootfs.Apt
+	if apt.KeepEnabled == nil {
+		return imagedefinition.ErrKeepEnabledNil
+	}
+	if *apt.KeepEnabled {
+		return nil
+	}
+	return removeAptConfig(stateMachine.tempDirs.chroot)
+}
@@ -0,0 +1,170 @@
+package statemachine
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/canonical/ubuntu-image/internal/helper"
+	"github.com/canonical/ubuntu-image/internal/imagedefinition"
+)
+
+// TestAptOptions tests that the apt options of the image definition are
+// followed by the ones of --apt-params
+func TestAptOptions(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	var stateMachine ClassicStateMachine
+	stateMachine.ImageDef = imagedefinition.ImageDefinition{
+		Rootfs: &imagedefinition.Rootfs{
+			Apt: &imagedefinition.Apt{
+				Proxy:             "http://proxy.example.com:3128",
+				Retries:           3,
+				InstallRecommends: helper.BoolPtr(false),
+				Options: map[string]string{
+					"Acquire::http::Timeout":     "30",
+					"Acquire::Check-Valid-Until": "false",
+				},
+			},
+		},
+	}
+	stateMachine.Opts.AptParams = []string{"Acquire::Retries=5"}
+	asserter.AssertEqual([]string{
+		"Acquire::http::Proxy=http://proxy.example.com:3128",
+		"Acquire::https::Proxy=http://proxy.example.com:3128",
+		"Acquire::Retries=3",
+		"APT::Install-Recommends=false",
+		"Acquire::Check-Valid-Until=false",
+		"Acquire::http::Timeout=30",
+		"Acquire::Retries=5",
+	}, stateMachine.aptOptions())
+
+	// without an apt section only --apt-params are used
+	stateMachine.ImageDef.Rootfs.Apt = nil
+	asserter.AssertEqual([]string{"Acquire::Retries=5"}, stateMachine.aptOptions())
+}
+
+// TestValidateAptParams tests that --apt-params must be apt options
+func TestValidateAptParams(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	err := validateAptParams([]string{"Acquire::Retries=3", "APT::Get::Assume-Yes="})
+	asserter.AssertErrNil(err, true)
+	for _, aptParam := range []string{"Acquire::Retries", "=3", "-o Acquire::Retries=3"} {
+		err = validateAptParams([]string{aptParam})
+		asserter.AssertErrContains(err, "Invalid --apt-params")
+	}
+
+	// they are validated when setting up the state machine
+	restoreCWD := helper.SaveCWD()
+	t.Cleanup(restoreCWD)
+	var stateMachine ClassicStateMachine
+	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+	stateMachine.Opts.AptParams = []string{"Acquire::Retries"}
+	err = stateMachine.Setup()
+	asserter.AssertErrContains(err, "Invalid --apt-params")
+}
+
+// TestConfigureApt tests that the apt configuration is written in the chroot
+// and removed from it unless it is kept enabled
+func TestConfigureApt(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	var stateMachine ClassicStateMachine
+	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+	stateMachine.parent = &stateMachine
+	stateMachine.tempDirs.chroot = t.TempDir()
+	stateMachine.ImageDef = imagedefinition.ImageDefinition{
+		Rootfs: &imagedefinition.Rootfs{
+			Apt: &imagedefinition.Apt{
+				Proxy:             "http://proxy.example.com:3128",
+				InstallRecommends: helper.BoolPtr(true),
+				Preferences: []*imagedefinition.AptPreference{
+					{Package: "*", Pin: "release o=LP-PPA-foo-bar", PinPriority: 1001},
+					{Package: "snapd", Pin: "version 2.58*", PinPriority: -1},
+				},
+				KeepEnabled: helper.BoolPtr(false),
+			},
+		},
+	}
+	// --apt-params are not part of the configuration of the image
+	stateMachine.Opts.AptParams = []string{"Acquire::Retries=5"}
+
+	err := stateMachine.configureApt()
+	asserter.AssertErrNil(err, true)
+	config, err := os.ReadFile(filepath.Join(stateMachine.tempDirs.chroot, aptConfigFile))
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual("// apt configuration of the image definition, written by ubuntu-image\n"+
+		"Acquire::http::Proxy \"http://proxy.example.com:3128\";\n"+
+		"Acquire::https::Proxy \"http://proxy.example.com:3128\";\n"+
+		"APT::Install-Recommends \"true\";\n", string(config))
+	preferences, err := os.ReadFile(filepath.Join(stateMachine.tempDirs.chroot, aptPreferencesFile))
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual("Package: *\nPin: release o=LP-PPA-foo-bar\nPin-Priority: 1001\n\n"+
+		"Package: snapd\nPin: version 2.58*\nPin-Priority: -1\n", string(preferences))
+
+	// the configuration is kept enabled
+	stateMachine.ImageDef.Rootfs.Apt.KeepEnabled = helper.BoolPtr(true)
+	err = stateMachine.cleanAptConfig()
+	asserter.AssertErrNil(err, true)
+	for _, aptFile := range []string{aptConfigFile, aptPreferencesFile} {
+		_, err = os.Stat(filepath.Join(stateMachine.tempDirs.chroot, aptFile))
+		asserter.AssertErrNil(err, true)
+	}
+
+	stateMachine.ImageDef.Rootfs.Apt.KeepEnabled = helper.BoolPtr(false)
+	err = stateMachine.cleanAptConfig()
+	asserter.AssertErrNil(err, true)
+	for _, aptFile := range []string{aptConfigFile, aptPreferencesFile} {
+		if _, err = os.Stat(filepath.Join(stateMachine.tempDirs.chroot, aptFile)); !os.IsNotExist(err) {
+			t.Errorf("Expected %s to be removed from the chroot", aptFile)
+		}
+	}
+
+	// without preferences only the configuration is written, and cleaning
+	// is not confused by the missing preferences
+	stateMachine.ImageDef.Rootfs.Apt.Preferences = nil
+	err = stateMachine.configureApt()
+	asserter.AssertErrNil(err, true)
+	_, err = os.Stat(filepath.Join(stateMachine.tempDirs.chroot, aptPreferencesFile))
+	if !os.IsNotExist(err) {
+		t.Errorf("Expected no apt preferences in the chroot")
+	}
+	err = stateMachine.cleanAptConfig()
+	asserter.AssertErrNil(err, true)
+}
+
+// TestFailedConfigureApt tests the failures of writing and removing the apt
+// configuration
+func TestFailedConfigureApt(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	var stateMachine ClassicStateMachine
+	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+	stateMachine.parent = &stateMachine
+	stateMachine.tempDirs.chroot = t.TempDir()
+	stateMachine.ImageDef = imagedefinition.ImageDefinition{
+		Rootfs: &imagedefinition.Rootfs{
+			Apt: &imagedefinition.Apt{
+				Preferences: []*imagedefinition.AptPreference{{Package: "*", Pin: "release a=jammy", PinPriority: 500}},
+			},
+		},
+	}
+
+	err := stateMachine.cleanAptConfig()
+	asserter.AssertErrContains(err, imagedefinition.ErrKeepEnabledNil.Error())
+
+	osMkdirAll = mockMkdirAll
+	t.Cleanup(func() { osMkdirAll = os.MkdirAll })
+	err = stateMachine.configureApt()
+	asserter.AssertErrContains(err, "Error creating apt configuration directory")
+	osMkdirAll = os.MkdirAll
+
+	osWriteFile = mockWriteFile
+	t.Cleanup(func() { osWriteFile = os.WriteFile })
+	err = stateMachine.configureApt()
+	asserter.AssertErrContains(err, "Error writing apt configuration")
+	osWriteFile = os.WriteFile
+
+	osRemove = mockRemove
+	t.Cleanup(func() { osRemove = os.Remove })
+	stateMachine.ImageDef.Rootfs.Apt.KeepEnabled = helper.BoolPtr(false)
+	err = stateMachine.cleanAptConfig()
+	asserter.AssertErrContains(err, "Error removing")
+}
@@ -0,0 +1,389 @@
+package statemachine
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// manifestSnapPrefix prefixes the names of the snaps in package manifests
+const manifestSnapPrefix = "snap:"
+
+// changelogEntryRegex matches the first line of the entries of Debian
+// changelogs, capturing the version of the entry
+var changelogEntryRegex = regexp.MustCompile(`^\S+ \(([^)]+)\)`)
+
+// manifestEntry is a package or a snap listed in a package manifest, with its
+// version or revision
+type manifestEntry struct {
+	name    string
+	version string
+}
+
+// manifestChange is a package or a snap that changed between two builds
+type manifestChange struct {
+	name            string
+	previousVersion string
+	version         string
+}
+
+// manifestDiff is the difference between the entries of two manifests
+type manifestDiff struct {
+	added   []manifestEntry
+	removed []manifestEntry
+	changed []manifestChange
+}
+
+// generateChangelog writes the changes of the packages and snaps of a
+// classic image since a previous build, with the changelog entries of the
+// packages that changed
+func (stateMachine *StateMachine) generateChangelog() error {
+	classicStateMachine := stateMachine.parent.(*ClassicStateMachine)
+	changelogArtifact := classicStateMachine.ImageDef.Artifacts.Changelog
+
+	// the snaps are only compared when the manifests list them
+	manifestName := ""
+	manifestSnaps := false
+	if manifest := classicStateMachine.ImageDef.Artifacts.Manifest; manifest != nil {
+		manifestName = manifest.ManifestName
+		manifestSnaps = manifest.Snaps != nil && *manifest.Snaps
+	}
+	previousPath, err := stateMachine.previousManifest(changelogArtifact.Previous, manifestName)
+	if err != nil {
+		return err
+	}
+	var previousManifest []byte
+	if previousPath != "" {
+		previousManifest, err = osReadFile(previousPath)
+		if err != nil {
+			return fmt.Errorf("Error reading the previous manifest: %s", err.Error())
+		}
+	}
+	currentManifest, err := packageManifest(stateMachine.tempDirs.rootfs, manifestSnaps, stateMachine.commonFlags.Debug)
+	if err != nil {
+		return err
+	}
+
+	previousPackages, previousSnaps := parseManifest(previousManifest)
+	currentPackages, currentSnaps := parseManifest(currentManifest)
+	packagesDiff := diffManifestEntries(previousPackages, currentPackages)
+	snapsDiff := diffManifestEntries(previousSnaps, currentSnaps)
+
+	var changelog bytes.Buffer
+	if previousPath != "" {
+		fmt.Fprintf(&changelog, "Changes since %s\n", previousPath)
+	} else {
+		fmt.Fprintf(&changelog, "No previous manifest, every package and snap is new\n")
+	}
+	writeManifestDiff(&changelog, "Packages", packagesDiff)
+	writeManifestDiff(&changelog, "Snaps", snapsDiff)
+	for _, change := range packagesDiff.changed {
+		fmt.Fprintf(&changelog, "\nChangelog of %s, %s => %s:\n\n", change.name, change.previousVersion, change.version)
+		entries, err := packageChangelogEntries(stateMachine.tempDirs.rootfs, change.name, change.previousVersion)
+		if err != nil {
+			return err
+		}
+		if entries == "" {
+			fmt.Fprintf(&changelog, "  No changelog entry found in the image\n")
+			continue
+		}
+		changelog.WriteString(entries)
+	}
+
+	outputPath := filepath.Join(stateMachine.commonFlags.OutputDir, changelogArtifact.ChangelogName)
+	if err := osWriteFile(outputPath, changelog.Bytes(), 0644); err != nil {
+		return fmt.Errorf("Error writing changelog: %s", err.Error())
+	}
+	return nil
+}
+
+// previousManifest finds the manifest of the previous build. previous is
+// either a manifest or a directory of previous builds, in which the most
+// recent manifest named manifestName, or ending in .manifest, is used. The
+// manifests of the output directory of the build are ignored, as they are
+// the ones of the build itself
+func (stateMachine *StateMachine) previousManifest(previous string, manifestName string) (string, error) {
+	if previous == "" {
+		return "", nil
+	}
+	previous = strings.TrimPrefix(previous, "file://")
+	if !filepath.IsAbs(previous) {
+		previous = filepath.Join(stateMachine.ConfDefPath, previous)
+	}
+	info, err := os.Stat(previous)
+	if err != nil {
+		stateMachine.warn("previous build %s not found, every package and snap is listed as new", previous)
+		return "", nil
+	}
+	if !info.IsDir() {
+		return previous, nil
+	}
+
+	// the manifests are looked for in the directory and its subdirectories
+	outputDir, _ := filepath.Abs(stateMachine.commonFlags.OutputDir)
+	dirs := []string{previous}
+	if entries, err := osReadDir(previous); err == nil {
+		for _, entry := range entries {
+			if entry.IsDir() {
+				dirs = append(dirs, filepath.Join(previous, entry.Name()))
+			}
+		}
+	}
+	var latestPath string
+	var latestTime time.Time
+	for _, dir := range dirs {
+		if absDir, _ := filepath.Abs(dir); absDir == outputDir {
+			continue
+		}
+		entries, err := osReadDir(dir)
+		if err != nil {
+			continue
+		}
+		for _, entry := range entries {
+			if entry.IsDir() || (manifestName != "" && entry.Name() != manifestName) ||
+				(manifestName == "" && !strings.HasSuffix(entry.Name(), ".manifest")) {
+				continue
+			}
+			entryInfo, err := entry.Info()
+			if err != nil {
+				continue
+			}
+			path := filepath.Join(dir, entry.Name())
+			if latestPath == "" || entryInfo.ModTime().After(latestTime) ||
+				(entryInfo.ModTime().Equal(latestTime) && path > latestPath) {
+				latestPath, latestTime = path, entryInfo.ModTime()
+			}
+		}
+	}
+	if latestPath == "" {
+		stateMachine.warn("no manifest found in the previous builds in %s, every package and snap is listed as new",
+			previous)
+	}
+	return latestPath, nil
+}
+
+// parseManifest reads the packages and the snaps of a package manifest.
+// The names and versions may be separated by spaces or tabs
+func parseManifest(manifest []byte) (packages []manifestEntry, snaps []manifestEntry) {
+	scanner := bufio.NewScanner(bytes.NewReader(manifest))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		if strings.HasPrefix(fields[0], manifestSnapPrefix) {
+			snaps = append(snaps, manifestEntry{strings.TrimPrefix(fields[0], manifestSnapPrefix), fields[1]})
+		} else {
+			packages = append(packages, manifestEntry{fields[0], fields[1]})
+		}
+	}
+	return packages, snaps
+}
+
+// diffManifestEntries compares the entries of two manifests, sorted by name
+func diffManifestEntries(previous, current []manifestEntry) manifestDiff {
+	previousVersions := make(map[string]string)
+	for _, entry := range previous {
+		previousVersions[entry.name] = entry.version
+	}
+	currentVersions := make(map[string]string)
+	for _, entry := range current {
+		currentVersions[entry.name] = entry.version
+	}
+
+	var diff manifestDiff
+	for _, entry := range current {
+		previousVersion, found := previousVersions[entry.name]
+		if !found {
+			diff.added = append(diff.added, entry)
+		} else if previousVersion != entry.version {
+			diff.changed = append(diff.changed, manifestChange{entry.name, previousVersion, entry.version})
+		}
+	}
+	for _, entry := range previous {
+		if _, found := currentVersions[entry.name]; !found {
+			diff.removed = append(diff.removed, entry)
+		}
+	}
+	sort.Slice(diff.added, func(i, j int) bool { return diff.added[i].name < diff.added[j].name })
+	sort.Slice(diff.removed, func(i, j int) bool { return diff.removed[i].name < diff.removed[j].name })
+	sort.Slice(diff.changed, func(i, j int) bool { return diff.changed[i].name < diff.changed[j].name })
+	return diff
+}
+
+// writeManifestDiff writes the added, removed and changed entries of a diff
+func writeManifestDiff(w io.Writer, kind string, diff manifestDiff) {
+	if len(diff.added) > 0 {
+		fmt.Fprintf(w, "\n%s added:\n", kind)
+		for _, entry := range diff.added {
+			fmt.Fprintf(w, "  %s %s\n", entry.name, entry.version)
+		}
+	}
+	if len(diff.removed) > 0 {
+		fmt.Fprintf(w, "\n%s removed:\n", kind)
+		for _, entry := range diff.removed {
+			fmt.Fprintf(w, "  %s %s\n", entry.name, entry.version)
+		}
+	}
+	if len(diff.changed) > 0 {
+		fmt.Fprintf(w, "\n%s changed:\n", kind)
+		for _, change := range diff.changed {
+			fmt.Fprintf(w, "  %s %s => %s\n", change.name, change.previousVersion, change.version)
+		}
+	}
+}
+
+// packageChangelogEntries returns the entries of the Debian changelog of a
+// package installed in a rootfs that are newer than previousVersion. It
+// returns nothing if the changelog is not in the rootfs, as in minimized images
+func packageChangelogEntries(rootfsDir, packageName, previousVersion string) (string, error) {
+	docDir := filepath.Join(rootfsDir, "usr", "share", "doc", packageName)
+	// the documentation of packages may be a link to the one of
+	// another package of the same source, which is relative to the rootfs
+	if target, err := os.Readlink(docDir); err == nil {
+		if filepath.IsAbs(target) {
+			docDir = filepath.Join(rootfsDir, target)
+		} else {
+			docDir = filepath.Join(filepath.Dir(docDir), target)
+		}
+	}
+
+	var changelog io.Reader
+	for _, name := range []string{"changelog.Debian.gz", "changelog.Debian", "changelog.gz", "changelog"} {
+		changelogFile, err := osOpen(filepath.Join(docDir, name))
+		if err != nil {
+			continue
+		}
+		defer changelogFile.Close()
+		changelog = changelogFile
+		if strings.HasSuffix(name, ".gz") {
+			gzipReader, err := gzip.NewReader(changelogFile)
+			if err != nil {
+				return "", fmt.Errorf("Error reading the changelog of %s: %s", packageName, err.Error())
+			}
+			defer gzipReader.Close()
+			changelog = gzipReader
+		}
+		break
+	}
+	if changelog == nil {
+		return "", nil
+	}
+
+	var entries strings.Builder
+	scanner := bufio.NewScanner(changelog)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if matches := changelogEntryRegex.FindStringSubmatch(line); matches != nil &&
+			compareDebianVersions(matches[1], previousVersion) <= 0 {
+			break
+		}
+		entries.WriteString(line + "\n")
+	}
+	if err := scanner.Err(); err != nil {
+		return "", fmt.Errorf("Error reading the changelog of %s: %s", packageName, err.Error())
+	}
+	return entries.String(), nil
+}
+
+// compareDebianVersions compares two Debian package versions the way dpkg
+// does. It returns a negative number, zero or a positive number when a is
+// lower than, equal to or greater than b
+func compareDebianVersions(a, b string) int {
+	aEpoch, aUpstream, aRevision := splitDebianVersion(a)
+	bEpoch, bUpstream, bRevision := splitDebianVersion(b)
+	if aEpoch != bEpoch {
+		return aEpoch - bEpoch
+	}
+	if result := compareDebianVersionParts(aUpstream, bUpstream); result != 0 {
+		return result
+	}
+	return compareDebianVersionParts(aRevision, bRevision)
+}
+
+// splitDebianVersion splits a Debian version into its epoch, its upstream
+// version and its revision
+func splitDebianVersion(version string) (int, string, string) {
+	epoch := 0
+	if colon := strings.Index(version, ":"); colon >= 0 {
+		epoch, _ = strconv.Atoi(version[:colon])
+		version = version[colon+1:]
+	}
+	revision := ""
+	if hyphen := strings.LastIndex(version, "-"); hyphen >= 0 {
+		revision = version[hyphen+1:]
+		version = version[:hyphen]
+	}
+	return epoch, version, revision
+}
+
+// debianVersionOrder returns the weight of a character of a non-digit part
+// of a Debian version: the end of the part sorts before everything except
+// the tilde, and letters sort before the other characters
+func debianVersionOrder(version string, i int) int {
+	if i >= len(version) {
+		return 0
+	}
+	c := version[i]
+	switch {
+	case c >= '0' && c <= '9':
+		return 0
+	case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z':
+		return int(c)
+	case c == '~':
+		return -1
+	}
+	return int(c) + 256
+}
+
+// compareDebianVersionParts compares upstream versions or revisions, made of
+// alternating non-digit and digit parts
+func compareDebianVersionParts(a, b string) int {
+	isDigit := func(version string, i int) bool {
+		return i < len(version) && version[i] >= '0' && version[i] <= '9'
+	}
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		for (i < len(a) && !isDigit(a, i)) || (j < len(b) && !isDigit(b, j)) {
+			aOrder, bOrder := debianVersionOrder(a, i), debianVersionOrder(b, j)
+			if aOrder != bOrder {
+				return aOrder - bOrder
+			}
+			i++
+			j++
+		}
+		for i < len(a) && a[i] == '0' {
+			i++
+		}
+		for j < len(b) && b[j] == '0' {
+			j++
+		}
+		firstDiff := 0
+		for isDigit(a, i) && isDigit(b, j) {
+			if firstDiff == 0 {
+				firstDiff = int(a[i]) - int(b[j])
+			}
+			i++
+			j++
+		}
+		if isDigit(a, i) {
+			return 1
+		}
+		if isDigit(b, j) {
+			return -1
+		}
+		if firstDiff != 0 {
+			return firstDiff
+		}
+	}
+	return 0
+}
@@ -0,0 +1,180 @@
+package statemachine
+
+import (
+	"compress/gzip"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/canonical/ubuntu-image/internal/helper"
+	"github.com/canonical/ubuntu-image/internal/imagedefinition"
+)
+
+// TestCompareDebianVersions tests that Debian versions are compared the way dpkg compares them
+func TestCompareDebianVersions(t *testing.T) {
+	testCases := []struct {
+		a        string
+		b        string
+		expected int
+	}{
+		{"1.2", "1.2", 0},
+		{"1.2", "1.10", -1},
+		{"1.2-1ubuntu1", "1.2-1", 1},
+		{"1.2-1ubuntu1.1", "1.2-1ubuntu1", 1},
+		{"1.2~rc1", "1.2", -1},
+		{"1.2+dfsg", "1.2", 1},
+		{"1:0.9", "2.0", 1},
+		{"1.02", "1.2", 0},
+		{"1.2a", "1.2+", -1},
+		{"2.0-1", "2.0", 1},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.a+"_"+tc.b, func(t *testing.T) {
+			result := compareDebianVersions(tc.a, tc.b)
+			if (result < 0 && tc.expected >= 0) || (result > 0 && tc.expected <= 0) ||
+				(result == 0 && tc.expected != 0) {
+				t.Errorf("Expected %s compared to %s to be %d, got %d", tc.a, tc.b, tc.expected, result)
+			}
+		})
+	}
+}
+
+// TestPackageManifestSnaps tests that the seeded snaps are only listed in
+// the package manifest when they are asked for
+func TestPackageManifestSnaps(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	testCaseName = "TestGeneratePackageManifest"
+	execCommand = fakeExecCommand
+	t.Cleanup(func() { execCommand = exec.Command })
+	var openedLabel string
+	mockFakeSeedOpen(t, &openedLabel)
+	rootfsDir := t.TempDir()
+	writeSeedAssertions(t, filepath.Join(rootfsDir, "var", "lib", "snapd", "seed"))
+
+	manifest, err := packageManifest(rootfsDir, false, false)
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual(false, strings.Contains(string(manifest), manifestSnapPrefix))
+
+	manifest, err = packageManifest(rootfsDir, true, false)
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual(true, strings.HasSuffix(string(manifest), "\nsnap:core22 864\nsnap:local x1\n"))
+}
+
+// TestGenerateChangelog tests that the changelog lists the changes since the
+// most recent previous build and the changelog entries of the changed packages
+func TestGenerateChangelog(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	testCaseName = "TestGeneratePackageManifest"
+	execCommand = fakeExecCommand
+	t.Cleanup(func() { execCommand = exec.Command })
+
+	// previous builds, along with the output directory of this build
+	buildsDir := t.TempDir()
+	writeManifest := func(build string, content string, age time.Duration) {
+		err := os.MkdirAll(filepath.Join(buildsDir, build), 0755)
+		asserter.AssertErrNil(err, true)
+		manifestPath := filepath.Join(buildsDir, build, "pc-amd64.manifest")
+		err = os.WriteFile(manifestPath, []byte(content), 0644)
+		asserter.AssertErrNil(err, true)
+		modTime := time.Now().Add(-age)
+		err = os.Chtimes(manifestPath, modTime, modTime)
+		asserter.AssertErrNil(err, true)
+	}
+	writeManifest("20231001", "foo 1.0\nbar 1.4-1ubuntu4.1\n", 48*time.Hour)
+	writeManifest("20231002", "foo 1.1\nbar\t1.4-1ubuntu4.1\nold 2.0\nsnap:lxd 100\n", 24*time.Hour)
+	writeManifest("current", "foo 1.2\n", 0)
+
+	// the changelog of foo, compressed as in the images
+	rootfsDir := t.TempDir()
+	docDir := filepath.Join(rootfsDir, "usr", "share", "doc", "foo")
+	err := os.MkdirAll(docDir, 0755)
+	asserter.AssertErrNil(err, true)
+	changelogFile, err := os.Create(filepath.Join(docDir, "changelog.Debian.gz"))
+	asserter.AssertErrNil(err, true)
+	gzipWriter := gzip.NewWriter(changelogFile)
+	_, err = gzipWriter.Write([]byte(
+		"foo (1.2) jammy; urgency=medium\n\n  * Fix the bar.\n\n -- Jane Doe <jane@example.com>  Mon, 02 Oct 2023 10:00:00 +0000\n\n" +
+			"foo (1.1.1) jammy; urgency=medium\n\n  * Fix the baz.\n\n -- Jane Doe <jane@example.com>  Sun, 01 Oct 2023 10:00:00 +0000\n\n" +
+			"foo (1.1) jammy; urgency=medium\n\n  * Already in the previous build.\n\n -- Jane Doe <jane@example.com>  Sat, 30 Sep 2023 10:00:00 +0000\n"))
+	asserter.AssertErrNil(err, true)
+	asserter.AssertErrNil(gzipWriter.Close(), true)
+	asserter.AssertErrNil(changelogFile.Close(), true)
+	// libbaz links to the documentation of foo
+	err = os.Symlink("/usr/share/doc/foo", filepath.Join(rootfsDir, "usr", "share", "doc", "libbaz"))
+	asserter.AssertErrNil(err, true)
+
+	var stateMachine ClassicStateMachine
+	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+	stateMachine.parent = &stateMachine
+	stateMachine.commonFlags.OutputDir = filepath.Join(buildsDir, "current")
+	stateMachine.tempDirs.rootfs = rootfsDir
+	stateMachine.ConfDefPath = filepath.Dir(buildsDir)
+	stateMachine.ImageDef = imagedefinition.ImageDefinition{
+		Artifacts: &imagedefinition.Artifact{
+			Manifest: &imagedefinition.Manifest{ManifestName: "pc-amd64.manifest", Snaps: helper.BoolPtr(true)},
+			Changelog: &imagedefinition.Changelog{
+				ChangelogName: "pc-amd64.changelog",
+				Previous:      filepath.Base(buildsDir),
+			},
+		},
+	}
+
+	err = stateMachine.generateChangelog()
+	asserter.AssertErrNil(err, true)
+	changelog, err := os.ReadFile(filepath.Join(stateMachine.commonFlags.OutputDir, "pc-amd64.changelog"))
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual("Changes since "+filepath.Join(buildsDir, "20231002", "pc-amd64.manifest")+"\n"+
+		"\nPackages added:\n  libbaz 0.1.3ubuntu2\n"+
+		"\nPackages removed:\n  old 2.0\n"+
+		"\nPackages changed:\n  foo 1.1 => 1.2\n"+
+		"\nSnaps removed:\n  lxd 100\n"+
+		"\nChangelog of foo, 1.1 => 1.2:\n\n"+
+		"foo (1.2) jammy; urgency=medium\n\n  * Fix the bar.\n\n -- Jane Doe <jane@example.com>  Mon, 02 Oct 2023 10:00:00 +0000\n\n"+
+		"foo (1.1.1) jammy; urgency=medium\n\n  * Fix the baz.\n\n -- Jane Doe <jane@example.com>  Sun, 01 Oct 2023 10:00:00 +0000\n\n",
+		string(changelog))
+
+	// without a previous build, everything is new
+	stateMachine.ImageDef.Artifacts.Changelog.Previous = "missing"
+	err = stateMachine.generateChangelog()
+	asserter.AssertErrNil(err, true)
+	changelog, err = os.ReadFile(filepath.Join(stateMachine.commonFlags.OutputDir, "pc-amd64.changelog"))
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual("No previous manifest, every package and snap is new\n"+
+		"\nPackages added:\n  bar 1.4-1ubuntu4.1\n  foo 1.2\n  libbaz 0.1.3ubuntu2\n", string(changelog))
+
+	// the documentation links of the packages are followed in the rootfs
+	entries, err := packageChangelogEntries(rootfsDir, "libbaz", "1.1.1")
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual("foo (1.2) jammy; urgency=medium\n\n  * Fix the bar.\n\n"+
+		" -- Jane Doe <jane@example.com>  Mon, 02 Oct 2023 10:00:00 +0000\n\n", entries)
+}
+
+// TestFailedGenerateChangelog tests the failures of generating the changelog
+func TestFailedGenerateChangelog(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	var stateMachine ClassicStateMachine
+	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+	stateMachine.parent = &stateMachine
+	stateMachine.commonFlags.OutputDir = t.TempDir()
+	stateMachine.tempDirs.rootfs = t.TempDir()
+	stateMachine.ImageDef = imagedefinition.ImageDefinition{
+		Artifacts: &imagedefinition.Artifact{
+			Changelog: &imagedefinition.Changelog{ChangelogName: "pc-amd64.changelog"},
+		},
+	}
+
+	execCommand = fakeExecCommand
+	t.Cleanup(func() { execCommand = exec.Command })
+	testCaseName = "TestFailedGeneratePackageManifest"
+	err := stateMachine.generateChangelog()
+	asserter.AssertErrContains(err, "Error generating package manifest with command")
+
+	testCaseName = "TestGeneratePackageManifest"
+	osWriteFile = mockWriteFile
+	t.Cleanup(func() { osWriteFile = os.WriteFile })
+	err = stateMachine.generateChangelog()
+	asserter.AssertErrContains(err, "Error writing changelog")
+}
@@ -1,6 +1,11 @@
 package statemachine
 
 import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+
 	"github.com/canonical/ubuntu-image/internal/commands"
 	"github.com/canonical/ubuntu-image/internal/imagedefinition"
 )
@@ -18,12 +23,24 @@ var rootfsSeedStates = []stateFunc{
 	{"create_chroot", (*StateMachine).createChroot},
 }
 
+var rootfsTasksStates = []stateFunc{
+	{"build_rootfs_from_tasks", (*StateMachine).buildRootfsFromTasks},
+	{"create_chroot", (*StateMachine).createChroot},
+}
+
 var imageCreationStates = []stateFunc{
 	{"calculate_rootfs_size", (*StateMachine).calculateRootfsSize},
 	{"populate_bootfs_contents", (*StateMachine).populateBootfsContents},
 	{"populate_prepare_partitions", (*StateMachine).populatePreparePartitions},
 }
 
+var installerStates = []stateFunc{
+	{"make_squashfs_layers", (*StateMachine).makeSquashfsLayers},
+	{"stage_installer_preseeds", (*StateMachine).stageInstallerPreseeds},
+	{"prepare_iso_bootloader", (*StateMachine).prepareISOBootloader},
+	{"make_iso", (*StateMachine).makeISO},
+}
+
 // ClassicStateMachine embeds StateMachine and adds the command line flags specific to classic images
 type ClassicStateMachine struct {
 	StateMachine
@@ -32,6 +49,15 @@ type ClassicStateMachine struct {
 	Args     commands.ClassicArgs
 	Packages []string
 	Snaps    []string
+
+	// sha256 sum of the image definition file and of the files it extends
+	// and includes, used to make sure they did not change when resuming a
+	// partial build
+	ImageDefinitionSHA256   string
+	ImageDefinitionIncludes map[string]string
+
+	// SHA of the commit of git gadgets, to trace the gadget of the build
+	GadgetCommit string
 }
 
 // Setup assigns variables and calls other functions that must be executed before Run()
@@ -51,6 +77,24 @@ func (classicStateMachine *ClassicStateMachine) Setup() error {
 		return err
 	}
 
+	if !classicStateMachine.Opts.Offline && (classicStateMachine.Opts.MirrorDir != "" ||
+		classicStateMachine.Opts.SnapsDir != "" || classicStateMachine.Opts.KeysDir != "") {
+		return fmt.Errorf("--mirror-dir, --snaps-dir and --keys-dir can only be used with --offline")
+	}
+
+	// the mirror directory is mounted in the chroot at the same path
+	if classicStateMachine.Opts.MirrorDir != "" {
+		mirrorDir, err := filepath.Abs(classicStateMachine.Opts.MirrorDir)
+		if err != nil {
+			return fmt.Errorf("Error getting absolute path of mirror directory: %s", err.Error())
+		}
+		classicStateMachine.Opts.MirrorDir = mirrorDir
+	}
+
+	if err := validateAptParams(classicStateMachine.Opts.AptParams); err != nil {
+		return err
+	}
+
 	// if --resume was passed, figure out where to start
 	if err := classicStateMachine.readMetadata(metadataStateFile); err != nil {
 		return err
@@ -58,3 +102,66 @@ func (classicStateMachine *ClassicStateMachine) Setup() error {
 
 	return nil
 }
+
+// imageDefinitionVariables returns the values of the variables given with --set
+func (classicStateMachine *ClassicStateMachine) imageDefinitionVariables() (map[string]string, error) {
+	variables := make(map[string]string)
+	for _, set := range classicStateMachine.Opts.Set {
+		keyValue := strings.SplitN(set, "=", 2)
+		if len(keyValue) != 2 || !imageDefinitionVariableNameRegex.MatchString(keyValue[0]) {
+			return nil, fmt.Errorf("Invalid --set \"%s\": it must be KEY=VALUE, with KEY a variable name", set)
+		}
+		variables[keyValue[0]] = keyValue[1]
+	}
+	return variables, nil
+}
+
+// loadClassicState restores the context specific to classic images from the
+// metadata of a partial state machine. If the image definition had already
+// been parsed, it must not have changed since then and the states calculated
+// from it are calculated again
+func (classicStateMachine *ClassicStateMachine) loadClassicState(metadata []byte, statesTaken []string) error {
+	var partialStateMachine ClassicStateMachine
+	if err := json.Unmarshal(metadata, &partialStateMachine); err != nil {
+		return fmt.Errorf("failed to parse metadata file: %s", err.Error())
+	}
+
+	// the image definition is not required on the command line when resuming
+	if classicStateMachine.Args.ImageDefinition == "" && partialStateMachine.Args.ImageDefinition != "" {
+		classicStateMachine.Args.ImageDefinition = filepath.Join(partialStateMachine.ConfDefPath,
+			filepath.Base(partialStateMachine.Args.ImageDefinition))
+	}
+
+	if partialStateMachine.ImageDefinitionSHA256 == "" {
+		// the image definition was not parsed yet
+		return nil
+	}
+	imageDefinitionSHA256, err := fileSHA256(classicStateMachine.Args.ImageDefinition)
+	if err != nil {
+		return fmt.Errorf("Error checking the image definition of the partial build: %s", err.Error())
+	}
+	if imageDefinitionSHA256 != partialStateMachine.ImageDefinitionSHA256 {
+		return fmt.Errorf("Image definition \"%s\" has changed since the partial build. "+
+			"The build needs to be restarted without --resume", classicStateMachine.Args.ImageDefinition)
+	}
+	for includePath, includeSHA256 := range partialStateMachine.ImageDefinitionIncludes {
+		if sum, err := fileSHA256(includePath); err != nil || sum != includeSHA256 {
+			return fmt.Errorf("Image definition \"%s\" has changed since the partial build. "+
+				"The build needs to be restarted without --resume", includePath)
+		}
+	}
+
+	classicStateMachine.ImageDef = partialStateMachine.ImageDef
+	classicStateMachine.ImageDefinitionSHA256 = partialStateMachine.ImageDefinitionSHA256
+	classicStateMachine.ImageDefinitionIncludes = partialStateMachine.ImageDefinitionIncludes
+	classicStateMachine.Packages = partialStateMachine.Packages
+	classicStateMachine.Snaps = partialStateMachine.Snaps
+	classicStateMachine.GadgetCommit = partialStateMachine.GadgetCommit
+
+	for _, stateName := range statesTaken {
+		if stateName == "calculate_states" {
+			return classicStateMachine.calculateStates()
+		}
+	}
+	return nil
+}
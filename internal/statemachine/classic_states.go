@@ -2,24 +2,26 @@ package statemachine
 
 import (
 	"bufio"
-	"context"
 	"fmt"
 	"io"
+	"math"
 	"os"
 	"os/exec"
 	"path"
 	"path/filepath"
 	"reflect"
 	"regexp"
+	"strconv"
 	"strings"
 
-	"github.com/invopop/jsonschema"
+	"github.com/snapcore/snapd/gadget"
+	"github.com/snapcore/snapd/gadget/quantity"
 	"github.com/snapcore/snapd/image"
 	"github.com/snapcore/snapd/image/preseed"
 	"github.com/snapcore/snapd/osutil"
 	"github.com/snapcore/snapd/seed/seedwriter"
 	"github.com/snapcore/snapd/snap"
-	"github.com/snapcore/snapd/store"
+	"github.com/snapcore/snapd/strutil/shlex"
 	"github.com/xeipuuv/gojsonschema"
 	"gopkg.in/yaml.v2"
 
@@ -30,27 +32,63 @@ import (
 var (
 	seedVersionRegex   = regexp.MustCompile(`^[a-z0-9].*`)
 	localePresentRegex = regexp.MustCompile(`(?m)^LANG=|LC_[A-Z_]+=`)
+	archiveTaskRegex   = regexp.MustCompile(`^[a-z0-9][a-z0-9+.-]*\^?$`)
 )
 
 // parseImageDefinition parses the provided yaml file and ensures it is valid
 func (stateMachine *StateMachine) parseImageDefinition() error {
 	classicStateMachine := stateMachine.parent.(*ClassicStateMachine)
 
-	// Open and decode the yaml file
-	var imageDefinition imagedefinition.ImageDefinition
-	imageFile, err := os.Open(classicStateMachine.Args.ImageDefinition)
+	imageDefinition, merger, result, err := classicStateMachine.readImageDefinition()
 	if err != nil {
-		return fmt.Errorf("Error opening image definition file: %s", err.Error())
+		return err
 	}
-	defer imageFile.Close()
-	if err := yaml.NewDecoder(imageFile).Decode(&imageDefinition); err != nil {
+
+	if !result.Valid() {
+		return fmt.Errorf("Schema validation failed: %s", result.Errors())
+	}
+
+	// Validation succeeded, so set the value in the parent struct
+	classicStateMachine.ImageDef = imageDefinition
+
+	// record the sum of the image definition so a partial build can only
+	// be resumed with the same image definition
+	imageDefinitionSHA256, err := fileSHA256(classicStateMachine.Args.ImageDefinition)
+	if err != nil {
 		return err
 	}
+	classicStateMachine.ImageDefinitionSHA256 = imageDefinitionSHA256
+	classicStateMachine.ImageDefinitionIncludes = merger.sums
+
+	return nil
+}
+
+// readImageDefinition reads the image definition, merged with the files it
+// extends and includes, and validates it. The problems found are returned
+// in the result of the validation
+func (classicStateMachine *ClassicStateMachine) readImageDefinition() (imagedefinition.ImageDefinition,
+	*imageDefinitionMerger, *gojsonschema.Result, error) {
+	var imageDefinition imagedefinition.ImageDefinition
+
+	// Read the yaml file, merged with the files it extends and includes,
+	// and decode it
+	variables, err := classicStateMachine.imageDefinitionVariables()
+	if err != nil {
+		return imageDefinition, nil, nil, err
+	}
+	merger := imageDefinitionMerger{variables: variables, sums: make(map[string]string)}
+	imageDefinitionYAML, err := merger.loadImageDefinition(classicStateMachine.Args.ImageDefinition)
+	if err != nil {
+		return imageDefinition, nil, nil, err
+	}
+	if err := yaml.Unmarshal(imageDefinitionYAML, &imageDefinition); err != nil {
+		return imageDefinition, nil, nil, err
+	}
 
 	// populate the default values for imageDefinition if they were not provided in
 	// the image definition YAML file
 	if err := helperSetDefaults(&imageDefinition); err != nil {
-		return err
+		return imageDefinition, nil, nil, err
 	}
 
 	// The official standard for YAML schemas states that they are an extension of
@@ -60,10 +98,9 @@ func (stateMachine *StateMachine) parseImageDefinition() error {
 	// 2. Load the created schema and parsed yaml into types defined by gojsonschema
 	// 3. Use the gojsonschema library to validate the parsed YAML against the schema
 
-	var jsonReflector jsonschema.Reflector
-
-	// 1. parse the ImageDefinition struct into a schema using the jsonschema tags
-	schema := jsonReflector.Reflect(&imagedefinition.ImageDefinition{})
+	// 1. parse the ImageDefinition struct into a schema using the jsonschema tags.
+	// It holds the constraints of the schema printed by the schema command
+	schema := imagedefinition.ValidationSchema()
 
 	// 2. load the schema and parsed YAML data into types understood by gojsonschema
 	schemaLoader := gojsonschema.NewGoLoader(schema)
@@ -72,7 +109,7 @@ func (stateMachine *StateMachine) parseImageDefinition() error {
 	// 3. validate the parsed data against the schema
 	result, err := gojsonschemaValidate(schemaLoader, imageDefinitionLoader)
 	if err != nil {
-		return fmt.Errorf("Schema validation returned an error: %s", err.Error())
+		return imageDefinition, nil, nil, fmt.Errorf("Schema validation returned an error: %s", err.Error())
 	}
 
 	// do custom validation for gadgetURL being required if gadget is not pre-built
@@ -98,7 +135,7 @@ func (stateMachine *StateMachine) parseImageDefinition() error {
 	if imageDefinition.Gadget == nil {
 		diskUsed, err := helperCheckTags(imageDefinition.Artifacts, "is_disk")
 		if err != nil {
-			return fmt.Errorf("Error checking struct tags for Artifacts: \"%s\"", err.Error())
+			return imageDefinition, nil, nil, fmt.Errorf("Error checking struct tags for Artifacts: \"%s\"", err.Error())
 		}
 		if diskUsed != "" {
 			jsonContext := gojsonschema.NewJsonContext("image_without_gadget", nil)
@@ -117,7 +154,43 @@ func (stateMachine *StateMachine) parseImageDefinition() error {
 		}
 	}
 
+	// installer images are only useful if an ISO is created
+	if imageDefinition.Class == "installer" &&
+		(imageDefinition.Artifacts == nil || imageDefinition.Artifacts.Iso == nil) {
+		jsonContext := gojsonschema.NewJsonContext("installer_without_iso", nil)
+		errDetail := gojsonschema.ErrorDetails{
+			"key1": "class:installer",
+			"key2": "artifacts:iso:",
+		}
+		result.AddError(
+			imagedefinition.NewDependentKeyError(
+				gojsonschema.NewJsonContext("dependentKey", jsonContext),
+				52,
+				errDetail,
+			),
+			errDetail,
+		)
+	}
+
 	if imageDefinition.Customization != nil {
+		// installer layers are built from the germinated seeds
+		if imageDefinition.Customization.Installer != nil &&
+			len(imageDefinition.Customization.Installer.Layers) > 0 &&
+			imageDefinition.Rootfs.Seed == nil {
+			jsonContext := gojsonschema.NewJsonContext("layers_without_seed", nil)
+			errDetail := gojsonschema.ErrorDetails{
+				"key1": "customization:installer:layers",
+				"key2": "rootfs:seed:",
+			}
+			result.AddError(
+				imagedefinition.NewDependentKeyError(
+					gojsonschema.NewJsonContext("dependentKey", jsonContext),
+					52,
+					errDetail,
+				),
+				errDetail,
+			)
+		}
 		// do custom validation for private PPAs requiring fingerprint
 		for _, ppa := range imageDefinition.Customization.ExtraPPAs {
 			if ppa.Auth != "" && ppa.Fingerprint == "" {
@@ -138,70 +211,7 @@ func (stateMachine *StateMachine) parseImageDefinition() error {
 		}
 		// do custom validation for manual customization paths
 		if imageDefinition.Customization.Manual != nil {
-			jsonContext := gojsonschema.NewJsonContext("manual_path_validation", nil)
-			if imageDefinition.Customization.Manual.MakeDirs != nil {
-				for _, mkdir := range imageDefinition.Customization.Manual.MakeDirs {
-					// XXX: filepath.IsAbs() does returns true for paths like /../../something
-					// and those are NOT absolute paths.
-					if !filepath.IsAbs(mkdir.Path) || strings.Contains(mkdir.Path, "/../") {
-						errDetail := gojsonschema.ErrorDetails{
-							"key":   "customization:manual:mkdir:destination",
-							"value": mkdir.Path,
-						}
-						result.AddError(
-							imagedefinition.NewPathNotAbsoluteError(
-								gojsonschema.NewJsonContext("nonAbsoluteManualPath",
-									jsonContext),
-								52,
-								errDetail,
-							),
-							errDetail,
-						)
-					}
-				}
-			}
-			if imageDefinition.Customization.Manual.CopyFile != nil {
-				for _, copy := range imageDefinition.Customization.Manual.CopyFile {
-					// XXX: filepath.IsAbs() does returns true for paths like /../../something
-					// and those are NOT absolute paths.
-					if !filepath.IsAbs(copy.Dest) || strings.Contains(copy.Dest, "/../") {
-						errDetail := gojsonschema.ErrorDetails{
-							"key":   "customization:manual:copy-file:destination",
-							"value": copy.Dest,
-						}
-						result.AddError(
-							imagedefinition.NewPathNotAbsoluteError(
-								gojsonschema.NewJsonContext("nonAbsoluteManualPath",
-									jsonContext),
-								52,
-								errDetail,
-							),
-							errDetail,
-						)
-					}
-				}
-			}
-			if imageDefinition.Customization.Manual.TouchFile != nil {
-				for _, touch := range imageDefinition.Customization.Manual.TouchFile {
-					// XXX: filepath.IsAbs() does returns true for paths like /../../something
-					// and those are NOT absolute paths.
-					if !filepath.IsAbs(touch.TouchPath) || strings.Contains(touch.TouchPath, "/../") {
-						errDetail := gojsonschema.ErrorDetails{
-							"key":   "customization:manual:touch-file:path",
-							"value": touch.TouchPath,
-						}
-						result.AddError(
-							imagedefinition.NewPathNotAbsoluteError(
-								gojsonschema.NewJsonContext("nonAbsoluteManualPath",
-									jsonContext),
-								52,
-								errDetail,
-							),
-							errDetail,
-						)
-					}
-				}
-			}
+			validateManualPaths(imageDefinition.Customization.Manual, result)
 		}
 	}
 
@@ -210,17 +220,10 @@ func (stateMachine *StateMachine) parseImageDefinition() error {
 	// if it gets merged this can be removed
 	err = helperCheckEmptyFields(&imageDefinition, result, schema)
 	if err != nil {
-		return err
-	}
-
-	if !result.Valid() {
-		return fmt.Errorf("Schema validation failed: %s", result.Errors())
+		return imageDefinition, nil, nil, err
 	}
 
-	// Validation succeeded, so set the value in the parent struct
-	classicStateMachine.ImageDef = imageDefinition
-
-	return nil
+	return imageDefinition, &merger, result, nil
 }
 
 // State responsible for dynamically calculating all the remaining states
@@ -233,6 +236,16 @@ func (stateMachine *StateMachine) calculateStates() error {
 
 	var rootfsCreationStates []stateFunc
 
+	if classicStateMachine.Opts.Offline {
+		// the snaps of offline builds are staged from local files, through a
+		// local store
+		if classicStateMachine.ImageDef.Store != nil {
+			return fmt.Errorf("The store section of the image definition can not be used with --offline")
+		}
+		rootfsCreationStates = append(rootfsCreationStates,
+			stateFunc{"check_offline_sources", (*StateMachine).checkOfflineSources})
+	}
+
 	if classicStateMachine.ImageDef.Gadget != nil {
 		// determine the states needed for preparing the gadget
 		switch classicStateMachine.ImageDef.Gadget.GadgetType {
@@ -270,6 +283,7 @@ func (stateMachine *StateMachine) calculateStates() error {
 	if classicStateMachine.ImageDef.Rootfs.Tarball != nil {
 		rootfsCreationStates = append(rootfsCreationStates,
 			stateFunc{"extract_rootfs_tar", (*StateMachine).extractRootfsTar})
+		rootfsCreationStates = append(rootfsCreationStates, classicStateMachine.aptConfigStates()...)
 		// if there are extra snaps or packages to install, these will have
 		// to be done as separate steps. To add one of these extra steps, add the
 		// struct tag "extra_step_prebuilt_rootfs" to a field in the image definition
@@ -282,19 +296,9 @@ func (stateMachine *StateMachine) calculateStates() error {
 		}
 	} else if classicStateMachine.ImageDef.Rootfs.Seed != nil {
 		rootfsCreationStates = append(rootfsCreationStates, rootfsSeedStates...)
-		if classicStateMachine.ImageDef.Customization != nil && len(classicStateMachine.ImageDef.Customization.ExtraPPAs) > 0 {
-			rootfsCreationStates = append(rootfsCreationStates,
-				[]stateFunc{
-					{"add_extra_ppas", (*StateMachine).addExtraPPAs},
-					{"install_packages", (*StateMachine).installPackages},
-					{"clean_extra_ppas", (*StateMachine).cleanExtraPPAs},
-				}...)
-
-		} else {
-			rootfsCreationStates = append(rootfsCreationStates,
-				stateFunc{"install_packages", (*StateMachine).installPackages},
-			)
-		}
+		rootfsCreationStates = append(rootfsCreationStates, classicStateMachine.aptConfigStates()...)
+		rootfsCreationStates = append(rootfsCreationStates,
+			classicStateMachine.installPackagesStates()...)
 
 		rootfsCreationStates = append(rootfsCreationStates,
 			[]stateFunc{
@@ -303,8 +307,32 @@ func (stateMachine *StateMachine) calculateStates() error {
 			}...,
 		)
 	} else {
+		rootfsCreationStates = append(rootfsCreationStates, rootfsTasksStates...)
+		rootfsCreationStates = append(rootfsCreationStates, classicStateMachine.aptConfigStates()...)
+		rootfsCreationStates = append(rootfsCreationStates,
+			classicStateMachine.installPackagesStates()...)
+
+		// unlike seeds, archive tasks do not provide a list of snaps, so
+		// snaps only need to be staged if extra snaps were requested
+		if classicStateMachine.ImageDef.Customization != nil && len(classicStateMachine.ImageDef.Customization.ExtraSnaps) > 0 {
+			rootfsCreationStates = append(rootfsCreationStates,
+				[]stateFunc{
+					{"prepare_image", (*StateMachine).prepareClassicImage},
+					{"preseed_image", (*StateMachine).preseedClassicImage},
+				}...,
+			)
+		}
+	}
+
+	if classicStateMachine.ImageDef.Rootfs.Apt != nil {
 		rootfsCreationStates = append(rootfsCreationStates,
-			stateFunc{"build_rootfs_from_tasks", (*StateMachine).buildRootfsFromTasks})
+			stateFunc{"clean_apt_config", (*StateMachine).cleanAptConfig})
+	}
+
+	// the image of an offline build uses the same sources as any other image
+	if classicStateMachine.Opts.Offline {
+		rootfsCreationStates = append(rootfsCreationStates,
+			stateFunc{"restore_apt_sources", (*StateMachine).restoreAptSources})
 	}
 
 	// Before customization, make sure we clean unwanted secrets/values that
@@ -333,6 +361,13 @@ func (stateMachine *StateMachine) calculateStates() error {
 	rootfsCreationStates = append(rootfsCreationStates,
 		stateFunc{"set_default_locale", (*StateMachine).setDefaultLocale})
 
+	// The emulator used to build images for foreign architectures
+	// must not end up in the resulting image
+	if isForeignArch(classicStateMachine.ImageDef.Architecture) {
+		rootfsCreationStates = append(rootfsCreationStates,
+			stateFunc{"remove_qemu_static", (*StateMachine).removeQemuStatic})
+	}
+
 	// The rootfs is laid out in a staging area, now populate it in the correct location
 	rootfsCreationStates = append(rootfsCreationStates,
 		stateFunc{"populate_rootfs_contents", (*StateMachine).populateClassicRootfsContents})
@@ -377,12 +412,23 @@ func (stateMachine *StateMachine) calculateStates() error {
 			stateFunc{"make_qcow2_image", (*StateMachine).makeQcow2Img})
 	}
 
+	// only build an installer ISO if there is an iso artifact to make
+	if classicStateMachine.ImageDef.Artifacts.Iso != nil {
+		rootfsCreationStates = append(rootfsCreationStates, installerStates...)
+	}
+
 	// only run generatePackageManifest if there is a manifest in the image definition
 	if classicStateMachine.ImageDef.Artifacts.Manifest != nil {
 		rootfsCreationStates = append(rootfsCreationStates,
 			stateFunc{"generate_manifest", (*StateMachine).generatePackageManifest})
 	}
 
+	// only run generateChangelog if there is a changelog in the image definition
+	if classicStateMachine.ImageDef.Artifacts.Changelog != nil {
+		rootfsCreationStates = append(rootfsCreationStates,
+			stateFunc{"generate_changelog", (*StateMachine).generateChangelog})
+	}
+
 	// only run generateFilelist if there is a filelist in the image definition
 	if classicStateMachine.ImageDef.Artifacts.Filelist != nil {
 		rootfsCreationStates = append(rootfsCreationStates,
@@ -395,6 +441,24 @@ func (stateMachine *StateMachine) calculateStates() error {
 			stateFunc{"generate_rootfs_tarball", (*StateMachine).generateRootfsTarball})
 	}
 
+	// only run generateClassicSBOM if there is an sbom in the image definition
+	if classicStateMachine.ImageDef.Artifacts.SBOM != nil {
+		rootfsCreationStates = append(rootfsCreationStates,
+			stateFunc{"generate_sbom", (*StateMachine).generateClassicSBOM})
+	}
+
+	// the report lists the other artifacts, so it must be generated last
+	if classicStateMachine.ImageDef.Artifacts.Report != nil {
+		rootfsCreationStates = append(rootfsCreationStates,
+			stateFunc{"generate_report", (*StateMachine).generateReport})
+	}
+
+	// the report is signed along with the other artifacts
+	if classicStateMachine.ImageDef.Signing != nil {
+		rootfsCreationStates = append(rootfsCreationStates,
+			stateFunc{"sign_artifacts", (*StateMachine).signArtifacts})
+	}
+
 	// add the no-op "finish" state
 	rootfsCreationStates = append(rootfsCreationStates,
 		stateFunc{"finish", (*StateMachine).finish})
@@ -404,11 +468,11 @@ func (stateMachine *StateMachine) calculateStates() error {
 
 	// if the --debug option was passed, print the calculated states
 	if stateMachine.commonFlags.Debug {
-		fmt.Println("\nThe calculated states are as follows:")
+		stateMachine.printProgress("\nThe calculated states are as follows:\n")
 		for i, state := range stateMachine.states {
-			fmt.Printf("[%d] %s\n", i, state.name)
+			stateMachine.printProgress("[%d] %s\n", i, state.name)
 		}
-		fmt.Println("\n\nContinuing")
+		stateMachine.printProgress("\n\nContinuing\n")
 	}
 
 	if err := stateMachine.validateUntilThru(); err != nil {
@@ -418,6 +482,36 @@ func (stateMachine *StateMachine) calculateStates() error {
 	return nil
 }
 
+// extraPackages returns the packages installed along with the seeded
+// packages: the extra packages and the extra kernel, if they are specified
+func (classicStateMachine *ClassicStateMachine) extraPackages() []string {
+	var packages []string
+	if classicStateMachine.ImageDef.Customization != nil {
+		for _, packageInfo := range classicStateMachine.ImageDef.Customization.ExtraPackages {
+			packages = append(packages, packageInfo.PackageName)
+		}
+	}
+	if classicStateMachine.ImageDef.Kernel != "" {
+		packages = append(packages, classicStateMachine.ImageDef.Kernel)
+	}
+	return packages
+}
+
+// installPackagesStates returns the states needed to install the packages
+// in the chroot, wrapping them with the extra PPA handling if needed
+func (classicStateMachine *ClassicStateMachine) installPackagesStates() []stateFunc {
+	if classicStateMachine.ImageDef.Customization != nil && len(classicStateMachine.ImageDef.Customization.ExtraPPAs) > 0 {
+		return []stateFunc{
+			{"add_extra_ppas", (*StateMachine).addExtraPPAs},
+			{"install_packages", (*StateMachine).installPackages},
+			{"clean_extra_ppas", (*StateMachine).cleanExtraPPAs},
+		}
+	}
+	return []stateFunc{
+		{"install_packages", (*StateMachine).installPackages},
+	}
+}
+
 // Build the gadget tree
 func (stateMachine *StateMachine) buildGadgetTree() error {
 	classicStateMachine := stateMachine.parent.(*ClassicStateMachine)
@@ -432,10 +526,15 @@ func (stateMachine *StateMachine) buildGadgetTree() error {
 
 	switch classicStateMachine.ImageDef.Gadget.GadgetType {
 	case "git":
-		err := cloneGitRepo(classicStateMachine.ImageDef, gadgetDir)
+		commit, err := cloneGitRepo(classicStateMachine.ImageDef, stateMachine.ConfDefPath, gadgetDir)
 		if err != nil {
 			return fmt.Errorf("Error cloning gadget repository: \"%s\"", err.Error())
 		}
+		classicStateMachine.GadgetCommit = commit
+		if !stateMachine.commonFlags.Quiet {
+			stateMachine.printProgress("Gadget repository %s checked out at commit %s\n",
+				classicStateMachine.ImageDef.Gadget.GadgetURL, commit)
+		}
 	case "directory":
 		gadgetTreePath := strings.TrimPrefix(classicStateMachine.ImageDef.Gadget.GadgetURL, "file://")
 		if !filepath.IsAbs(gadgetTreePath) {
@@ -472,7 +571,7 @@ func (stateMachine *StateMachine) buildGadgetTree() error {
 	makeCmd.Env = append(makeCmd.Env, os.Environ()...)
 	makeCmd.Dir = gadgetDir
 
-	makeOutput := helper.SetCommandOutput(makeCmd, classicStateMachine.commonFlags.Debug)
+	makeOutput := setCommandOutput(makeCmd, classicStateMachine.commonFlags.Debug)
 
 	if err := makeCmd.Run(); err != nil {
 		return fmt.Errorf("Error running \"make\" in gadget source. "+
@@ -526,18 +625,33 @@ func (stateMachine *StateMachine) createChroot() error {
 		return fmt.Errorf("Failed to create chroot directory: %s", err.Error())
 	}
 
-	debootstrapCmd := generateDebootstrapCmd(classicStateMachine.ImageDef,
+	debootstrapCmd := generateDebootstrapCmd(classicStateMachine.buildImageDef(),
 		stateMachine.tempDirs.chroot,
 		classicStateMachine.Packages,
 	)
 
-	debootstrapOutput := helper.SetCommandOutput(debootstrapCmd, classicStateMachine.commonFlags.Debug)
+	debootstrapOutput := setCommandOutput(debootstrapCmd, classicStateMachine.commonFlags.Debug)
 
 	if err := debootstrapCmd.Run(); err != nil {
 		return fmt.Errorf("Error running debootstrap command \"%s\". Error is \"%s\". Output is: \n%s",
 			debootstrapCmd.String(), err.Error(), debootstrapOutput.String())
 	}
 
+	// for foreign architectures only the first stage of debootstrap has
+	// been run, so finish bootstrapping the chroot through qemu-user-static
+	if isForeignArch(classicStateMachine.ImageDef.Architecture) {
+		if err := stateMachine.copyQemuStatic(stateMachine.tempDirs.chroot); err != nil {
+			return err
+		}
+		secondStageCmd := execCommand("chroot", stateMachine.tempDirs.chroot,
+			"/debootstrap/debootstrap", "--second-stage")
+		secondStageOutput := setCommandOutput(secondStageCmd, classicStateMachine.commonFlags.Debug)
+		if err := secondStageCmd.Run(); err != nil {
+			return fmt.Errorf("Error running debootstrap command \"%s\". Error is \"%s\". Output is: \n%s",
+				secondStageCmd.String(), err.Error(), secondStageOutput.String())
+		}
+	}
+
 	// debootstrap copies /etc/hostname from build environment; replace it
 	// with a fresh version
 	hostname := filepath.Join(stateMachine.tempDirs.chroot, "etc", "hostname")
@@ -558,8 +672,12 @@ func (stateMachine *StateMachine) createChroot() error {
 		return fmt.Errorf("Error truncating resolv.conf: %s", err.Error())
 	}
 
-	// add any extra apt sources to /etc/apt/sources.list
+	// add any extra apt sources to /etc/apt/sources.list. Offline builds
+	// read all of them from the local mirror until restore_apt_sources
 	aptSources := classicStateMachine.ImageDef.GeneratePocketList()
+	if classicStateMachine.Opts.Offline {
+		aptSources = classicStateMachine.ImageDef.GenerateLocalPocketList(classicStateMachine.localMirror())
+	}
 
 	sourcesList := filepath.Join(stateMachine.tempDirs.chroot, "etc", "apt", "sources.list")
 	sourcesListFile, err := osOpenFile(sourcesList, os.O_APPEND|os.O_WRONLY, 0644)
@@ -610,6 +728,11 @@ func (stateMachine *StateMachine) addExtraPPAs() (err error) {
 	for _, ppa := range classicStateMachine.ImageDef.Customization.ExtraPPAs {
 		ppaFileName, ppaFileContents := createPPAInfo(ppa,
 			classicStateMachine.ImageDef.Series)
+		if classicStateMachine.Opts.Offline {
+			ppaFileContents = fmt.Sprintf("deb %s %s main",
+				localPPAURL(classicStateMachine.localMirror(), ppa.PPAName),
+				classicStateMachine.ImageDef.Series)
+		}
 
 		var ppaIO *os.File
 		ppaFile := filepath.Join(sourcesListD, ppaFileName)
@@ -633,7 +756,15 @@ func (stateMachine *StateMachine) addExtraPPAs() (err error) {
 		*/
 		keyFileName := strings.Replace(ppaFileName, ".list", ".gpg", 1)
 		keyFilePath := filepath.Join(trustedGPGD, keyFileName)
-		err = importPPAKeys(ppa, tmpGPGDir, keyFilePath, stateMachine.commonFlags.Debug)
+		var localKeyFile string
+		if classicStateMachine.Opts.Offline {
+			localKeyFile, err = localPPAKey(classicStateMachine.Opts.KeysDir, ppa.Fingerprint)
+			if err != nil {
+				err = fmt.Errorf("Error finding signing key for ppa \"%s\": %s", ppa.PPAName, err.Error())
+				return err
+			}
+		}
+		err = importPPAKeys(ppa, tmpGPGDir, keyFilePath, localKeyFile, stateMachine.commonFlags.Debug)
 		if err != nil {
 			err = fmt.Errorf("Error retrieving signing key for ppa \"%s\": %s",
 				ppa.PPAName, err.Error())
@@ -694,25 +825,20 @@ func (stateMachine *StateMachine) cleanExtraPPAs() (err error) {
 func (stateMachine *StateMachine) installPackages() error {
 	classicStateMachine := stateMachine.parent.(*ClassicStateMachine)
 
+	// make sure apt can run in the chroot of foreign architectures
+	if err := stateMachine.copyQemuStatic(stateMachine.tempDirs.chroot); err != nil {
+		return err
+	}
+
 	// copy /etc/resolv.conf from the host system into the chroot
 	err := helperBackupAndCopyResolvConf(classicStateMachine.tempDirs.chroot)
 	if err != nil {
 		return fmt.Errorf("Error setting up /etc/resolv.conf in the chroot: \"%s\"", err.Error())
 	}
 
-	// if any extra packages are specified, install them alongside the seeded packages
-	if classicStateMachine.ImageDef.Customization != nil {
-		for _, packageInfo := range classicStateMachine.ImageDef.Customization.ExtraPackages {
-			classicStateMachine.Packages = append(classicStateMachine.Packages,
-				packageInfo.PackageName)
-		}
-	}
-
-	// Make sure to install the extra kernel if it is specified
-	if classicStateMachine.ImageDef.Kernel != "" {
-		classicStateMachine.Packages = append(classicStateMachine.Packages,
-			classicStateMachine.ImageDef.Kernel)
-	}
+	// install the extra packages and kernel alongside the seeded packages
+	classicStateMachine.Packages = append(classicStateMachine.Packages,
+		classicStateMachine.extraPackages()...)
 
 	// Slice used to store all the commands that need to be run
 	// to install the packages
@@ -741,6 +867,16 @@ func (stateMachine *StateMachine) installPackages() error {
 			fromHost: false,
 		},
 	}
+	// apt reads the packages of offline builds from the local mirror
+	removeMirrorMountpoint := func() error { return nil }
+	if classicStateMachine.Opts.Offline {
+		mirrorDir := strings.TrimPrefix(classicStateMachine.localMirror(), "file://")
+		removeMirrorMountpoint, err = makeMirrorMountpoint(stateMachine.tempDirs.chroot, mirrorDir)
+		if err != nil {
+			return err
+		}
+		mountPoints = append(mountPoints, mountPoint{dest: mirrorDir, fromHost: true})
+	}
 
 	var umounts []*exec.Cmd
 	for _, mount := range mountPoints {
@@ -770,12 +906,13 @@ func (stateMachine *StateMachine) installPackages() error {
 	}
 
 	// generate the apt update/install commands and append them to the slice of commands
-	aptCmds := generateAptCmds(stateMachine.tempDirs.chroot, classicStateMachine.Packages)
+	aptCmds := generateAptCmds(stateMachine.tempDirs.chroot, classicStateMachine.Packages,
+		classicStateMachine.aptOptions())
 	installPackagesCmds = append(installPackagesCmds, aptCmds...)
 	installPackagesCmds = append(installPackagesCmds, umounts...) // don't forget to unmount!
 
 	for _, cmd := range installPackagesCmds {
-		cmdOutput := helper.SetCommandOutput(cmd, classicStateMachine.commonFlags.Debug)
+		cmdOutput := setCommandOutput(cmd, classicStateMachine.commonFlags.Debug)
 		err := cmd.Run()
 		if err != nil {
 			return fmt.Errorf("Error running command \"%s\". Error is \"%s\". Output is: \n%s",
@@ -783,7 +920,7 @@ func (stateMachine *StateMachine) installPackages() error {
 		}
 	}
 
-	return nil
+	return removeMirrorMountpoint()
 }
 
 // Verify artifact names have volumes listed for multi-volume gadgets and set
@@ -793,6 +930,10 @@ func (stateMachine *StateMachine) verifyArtifactNames() error {
 
 	stateMachine.VolumeNames = make(map[string]string)
 
+	if err := stateMachine.verifyISOVolumes(); err != nil {
+		return err
+	}
+
 	if len(stateMachine.GadgetInfo.Volumes) > 1 {
 		// first handle .img files if they are specified
 		if classicStateMachine.ImageDef.Artifacts.Img != nil {
@@ -876,9 +1017,54 @@ func (stateMachine *StateMachine) verifyArtifactNames() error {
 	return nil
 }
 
-// Build a rootfs from a list of archive tasks
+// verifyISOVolumes makes sure every iso artifact is associated with a volume of
+// the gadget. The volume is used to source the bootloader assets of the ISO,
+// so no disk image needs to be created for it. The ISOs are made from the same
+// tree, with the same EFI image, so they must all use the same volume
+func (stateMachine *StateMachine) verifyISOVolumes() error {
+	classicStateMachine := stateMachine.parent.(*ClassicStateMachine)
+
+	if classicStateMachine.ImageDef.Artifacts.Iso == nil {
+		return nil
+	}
+
+	for i, iso := range *classicStateMachine.ImageDef.Artifacts.Iso {
+		if iso.IsoVolume == "" {
+			if len(stateMachine.GadgetInfo.Volumes) > 1 {
+				return fmt.Errorf("Volume names must be specified for each image when using a gadget with more than one volume")
+			}
+			// there is only one volume, so get it from the map
+			iso.IsoVolume = reflect.ValueOf(stateMachine.GadgetInfo.Volumes).MapKeys()[0].String()
+		} else if _, found := stateMachine.GadgetInfo.Volumes[iso.IsoVolume]; !found {
+			return fmt.Errorf("Volume \"%s\" of iso artifact \"%s\" does not exist in gadget.yaml",
+				iso.IsoVolume, iso.IsoName)
+		}
+		if i > 0 && iso.IsoVolume != (*classicStateMachine.ImageDef.Artifacts.Iso)[0].IsoVolume {
+			return fmt.Errorf("iso artifacts \"%s\" and \"%s\" use different volumes. "+
+				"All the iso artifacts must use the same volume of the gadget",
+				(*classicStateMachine.ImageDef.Artifacts.Iso)[0].IsoName, iso.IsoName)
+		}
+		(*classicStateMachine.ImageDef.Artifacts.Iso)[i] = iso
+	}
+	return nil
+}
+
+// Build a rootfs from a list of archive tasks. Tasks are resolved by apt
+// from the Task field of the archive's package indices, so the tasks only
+// need to be added to the list of packages using apt's "<task>^" syntax.
+// The chroot is then bootstrapped and the packages installed by the
+// create_chroot and install_packages states
 func (stateMachine *StateMachine) buildRootfsFromTasks() error {
-	// currently a no-op pending implementation of the classic image redesign
+	classicStateMachine := stateMachine.parent.(*ClassicStateMachine)
+
+	for _, task := range classicStateMachine.ImageDef.Rootfs.ArchiveTasks {
+		if !archiveTaskRegex.MatchString(task) {
+			return fmt.Errorf("Invalid archive task name \"%s\"", task)
+		}
+		classicStateMachine.Packages = append(classicStateMachine.Packages,
+			strings.TrimSuffix(task, "^")+"^")
+	}
+
 	return nil
 }
 
@@ -891,24 +1077,38 @@ func (stateMachine *StateMachine) extractRootfsTar() error {
 		return fmt.Errorf("Failed to create chroot directory: %s", err.Error())
 	}
 
-	// convert the URL to a file path
-	// no need to check error here as the validity of the URL
-	// has been confirmed by the schema validation
-	tarPath := strings.TrimPrefix(classicStateMachine.ImageDef.Rootfs.Tarball.TarballURL, "file://")
-	if !filepath.IsAbs(tarPath) {
-		tarPath = filepath.Join(stateMachine.ConfDefPath, tarPath)
+	// download the tarball and its signature if they are not local files
+	tarball := classicStateMachine.ImageDef.Rootfs.Tarball
+	tarPath, err := stateMachine.localTarballFile(tarball.TarballURL, tarball.SHA256sum)
+	if err != nil {
+		return err
 	}
 
 	// if the sha256 sum of the tarball is provided, make sure it matches
-	if classicStateMachine.ImageDef.Rootfs.Tarball.SHA256sum != "" {
-		tarSHA256, err := helper.CalculateSHA256(tarPath)
+	if tarball.SHA256sum != "" {
+		tarSHA256, err := fileSHA256(tarPath)
 		if err != nil {
 			return err
 		}
-		if tarSHA256 != classicStateMachine.ImageDef.Rootfs.Tarball.SHA256sum {
+		if !strings.EqualFold(tarSHA256, tarball.SHA256sum) {
 			return fmt.Errorf("Calculated SHA256 sum of rootfs tarball \"%s\" does not match "+
 				"the expected value specified in the image definition: \"%s\"",
-				tarSHA256, classicStateMachine.ImageDef.Rootfs.Tarball.SHA256sum)
+				tarSHA256, tarball.SHA256sum)
+		}
+	}
+
+	// if a detached signature of the tarball is provided, verify it
+	if tarball.GPG != "" {
+		signaturePath, err := stateMachine.localTarballFile(tarball.GPG, "")
+		if err != nil {
+			return err
+		}
+		keyring := tarball.Keyring
+		if keyring != "" && !filepath.IsAbs(keyring) {
+			keyring = filepath.Join(stateMachine.ConfDefPath, keyring)
+		}
+		if err := stateMachine.verifyTarballSignature(tarPath, signaturePath, keyring); err != nil {
+			return err
 		}
 	}
 
@@ -929,10 +1129,10 @@ func (stateMachine *StateMachine) germinate() error {
 		return fmt.Errorf("Error creating germinate directory: \"%s\"", err.Error())
 	}
 
-	germinateCmd := generateGerminateCmd(classicStateMachine.ImageDef)
+	germinateCmd := generateGerminateCmd(classicStateMachine.buildImageDef())
 	germinateCmd.Dir = germinateDir
 
-	germinateOutput := helper.SetCommandOutput(germinateCmd, classicStateMachine.commonFlags.Debug)
+	germinateOutput := setCommandOutput(germinateCmd, classicStateMachine.commonFlags.Debug)
 
 	if err := germinateCmd.Run(); err != nil {
 		return fmt.Errorf("Error running germinate command \"%s\". Error is \"%s\". Output is: \n%s",
@@ -1065,44 +1265,131 @@ func (stateMachine *StateMachine) customizeFstab() error {
 	return err
 }
 
-// Handle any manual customizations specified in the image definition
-func (stateMachine *StateMachine) manualCustomization() error {
-	classicStateMachine := stateMachine.parent.(*ClassicStateMachine)
-
-	// copy /etc/resolv.conf from the host system into the chroot if it hasn't already been done
-	err := helperBackupAndCopyResolvConf(classicStateMachine.tempDirs.chroot)
-	if err != nil {
-		return fmt.Errorf("Error setting up /etc/resolv.conf in the chroot: \"%s\"", err.Error())
+// validateManualPaths checks that the paths of the manual customizations
+// are absolute paths in the chroot
+func validateManualPaths(manual *imagedefinition.Manual, result *gojsonschema.Result) {
+	jsonContext := gojsonschema.NewJsonContext("manual_path_validation", nil)
+	checkPath := func(key string, path string) {
+		// XXX: filepath.IsAbs() does returns true for paths like /../../something
+		// and those are NOT absolute paths.
+		if filepath.IsAbs(path) && !strings.Contains(path, "/../") {
+			return
+		}
+		errDetail := gojsonschema.ErrorDetails{
+			"key":   "customization:manual:" + key,
+			"value": path,
+		}
+		result.AddError(
+			imagedefinition.NewPathNotAbsoluteError(
+				gojsonschema.NewJsonContext("nonAbsoluteManualPath",
+					jsonContext),
+				52,
+				errDetail,
+			),
+			errDetail,
+		)
 	}
 
-	err = manualMakeDirs(classicStateMachine.ImageDef.Customization.Manual.MakeDirs, stateMachine.tempDirs.chroot, stateMachine.commonFlags.Debug)
-	if err != nil {
-		return err
+	for _, mkdir := range manual.MakeDirs {
+		checkPath("mkdir:destination", mkdir.Path)
 	}
-
-	err = manualCopyFile(classicStateMachine.ImageDef.Customization.Manual.CopyFile, classicStateMachine.ConfDefPath, stateMachine.tempDirs.chroot, stateMachine.commonFlags.Debug)
-	if err != nil {
-		return err
+	for _, copy := range manual.CopyFile {
+		checkPath("copy-file:destination", copy.Dest)
 	}
-
-	err = manualExecute(classicStateMachine.ImageDef.Customization.Manual.Execute, stateMachine.tempDirs.chroot, stateMachine.commonFlags.Debug)
-	if err != nil {
-		return err
+	for _, copyTree := range manual.CopyTree {
+		checkPath("copy-tree:destination", copyTree.Dest)
 	}
-
-	err = manualTouchFile(classicStateMachine.ImageDef.Customization.Manual.TouchFile, stateMachine.tempDirs.chroot, stateMachine.commonFlags.Debug)
-	if err != nil {
-		return err
+	for _, writeFile := range manual.WriteFile {
+		checkPath("write-file:path", writeFile.Path)
+	}
+	for _, symlink := range manual.Symlink {
+		checkPath("symlink:path", symlink.Path)
+	}
+	for _, chmod := range manual.Chmod {
+		checkPath("chmod:path", chmod.Path)
 	}
+	for _, chown := range manual.Chown {
+		checkPath("chown:path", chown.Path)
+	}
+	for _, removePath := range manual.RemovePath {
+		checkPath("remove-path:path", removePath.Path)
+	}
+	for _, touch := range manual.TouchFile {
+		checkPath("touch-file:path", touch.TouchPath)
+	}
+}
 
-	err = manualAddGroup(classicStateMachine.ImageDef.Customization.Manual.AddGroup, stateMachine.tempDirs.chroot, stateMachine.commonFlags.Debug)
+// defaultManualOrder is the order in which manual customizations run when
+// the order they were written in is unknown
+var defaultManualOrder = []string{
+	"make-dirs",
+	"copy-file",
+	"copy-tree",
+	"write-file",
+	"symlink",
+	"chmod",
+	"chown",
+	"remove-path",
+	"execute",
+	"touch-file",
+	"add-group",
+	"add-user",
+}
+
+// Handle any manual customizations specified in the image definition.
+// Customizations run in the order they appear in the image definition
+func (stateMachine *StateMachine) manualCustomization() error {
+	classicStateMachine := stateMachine.parent.(*ClassicStateMachine)
+	chroot := stateMachine.tempDirs.chroot
+	debug := stateMachine.commonFlags.Debug
+
+	// copy /etc/resolv.conf from the host system into the chroot if it hasn't already been done
+	err := helperBackupAndCopyResolvConf(chroot)
 	if err != nil {
-		return err
+		return fmt.Errorf("Error setting up /etc/resolv.conf in the chroot: \"%s\"", err.Error())
 	}
 
-	err = manualAddUser(classicStateMachine.ImageDef.Customization.Manual.AddUser, stateMachine.tempDirs.chroot, stateMachine.commonFlags.Debug)
-	if err != nil {
-		return err
+	manual := classicStateMachine.ImageDef.Customization.Manual
+	order := manual.Order
+	if len(order) == 0 {
+		order = defaultManualOrder
+	}
+	for _, customization := range order {
+		switch customization {
+		case "make-dirs":
+			err = manualMakeDirs(manual.MakeDirs, chroot, debug)
+		case "copy-file":
+			err = manualCopyFile(manual.CopyFile, classicStateMachine.ConfDefPath, chroot, debug)
+		case "copy-tree":
+			err = manualCopyTree(manual.CopyTree, classicStateMachine.ConfDefPath, chroot, debug)
+		case "write-file":
+			err = manualWriteFile(manual.WriteFile, classicStateMachine.ImageDef, chroot, debug)
+		case "symlink":
+			err = manualSymlink(manual.Symlink, chroot, debug)
+		case "chmod":
+			err = manualChmod(manual.Chmod, chroot, debug)
+		case "chown":
+			err = manualChown(manual.Chown, chroot, debug)
+		case "remove-path":
+			err = manualRemovePath(manual.RemovePath, chroot, debug)
+		case "execute":
+			if len(manual.Execute) > 0 {
+				// scripts may run binaries of the chroot
+				if err := stateMachine.copyQemuStatic(chroot); err != nil {
+					return err
+				}
+			}
+			err = manualExecute(manual.Execute, chroot, debug)
+		case "touch-file":
+			err = manualTouchFile(manual.TouchFile, chroot, debug)
+		case "add-group":
+			err = manualAddGroup(manual.AddGroup, chroot, debug)
+		case "add-user":
+			err = manualAddUser(manual.AddUser, chroot, debug)
+		}
+		if err != nil {
+			return err
+		}
 	}
 
 	return nil
@@ -1114,7 +1401,10 @@ func (stateMachine *StateMachine) prepareClassicImage() error {
 
 	var imageOpts image.Options
 
-	var err error
+	storeConfig, err := classicStateMachine.snapStore()
+	if err != nil {
+		return err
+	}
 	imageOpts.Snaps, imageOpts.SnapChannels, err = parseSnapsAndChannels(classicStateMachine.Snaps)
 	if err != nil {
 		return err
@@ -1167,17 +1457,27 @@ func (stateMachine *StateMachine) prepareClassicImage() error {
 	// are also set to be installed. Note we only do this for snaps that are
 	// seeded. Users are expected to specify all base and content provider
 	// snaps in the image definition.
-	snapStore := store.New(nil, nil)
-	snapContext := context.Background()
+	// the revisions of the extra snaps select their local files when offline
+	revisions := make(map[string]int)
+	if classicStateMachine.ImageDef.Customization != nil {
+		for _, extraSnap := range classicStateMachine.ImageDef.Customization.ExtraSnaps {
+			revisions[extraSnap.SnapName] = extraSnap.SnapRevision
+		}
+	}
+	snapBase := storeConfig.storeSnapBase
+	if classicStateMachine.Opts.Offline {
+		snapBase = func(name string) (string, error) {
+			return localSnapBase(classicStateMachine.Opts.SnapsDir, name, revisions[name])
+		}
+	}
 	for _, seededSnap := range imageOpts.Snaps {
-		snapSpec := store.SnapSpec{Name: seededSnap}
-		snapInfo, err := snapStore.SnapInfo(snapContext, snapSpec, nil)
+		base, err := snapBase(seededSnap)
 		if err != nil {
 			return fmt.Errorf("Error getting info for snap %s: \"%s\"",
 				seededSnap, err.Error())
 		}
-		if snapInfo.Base != "" && !helper.SliceHasElement(imageOpts.Snaps, snapInfo.Base) {
-			imageOpts.Snaps = append(imageOpts.Snaps, snapInfo.Base)
+		if base != "" && !helper.SliceHasElement(imageOpts.Snaps, base) {
+			imageOpts.Snaps = append(imageOpts.Snaps, base)
 		}
 	}
 
@@ -1193,7 +1493,7 @@ func (stateMachine *StateMachine) prepareClassicImage() error {
 				imageOpts.SnapChannels[extraSnap.SnapName] = extraSnap.Channel
 			}
 			if extraSnap.SnapRevision != 0 {
-				fmt.Printf("WARNING: revision %d for snap %s may not be the latest available version!\n",
+				stateMachine.warn("revision %d for snap %s may not be the latest available version!",
 					extraSnap.SnapRevision,
 					extraSnap.SnapName,
 				)
@@ -1216,6 +1516,31 @@ func (stateMachine *StateMachine) prepareClassicImage() error {
 		}
 	}
 
+	if classicStateMachine.Opts.Offline {
+		// snaps are staged from their local files, whose assertions are
+		// served to snapd by a local store
+		imageOpts.Snaps, err = localSnapPaths(imageOpts.Snaps, revisions, classicStateMachine.Opts.SnapsDir)
+		if err != nil {
+			return err
+		}
+		// the revisions are those of the local files
+		imageOpts.SeedManifest = nil
+		stopLocalStore, err := serveLocalAssertions(classicStateMachine.Opts.SnapsDir)
+		if err != nil {
+			return err
+		}
+		defer stopLocalStore()
+	} else {
+		if err := checkModelStore(storeConfig, imageOpts.ModelFile); err != nil {
+			return err
+		}
+		restoreStore, err := useSnapStore(storeConfig)
+		if err != nil {
+			return err
+		}
+		defer restoreStore()
+	}
+
 	imageOpts.Classic = true
 	imageOpts.Architecture = classicStateMachine.ImageDef.Architecture
 	imageOpts.PrepareDir = classicStateMachine.tempDirs.chroot
@@ -1243,6 +1568,11 @@ func (stateMachine *StateMachine) prepareClassicImage() error {
 func (stateMachine *StateMachine) preseedClassicImage() error {
 	classicStateMachine := stateMachine.parent.(*ClassicStateMachine)
 
+	// snap-preseed runs snapd from the chroot
+	if err := stateMachine.copyQemuStatic(stateMachine.tempDirs.chroot); err != nil {
+		return err
+	}
+
 	// create some directories in the chroot that we will bind mount from the
 	// host system. This is required or else the call to snap-preseed will fail
 	mkdirs := []string{
@@ -1281,7 +1611,7 @@ func (stateMachine *StateMachine) preseedClassicImage() error {
 	)
 	preseedCmds = append(preseedCmds, umountCmds...)
 	for _, cmd := range preseedCmds {
-		cmdOutput := helper.SetCommandOutput(cmd, classicStateMachine.commonFlags.Debug)
+		cmdOutput := setCommandOutput(cmd, classicStateMachine.commonFlags.Debug)
 		err := cmd.Run()
 		if err != nil {
 			return fmt.Errorf("Error running command \"%s\". Error is \"%s\". Output is: \n%s",
@@ -1291,6 +1621,12 @@ func (stateMachine *StateMachine) preseedClassicImage() error {
 	return nil
 }
 
+// removeQemuStatic removes the qemu-user-static binary used to
+// build the chroot of foreign architecture images
+func (stateMachine *StateMachine) removeQemuStatic() error {
+	return stateMachine.deleteQemuStatic(stateMachine.tempDirs.chroot)
+}
+
 // populateClassicRootfsContents copies over the staged rootfs
 // to rootfs. It also changes fstab and handles the --cloud-init flag
 func (stateMachine *StateMachine) populateClassicRootfsContents() error {
@@ -1407,58 +1743,20 @@ func (stateMachine *StateMachine) setDefaultLocale() error {
 func (stateMachine *StateMachine) generatePackageManifest() error {
 	classicStateMachine := stateMachine.parent.(*ClassicStateMachine)
 
-	// This is basically just a wrapper around dpkg-query
-	outputPath := filepath.Join(stateMachine.commonFlags.OutputDir,
-		classicStateMachine.ImageDef.Artifacts.Manifest.ManifestName)
-	cmd := execCommand("chroot", stateMachine.tempDirs.rootfs, "dpkg-query", "-W", "--showformat=${Package} ${Version}\n")
-	cmdOutput := helper.SetCommandOutput(cmd, classicStateMachine.commonFlags.Debug)
-
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("Error generating package manifest with command \"%s\". "+
-			"Error is \"%s\". Full output below:\n%s",
-			cmd.String(), err.Error(), cmdOutput.String())
-	}
-
-	// write the output to a file on successful executions
-	manifest, err := osCreate(outputPath)
-	if err != nil {
-		return fmt.Errorf("Error creating manifest file: %s", err.Error())
-	}
-	defer manifest.Close()
-	_, err = manifest.Write(cmdOutput.Bytes())
-	if err != nil {
-		return fmt.Errorf("error writing the manifest file: %w", err)
-	}
-	return nil
+	manifest := classicStateMachine.ImageDef.Artifacts.Manifest
+	outputPath := filepath.Join(stateMachine.commonFlags.OutputDir, manifest.ManifestName)
+	return writePackageManifest(stateMachine.tempDirs.rootfs, outputPath,
+		manifest.Snaps != nil && *manifest.Snaps, stateMachine.commonFlags.Debug)
 }
 
-// Generate the manifest
+// Generate the filelist
 func (stateMachine *StateMachine) generateFilelist() error {
 	classicStateMachine := stateMachine.parent.(*ClassicStateMachine)
 
-	// This is basically just a wrapper around find (similar to what we do in livecd-rootfs)
 	outputPath := filepath.Join(stateMachine.commonFlags.OutputDir,
 		classicStateMachine.ImageDef.Artifacts.Filelist.FilelistName)
-	cmd := execCommand("chroot", stateMachine.tempDirs.rootfs, "find", "-xdev")
-	cmdOutput := helper.SetCommandOutput(cmd, classicStateMachine.commonFlags.Debug)
-
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("Error generating file list with command \"%s\". "+
-			"Error is \"%s\". Full output below:\n%s",
-			cmd.String(), err.Error(), cmdOutput.String())
-	}
-
-	// write the output to a file on successful executions
-	filelist, err := osCreate(outputPath)
-	if err != nil {
-		return fmt.Errorf("Error creating filelist file: %s", err.Error())
-	}
-	defer filelist.Close()
-	_, err = filelist.Write(cmdOutput.Bytes())
-	if err != nil {
-		return fmt.Errorf("error writing the filelist file: %w", err)
-	}
-	return nil
+	return writeFilelist(stateMachine.tempDirs.rootfs, outputPath,
+		stateMachine.reproducible(), stateMachine.commonFlags.Debug)
 }
 
 // Generate the rootfs tarball
@@ -1471,7 +1769,8 @@ func (stateMachine *StateMachine) generateRootfsTarball() error {
 		classicStateMachine.ImageDef.Artifacts.RootfsTar.RootfsTarName)
 	return helper.CreateTarArchive(rootfsSrc, rootfsDst,
 		classicStateMachine.ImageDef.Artifacts.RootfsTar.Compression,
-		stateMachine.commonFlags.Verbose, stateMachine.commonFlags.Debug)
+		stateMachine.commonFlags.Verbose, stateMachine.commonFlags.Debug,
+		stateMachine.reproducibleTime())
 }
 
 // makeQcow2Img converts raw .img artifacts into qcow2 artifacts
@@ -1481,21 +1780,8 @@ func (stateMachine *StateMachine) makeQcow2Img() error {
 	for _, qcow2 := range *classicStateMachine.ImageDef.Artifacts.Qcow2 {
 		backingFile := filepath.Join(stateMachine.commonFlags.OutputDir, stateMachine.VolumeNames[qcow2.Qcow2Volume])
 		resultingFile := filepath.Join(stateMachine.commonFlags.OutputDir, qcow2.Qcow2Name)
-		qemuImgCommand := execCommand("qemu-img",
-			"convert",
-			"-c",
-			"-O",
-			"qcow2",
-			"-o",
-			"compat=0.10",
-			backingFile,
-			resultingFile,
-		)
-		qemuOutput := helper.SetCommandOutput(qemuImgCommand, classicStateMachine.commonFlags.Debug)
-		if err := qemuImgCommand.Run(); err != nil {
-			return fmt.Errorf("Error creating qcow2 artifact with command \"%s\". "+
-				"Error is \"%s\". Full output below:\n%s",
-				qemuImgCommand.String(), err.Error(), qemuOutput.String())
+		if err := stateMachine.convertImage(backingFile, resultingFile, "qcow2", qcow2Options(qcow2)); err != nil {
+			return err
 		}
 	}
 	return nil
@@ -1504,18 +1790,18 @@ func (stateMachine *StateMachine) makeQcow2Img() error {
 // updateBootloader determines the bootloader for each volume
 // and runs the correct helper function to update the bootloader
 func (stateMachine *StateMachine) updateBootloader() error {
-	if stateMachine.rootfsPartNum == -1 || stateMachine.rootfsVolName == "" {
+	if stateMachine.RootfsPartNum == -1 || stateMachine.RootfsVolName == "" {
 		return fmt.Errorf("Error: could not determine partition number of the root filesystem")
 	}
-	volume := stateMachine.GadgetInfo.Volumes[stateMachine.rootfsVolName]
+	volume := stateMachine.GadgetInfo.Volumes[stateMachine.RootfsVolName]
 	switch volume.Bootloader {
 	case "grub":
-		err := stateMachine.updateGrub(stateMachine.rootfsVolName, stateMachine.rootfsPartNum)
+		err := stateMachine.updateGrub(stateMachine.RootfsVolName, stateMachine.RootfsPartNum)
 		if err != nil {
 			return err
 		}
 	default:
-		fmt.Printf("WARNING: updating bootloader %s not yet supported\n",
+		stateMachine.warn("updating bootloader %s not yet supported",
 			volume.Bootloader,
 		)
 	}
@@ -1582,3 +1868,414 @@ func (stateMachine *StateMachine) cleanRootfs() error {
 
 	return nil
 }
+
+// makeSquashfsLayers creates the squashfs filesystems of the live system of
+// an installer image. Without layers, the whole chroot is squashed into
+// casper/filesystem.squashfs. With layers, the first layer is the chroot and
+// every following layer is built in an overlay on top of the previous ones,
+// installing the packages of the seed named by the last component of the
+// layer name. Only the upper directory of the overlay is squashed, so each
+// layer only contains the changes on top of the layers below it
+func (stateMachine *StateMachine) makeSquashfsLayers() error {
+	classicStateMachine := stateMachine.parent.(*ClassicStateMachine)
+
+	casperDir := filepath.Join(stateMachine.tempDirs.scratch, "iso", "casper")
+	if err := osMkdirAll(casperDir, 0755); err != nil {
+		return fmt.Errorf("Error creating casper directory: %s", err.Error())
+	}
+
+	var layers []string
+	if classicStateMachine.ImageDef.Customization != nil &&
+		classicStateMachine.ImageDef.Customization.Installer != nil {
+		layers = classicStateMachine.ImageDef.Customization.Installer.Layers
+	}
+
+	if len(layers) == 0 {
+		return runMksquashfs(stateMachine.tempDirs.chroot,
+			filepath.Join(casperDir, "filesystem.squashfs"), stateMachine.commonFlags.Debug)
+	}
+
+	if err := validateLayerNames(layers); err != nil {
+		return err
+	}
+
+	// the base layer is the chroot itself
+	if err := runMksquashfs(stateMachine.tempDirs.chroot,
+		filepath.Join(casperDir, layers[0]+".squashfs"), stateMachine.commonFlags.Debug); err != nil {
+		return err
+	}
+
+	// overlayfs expects the lower directories to be listed from top to bottom
+	lowerDirs := []string{stateMachine.tempDirs.chroot}
+	germinateDir := filepath.Join(stateMachine.stateMachineFlags.WorkDir, "germinate")
+	for _, layer := range layers[1:] {
+		nameParts := strings.Split(layer, ".")
+		packages, err := readSeedPackages(filepath.Join(germinateDir, nameParts[len(nameParts)-1]+".seed"))
+		if err != nil {
+			return err
+		}
+		layerDir := filepath.Join(stateMachine.tempDirs.scratch, "layers", layer)
+		if err := stateMachine.buildLayer(layerDir, lowerDirs, packages); err != nil {
+			return fmt.Errorf("Error building layer \"%s\": %s", layer, err.Error())
+		}
+		upperDir := filepath.Join(layerDir, "upper")
+		if err := runMksquashfs(upperDir,
+			filepath.Join(casperDir, layer+".squashfs"), stateMachine.commonFlags.Debug); err != nil {
+			return err
+		}
+		lowerDirs = append([]string{upperDir}, lowerDirs...)
+	}
+
+	return nil
+}
+
+// buildLayer mounts an overlay of the given lower directories and installs
+// a list of packages in it. The changes end up in the "upper" subdirectory
+// of layerDir
+func (stateMachine *StateMachine) buildLayer(layerDir string, lowerDirs []string, packages []string) (err error) {
+	classicStateMachine := stateMachine.parent.(*ClassicStateMachine)
+
+	for _, dir := range []string{"upper", "work", "merged"} {
+		if err := osMkdirAll(filepath.Join(layerDir, dir), 0755); err != nil {
+			return fmt.Errorf("Error creating layer directory: %s", err.Error())
+		}
+	}
+	mergedDir := filepath.Join(layerDir, "merged")
+
+	mountCmds, umountCmds := mountOverlay(mergedDir, lowerDirs,
+		filepath.Join(layerDir, "upper"), filepath.Join(layerDir, "work"))
+	for _, mountPoint := range []string{"/dev", "/proc", "/sys"} {
+		thisMountCmds, thisUmountCmds := mountFromHost(mergedDir, mountPoint)
+		mountCmds = append(mountCmds, thisMountCmds...)
+		umountCmds = append(thisUmountCmds, umountCmds...)
+	}
+
+	defer func(cmds []*exec.Cmd) {
+		_ = runAll(cmds)
+	}(umountCmds)
+
+	for _, cmd := range mountCmds {
+		cmdOutput := setCommandOutput(cmd, stateMachine.commonFlags.Debug)
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("Error running command \"%s\". Error is \"%s\". Output is: \n%s",
+				cmd.String(), err.Error(), cmdOutput.String())
+		}
+	}
+
+	if err := helperBackupAndCopyResolvConf(mergedDir); err != nil {
+		return fmt.Errorf("Error setting up /etc/resolv.conf in the layer: \"%s\"", err.Error())
+	}
+	defer func() {
+		tmpErr := helperRestoreResolvConf(mergedDir)
+		if tmpErr != nil && err == nil {
+			err = fmt.Errorf("Error restoring /etc/resolv.conf in the layer: \"%s\"", tmpErr.Error())
+		}
+	}()
+
+	// qemu-user-static was already removed from the rootfs of foreign
+	// architecture images, but apt runs binaries of the layer
+	if err := stateMachine.copyQemuStatic(mergedDir); err != nil {
+		return err
+	}
+	defer func() {
+		tmpErr := stateMachine.deleteQemuStatic(mergedDir)
+		if tmpErr != nil && err == nil {
+			err = tmpErr
+		}
+	}()
+
+	// the apt configuration was removed from the rootfs the layer is built
+	// on, unless it is kept enabled
+	if rootfs := classicStateMachine.ImageDef.Rootfs; rootfs != nil && rootfs.Apt != nil && !keepAptConfig(rootfs.Apt) {
+		if err := writeAptConfig(mergedDir, rootfs.Apt); err != nil {
+			return err
+		}
+		defer func() {
+			tmpErr := removeAptConfig(mergedDir)
+			if tmpErr != nil && err == nil {
+				err = tmpErr
+			}
+		}()
+	}
+
+	for _, cmd := range generateAptCmds(mergedDir, packages, classicStateMachine.aptOptions()) {
+		cmdOutput := setCommandOutput(cmd, stateMachine.commonFlags.Debug)
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("Error running command \"%s\". Error is \"%s\". Output is: \n%s",
+				cmd.String(), err.Error(), cmdOutput.String())
+		}
+	}
+
+	return nil
+}
+
+// stageInstallerPreseeds copies the preseed files listed in the image
+// definition to the preseed directory of the ISO
+func (stateMachine *StateMachine) stageInstallerPreseeds() error {
+	classicStateMachine := stateMachine.parent.(*ClassicStateMachine)
+
+	if classicStateMachine.ImageDef.Customization == nil ||
+		classicStateMachine.ImageDef.Customization.Installer == nil ||
+		len(classicStateMachine.ImageDef.Customization.Installer.Preseeds) == 0 {
+		return nil
+	}
+
+	preseedDir := filepath.Join(stateMachine.tempDirs.scratch, "iso", "preseed")
+	if err := osMkdirAll(preseedDir, 0755); err != nil {
+		return fmt.Errorf("Error creating preseed directory: %s", err.Error())
+	}
+
+	for _, preseed := range classicStateMachine.ImageDef.Customization.Installer.Preseeds {
+		preseedPath := preseed
+		if !filepath.IsAbs(preseedPath) {
+			preseedPath = filepath.Join(stateMachine.ConfDefPath, preseedPath)
+		}
+		dest := filepath.Join(preseedDir, filepath.Base(preseedPath))
+		if err := osutilCopyFile(preseedPath, dest, osutil.CopyFlagOverwrite); err != nil {
+			return fmt.Errorf("Error copying preseed file \"%s\": %s", preseedPath, err.Error())
+		}
+	}
+
+	return nil
+}
+
+// prepareISOBootloader stages the kernel, initrd and the bootloader assets
+// needed to boot the ISO on both BIOS and UEFI systems. The UEFI assets are
+// taken from the system-boot structure of the gadget volume of the ISO, while
+// the BIOS El Torito image is built with grub-mkimage in the chroot, if the
+// i386-pc grub modules are available there
+func (stateMachine *StateMachine) prepareISOBootloader() error {
+	classicStateMachine := stateMachine.parent.(*ClassicStateMachine)
+
+	isoDir := filepath.Join(stateMachine.tempDirs.scratch, "iso")
+	for _, dir := range []string{
+		filepath.Join(isoDir, "casper"),
+		filepath.Join(isoDir, "boot", "grub"),
+		filepath.Join(isoDir, ".disk"),
+	} {
+		if err := osMkdirAll(dir, 0755); err != nil {
+			return fmt.Errorf("Error creating ISO directory \"%s\": %s", dir, err.Error())
+		}
+	}
+
+	// casper boots the kernel and initrd found in the casper directory
+	bootFiles := []struct {
+		src  string
+		dest string
+	}{
+		{filepath.Join("boot", "vmlinuz"), "vmlinuz"},
+		{filepath.Join("boot", "initrd.img"), "initrd"},
+	}
+	for _, bootFile := range bootFiles {
+		src := filepath.Join(stateMachine.tempDirs.chroot, bootFile.src)
+		dest := filepath.Join(isoDir, "casper", bootFile.dest)
+		if err := osutilCopyFile(src, dest, osutil.CopyFlagOverwrite); err != nil {
+			return fmt.Errorf("Error copying %s to the ISO: %s", bootFile.src, err.Error())
+		}
+	}
+
+	diskInfo := fmt.Sprintf("%s \"%s\" - %s (%s)",
+		classicStateMachine.ImageDef.DisplayName,
+		classicStateMachine.ImageDef.Series,
+		classicStateMachine.ImageDef.Architecture,
+		classicStateMachine.ImageDef.Class,
+	)
+	if err := osWriteFile(filepath.Join(isoDir, ".disk", "info"), []byte(diskInfo), 0644); err != nil {
+		return fmt.Errorf("Error writing .disk/info: %s", err.Error())
+	}
+
+	grubCfg := fmt.Sprintf(isoGrubCfgTemplate, classicStateMachine.ImageDef.DisplayName)
+	if err := osWriteFile(filepath.Join(isoDir, "boot", "grub", "grub.cfg"), []byte(grubCfg), 0644); err != nil {
+		return fmt.Errorf("Error writing grub.cfg: %s", err.Error())
+	}
+
+	// every iso artifact uses the same volume, as checked by verifyISOVolumes
+	volumeName := (*classicStateMachine.ImageDef.Artifacts.Iso)[0].IsoVolume
+	volume := stateMachine.GadgetInfo.Volumes[volumeName]
+	if volume.Bootloader != "grub" {
+		return fmt.Errorf("Bootloader \"%s\" of volume \"%s\" is not supported for iso artifacts",
+			volume.Bootloader, volumeName)
+	}
+	if err := stateMachine.makeISOEFIImage(volumeName, volume, isoDir); err != nil {
+		return err
+	}
+
+	return stateMachine.makeISOBIOSImage(isoDir)
+}
+
+// makeISOEFIImage creates a FAT image with the contents of the system-boot
+// structure of the volume, to be used as the El Torito EFI boot image. The
+// EFI grub configuration is replaced to chain load the grub.cfg of the ISO
+func (stateMachine *StateMachine) makeISOEFIImage(volumeName string, volume *gadget.Volume, isoDir string) error {
+	structureNumber := -1
+	for ii, structure := range volume.Structure {
+		if structure.Role == gadget.SystemBoot || structure.Label == gadget.SystemBoot {
+			structureNumber = ii
+			break
+		}
+	}
+	if structureNumber == -1 {
+		return fmt.Errorf("No system-boot structure found in volume \"%s\"", volumeName)
+	}
+
+	efiContentDir := filepath.Join(stateMachine.tempDirs.scratch, "efi", volumeName)
+	if err := osRemoveAll(efiContentDir); err != nil {
+		return fmt.Errorf("Error removing old EFI content: %s", err.Error())
+	}
+	if err := osMkdirAll(filepath.Dir(efiContentDir), 0755); err != nil {
+		return fmt.Errorf("Error creating EFI content directory: %s", err.Error())
+	}
+	partDir := filepath.Join(stateMachine.tempDirs.volumes, volumeName,
+		"part"+strconv.Itoa(structureNumber))
+	if err := osutilCopySpecialFile(partDir, efiContentDir); err != nil {
+		return fmt.Errorf("Error copying EFI content: %s", err.Error())
+	}
+
+	grubDir := filepath.Join(efiContentDir, "EFI", "ubuntu")
+	if err := osMkdirAll(grubDir, 0755); err != nil {
+		return fmt.Errorf("Error creating EFI grub directory: %s", err.Error())
+	}
+	if err := osWriteFile(filepath.Join(grubDir, "grub.cfg"), []byte(isoEFIGrubCfg), 0644); err != nil {
+		return fmt.Errorf("Error writing EFI grub.cfg: %s", err.Error())
+	}
+
+	contentSize, err := helper.Du(efiContentDir)
+	if err != nil {
+		return fmt.Errorf("Error getting size of the EFI content: %s", err.Error())
+	}
+	// leave room for the FAT metadata and round up to the next MiB
+	imgSize := quantity.Size(math.Ceil(float64(contentSize+4*quantity.SizeMiB)/float64(quantity.SizeMiB))) *
+		quantity.SizeMiB
+
+	efiImg := filepath.Join(isoDir, "boot", "grub", "efi.img")
+	if err := osRemoveAll(efiImg); err != nil {
+		return fmt.Errorf("Error removing old EFI image: %s", err.Error())
+	}
+	if err := stateMachine.makeFilesystem("vfat", efiImg, "ESP", efiContentDir,
+		imgSize, "iso-esp", volumeName); err != nil {
+		return fmt.Errorf("Error creating EFI image: %s", err.Error())
+	}
+	return nil
+}
+
+// makeISOBIOSImage creates the El Torito BIOS boot image with grub-mkimage
+// in the chroot. If the i386-pc grub modules are not available, the ISO can
+// only be booted on UEFI systems
+func (stateMachine *StateMachine) makeISOBIOSImage(isoDir string) (err error) {
+	grubModulesDir := filepath.Join(stateMachine.tempDirs.chroot, "usr", "lib", "grub", "i386-pc")
+	if _, err := osStat(grubModulesDir); err != nil {
+		stateMachine.warn("grub i386-pc modules not found in the rootfs, " +
+			"the ISO will only be bootable on UEFI systems")
+		return nil
+	}
+
+	biosDir := filepath.Join(isoDir, "boot", "grub", "i386-pc")
+	if err := osMkdirAll(biosDir, 0755); err != nil {
+		return fmt.Errorf("Error creating BIOS boot directory: %s", err.Error())
+	}
+
+	// qemu-user-static was already removed from the rootfs of foreign
+	// architecture images, but grub-mkimage is a binary of the rootfs
+	if err := stateMachine.copyQemuStatic(stateMachine.tempDirs.chroot); err != nil {
+		return err
+	}
+	defer func() {
+		tmpErr := stateMachine.deleteQemuStatic(stateMachine.tempDirs.chroot)
+		if tmpErr != nil && err == nil {
+			err = tmpErr
+		}
+	}()
+
+	// grub-mkimage runs in the chroot, so generate the image in the
+	// chroot and move it to the ISO afterwards
+	chrootImg := filepath.Join("/tmp", "eltorito.img")
+	mkimageCmd := execCommand("chroot", stateMachine.tempDirs.chroot,
+		"grub-mkimage",
+		"--format", "i386-pc-eltorito",
+		"--prefix", "/boot/grub",
+		"--output", chrootImg,
+		"biosdisk", "iso9660", "part_gpt", "part_msdos", "normal", "configfile",
+		"linux", "search", "search_label", "all_video", "gfxterm", "font",
+	)
+	mkimageOutput := setCommandOutput(mkimageCmd, stateMachine.commonFlags.Debug)
+	if err := mkimageCmd.Run(); err != nil {
+		return fmt.Errorf("Error running command \"%s\". Error is \"%s\". Output is: \n%s",
+			mkimageCmd.String(), err.Error(), mkimageOutput.String())
+	}
+
+	if err := osRename(filepath.Join(stateMachine.tempDirs.chroot, chrootImg),
+		filepath.Join(biosDir, "eltorito.img")); err != nil {
+		return fmt.Errorf("Error moving BIOS boot image to the ISO: %s", err.Error())
+	}
+	return nil
+}
+
+// makeISO runs xorriso to create the ISO images. If a xorriso-command is given
+// for an iso artifact, its arguments are used instead of the generated ones,
+// with or without a leading xorriso. In both cases xorriso is run from the
+// root of the ISO tree
+func (stateMachine *StateMachine) makeISO() error {
+	classicStateMachine := stateMachine.parent.(*ClassicStateMachine)
+
+	isoDir := filepath.Join(stateMachine.tempDirs.scratch, "iso")
+	for _, iso := range *classicStateMachine.ImageDef.Artifacts.Iso {
+		var xorrisoArgs []string
+		if iso.Command != "" {
+			var err error
+			xorrisoArgs, err = shlex.Split(iso.Command)
+			if err != nil {
+				return fmt.Errorf("Error parsing xorriso-command \"%s\": %s", iso.Command, err.Error())
+			}
+			if len(xorrisoArgs) > 0 && filepath.Base(xorrisoArgs[0]) == "xorriso" {
+				xorrisoArgs = xorrisoArgs[1:]
+			}
+		} else {
+			xorrisoArgs = stateMachine.generateXorrisoArgs(iso, isoDir)
+		}
+
+		xorrisoCmd := execCommand("xorriso", xorrisoArgs...)
+		xorrisoCmd.Dir = isoDir
+		xorrisoOutput := setCommandOutput(xorrisoCmd, stateMachine.commonFlags.Debug)
+		if err := xorrisoCmd.Run(); err != nil {
+			return fmt.Errorf("Error creating iso artifact with command \"%s\". "+
+				"Error is \"%s\". Full output below:\n%s",
+				xorrisoCmd.String(), err.Error(), xorrisoOutput.String())
+		}
+	}
+	return nil
+}
+
+// generateXorrisoArgs generates the arguments to create a hybrid ISO bootable
+// on UEFI systems, and on BIOS systems if the El Torito BIOS image exists
+func (stateMachine *StateMachine) generateXorrisoArgs(iso imagedefinition.Iso, isoDir string) []string {
+	classicStateMachine := stateMachine.parent.(*ClassicStateMachine)
+
+	xorrisoArgs := []string{
+		"-as", "mkisofs",
+		"-r", "-J", "-joliet-long", "-l",
+		"-iso-level", "3",
+		"-V", isoVolumeID(classicStateMachine.ImageDef),
+		"-o", filepath.Join(stateMachine.commonFlags.OutputDir, iso.IsoName),
+	}
+
+	if osutil.FileExists(filepath.Join(isoDir, "boot", "grub", "i386-pc", "eltorito.img")) {
+		xorrisoArgs = append(xorrisoArgs,
+			"-b", "boot/grub/i386-pc/eltorito.img",
+			"-no-emul-boot",
+			"-boot-load-size", "4",
+			"-boot-info-table",
+			"--grub2-boot-info",
+			"--grub2-mbr", filepath.Join(stateMachine.tempDirs.chroot,
+				"usr", "lib", "grub", "i386-pc", "boot_hybrid.img"),
+		)
+	}
+
+	xorrisoArgs = append(xorrisoArgs,
+		"-eltorito-alt-boot",
+		"-e", "boot/grub/efi.img",
+		"-no-emul-boot",
+		"-isohybrid-gpt-basdat",
+		".",
+	)
+	return xorrisoArgs
+}
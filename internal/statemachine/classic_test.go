@@ -19,6 +19,7 @@ import (
 	"testing"
 
 	"github.com/pkg/xattr"
+	"github.com/snapcore/snapd/gadget"
 	"github.com/snapcore/snapd/image"
 	"github.com/snapcore/snapd/osutil"
 	"github.com/snapcore/snapd/seed"
@@ -26,6 +27,7 @@ import (
 	"github.com/xeipuuv/gojsonschema"
 	"gopkg.in/yaml.v2"
 
+	"github.com/canonical/ubuntu-image/internal/diskimage"
 	"github.com/canonical/ubuntu-image/internal/helper"
 	"github.com/canonical/ubuntu-image/internal/imagedefinition"
 )
@@ -65,6 +67,10 @@ func TestYAMLSchemaParsing(t *testing.T) {
 		{"invalid_ppa_auth", "test_bad_ppa_name.yaml", false, "Auth: Does not match pattern"},
 		{"both_seed_and_tasks", "test_both_seed_and_tasks.yaml", false, "Must validate one and only one schema"},
 		{"git_gadget_without_url", "test_git_gadget_without_url.yaml", false, "When key gadget:type is specified as git, a URL must be provided"},
+		{"git_gadget_auth", "test_git_gadget_auth.yaml", true, ""},
+		{"git_gadget_ssh_key_and_token", "test_git_gadget_bad_auth.yaml", false, "Must validate one and only one schema"},
+		{"apt", "test_apt.yaml", true, ""},
+		{"apt_missing_pin_priority", "test_apt_missing_pin_priority.yaml", false, "Key \"pin-priority\" is required in struct \"AptPreference\""},
 		{"file_doesnt_exist", "test_not_exist.yaml", false, "no such file or directory"},
 		{"not_valid_yaml", "test_invalid_yaml.yaml", false, "yaml: unmarshal errors"},
 		{"missing_yaml_fields", "test_missing_name.yaml", false, "Key \"name\" is required in struct \"ImageDefinition\", but is not in the YAML file!"},
@@ -76,6 +82,17 @@ func TestYAMLSchemaParsing(t *testing.T) {
 		{"invalid_paths_in_manual_touch_file", "test_invalid_paths_in_manual_touch_file.yaml", false, "needs to be an absolute path (../../malicious)"},
 		{"invalid_paths_in_manual_touch_file_bug", "test_invalid_paths_in_manual_touch_file.yaml", false, "needs to be an absolute path (/../../malicious)"},
 		{"img_specified_without_gadget", "test_image_without_gadget.yaml", false, "Key img cannot be used without key gadget:"},
+		{"installer_without_iso", "test_installer_without_iso.yaml", false, "Key class:installer cannot be used without key artifacts:iso:"},
+		{"installer_layers_without_seed", "test_installer_layers_without_seed.yaml", false, "Key customization:installer:layers cannot be used without key rootfs:seed:"},
+		{"sandboxed_execute", "test_sandboxed_execute.yaml", true, ""},
+		{"manual_customization_order", "test_manual_customization_order.yaml", true, ""},
+		{"add_user", "test_add_user.yaml", true, ""},
+		{"invalid_add_user_sudo", "test_bad_add_user_sudo.yaml", false, "Sudo: Does not match pattern"},
+		{"invalid_paths_in_manual_write_file", "test_invalid_paths_in_manual_write_file.yaml", false, "needs to be an absolute path (../../malicious)"},
+		{"invalid_paths_in_manual_write_file_bug", "test_invalid_paths_in_manual_write_file.yaml", false, "needs to be an absolute path (/../../malicious)"},
+		{"invalid_paths_in_manual_symlink", "test_invalid_paths_in_manual_write_file.yaml", false, "needs to be an absolute path (../../symlink)"},
+		{"invalid_execute_timeout", "test_bad_execute_timeout.yaml", false, "Timeout: Does not match pattern"},
+		{"invalid_execute_sandbox", "test_bad_execute_sandbox.yaml", false, "Sandbox must be one of the following"},
 	}
 	for _, tc := range testCases {
 		t.Run("test_yaml_schema_"+tc.name, func(t *testing.T) {
@@ -99,6 +116,76 @@ func TestYAMLSchemaParsing(t *testing.T) {
 	}
 }
 
+// TestManualCustomizationOrder ensures the order of the manual customizations
+// in the image definition is recorded and followed
+func TestManualCustomizationOrder(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	restoreCWD := helper.SaveCWD()
+	t.Cleanup(restoreCWD)
+
+	var stateMachine ClassicStateMachine
+	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+	stateMachine.parent = &stateMachine
+	stateMachine.Args.ImageDefinition = filepath.Join("testdata", "image_definitions",
+		"test_manual_customization_order.yaml")
+	err := stateMachine.parseImageDefinition()
+	asserter.AssertErrNil(err, true)
+
+	manual := stateMachine.ImageDef.Customization.Manual
+	expectedOrder := []string{"write-file", "copy-file", "symlink", "make-dirs",
+		"copy-tree", "chmod", "chown", "remove-path"}
+	asserter.AssertEqual(expectedOrder, manual.Order)
+	asserter.AssertEqual(uint32(0644), manual.WriteFile[0].Permissions)
+	asserter.AssertEqual(uint32(0600), manual.WriteFile[1].Permissions)
+
+	// a file written and then removed does not exist in the chroot, but it
+	// does when the same customizations are listed the other way around
+	helperBackupAndCopyResolvConf = func(string) error { return nil }
+	t.Cleanup(func() { helperBackupAndCopyResolvConf = helper.BackupAndCopyResolvConf })
+	stateMachine.tempDirs.chroot = t.TempDir()
+	stateMachine.ImageDef.Customization.Manual = &imagedefinition.Manual{
+		WriteFile:  []*imagedefinition.WriteFile{{Path: "/file", Content: "test", Permissions: 0644}},
+		RemovePath: []*imagedefinition.RemovePath{{Path: "/file"}},
+		Order:      []string{"write-file", "remove-path"},
+	}
+	err = stateMachine.manualCustomization()
+	asserter.AssertErrNil(err, true)
+	_, err = os.Stat(filepath.Join(stateMachine.tempDirs.chroot, "file"))
+	if !os.IsNotExist(err) {
+		t.Errorf("Expected /file to be removed")
+	}
+
+	stateMachine.ImageDef.Customization.Manual.Order = []string{"remove-path", "write-file"}
+	err = stateMachine.manualCustomization()
+	asserter.AssertErrContains(err, "Error removing")
+	err = os.WriteFile(filepath.Join(stateMachine.tempDirs.chroot, "file"), []byte("old"), 0644)
+	asserter.AssertErrNil(err, true)
+	err = stateMachine.manualCustomization()
+	asserter.AssertErrNil(err, true)
+	content, err := os.ReadFile(filepath.Join(stateMachine.tempDirs.chroot, "file"))
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual("test", string(content))
+}
+
+// TestQcow2Defaults ensures the defaults of the qcow2 artifacts are set
+// when parsing the image definition
+func TestQcow2Defaults(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	restoreCWD := helper.SaveCWD()
+	t.Cleanup(restoreCWD)
+
+	var stateMachine ClassicStateMachine
+	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+	stateMachine.parent = &stateMachine
+	stateMachine.Args.ImageDefinition = filepath.Join("testdata", "image_definitions", "test_qcow2.yaml")
+	err := stateMachine.parseImageDefinition()
+	asserter.AssertErrNil(err, true)
+
+	qcow2 := (*stateMachine.ImageDef.Artifacts.Qcow2)[0]
+	asserter.AssertEqual(helper.BoolPtr(true), qcow2.Compression)
+	asserter.AssertEqual("0.10", qcow2.Compat)
+}
+
 // TestFailedParseImageDefinition mocks function calls to test
 // failure cases in the parseImageDefinition state
 func TestFailedParseImageDefinition(t *testing.T) {
@@ -196,7 +283,12 @@ func TestClassicStateMachine_calculateStates(t *testing.T) {
 		{
 			name:            "build_rootfs_from_tasks",
 			imageDefinition: "test_rootfs_tasks.yaml",
-			expectedStates:  []string{"build_rootfs_from_tasks"},
+			expectedStates:  []string{"build_rootfs_from_tasks", "create_chroot", "install_packages"},
+		},
+		{
+			name:            "apt",
+			imageDefinition: "test_apt.yaml",
+			expectedStates:  []string{"build_rootfs_from_tasks", "create_chroot", "configure_apt", "install_packages", "clean_apt_config", "clean_rootfs"},
 		},
 		{
 			name:            "customization_states",
@@ -208,6 +300,26 @@ func TestClassicStateMachine_calculateStates(t *testing.T) {
 			imageDefinition: "test_qcow2.yaml",
 			expectedStates:  []string{"make_disk", "make_qcow2_image"},
 		},
+		{
+			name:            "installer_iso",
+			imageDefinition: "test_installer_iso.yaml",
+			expectedStates:  []string{"make_squashfs_layers", "stage_installer_preseeds", "prepare_iso_bootloader", "make_iso"},
+		},
+		{
+			name:            "report",
+			imageDefinition: "test_report.yaml",
+			expectedStates:  []string{"make_disk", "generate_manifest", "generate_sbom", "generate_report", "finish"},
+		},
+		{
+			name:            "changelog",
+			imageDefinition: "test_changelog.yaml",
+			expectedStates:  []string{"generate_manifest", "generate_changelog", "finish"},
+		},
+		{
+			name:            "signing",
+			imageDefinition: "test_signing.yaml",
+			expectedStates:  []string{"generate_manifest", "generate_report", "sign_artifacts", "finish"},
+		},
 	}
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
@@ -283,6 +395,51 @@ func TestFailedCalculateStates(t *testing.T) {
 	})
 }
 
+// TestCalculateStatesForeignArch ensures the qemu-user-static binary is
+// removed before populating the rootfs of foreign architecture images
+func TestCalculateStatesForeignArch(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+
+	var stateMachine ClassicStateMachine
+	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+	stateMachine.parent = &stateMachine
+	stateMachine.ImageDef = imagedefinition.ImageDefinition{
+		Architecture: foreignArchForTests(),
+		Rootfs: &imagedefinition.Rootfs{
+			ArchiveTasks: []string{"test"},
+		},
+		Artifacts: &imagedefinition.Artifact{},
+	}
+
+	err := stateMachine.calculateStates()
+	asserter.AssertErrNil(err, true)
+
+	removeIndex, populateIndex := -1, -1
+	for i, state := range stateMachine.states {
+		switch state.name {
+		case "remove_qemu_static":
+			removeIndex = i
+		case "populate_rootfs_contents":
+			populateIndex = i
+		}
+	}
+	if removeIndex == -1 || removeIndex > populateIndex {
+		t.Errorf("remove_qemu_static should run before populate_rootfs_contents in %v",
+			stateMachine.states)
+	}
+
+	// no emulator is used for native builds
+	stateMachine.states = []stateFunc{}
+	stateMachine.ImageDef.Architecture = getHostArch()
+	err = stateMachine.calculateStates()
+	asserter.AssertErrNil(err, true)
+	for _, state := range stateMachine.states {
+		if state.name == "remove_qemu_static" {
+			t.Errorf("state remove_qemu_static should not exist in %v", stateMachine.states)
+		}
+	}
+}
+
 // TestPrintStates ensures the states are printed to stdout when the --debug flag is set
 func TestPrintStates(t *testing.T) {
 	t.Run("test_print_states", func(t *testing.T) {
@@ -299,6 +456,9 @@ func TestPrintStates(t *testing.T) {
 		err := stateMachine.parseImageDefinition()
 		asserter.AssertErrNil(err, true)
 
+		// build natively so the printed states don't depend on the host
+		stateMachine.ImageDef.Architecture = getHostArch()
+
 		// capture stdout, calculate the states, and ensure they were printed
 		stdout, restoreStdout, err := helper.CaptureStd(&os.Stdout)
 		defer restoreStdout()
@@ -409,6 +569,69 @@ func TestFailedReadMetadataClassic(t *testing.T) {
 	})
 }
 
+// TestResumeClassic tests that a partial classic build is resumed with the
+// same context and states, and only with an unchanged image definition
+func TestResumeClassic(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	saveCWD := helper.SaveCWD()
+	defer saveCWD()
+
+	workDir := t.TempDir()
+	imageDefinition := filepath.Join(t.TempDir(), "image_definition.yaml")
+	err := osutil.CopyFile(filepath.Join("testdata", "image_definitions", "test_amd64.yaml"),
+		imageDefinition, 0)
+	asserter.AssertErrNil(err, true)
+
+	var partialStateMachine ClassicStateMachine
+	partialStateMachine.commonFlags, partialStateMachine.stateMachineFlags = helper.InitCommonOpts()
+	partialStateMachine.stateMachineFlags.WorkDir = workDir
+	partialStateMachine.stateMachineFlags.Thru = "make_temporary_directories"
+	partialStateMachine.Args.ImageDefinition = imageDefinition
+	partialStateMachine.Packages = []string{"ubuntu-server"}
+	partialStateMachine.RootfsVolName = "pc"
+	partialStateMachine.RootfsPartNum = 3
+
+	err = partialStateMachine.Setup()
+	asserter.AssertErrNil(err, true)
+	err = partialStateMachine.Run()
+	asserter.AssertErrNil(err, true)
+	err = partialStateMachine.Teardown()
+	asserter.AssertErrNil(err, true)
+
+	// resume without giving the image definition again
+	var stateMachine ClassicStateMachine
+	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+	stateMachine.stateMachineFlags.WorkDir = workDir
+	stateMachine.stateMachineFlags.Resume = true
+
+	err = stateMachine.Setup()
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual(partialStateMachine.ImageDef, stateMachine.ImageDef)
+	asserter.AssertEqual(partialStateMachine.Packages, stateMachine.Packages)
+	asserter.AssertEqual(imageDefinition, stateMachine.Args.ImageDefinition)
+	asserter.AssertEqual("pc", stateMachine.RootfsVolName)
+	asserter.AssertEqual(3, stateMachine.RootfsPartNum)
+	asserter.AssertEqual(partialStateMachine.stateNames(), stateMachine.stateNames())
+	asserter.AssertEqual(partialStateMachine.StatesTaken, stateMachine.StatesTaken)
+	asserter.AssertEqual(filepath.Join(workDir, "chroot"), stateMachine.tempDirs.chroot)
+	asserter.AssertEqual(filepath.Join(workDir, "scratch"), stateMachine.tempDirs.scratch)
+
+	// a changed image definition can not be resumed
+	imageDefinitionFile, err := os.OpenFile(imageDefinition, os.O_APPEND|os.O_WRONLY, 0644)
+	asserter.AssertErrNil(err, true)
+	_, err = imageDefinitionFile.WriteString("# changed\n")
+	asserter.AssertErrNil(err, true)
+	imageDefinitionFile.Close()
+
+	var changedStateMachine ClassicStateMachine
+	changedStateMachine.commonFlags, changedStateMachine.stateMachineFlags = helper.InitCommonOpts()
+	changedStateMachine.stateMachineFlags.WorkDir = workDir
+	changedStateMachine.stateMachineFlags.Resume = true
+
+	err = changedStateMachine.Setup()
+	asserter.AssertErrContains(err, "has changed since the partial build")
+}
+
 // TestPrepareGadgetTree runs prepareGadgetTree() and ensures the gadget_tree files
 // are placed in the correct locations
 func TestPrepareGadgetTree(t *testing.T) {
@@ -917,14 +1140,44 @@ func TestBuildRootfsFromTasks(t *testing.T) {
 
 		var stateMachine ClassicStateMachine
 		stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+		stateMachine.parent = &stateMachine
+		stateMachine.ImageDef = imagedefinition.ImageDefinition{
+			Rootfs: &imagedefinition.Rootfs{
+				ArchiveTasks: []string{"ubuntu-server-minimal", "ubuntu-server^"},
+			},
+		}
 
 		err := stateMachine.buildRootfsFromTasks()
 		asserter.AssertErrNil(err, true)
 
+		expectedPackages := []string{"ubuntu-server-minimal^", "ubuntu-server^"}
+		asserter.AssertEqual(expectedPackages, stateMachine.Packages)
+
 		os.RemoveAll(stateMachine.stateMachineFlags.WorkDir)
 	})
 }
 
+// TestFailedBuildRootfsFromTasks tests failures in the buildRootfsFromTasks function
+func TestFailedBuildRootfsFromTasks(t *testing.T) {
+	t.Run("test_failed_build_rootfs_from_tasks", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		saveCWD := helper.SaveCWD()
+		defer saveCWD()
+
+		var stateMachine ClassicStateMachine
+		stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+		stateMachine.parent = &stateMachine
+		stateMachine.ImageDef = imagedefinition.ImageDefinition{
+			Rootfs: &imagedefinition.Rootfs{
+				ArchiveTasks: []string{"ubuntu-server", "bad task; rm -rf"},
+			},
+		}
+
+		err := stateMachine.buildRootfsFromTasks()
+		asserter.AssertErrContains(err, "Invalid archive task name")
+	})
+}
+
 // TestExtractRootfsTar unit tests the extractRootfsTar function
 func TestExtractRootfsTar(t *testing.T) {
 	wd, _ := os.Getwd()
@@ -1013,6 +1266,7 @@ func TestExtractRootfsTar(t *testing.T) {
 				Rootfs: &imagedefinition.Rootfs{
 					Tarball: &imagedefinition.Tarball{
 						TarballURL: fmt.Sprintf("file://%s", tc.rootfsTar),
+						SHA256sum:  tc.SHA256sum,
 					},
 				},
 			}
@@ -4045,7 +4299,7 @@ func TestTarXattrs(t *testing.T) {
 
 		// now run the helper tar creation and extraction functions
 		tarPath := filepath.Join(testDir, "test-xattrs.tar")
-		err = helper.CreateTarArchive(testDir, tarPath, "uncompressed", false, false)
+		err = helper.CreateTarArchive(testDir, tarPath, "uncompressed", false, false, nil)
 		asserter.AssertErrNil(err, true)
 
 		err = helper.ExtractTarArchive(tarPath, extractDir, false, false)
@@ -4112,18 +4366,547 @@ func TestFailedMakeQcow2Img(t *testing.T) {
 			},
 		}
 
-		// Setup the exec.Command mock
-		testCaseName = "TestFailedMakeQcow2Image"
-		execCommand = fakeExecCommand
-		defer func() {
-			execCommand = exec.Command
-		}()
-
+		// the raw image to convert does not exist
 		err := stateMachine.makeQcow2Img()
 		asserter.AssertErrContains(err, "Error creating qcow2 artifact")
 	})
 }
 
+// TestMakeQcow2ImgOptions tests that the qcow2 options of the image
+// definition are used to convert the raw images
+func TestMakeQcow2ImgOptions(t *testing.T) {
+	testCases := []struct {
+		name         string
+		qcow2        imagedefinition.Qcow2
+		expectedOpts diskimage.Qcow2Options
+	}{
+		{
+			"defaults",
+			imagedefinition.Qcow2{Qcow2Name: "test.qcow2", Qcow2Volume: "pc"},
+			diskimage.Qcow2Options{Compress: true, Compat: "0.10"},
+		},
+		{
+			"uncompressed_compat_1.1",
+			imagedefinition.Qcow2{
+				Qcow2Name:   "test.qcow2",
+				Qcow2Volume: "pc",
+				Compression: helper.BoolPtr(false),
+				Compat:      "1.1",
+			},
+			diskimage.Qcow2Options{Compress: false, Compat: "1.1"},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run("test_make_qcow2_image_options_"+tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+
+			var stateMachine ClassicStateMachine
+			stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+			stateMachine.parent = &stateMachine
+			stateMachine.commonFlags.OutputDir = "/output"
+			stateMachine.VolumeNames = map[string]string{"pc": "pc.img"}
+			stateMachine.ImageDef = imagedefinition.ImageDefinition{
+				Artifacts: &imagedefinition.Artifact{
+					Qcow2: &[]imagedefinition.Qcow2{tc.qcow2},
+				},
+			}
+
+			var src, dest string
+			var opts diskimage.Qcow2Options
+			diskimageConvertToQcow2 = func(s, d string, o diskimage.Qcow2Options) error {
+				src, dest, opts = s, d, o
+				return nil
+			}
+			defer func() {
+				diskimageConvertToQcow2 = diskimage.ConvertToQcow2
+			}()
+
+			err := stateMachine.makeQcow2Img()
+			asserter.AssertErrNil(err, true)
+			asserter.AssertEqual("/output/pc.img", src)
+			asserter.AssertEqual("/output/test.qcow2", dest)
+			asserter.AssertEqual(tc.expectedOpts, opts)
+		})
+	}
+}
+
+// TestVerifyISOVolumes tests that the volumes of iso artifacts
+// are resolved and validated against the gadget
+func TestVerifyISOVolumes(t *testing.T) {
+	testCases := []struct {
+		name           string
+		volumes        map[string]*gadget.Volume
+		isoVolume      string
+		otherIsoVolume string
+		expectedVolume string
+		expectedError  string
+	}{
+		{
+			name:           "single_volume_default",
+			volumes:        map[string]*gadget.Volume{"pc": {}},
+			expectedVolume: "pc",
+		},
+		{
+			name:           "volume_specified",
+			volumes:        map[string]*gadget.Volume{"pc": {}, "other": {}},
+			isoVolume:      "other",
+			expectedVolume: "other",
+		},
+		{
+			name:          "multi_volume_without_name",
+			volumes:       map[string]*gadget.Volume{"pc": {}, "other": {}},
+			expectedError: "Volume names must be specified",
+		},
+		{
+			name:          "volume_does_not_exist",
+			volumes:       map[string]*gadget.Volume{"pc": {}},
+			isoVolume:     "fake",
+			expectedError: "does not exist in gadget.yaml",
+		},
+		{
+			name:           "same_volume",
+			volumes:        map[string]*gadget.Volume{"pc": {}, "other": {}},
+			isoVolume:      "other",
+			otherIsoVolume: "other",
+			expectedVolume: "other",
+		},
+		{
+			name:           "different_volumes",
+			volumes:        map[string]*gadget.Volume{"pc": {}, "other": {}},
+			isoVolume:      "pc",
+			otherIsoVolume: "other",
+			expectedError:  "use different volumes",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run("test_verify_iso_volumes_"+tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+
+			var stateMachine ClassicStateMachine
+			stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+			stateMachine.parent = &stateMachine
+			stateMachine.GadgetInfo = &gadget.Info{Volumes: tc.volumes}
+			stateMachine.ImageDef = imagedefinition.ImageDefinition{
+				Artifacts: &imagedefinition.Artifact{
+					Iso: &[]imagedefinition.Iso{
+						{
+							IsoName:   "test.iso",
+							IsoVolume: tc.isoVolume,
+						},
+					},
+				},
+			}
+			if tc.otherIsoVolume != "" {
+				*stateMachine.ImageDef.Artifacts.Iso = append(*stateMachine.ImageDef.Artifacts.Iso,
+					imagedefinition.Iso{IsoName: "other.iso", IsoVolume: tc.otherIsoVolume})
+			}
+
+			err := stateMachine.verifyISOVolumes()
+			if tc.expectedError != "" {
+				asserter.AssertErrContains(err, tc.expectedError)
+				return
+			}
+			asserter.AssertErrNil(err, true)
+			asserter.AssertEqual(tc.expectedVolume, (*stateMachine.ImageDef.Artifacts.Iso)[0].IsoVolume)
+		})
+	}
+}
+
+// TestStageInstallerPreseeds tests that preseed files are copied to the ISO tree
+func TestStageInstallerPreseeds(t *testing.T) {
+	t.Run("test_stage_installer_preseeds", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+
+		var stateMachine ClassicStateMachine
+		stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+		stateMachine.parent = &stateMachine
+		stateMachine.ConfDefPath = t.TempDir()
+		stateMachine.tempDirs.scratch = t.TempDir()
+		stateMachine.ImageDef = imagedefinition.ImageDefinition{
+			Customization: &imagedefinition.Customization{
+				Installer: &imagedefinition.Installer{
+					Preseeds: []string{"server.seed"},
+				},
+			},
+		}
+
+		err := os.WriteFile(filepath.Join(stateMachine.ConfDefPath, "server.seed"),
+			[]byte("d-i debian-installer/locale string en_US\n"), 0644)
+		asserter.AssertErrNil(err, true)
+
+		err = stateMachine.stageInstallerPreseeds()
+		asserter.AssertErrNil(err, true)
+
+		_, err = os.Stat(filepath.Join(stateMachine.tempDirs.scratch, "iso", "preseed", "server.seed"))
+		asserter.AssertErrNil(err, true)
+
+		// now a preseed that does not exist
+		stateMachine.ImageDef.Customization.Installer.Preseeds = []string{"fake.seed"}
+		err = stateMachine.stageInstallerPreseeds()
+		asserter.AssertErrContains(err, "Error copying preseed file")
+	})
+}
+
+// TestFailedMakeSquashfsLayers tests failures in the makeSquashfsLayers function
+func TestFailedMakeSquashfsLayers(t *testing.T) {
+	t.Run("test_failed_make_squashfs_layers", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+
+		var stateMachine ClassicStateMachine
+		stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+		stateMachine.parent = &stateMachine
+		stateMachine.tempDirs.scratch = t.TempDir()
+		stateMachine.tempDirs.chroot = t.TempDir()
+		stateMachine.stateMachineFlags.WorkDir = t.TempDir()
+		stateMachine.ImageDef = imagedefinition.ImageDefinition{
+			Customization: &imagedefinition.Customization{
+				Installer: &imagedefinition.Installer{
+					Layers: []string{"minimal", "standard"},
+				},
+			},
+		}
+
+		mockCmder := NewMockExecCommand()
+		execCommand = mockCmder.Command
+		t.Cleanup(func() { execCommand = exec.Command })
+
+		// layers that don't extend each other
+		err := stateMachine.makeSquashfsLayers()
+		asserter.AssertErrContains(err, "does not extend the previous layer")
+
+		// the germinate output for the layer is missing
+		stateMachine.ImageDef.Customization.Installer.Layers = []string{"minimal", "minimal.standard"}
+		err = stateMachine.makeSquashfsLayers()
+		asserter.AssertErrContains(err, "Error opening seed file")
+
+		// mksquashfs fails
+		testCaseName = "TestFailedMakeSquashfsLayers"
+		execCommand = fakeExecCommand
+		err = stateMachine.makeSquashfsLayers()
+		asserter.AssertErrContains(err, "Error running command")
+
+		// mock os.MkdirAll
+		osMkdirAll = mockMkdirAll
+		t.Cleanup(func() { osMkdirAll = os.MkdirAll })
+		err = stateMachine.makeSquashfsLayers()
+		asserter.AssertErrContains(err, "Error creating casper directory")
+	})
+}
+
+// TestBuildLayerQemuStatic tests that qemu-user-static is available while
+// the packages of the layers of foreign architecture images are installed,
+// and removed from the layers afterwards
+func TestBuildLayerQemuStatic(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+
+	var stateMachine ClassicStateMachine
+	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+	stateMachine.parent = &stateMachine
+	stateMachine.ImageDef = imagedefinition.ImageDefinition{
+		Architecture: foreignArchForTests(),
+	}
+	qemuStatic := getQemuStaticForArch(stateMachine.ImageDef.Architecture)
+
+	qemuStaticDir = t.TempDir()
+	binfmtMiscDir = t.TempDir()
+	t.Cleanup(func() {
+		qemuStaticDir = "/usr/bin"
+		binfmtMiscDir = "/proc/sys/fs/binfmt_misc"
+	})
+	err := os.WriteFile(filepath.Join(qemuStaticDir, qemuStatic), []byte("qemu"), 0755)
+	asserter.AssertErrNil(err, true)
+	err = os.WriteFile(filepath.Join(binfmtMiscDir, strings.TrimSuffix(qemuStatic, "-static")),
+		[]byte("enabled"), 0644)
+	asserter.AssertErrNil(err, true)
+
+	helperBackupAndCopyResolvConf = func(string) error { return nil }
+	helperRestoreResolvConf = func(string) error { return nil }
+	t.Cleanup(func() {
+		helperBackupAndCopyResolvConf = helper.BackupAndCopyResolvConf
+		helperRestoreResolvConf = helper.RestoreResolvConf
+	})
+
+	layerDir := t.TempDir()
+	qemuStaticPath := filepath.Join(layerDir, "merged", "usr", "bin", qemuStatic)
+	aptRuns := 0
+	mockCmder := NewMockExecCommand()
+	execCommand = func(name string, args ...string) *exec.Cmd {
+		if name == "chroot" && len(args) > 1 && args[1] == "apt" {
+			aptRuns++
+			if !osutil.FileExists(qemuStaticPath) {
+				t.Errorf("Expected %s to be in the layer when running apt", qemuStatic)
+			}
+		}
+		return mockCmder.Command(name, args...)
+	}
+	t.Cleanup(func() { execCommand = exec.Command })
+
+	err = stateMachine.buildLayer(layerDir, []string{t.TempDir()}, []string{"ubuntu-server"})
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual(2, aptRuns)
+	if osutil.FileExists(qemuStaticPath) {
+		t.Errorf("File \"%s\" should not exist, but does", qemuStaticPath)
+	}
+}
+
+// TestMakeISOBIOSImageQemuStatic tests that qemu-user-static is available
+// while grub-mkimage runs in the chroot of foreign architecture images, and
+// removed from the chroot afterwards
+func TestMakeISOBIOSImageQemuStatic(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+
+	var stateMachine ClassicStateMachine
+	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+	stateMachine.parent = &stateMachine
+	stateMachine.tempDirs.chroot = t.TempDir()
+	stateMachine.ImageDef = imagedefinition.ImageDefinition{
+		Architecture: foreignArchForTests(),
+	}
+	qemuStatic := getQemuStaticForArch(stateMachine.ImageDef.Architecture)
+	isoDir := t.TempDir()
+
+	qemuStaticDir = t.TempDir()
+	binfmtMiscDir = t.TempDir()
+	t.Cleanup(func() {
+		qemuStaticDir = "/usr/bin"
+		binfmtMiscDir = "/proc/sys/fs/binfmt_misc"
+	})
+	err := os.WriteFile(filepath.Join(qemuStaticDir, qemuStatic), []byte("qemu"), 0755)
+	asserter.AssertErrNil(err, true)
+	err = os.WriteFile(filepath.Join(binfmtMiscDir, strings.TrimSuffix(qemuStatic, "-static")),
+		[]byte("enabled"), 0644)
+	asserter.AssertErrNil(err, true)
+	for _, dir := range []string{"usr/lib/grub/i386-pc", "tmp"} {
+		err = os.MkdirAll(filepath.Join(stateMachine.tempDirs.chroot, dir), 0755)
+		asserter.AssertErrNil(err, true)
+	}
+
+	qemuStaticPath := filepath.Join(stateMachine.tempDirs.chroot, "usr", "bin", qemuStatic)
+	mockCmder := NewMockExecCommand()
+	execCommand = func(name string, args ...string) *exec.Cmd {
+		if name == "chroot" && len(args) > 1 && args[1] == "grub-mkimage" {
+			if !osutil.FileExists(qemuStaticPath) {
+				t.Errorf("Expected %s to be in the chroot when running grub-mkimage", qemuStatic)
+			}
+			err := os.WriteFile(filepath.Join(args[0], "tmp", "eltorito.img"), []byte("eltorito"), 0644)
+			asserter.AssertErrNil(err, true)
+		}
+		return mockCmder.Command(name, args...)
+	}
+	t.Cleanup(func() { execCommand = exec.Command })
+
+	err = stateMachine.makeISOBIOSImage(isoDir)
+	asserter.AssertErrNil(err, true)
+	_, err = os.Stat(filepath.Join(isoDir, "boot", "grub", "i386-pc", "eltorito.img"))
+	asserter.AssertErrNil(err, true)
+	if osutil.FileExists(qemuStaticPath) {
+		t.Errorf("File \"%s\" should not exist, but does", qemuStaticPath)
+	}
+}
+
+// TestMakeISOBIOSImageUEFIOnly tests that ISOs are only made bootable on
+// UEFI systems when the rootfs has no i386-pc grub modules
+func TestMakeISOBIOSImageUEFIOnly(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+
+	var stateMachine ClassicStateMachine
+	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+	stateMachine.parent = &stateMachine
+	stateMachine.tempDirs.chroot = t.TempDir()
+	isoDir := t.TempDir()
+
+	osStat = mockStat
+	t.Cleanup(func() { osStat = os.Stat })
+	testCaseName = "TestFailedMakeISOBIOSImage"
+	execCommand = fakeExecCommand
+	t.Cleanup(func() {
+		execCommand = exec.Command
+		testCaseName = ""
+	})
+
+	stdout, restoreStdout, err := helper.CaptureStd(&os.Stdout)
+	asserter.AssertErrNil(err, true)
+	t.Cleanup(func() { restoreStdout() })
+
+	err = stateMachine.makeISOBIOSImage(isoDir)
+	asserter.AssertErrNil(err, true)
+
+	restoreStdout()
+	readStdout, err := io.ReadAll(stdout)
+	asserter.AssertErrNil(err, true)
+	if !strings.Contains(string(readStdout), "the ISO will only be bootable on UEFI systems") {
+		t.Errorf("Expected a warning about the UEFI only ISO. Output is:\n%s", readStdout)
+	}
+	_, err = os.Stat(filepath.Join(isoDir, "boot", "grub", "i386-pc"))
+	if !os.IsNotExist(err) {
+		t.Errorf("Did not expect a BIOS boot image in the ISO")
+	}
+}
+
+// TestStateMachine_makeISO_checkcmds checks the xorriso commands used to create the ISO
+func TestStateMachine_makeISO_checkcmds(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+
+	var stateMachine ClassicStateMachine
+	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+	stateMachine.commonFlags.Debug = true
+	stateMachine.commonFlags.OutputDir = "/tmp"
+	stateMachine.parent = &stateMachine
+	stateMachine.tempDirs.scratch = t.TempDir()
+	stateMachine.ImageDef = imagedefinition.ImageDefinition{
+		DisplayName: "Ubuntu Server amd64 Installer Long Display Name",
+		Artifacts: &imagedefinition.Artifact{
+			Iso: &[]imagedefinition.Iso{
+				{
+					IsoName: "default.iso",
+				},
+				{
+					IsoName: "custom.iso",
+					Command: "-as mkisofs -V \"Custom Label\" -o /tmp/custom.iso .",
+				},
+				{
+					IsoName: "xorriso.iso",
+					Command: "xorriso -as mkisofs -o /tmp/xorriso.iso .",
+				},
+			},
+		},
+	}
+
+	err := os.MkdirAll(filepath.Join(stateMachine.tempDirs.scratch, "iso"), 0755)
+	asserter.AssertErrNil(err, true)
+
+	mockCmder := NewMockExecCommand()
+	execCommand = mockCmder.Command
+	t.Cleanup(func() { execCommand = exec.Command })
+
+	stdout, restoreStdout, err := helper.CaptureStd(&os.Stdout)
+	asserter.AssertErrNil(err, true)
+	t.Cleanup(func() { restoreStdout() })
+
+	err = stateMachine.makeISO()
+	asserter.AssertErrNil(err, true)
+
+	restoreStdout()
+	readStdout, err := io.ReadAll(stdout)
+	asserter.AssertErrNil(err, true)
+
+	expectedCmds := []*regexp.Regexp{
+		regexp.MustCompile("^xorriso -as mkisofs -r -J -joliet-long -l -iso-level 3 " +
+			"-V Ubuntu Server amd64 Installer Lo -o /tmp/default.iso " +
+			"-eltorito-alt-boot -e boot/grub/efi.img -no-emul-boot -isohybrid-gpt-basdat .$"),
+		regexp.MustCompile("^xorriso -as mkisofs -V Custom Label -o /tmp/custom.iso .$"),
+		regexp.MustCompile("^xorriso -as mkisofs -o /tmp/xorriso.iso .$"),
+	}
+
+	gotCmds := strings.Split(strings.TrimSpace(string(readStdout)), "\n")
+	if len(expectedCmds) != len(gotCmds) {
+		t.Fatalf("%v commands to be executed, expected %v", len(gotCmds), len(expectedCmds))
+	}
+
+	for i, gotCmd := range gotCmds {
+		expected := expectedCmds[i]
+
+		if !expected.Match([]byte(gotCmd)) {
+			t.Errorf("Cmd \"%v\" not matching. Expected %v\n", gotCmd, expected.String())
+		}
+	}
+}
+
+// TestFailedMakeISO tests failures in the makeISO function
+func TestFailedMakeISO(t *testing.T) {
+	t.Run("test_failed_make_iso", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+
+		var stateMachine ClassicStateMachine
+		stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+		stateMachine.parent = &stateMachine
+		stateMachine.tempDirs.scratch = t.TempDir()
+		stateMachine.ImageDef = imagedefinition.ImageDefinition{
+			Artifacts: &imagedefinition.Artifact{
+				Iso: &[]imagedefinition.Iso{
+					{
+						IsoName: "test.iso",
+						Command: "-as mkisofs \"unterminated",
+					},
+				},
+			},
+		}
+
+		err := os.MkdirAll(filepath.Join(stateMachine.tempDirs.scratch, "iso"), 0755)
+		asserter.AssertErrNil(err, true)
+
+		err = stateMachine.makeISO()
+		asserter.AssertErrContains(err, "Error parsing xorriso-command")
+
+		// now make xorriso fail
+		(*stateMachine.ImageDef.Artifacts.Iso)[0].Command = ""
+		testCaseName = "TestFailedMakeISO"
+		execCommand = fakeExecCommand
+		t.Cleanup(func() { execCommand = exec.Command })
+
+		err = stateMachine.makeISO()
+		asserter.AssertErrContains(err, "Error creating iso artifact")
+	})
+}
+
+// TestFailedPrepareISOBootloader tests failures in the prepareISOBootloader function
+func TestFailedPrepareISOBootloader(t *testing.T) {
+	t.Run("test_failed_prepare_iso_bootloader", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+
+		var stateMachine ClassicStateMachine
+		stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+		stateMachine.parent = &stateMachine
+		stateMachine.tempDirs.scratch = t.TempDir()
+		stateMachine.tempDirs.chroot = t.TempDir()
+		stateMachine.tempDirs.volumes = t.TempDir()
+		stateMachine.GadgetInfo = &gadget.Info{
+			Volumes: map[string]*gadget.Volume{
+				"pc": {
+					Bootloader: "u-boot",
+				},
+			},
+		}
+		stateMachine.ImageDef = imagedefinition.ImageDefinition{
+			Artifacts: &imagedefinition.Artifact{
+				Iso: &[]imagedefinition.Iso{
+					{
+						IsoName:   "test.iso",
+						IsoVolume: "pc",
+					},
+				},
+			},
+		}
+
+		// no kernel in the chroot
+		err := stateMachine.prepareISOBootloader()
+		asserter.AssertErrContains(err, "Error copying boot/vmlinuz to the ISO")
+
+		bootDir := filepath.Join(stateMachine.tempDirs.chroot, "boot")
+		err = os.MkdirAll(bootDir, 0755)
+		asserter.AssertErrNil(err, true)
+		for _, bootFile := range []string{"vmlinuz", "initrd.img"} {
+			err = os.WriteFile(filepath.Join(bootDir, bootFile), []byte("test"), 0644)
+			asserter.AssertErrNil(err, true)
+		}
+
+		// unsupported bootloader
+		err = stateMachine.prepareISOBootloader()
+		asserter.AssertErrContains(err, "is not supported for iso artifacts")
+
+		// no system-boot structure
+		stateMachine.GadgetInfo.Volumes["pc"].Bootloader = "grub"
+		err = stateMachine.prepareISOBootloader()
+		asserter.AssertErrContains(err, "No system-boot structure found")
+
+		// mock os.WriteFile
+		osWriteFile = mockWriteFile
+		t.Cleanup(func() { osWriteFile = os.WriteFile })
+		err = stateMachine.prepareISOBootloader()
+		asserter.AssertErrContains(err, "Error writing .disk/info")
+	})
+}
+
 // TestPreseedResetChroot tests that calling prepareClassicImage on a
 // preseeded chroot correctly resets the chroot and preseeds over it
 func TestPreseedResetChroot(t *testing.T) {
@@ -4238,8 +5021,8 @@ func TestFailedUpdateBootloader(t *testing.T) {
 
 		// first, test that updateBootloader fails when the rootfs partition
 		// has not been found in earlier steps
-		stateMachine.rootfsPartNum = -1
-		stateMachine.rootfsVolName = ""
+		stateMachine.RootfsPartNum = -1
+		stateMachine.RootfsVolName = ""
 		err = stateMachine.updateBootloader()
 		asserter.AssertErrContains(err, "Error: could not determine partition number of the root filesystem")
 
@@ -4263,8 +5046,8 @@ func TestFailedUpdateBootloader(t *testing.T) {
 
 		// prepare state in such a way that the rootfs partition was found in
 		// earlier steps
-		stateMachine.rootfsPartNum = 3
-		stateMachine.rootfsVolName = "pc"
+		stateMachine.RootfsPartNum = 3
+		stateMachine.RootfsVolName = "pc"
 
 		// parse gadget.yaml and run updateBootloader with the mocked os.Mkdir
 		err = stateMachine.prepareGadgetTree()
@@ -4331,8 +5114,8 @@ func TestUnsupportedBootloader(t *testing.T) {
 
 		// prepare state in such a way that the rootfs partition was found in
 		// earlier steps
-		stateMachine.rootfsPartNum = 3
-		stateMachine.rootfsVolName = "pc"
+		stateMachine.RootfsPartNum = 3
+		stateMachine.RootfsVolName = "pc"
 
 		// set the bootloader for the volume to "test"
 		stateMachine.GadgetInfo.Volumes["pc"].Bootloader = "test"
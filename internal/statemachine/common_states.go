@@ -372,11 +372,14 @@ func (stateMachine *StateMachine) makeDisk() error {
 
 		// set up the partitions on the device
 		partitionTable, rootfsPartitionNumber := createPartitionTable(volumeName, volume, uint64(stateMachine.SectorSize), stateMachine.IsSeeded)
+		if stateMachine.reproducible() {
+			stateMachine.setReproducibleGUIDs(volumeName, *partitionTable)
+		}
 
 		// Save the rootfs partition number, if found, for later use
 		if rootfsPartitionNumber != -1 {
-			stateMachine.rootfsVolName = volumeName
-			stateMachine.rootfsPartNum = rootfsPartitionNumber
+			stateMachine.RootfsVolName = volumeName
+			stateMachine.RootfsPartNum = rootfsPartitionNumber
 		}
 
 		// Write the partition table to disk
@@ -387,7 +390,11 @@ func (stateMachine *StateMachine) makeDisk() error {
 		// TODO: go-diskfs doesn't set the disk ID when using an MBR partition table.
 		// this function is a temporary workaround, but we should change upstream go-diskfs
 		if volume.Schema == "mbr" {
-			randomBytes, err := generateUniqueDiskID(&existingDiskIds)
+			readDiskID := randRead
+			if stateMachine.reproducible() {
+				readDiskID = stateMachine.reproducibleReader("mbr-disk-id", volumeName)
+			}
+			randomBytes, err := generateUniqueDiskID(&existingDiskIds, readDiskID)
 			if err != nil {
 				return fmt.Errorf("Error generating disk ID: %s", err.Error())
 			}
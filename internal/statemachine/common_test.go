@@ -842,8 +842,8 @@ func TestMakeDiskPartitionSchemes(t *testing.T) {
 		name          string
 		tableType     string
 		sectorSize    string
-		rootfsVolName string
-		rootfsPartNum int
+		RootfsVolName string
+		RootfsPartNum int
 	}{
 		{"gpt", "gpt", "512", "pc", 3},
 		{"mbr", "dos", "512", "pc", 3},
@@ -938,9 +938,9 @@ func TestMakeDiskPartitionSchemes(t *testing.T) {
 			}
 
 			// while at it, ensure that the root partition has been found
-			if stateMachine.rootfsPartNum != tc.rootfsPartNum || stateMachine.rootfsVolName != tc.rootfsVolName {
+			if stateMachine.RootfsPartNum != tc.RootfsPartNum || stateMachine.RootfsVolName != tc.RootfsVolName {
 				t.Errorf("Root partition volume/numbe not detected correctly, expected %s/%d, got %s/%d",
-					tc.rootfsVolName, tc.rootfsPartNum, stateMachine.rootfsVolName, stateMachine.rootfsPartNum)
+					tc.RootfsVolName, tc.RootfsPartNum, stateMachine.RootfsVolName, stateMachine.RootfsPartNum)
 			}
 		})
 	}
@@ -1,6 +1,7 @@
 package statemachine
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/binary"
 	"fmt"
@@ -10,8 +11,12 @@ import (
 	"os/exec"
 	"path/filepath"
 	"reflect"
+	"sort"
 	"strconv"
 	"strings"
+	"syscall"
+	"text/template"
+	"time"
 
 	"github.com/diskfs/go-diskfs/disk"
 	"github.com/diskfs/go-diskfs/partition"
@@ -19,11 +24,16 @@ import (
 	"github.com/diskfs/go-diskfs/partition/mbr"
 	"github.com/go-git/go-git/v5"
 	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
+	gitssh "github.com/go-git/go-git/v5/plumbing/transport/ssh"
 	"github.com/snapcore/snapd/gadget"
 	"github.com/snapcore/snapd/gadget/quantity"
+	"github.com/snapcore/snapd/osutil"
 	"github.com/snapcore/snapd/seed"
 	"github.com/snapcore/snapd/timings"
 
+	"github.com/canonical/ubuntu-image/internal/diskimage"
 	"github.com/canonical/ubuntu-image/internal/helper"
 	"github.com/canonical/ubuntu-image/internal/imagedefinition"
 )
@@ -38,6 +48,11 @@ func (stateMachine *StateMachine) validateInput() error {
 	if stateMachine.stateMachineFlags.WorkDir == "" && stateMachine.stateMachineFlags.Resume {
 		return fmt.Errorf("must specify workdir when using --resume flag")
 	}
+	if stateMachine.stateMachineFlags.DryRun &&
+		(stateMachine.stateMachineFlags.Until != "" || stateMachine.stateMachineFlags.Thru != "" ||
+			stateMachine.stateMachineFlags.Resume || stateMachine.commonFlags.VerifyReproducible) {
+		return fmt.Errorf("--dry-run can not be used with --until, --thru, --resume or --verify-reproducible")
+	}
 
 	logLevelFlags := []bool{stateMachine.commonFlags.Debug,
 		stateMachine.commonFlags.Verbose,
@@ -55,7 +70,11 @@ func (stateMachine *StateMachine) validateInput() error {
 		return fmt.Errorf("--quiet, --verbose, and --debug flags are mutually exclusive")
 	}
 
-	return nil
+	if stateMachine.commonFlags.ProgressFile != "" && stateMachine.commonFlags.ProgressFormat != "json" {
+		return fmt.Errorf("--progress-file can only be used with --progress-format=json")
+	}
+
+	return stateMachine.setupReproducibility()
 }
 
 func (stateMachine *StateMachine) setConfDefDir(confFileArg string) error {
@@ -191,12 +210,10 @@ func (stateMachine *StateMachine) copyStructureContent(volume *gadget.Volume,
 			// system-data and system-seed structures are not required to have
 			// an explicit size set in the yaml file
 			if structure.Size < stateMachine.RootfsSize {
-				if !stateMachine.commonFlags.Quiet {
-					fmt.Printf("WARNING: rootfs structure size %s smaller "+
-						"than actual rootfs contents %s\n",
-						structure.Size.IECString(),
-						stateMachine.RootfsSize.IECString())
-				}
+				stateMachine.warn("rootfs structure size %s smaller "+
+					"than actual rootfs contents %s",
+					structure.Size.IECString(),
+					stateMachine.RootfsSize.IECString())
 				blockSize = stateMachine.RootfsSize
 				structure.Size = stateMachine.RootfsSize
 				volume.Structure[structureNumber] = structure
@@ -232,14 +249,14 @@ func (stateMachine *StateMachine) copyStructureContent(volume *gadget.Volume,
 		}
 		// use mkfs functions from snapd to create the filesystems
 		if structure.Content != nil || len(contentFiles) > 0 {
-			err := mkfsMakeWithContent(structure.Filesystem, partImg, structure.Label,
-				contentRoot, structure.Size, stateMachine.SectorSize)
+			err := stateMachine.makeFilesystem(structure.Filesystem, partImg, structure.Label,
+				contentRoot, structure.Size, volume.Name, strconv.Itoa(structureNumber))
 			if err != nil {
 				return fmt.Errorf("Error running mkfs with content: %s", err.Error())
 			}
 		} else {
-			err := mkfsMake(structure.Filesystem, partImg, structure.Label,
-				structure.Size, stateMachine.SectorSize)
+			err := stateMachine.makeFilesystem(structure.Filesystem, partImg, structure.Label,
+				"", structure.Size, volume.Name, strconv.Itoa(structureNumber))
 			if err != nil {
 				return fmt.Errorf("Error running mkfs: %s", err.Error())
 			}
@@ -342,6 +359,104 @@ func getQemuStaticForArch(arch string) string {
 	return ""
 }
 
+// isForeignArch checks whether binaries built for arch can not be
+// run natively on the host
+func isForeignArch(arch string) bool {
+	hostArch := getHostArch()
+	return arch != "" && hostArch != "" && arch != hostArch
+}
+
+// foreignQemuStatic returns the name of the qemu-user-static binary needed to run
+// the binaries of a classic image in a chroot. An empty string is returned if
+// the image is built for the architecture of the host
+func (stateMachine *StateMachine) foreignQemuStatic() (string, error) {
+	classicStateMachine, ok := stateMachine.parent.(*ClassicStateMachine)
+	if !ok || !isForeignArch(classicStateMachine.ImageDef.Architecture) {
+		return "", nil
+	}
+	qemuStatic := getQemuStaticForArch(classicStateMachine.ImageDef.Architecture)
+	if qemuStatic == "" {
+		return "", fmt.Errorf("Building images for architecture %s is not supported on %s hosts",
+			classicStateMachine.ImageDef.Architecture, getHostArch())
+	}
+	return qemuStatic, nil
+}
+
+// enableBinfmt makes sure the binfmt_misc handler for the qemu-user-static
+// binary is registered, so binaries of the foreign architecture are
+// transparently run through the emulator
+func (stateMachine *StateMachine) enableBinfmt(qemuStatic string) error {
+	binfmtName := strings.TrimSuffix(qemuStatic, "-static")
+	if osutil.FileExists(filepath.Join(binfmtMiscDir, binfmtName)) {
+		return nil
+	}
+	updateBinfmtsCmd := execCommand("update-binfmts", "--enable", binfmtName)
+	updateBinfmtsOutput := setCommandOutput(updateBinfmtsCmd, stateMachine.commonFlags.Debug)
+	if err := updateBinfmtsCmd.Run(); err != nil {
+		return fmt.Errorf("Error enabling binfmt handler with command \"%s\". "+
+			"Error is \"%s\". Output is: \n%s",
+			updateBinfmtsCmd.String(), err.Error(), updateBinfmtsOutput.String())
+	}
+	return nil
+}
+
+// copyQemuStatic copies the qemu-user-static binary of the host into targetDir
+// when building a foreign architecture image, so commands can be run in it
+// with chroot. Nothing is done if the binary is already present
+func (stateMachine *StateMachine) copyQemuStatic(targetDir string) error {
+	qemuStatic, err := stateMachine.foreignQemuStatic()
+	if err != nil || qemuStatic == "" {
+		return err
+	}
+
+	dest := filepath.Join(targetDir, "usr", "bin", qemuStatic)
+	if osutil.FileExists(dest) {
+		return nil
+	}
+
+	src := qemuStaticSource(qemuStatic)
+	if !osutil.FileExists(src) {
+		return fmt.Errorf("%s does not exist. Install qemu-user-static to build images "+
+			"for foreign architectures", src)
+	}
+
+	if err := stateMachine.enableBinfmt(qemuStatic); err != nil {
+		return err
+	}
+
+	if err := osMkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return fmt.Errorf("Error creating %s: %s", filepath.Dir(dest), err.Error())
+	}
+	if err := osutilCopyFile(src, dest, osutil.CopyFlagPreserveAll); err != nil {
+		return fmt.Errorf("Error copying %s to %s: %s", src, dest, err.Error())
+	}
+	return nil
+}
+
+// qemuStaticSource returns the path of the qemu-user-static binary on the host,
+// which can be overridden with the UBUNTU_IMAGE_QEMU_USER_STATIC_PATH variable
+func qemuStaticSource(qemuStatic string) string {
+	if qemuStaticPath := os.Getenv("UBUNTU_IMAGE_QEMU_USER_STATIC_PATH"); qemuStaticPath != "" {
+		return qemuStaticPath
+	}
+	return filepath.Join(qemuStaticDir, qemuStatic)
+}
+
+// deleteQemuStatic removes the qemu-user-static binary copied by copyQemuStatic
+// from targetDir, so it does not end up in the resulting image
+func (stateMachine *StateMachine) deleteQemuStatic(targetDir string) error {
+	qemuStatic, err := stateMachine.foreignQemuStatic()
+	if err != nil || qemuStatic == "" {
+		return err
+	}
+
+	qemuStaticPath := filepath.Join(targetDir, "usr", "bin", qemuStatic)
+	if err := osRemove(qemuStaticPath); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Error removing %s: %s", qemuStaticPath, err.Error())
+	}
+	return nil
+}
+
 // maxOffset returns the maximum of two quantity.Offset types
 func maxOffset(offset1, offset2 quantity.Offset) quantity.Offset {
 	if offset1 > offset2 {
@@ -497,14 +612,14 @@ func writeOffsetValues(volume *gadget.Volume, imgName string, sectorSize, imgSiz
 	return nil
 }
 
-// generateUniqueDiskID returns a random 4-byte long disk ID, unique per the list of existing IDs
-func generateUniqueDiskID(existing *[][]byte) ([]byte, error) {
+// generateUniqueDiskID returns a 4-byte long disk ID read from readBytes, unique per the list of existing IDs
+func generateUniqueDiskID(existing *[][]byte, readBytes func([]byte) (int, error)) ([]byte, error) {
 	var retry bool
 	randomBytes := make([]byte, 4)
 	// we'll try 10 times, not to loop into infinity in case the RNG is broken (no entropy?)
 	for i := 0; i < 10; i++ {
 		retry = false
-		_, err := randRead(randomBytes)
+		_, err := readBytes(randomBytes)
 		if err != nil {
 			retry = true
 			continue
@@ -586,25 +701,121 @@ func generateGerminateCmd(imageDefinition imagedefinition.ImageDefinition) *exec
 }
 
 // cloneGitRepo takes options from the image definition and clones the git
-// repo with the corresponding options
-func cloneGitRepo(imageDefinition imagedefinition.ImageDefinition, workDir string) error {
-	// clone the repo
+// repo with the corresponding options. The paths of the authentication files
+// are relative to confDefPath. It returns the SHA of the commit checked out
+func cloneGitRepo(imageDefinition imagedefinition.ImageDefinition, confDefPath string, workDir string) (string, error) {
+	gadgetDef := imageDefinition.Gadget
+	auth, err := gitAuth(gadgetDef.Auth, confDefPath)
+	if err != nil {
+		return "", err
+	}
+
+	// clone the repo. Only the tip of the branch is needed unless a
+	// specific ref has to be checked out. go-git expects the default branch
+	// to be named master when cloning a single branch without naming it
 	cloneOptions := &git.CloneOptions{
-		URL:          imageDefinition.Gadget.GadgetURL,
-		SingleBranch: true,
-		Depth:        1,
+		URL:  gadgetDef.GadgetURL,
+		Auth: auth,
+	}
+	if gadgetDef.GadgetBranch != "" {
+		cloneOptions.ReferenceName = plumbing.NewBranchReferenceName(gadgetDef.GadgetBranch)
+		cloneOptions.SingleBranch = true
 	}
-	if imageDefinition.Gadget.GadgetBranch != "" {
-		cloneOptions.ReferenceName = plumbing.NewBranchReferenceName(imageDefinition.Gadget.GadgetBranch)
+	if gadgetDef.Ref == "" {
+		cloneOptions.Depth = 1
 	}
 
-	err := cloneOptions.Validate()
+	err = cloneOptions.Validate()
 	if err != nil {
-		return err
+		return "", err
+	}
+
+	repo, err := git.PlainClone(workDir, false, cloneOptions)
+	if err != nil {
+		return "", err
+	}
+	worktree, err := repo.Worktree()
+	if err != nil {
+		return "", err
+	}
+
+	if gadgetDef.Ref != "" {
+		hash, err := repo.ResolveRevision(plumbing.Revision(gadgetDef.Ref))
+		if err != nil {
+			return "", fmt.Errorf("Error resolving ref \"%s\": %s", gadgetDef.Ref, err.Error())
+		}
+		err = worktree.Checkout(&git.CheckoutOptions{Hash: *hash, Force: true})
+		if err != nil {
+			return "", fmt.Errorf("Error checking out ref \"%s\": %s", gadgetDef.Ref, err.Error())
+		}
 	}
 
-	_, err = git.PlainClone(workDir, false, cloneOptions)
-	return err
+	// the submodules are updated after the checkout so they match the ref
+	if gadgetDef.Submodules {
+		submodules, err := worktree.Submodules()
+		if err != nil {
+			return "", fmt.Errorf("Error reading submodules: %s", err.Error())
+		}
+		err = submodules.Update(&git.SubmoduleUpdateOptions{
+			Init:              true,
+			RecurseSubmodules: git.DefaultSubmoduleRecursionDepth,
+			Auth:              auth,
+		})
+		if err != nil {
+			return "", fmt.Errorf("Error updating submodules: %s", err.Error())
+		}
+	}
+
+	head, err := repo.Head()
+	if err != nil {
+		return "", err
+	}
+	return head.Hash().String(), nil
+}
+
+// gitAuth returns the authentication method of a private gadget repository,
+// reading the SSH key or the token from local files
+func gitAuth(authDef *imagedefinition.GadgetAuth, confDefPath string) (transport.AuthMethod, error) {
+	if authDef == nil {
+		return nil, nil
+	}
+	localPath := func(path string) string {
+		if filepath.IsAbs(path) {
+			return path
+		}
+		return filepath.Join(confDefPath, path)
+	}
+
+	if authDef.SSHKey != "" {
+		var passphrase string
+		if authDef.PassphraseFile != "" {
+			passphraseBytes, err := osReadFile(localPath(authDef.PassphraseFile))
+			if err != nil {
+				return nil, fmt.Errorf("Error reading SSH key passphrase: %s", err.Error())
+			}
+			passphrase = strings.TrimSpace(string(passphraseBytes))
+		}
+		username := authDef.Username
+		if username == "" {
+			username = gitssh.DefaultUsername
+		}
+		auth, err := gitssh.NewPublicKeysFromFile(username, localPath(authDef.SSHKey), passphrase)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading SSH key: %s", err.Error())
+		}
+		return auth, nil
+	}
+
+	token, err := osReadFile(localPath(authDef.TokenFile))
+	if err != nil {
+		return nil, fmt.Errorf("Error reading token: %s", err.Error())
+	}
+	// most git hosts accept any username along with a token
+	username := authDef.Username
+	if username == "" {
+		username = "git"
+	}
+	return &githttp.BasicAuth{Username: username, Password: strings.TrimSpace(string(token))}, nil
 }
 
 // generateDebootstrapCmd generates the debootstrap command used to create a chroot
@@ -616,6 +827,12 @@ func generateDebootstrapCmd(imageDefinition imagedefinition.ImageDefinition, tar
 		"--variant=minbase",
 	)
 
+	// binaries of foreign architectures can not be run during the first
+	// stage, so the second stage is run separately with qemu-user-static
+	if isForeignArch(imageDefinition.Architecture) {
+		debootstrapCmd.Args = append(debootstrapCmd.Args, "--foreign")
+	}
+
 	if imageDefinition.Customization != nil && len(imageDefinition.Customization.ExtraPPAs) > 0 {
 		// ca-certificates is needed to use PPAs
 		debootstrapCmd.Args = append(debootstrapCmd.Args, "--include=ca-certificates")
@@ -633,13 +850,32 @@ func generateDebootstrapCmd(imageDefinition imagedefinition.ImageDefinition, tar
 		imageDefinition.Rootfs.Mirror,
 	}...)
 
+	// debootstrap does not use apt to download packages, but honors the
+	// proxy variables of the environment
+	if imageDefinition.Rootfs.Apt != nil && imageDefinition.Rootfs.Apt.Proxy != "" {
+		if debootstrapCmd.Env == nil {
+			debootstrapCmd.Env = os.Environ()
+		}
+		debootstrapCmd.Env = append(debootstrapCmd.Env,
+			"http_proxy="+imageDefinition.Rootfs.Apt.Proxy,
+			"https_proxy="+imageDefinition.Rootfs.Apt.Proxy,
+		)
+	}
+
 	return debootstrapCmd
 }
 
 // generateAptCmd generates the apt command used to create a chroot
-// environment that will eventually become the rootfs of the resulting image
-func generateAptCmds(targetDir string, packageList []string) []*exec.Cmd {
+// environment that will eventually become the rootfs of the resulting image.
+// aptOptions are NAME=VALUE options given to every apt command
+func generateAptCmds(targetDir string, packageList []string, aptOptions []string) []*exec.Cmd {
+	var optionArgs []string
+	for _, aptOption := range aptOptions {
+		optionArgs = append(optionArgs, "--option="+aptOption)
+	}
+
 	updateCmd := execCommand("chroot", targetDir, "apt", "update")
+	updateCmd.Args = append(updateCmd.Args, optionArgs...)
 
 	installCmd := execCommand("chroot", targetDir, "apt", "install",
 		"--assume-yes",
@@ -648,6 +884,7 @@ func generateAptCmds(targetDir string, packageList []string) []*exec.Cmd {
 		"--option=Dpkg::Options::=--force-confold",
 	)
 
+	installCmd.Args = append(installCmd.Args, optionArgs...)
 	installCmd.Args = append(installCmd.Args, packageList...)
 
 	// Env is sometimes used for mocking command calls in tests,
@@ -697,8 +934,10 @@ func createPPAInfo(ppa *imagedefinition.PPA, series string) (fileName string, fi
 // importPPAKeys imports keys for ppas with specified fingerprints.
 // The schema parsing has already validated that either Fingerprint is
 // specified or the PPA is public. If no fingerprint is provided, this
-// function reaches out to the Launchpad API to get the signing key
-func importPPAKeys(ppa *imagedefinition.PPA, tmpGPGDir, keyFilePath string, debug bool) error {
+// function reaches out to the Launchpad API to get the signing key.
+// If localKeyFile is given, the key is imported from it rather than
+// from the keyserver
+func importPPAKeys(ppa *imagedefinition.PPA, tmpGPGDir, keyFilePath, localKeyFile string, debug bool) error {
 	if ppa.Fingerprint == "" {
 		// The YAML schema has already validated that if no fingerprint is
 		// provided, then this is a public PPA. We will get the fingerprint
@@ -738,10 +977,12 @@ func importPPAKeys(ppa *imagedefinition.PPA, tmpGPGDir, keyFilePath string, debu
 		tmpGPGDir,
 		"--secret-keyring",
 		filepath.Join(tmpGPGDir, "tempring.gpg"),
-		"--keyserver",
-		"hkp://keyserver.ubuntu.com:80",
 	}
-	recvKeyArgs := append(commonGPGArgs, []string{"--recv-keys", ppa.Fingerprint}...)
+	recvKeyArgs := append(commonGPGArgs, []string{"--keyserver", "hkp://keyserver.ubuntu.com:80",
+		"--recv-keys", ppa.Fingerprint}...)
+	if localKeyFile != "" {
+		recvKeyArgs = append(commonGPGArgs, []string{"--import", localKeyFile}...)
+	}
 	exportKeyArgs := append(commonGPGArgs, []string{"--output", keyFilePath, "--export", ppa.Fingerprint}...)
 	gpgCmds := []*exec.Cmd{
 		execCommand(
@@ -755,7 +996,7 @@ func importPPAKeys(ppa *imagedefinition.PPA, tmpGPGDir, keyFilePath string, debu
 	}
 
 	for _, gpgCmd := range gpgCmds {
-		gpgOutput := helper.SetCommandOutput(gpgCmd, debug)
+		gpgOutput := setCommandOutput(gpgCmd, debug)
 		err := gpgCmd.Run()
 		if err != nil {
 			return fmt.Errorf("Error running gpg command \"%s\". Error is \"%s\". Full output below:\n%s",
@@ -795,12 +1036,15 @@ func manualMakeDirs(customizations []*imagedefinition.MakeDirs, targetDir string
 	for _, c := range customizations {
 		path := filepath.Join(targetDir, c.Path)
 		if debug {
-			fmt.Printf("Creating directory \"%s\"\n", path)
+			printDebug("Creating directory \"%s\"\n", path)
 		}
 		if err := osMkdirAll(path, fs.FileMode(c.Permissions)); err != nil {
 			return fmt.Errorf("Error creating directory \"%s\" into chroot: %s",
 				path, err.Error())
 		}
+		if err := chownInChroot(targetDir, c.Path, c.Owner, false, debug); err != nil {
+			return err
+		}
 	}
 	return nil
 }
@@ -809,14 +1053,238 @@ func manualMakeDirs(customizations []*imagedefinition.MakeDirs, targetDir string
 func manualCopyFile(customizations []*imagedefinition.CopyFile, confDefPath string, targetDir string, debug bool) error {
 	for _, c := range customizations {
 		source := filepath.Join(confDefPath, c.Source)
-		dest := filepath.Join(targetDir, c.Dest)
+		dest, err := resolveInChroot(targetDir, c.Dest)
+		if err != nil {
+			return err
+		}
 		if debug {
-			fmt.Printf("Copying file \"%s\" to \"%s\"\n", source, dest)
+			printDebug("Copying file \"%s\" to \"%s\"\n", source, dest)
 		}
 		if err := osutilCopySpecialFile(source, dest); err != nil {
 			return fmt.Errorf("Error copying file \"%s\" into chroot: %s",
 				source, err.Error())
 		}
+		if c.Permissions != 0 {
+			if err := osChmod(dest, fs.FileMode(c.Permissions)); err != nil {
+				return fmt.Errorf("Error changing permissions of \"%s\": %s",
+					dest, err.Error())
+			}
+		}
+		if err := chownInChroot(targetDir, c.Dest, c.Owner, false, debug); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// manualCopyTree copies the contents of a directory into the chroot
+func manualCopyTree(customizations []*imagedefinition.CopyTree, confDefPath string, targetDir string, debug bool) error {
+	for _, c := range customizations {
+		source := filepath.Join(confDefPath, c.Source)
+		dest, err := resolveInChroot(targetDir, c.Dest)
+		if err != nil {
+			return err
+		}
+		if debug {
+			printDebug("Copying directory \"%s\" to \"%s\"\n", source, dest)
+		}
+		entries, err := osReadDir(source)
+		if err != nil {
+			return fmt.Errorf("Error reading directory \"%s\": %s", source, err.Error())
+		}
+		if err := osMkdirAll(dest, 0755); err != nil {
+			return fmt.Errorf("Error creating directory \"%s\" into chroot: %s",
+				dest, err.Error())
+		}
+		for _, entry := range entries {
+			if err := osutilCopySpecialFile(filepath.Join(source, entry.Name()), dest); err != nil {
+				return fmt.Errorf("Error copying directory \"%s\" into chroot: %s",
+					source, err.Error())
+			}
+		}
+		if err := chownInChroot(targetDir, c.Dest, c.Owner, true, debug); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// manualWriteFile writes files with inline content in the chroot. Templates
+// are rendered with the image definition, so they can refer to fields such
+// as {{.Series}} or {{.Architecture}}
+func manualWriteFile(customizations []*imagedefinition.WriteFile, imageDef imagedefinition.ImageDefinition, targetDir string, debug bool) error {
+	for _, c := range customizations {
+		path, err := resolveInChroot(targetDir, c.Path)
+		if err != nil {
+			return err
+		}
+		if debug {
+			printDebug("Writing file \"%s\"\n", path)
+		}
+		content := []byte(c.Content)
+		if c.Template {
+			tmpl, err := template.New(c.Path).Option("missingkey=error").Parse(c.Content)
+			if err != nil {
+				return fmt.Errorf("Error parsing template of file \"%s\": %s", c.Path, err.Error())
+			}
+			var rendered bytes.Buffer
+			if err := tmpl.Execute(&rendered, imageDef); err != nil {
+				return fmt.Errorf("Error rendering template of file \"%s\": %s", c.Path, err.Error())
+			}
+			content = rendered.Bytes()
+		}
+		if err := osWriteFile(path, content, fs.FileMode(c.Permissions)); err != nil {
+			return fmt.Errorf("Error writing file \"%s\" into chroot: %s", path, err.Error())
+		}
+		// the permissions given to WriteFile are only used for new files
+		// and are subject to the umask
+		if err := osChmod(path, fs.FileMode(c.Permissions)); err != nil {
+			return fmt.Errorf("Error changing permissions of \"%s\": %s", path, err.Error())
+		}
+		if err := chownInChroot(targetDir, c.Path, c.Owner, false, debug); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// manualSymlink creates symbolic links in the chroot, replacing any file
+// already at the path of the link
+func manualSymlink(customizations []*imagedefinition.Symlink, targetDir string, debug bool) error {
+	for _, c := range customizations {
+		path := filepath.Join(targetDir, c.Path)
+		if debug {
+			printDebug("Creating symbolic link \"%s\" to \"%s\"\n", path, c.Target)
+		}
+		if info, err := osLstat(path); err == nil && !info.IsDir() {
+			if err := osRemove(path); err != nil {
+				return fmt.Errorf("Error removing \"%s\": %s", path, err.Error())
+			}
+		}
+		if err := osSymlink(c.Target, path); err != nil {
+			return fmt.Errorf("Error creating symbolic link \"%s\" in chroot: %s", path, err.Error())
+		}
+	}
+	return nil
+}
+
+// manualChmod changes the permissions of paths in the chroot
+func manualChmod(customizations []*imagedefinition.Chmod, targetDir string, debug bool) error {
+	for _, c := range customizations {
+		path, err := resolveInChroot(targetDir, c.Path)
+		if err != nil {
+			return err
+		}
+		if debug {
+			printDebug("Changing permissions of \"%s\" to %#o\n", path, c.Permissions)
+		}
+		if err := osChmod(path, fs.FileMode(c.Permissions)); err != nil {
+			return fmt.Errorf("Error changing permissions of \"%s\": %s", path, err.Error())
+		}
+	}
+	return nil
+}
+
+// manualChown changes the owner of paths in the chroot
+func manualChown(customizations []*imagedefinition.Chown, targetDir string, debug bool) error {
+	for _, c := range customizations {
+		if err := chownInChroot(targetDir, c.Path, c.Owner, c.Recursive, debug); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// chownInChroot changes the owner of a path with the chown of the chroot,
+// so that user and group names are resolved with the databases of the
+// image rather than the ones of the host. Nothing is done if owner is empty
+func chownInChroot(targetDir string, path string, owner string, recursive bool, debug bool) error {
+	if owner == "" {
+		return nil
+	}
+	if debug {
+		printDebug("Changing owner of \"%s\" to \"%s\"\n", path, owner)
+	}
+	chownCmd := execCommand("chroot", targetDir, "chown")
+	if recursive {
+		chownCmd.Args = append(chownCmd.Args, "--recursive")
+	}
+	chownCmd.Args = append(chownCmd.Args, "--no-dereference", owner, path)
+	chownOutput := setCommandOutput(chownCmd, debug)
+	if err := chownCmd.Run(); err != nil {
+		return fmt.Errorf("Error changing owner of \"%s\". Command used is \"%s\". Error is %s. Full output below:\n%s",
+			path, chownCmd.String(), err.Error(), chownOutput.String())
+	}
+	return nil
+}
+
+// maxSymlinks is the number of symbolic links followed when resolving a path,
+// the same limit as the one of Linux
+const maxSymlinks = 40
+
+// resolveInChroot returns the path on the host of the given path of the
+// chroot, following symbolic links the way they are followed in the chroot.
+// Absolute links are resolved relative to targetDir and ".." stops at the
+// root of the chroot, so that writing to the returned path can not change a
+// file of the host through links such as /etc/localtime
+func resolveInChroot(targetDir string, path string) (string, error) {
+	resolved := "/"
+	components := strings.Split(path, "/")
+	links := 0
+	for len(components) > 0 {
+		component := components[0]
+		components = components[1:]
+		switch component {
+		case "", ".":
+			continue
+		case "..":
+			resolved = filepath.Dir(resolved)
+			continue
+		}
+		next := filepath.Join(resolved, component)
+		info, err := osLstat(filepath.Join(targetDir, next))
+		if os.IsNotExist(err) {
+			// there is no link to follow in a path that does not exist yet
+			resolved = filepath.Join(append([]string{next}, components...)...)
+			break
+		}
+		if err != nil {
+			return "", fmt.Errorf("Error resolving \"%s\" in chroot: %s", path, err.Error())
+		}
+		if info.Mode()&fs.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+		links++
+		if links > maxSymlinks {
+			return "", fmt.Errorf("Error resolving \"%s\" in chroot: too many levels of symbolic links", path)
+		}
+		target, err := osReadlink(filepath.Join(targetDir, next))
+		if err != nil {
+			return "", fmt.Errorf("Error resolving \"%s\" in chroot: %s", path, err.Error())
+		}
+		if filepath.IsAbs(target) {
+			resolved = "/"
+		}
+		components = append(strings.Split(target, "/"), components...)
+	}
+	return filepath.Join(targetDir, resolved), nil
+}
+
+// manualRemovePath removes paths from the chroot
+func manualRemovePath(customizations []*imagedefinition.RemovePath, targetDir string, debug bool) error {
+	for _, c := range customizations {
+		path := filepath.Join(targetDir, c.Path)
+		if debug {
+			printDebug("Removing \"%s\"\n", path)
+		}
+		remove := osRemove
+		if c.Recursive {
+			remove = osRemoveAll
+		}
+		if err := remove(path); err != nil {
+			return fmt.Errorf("Error removing \"%s\" from chroot: %s", path, err.Error())
+		}
 	}
 	return nil
 }
@@ -824,12 +1292,23 @@ func manualCopyFile(customizations []*imagedefinition.CopyFile, confDefPath stri
 // manualExecute executes executable files in the chroot
 func manualExecute(customizations []*imagedefinition.Execute, targetDir string, debug bool) error {
 	for _, c := range customizations {
-		executeCmd := execCommand("chroot", targetDir, c.ExecutePath)
+		var timeout time.Duration
+		if c.Timeout != "" {
+			var err error
+			timeout, err = time.ParseDuration(c.Timeout)
+			if err != nil {
+				return fmt.Errorf("Error parsing timeout of script \"%s\": %s", c.ExecutePath, err.Error())
+			}
+		}
+		executeCmd, err := manualExecuteCmd(c, targetDir)
+		if err != nil {
+			return err
+		}
 		if debug {
-			fmt.Printf("Executing command \"%s\"\n", executeCmd.String())
+			printDebug("Executing command \"%s\"\n", executeCmd.String())
 		}
-		executeOutput := helper.SetCommandOutput(executeCmd, debug)
-		err := executeCmd.Run()
+		executeOutput := setCommandOutput(executeCmd, debug)
+		err = runWithTimeout(executeCmd, timeout)
 		if err != nil {
 			return fmt.Errorf("Error running script \"%s\". Error is %s. Full output below:\n%s",
 				executeCmd.String(), err.Error(), executeOutput.String())
@@ -838,12 +1317,105 @@ func manualExecute(customizations []*imagedefinition.Execute, targetDir string,
 	return nil
 }
 
+// manualExecuteCmd prepares the command running a script in the requested sandbox.
+// The chroot sandbox only isolates the filesystem. nspawn and unshare also run
+// the script in private mount, PID and network namespaces, so it can neither
+// see nor signal the processes of the host, nor reach the network
+func manualExecuteCmd(c *imagedefinition.Execute, targetDir string) (*exec.Cmd, error) {
+	// sort the environment so the command is the same from one build to the next
+	var env []string
+	for name, value := range c.Env {
+		env = append(env, name+"="+value)
+	}
+	sort.Strings(env)
+	script := append([]string{c.ExecutePath}, c.Args...)
+
+	switch c.Sandbox {
+	case "", "chroot":
+		args := []string{targetDir}
+		if c.WorkingDir != "" || len(env) > 0 {
+			args = append(args, "/usr/bin/env")
+			if c.WorkingDir != "" {
+				args = append(args, "--chdir="+c.WorkingDir)
+			}
+			args = append(args, env...)
+		}
+		return execCommand("chroot", append(args, script...)...), nil
+	case "nspawn":
+		args := []string{
+			"--quiet",
+			"--register=no",
+			"--as-pid2",
+			"--private-network",
+			"--console=pipe",
+			"--resolv-conf=off",
+			"--timezone=off",
+			"--link-journal=no",
+			"--directory=" + targetDir,
+		}
+		if c.WorkingDir != "" {
+			args = append(args, "--chdir="+c.WorkingDir)
+		}
+		for _, variable := range env {
+			args = append(args, "--setenv="+variable)
+		}
+		args = append(args, "--")
+		return execCommand("systemd-nspawn", append(args, script...)...), nil
+	case "unshare":
+		args := []string{
+			"--mount",
+			"--pid",
+			"--net",
+			"--ipc",
+			"--uts",
+			"--fork",
+			"--kill-child",
+			"--mount-proc",
+			"--root=" + targetDir,
+		}
+		if c.WorkingDir != "" {
+			args = append(args, "--wd="+c.WorkingDir)
+		}
+		if len(env) > 0 {
+			args = append(args, "/usr/bin/env")
+			args = append(args, env...)
+		}
+		return execCommand("unshare", append(args, script...)...), nil
+	default:
+		return nil, fmt.Errorf("Unknown sandbox \"%s\" for script \"%s\"", c.Sandbox, c.ExecutePath)
+	}
+}
+
+// runWithTimeout runs a command and kills its whole process group if it is
+// still running after timeout. A timeout of zero means no timeout
+func runWithTimeout(cmd *exec.Cmd, timeout time.Duration) error {
+	if timeout == 0 {
+		return cmd.Run()
+	}
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(timeout):
+		_ = syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		<-done
+		return fmt.Errorf("timed out after %s", timeout)
+	}
+}
+
 // manualTouchFile touches files in the chroot
 func manualTouchFile(customizations []*imagedefinition.TouchFile, targetDir string, debug bool) error {
 	for _, c := range customizations {
 		fullPath := filepath.Join(targetDir, c.TouchPath)
 		if debug {
-			fmt.Printf("Creating empty file \"%s\"\n", fullPath)
+			printDebug("Creating empty file \"%s\"\n", fullPath)
 		}
 		_, err := osCreate(fullPath)
 		if err != nil {
@@ -863,9 +1435,9 @@ func manualAddGroup(customizations []*imagedefinition.AddGroup, targetDir string
 			debugStatement = fmt.Sprintf("%s with GID %s\n", strings.TrimSpace(debugStatement), c.GroupID)
 		}
 		if debug {
-			fmt.Print(debugStatement)
+			printDebug("%s", debugStatement)
 		}
-		addGroupOutput := helper.SetCommandOutput(addGroupCmd, debug)
+		addGroupOutput := setCommandOutput(addGroupCmd, debug)
 		err := addGroupCmd.Run()
 		if err != nil {
 			return fmt.Errorf("Error adding group. Command used is \"%s\". Error is %s. Full output below:\n%s",
@@ -875,7 +1447,7 @@ func manualAddGroup(customizations []*imagedefinition.AddGroup, targetDir string
 	return nil
 }
 
-// manualAddUser adds users in the chroot
+// manualAddUser adds users in the chroot and sets up their accounts
 func manualAddUser(customizations []*imagedefinition.AddUser, targetDir string, debug bool) error {
 	for _, c := range customizations {
 		addUserCmd := execCommand("chroot", targetDir, "useradd", c.UserName)
@@ -884,15 +1456,170 @@ func manualAddUser(customizations []*imagedefinition.AddUser, targetDir string,
 			addUserCmd.Args = append(addUserCmd.Args, []string{"--uid", c.UserID}...)
 			debugStatement = fmt.Sprintf("%s with UID %s\n", strings.TrimSpace(debugStatement), c.UserID)
 		}
+		addUserCmd.Args = append(addUserCmd.Args, addUserOptions(c)...)
 		if debug {
-			fmt.Print(debugStatement)
+			printDebug("%s", debugStatement)
 		}
-		addUserOutput := helper.SetCommandOutput(addUserCmd, debug)
+		addUserOutput := setCommandOutput(addUserCmd, debug)
 		err := addUserCmd.Run()
 		if err != nil {
 			return fmt.Errorf("Error adding user. Command used is \"%s\". Error is %s. Full output below:\n%s",
 				addUserCmd.String(), err.Error(), addUserOutput.String())
 		}
+
+		if c.Password != "" {
+			// the hash is given on stdin so that it does not end up in the
+			// process list or in error messages
+			err = runInChroot(targetDir, c.UserName+":"+c.Password+"\n", debug,
+				"chpasswd", "--encrypted")
+			if err != nil {
+				return fmt.Errorf("Error setting password of user \"%s\": %s", c.UserName, err.Error())
+			}
+		}
+		if c.ExpirePassword != nil && *c.ExpirePassword {
+			err = runInChroot(targetDir, "", debug, "passwd", "--expire", c.UserName)
+			if err != nil {
+				return fmt.Errorf("Error expiring password of user \"%s\": %s", c.UserName, err.Error())
+			}
+		}
+		if len(c.AuthorizedKeys) > 0 {
+			if err := addAuthorizedKeys(c, targetDir, debug); err != nil {
+				return err
+			}
+		}
+		if c.Sudo != "" {
+			if err := addSudoRule(c, targetDir, debug); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// addUserOptions returns the useradd options creating the account
+// described by an add-user customization
+func addUserOptions(c *imagedefinition.AddUser) []string {
+	var options []string
+	if c.PrimaryGroup != "" {
+		options = append(options, "--gid", c.PrimaryGroup)
+	}
+	if len(c.Groups) > 0 {
+		options = append(options, "--groups", strings.Join(c.Groups, ","))
+	}
+	if c.Shell != "" {
+		options = append(options, "--shell", c.Shell)
+	}
+	if c.Home != "" {
+		options = append(options, "--home-dir", c.Home)
+	}
+	if c.CreateHome != nil && *c.CreateHome {
+		options = append(options, "--create-home")
+	}
+	return options
+}
+
+// runInChroot runs a command in the chroot, with the given input on stdin
+func runInChroot(targetDir string, stdin string, debug bool, args ...string) error {
+	cmd := execCommand("chroot", append([]string{targetDir}, args...)...)
+	if stdin != "" {
+		cmd.Stdin = strings.NewReader(stdin)
+	}
+	cmdOutput := setCommandOutput(cmd, debug)
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("Command used is \"%s\". Error is %s. Full output below:\n%s",
+			cmd.String(), err.Error(), cmdOutput.String())
+	}
+	return nil
+}
+
+// userHome looks up the home directory of a user in the chroot
+func userHome(userName string, targetDir string) (string, error) {
+	getentCmd := execCommand("chroot", targetDir, "getent", "passwd", userName)
+	getentOutput, err := getentCmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("Error looking up user \"%s\": %s", userName, err.Error())
+	}
+	// name:password:UID:GID:GECOS:directory:shell
+	fields := strings.Split(strings.TrimSpace(string(getentOutput)), ":")
+	if len(fields) != 7 || !filepath.IsAbs(fields[5]) {
+		return "", fmt.Errorf("Error looking up user \"%s\": unexpected passwd entry \"%s\"",
+			userName, strings.TrimSpace(string(getentOutput)))
+	}
+	return fields[5], nil
+}
+
+// addAuthorizedKeys writes the SSH authorized_keys file of a user
+func addAuthorizedKeys(c *imagedefinition.AddUser, targetDir string, debug bool) error {
+	home := c.Home
+	if home == "" {
+		var err error
+		home, err = userHome(c.UserName, targetDir)
+		if err != nil {
+			return err
+		}
+	}
+	sshDir := filepath.Join(home, ".ssh")
+	sshDirPath, err := resolveInChroot(targetDir, sshDir)
+	if err != nil {
+		return err
+	}
+	authorizedKeysPath, err := resolveInChroot(targetDir, filepath.Join(sshDir, "authorized_keys"))
+	if err != nil {
+		return err
+	}
+	if debug {
+		printDebug("Adding SSH authorized keys of user \"%s\"\n", c.UserName)
+	}
+	if err := osMkdirAll(sshDirPath, 0700); err != nil {
+		return fmt.Errorf("Error creating directory \"%s\" into chroot: %s", sshDirPath, err.Error())
+	}
+	if err := osChmod(sshDirPath, 0700); err != nil {
+		return fmt.Errorf("Error changing permissions of \"%s\": %s", sshDirPath, err.Error())
+	}
+	authorizedKeys := strings.Join(c.AuthorizedKeys, "\n") + "\n"
+	if err := osWriteFile(authorizedKeysPath, []byte(authorizedKeys), 0600); err != nil {
+		return fmt.Errorf("Error writing file \"%s\" into chroot: %s", authorizedKeysPath, err.Error())
+	}
+	// "user:" gives the files to the login group of the user
+	return chownInChroot(targetDir, sshDir, c.UserName+":", true, debug)
+}
+
+// addSudoRule gives sudo rights to a user with a file in /etc/sudoers.d
+func addSudoRule(c *imagedefinition.AddUser, targetDir string, debug bool) error {
+	sudoersDir, err := resolveInChroot(targetDir, "/etc/sudoers.d")
+	if err != nil {
+		return err
+	}
+	if err := osMkdirAll(sudoersDir, 0755); err != nil {
+		return fmt.Errorf("Error creating directory \"%s\" into chroot: %s", sudoersDir, err.Error())
+	}
+	// sudo ignores the files of sudoers.d with a "." in their name
+	sudoersName := strings.ReplaceAll(c.UserName, ".", "_")
+	sudoersFile := filepath.Join(sudoersDir, sudoersName)
+	if debug {
+		printDebug("Writing sudo rule of user \"%s\" to \"%s\"\n", c.UserName, sudoersFile)
+	}
+	// the rule is checked by visudo before it is installed, as a broken
+	// sudoers.d file breaks sudo for every user. Until then it is written
+	// to a name sudo ignores
+	chrootFile := filepath.Join("/etc", "sudoers.d", sudoersName+".new")
+	uncheckedFile, err := resolveInChroot(targetDir, chrootFile)
+	if err != nil {
+		return err
+	}
+	rule := fmt.Sprintf("%s %s\n", c.UserName, c.Sudo)
+	if err := osWriteFile(uncheckedFile, []byte(rule), 0440); err != nil {
+		return fmt.Errorf("Error writing file \"%s\" into chroot: %s", uncheckedFile, err.Error())
+	}
+	if err := osChmod(uncheckedFile, 0440); err != nil {
+		return fmt.Errorf("Error changing permissions of \"%s\": %s", uncheckedFile, err.Error())
+	}
+	if err := runInChroot(targetDir, "", debug, "visudo", "-c", "-f", chrootFile); err != nil {
+		_ = osRemove(uncheckedFile)
+		return fmt.Errorf("Error checking sudo rule of user \"%s\": %s", c.UserName, err.Error())
+	}
+	if err := osRename(uncheckedFile, sudoersFile); err != nil {
+		return fmt.Errorf("Error installing file \"%s\" into chroot: %s", sudoersFile, err.Error())
 	}
 	return nil
 }
@@ -1043,7 +1770,7 @@ func (stateMachine *StateMachine) updateGrub(rootfsVolName string, rootfsPartNum
 
 	defer func() {
 		for _, teardownCmd := range teardownCmds {
-			cmdOutput := helper.SetCommandOutput(teardownCmd, stateMachine.commonFlags.Debug)
+			cmdOutput := setCommandOutput(teardownCmd, stateMachine.commonFlags.Debug)
 			tmpErr := teardownCmd.Run()
 			if tmpErr != nil {
 				if err != nil {
@@ -1085,6 +1812,23 @@ func (stateMachine *StateMachine) updateGrub(rootfsVolName string, rootfsPartNum
 		teardownCmds = append(umountCmds, teardownCmds...)
 	}
 
+	// the qemu-user-static binary was removed from the rootfs before
+	// the image was created, so copy it again while update-grub runs
+	qemuStatic, err := stateMachine.foreignQemuStatic()
+	if err != nil {
+		return err
+	}
+	if qemuStatic != "" {
+		if err = stateMachine.enableBinfmt(qemuStatic); err != nil {
+			return err
+		}
+		qemuStaticDest := filepath.Join(mountDir, "usr", "bin", qemuStatic)
+		updateGrubCmds = append(updateGrubCmds,
+			execCommand("cp", "--preserve=mode", qemuStaticSource(qemuStatic), qemuStaticDest),
+		)
+		teardownCmds = append([]*exec.Cmd{execCommand("rm", "--force", qemuStaticDest)}, teardownCmds...)
+	}
+
 	divert, undivert := divertOSProber(mountDir)
 
 	updateGrubCmds = append(updateGrubCmds, divert)
@@ -1100,7 +1844,7 @@ func (stateMachine *StateMachine) updateGrub(rootfsVolName string, rootfsPartNum
 
 	// now run all the commands
 	for _, cmd := range updateGrubCmds {
-		cmdOutput := helper.SetCommandOutput(cmd, stateMachine.commonFlags.Debug)
+		cmdOutput := setCommandOutput(cmd, stateMachine.commonFlags.Debug)
 		err = cmd.Run()
 		if err != nil {
 			err = fmt.Errorf("Error running command \"%s\". Error is \"%s\". Output is: \n%s",
@@ -1111,3 +1855,244 @@ func (stateMachine *StateMachine) updateGrub(rootfsVolName string, rootfsPartNum
 
 	return nil
 }
+
+// isoGrubCfgTemplate is the grub configuration used to boot
+// the live system of installer ISOs
+const isoGrubCfgTemplate = `set timeout=30
+
+loadfont unicode
+
+set menu_color_normal=white/black
+set menu_color_highlight=black/light-gray
+
+menuentry "Try or Install %s" {
+	set gfxpayload=keep
+	linux	/casper/vmlinuz  ---
+	initrd	/casper/initrd
+}
+`
+
+// isoEFIGrubCfg is placed in the EFI image of installer ISOs
+// and loads the grub configuration of the ISO
+const isoEFIGrubCfg = `search --set=root --file /.disk/info
+set prefix=($root)/boot/grub
+configfile $prefix/grub.cfg
+`
+
+// runMksquashfs creates a squashfs filesystem with the contents of a directory
+func runMksquashfs(src, dest string, debug bool) error {
+	if err := osRemoveAll(dest); err != nil {
+		return fmt.Errorf("Error removing old squashfs \"%s\": %s", dest, err.Error())
+	}
+	mksquashfsCmd := execCommand("mksquashfs", src, dest,
+		"-noappend",
+		"-no-progress",
+		"-xattrs",
+		"-comp", "xz",
+	)
+	mksquashfsOutput := setCommandOutput(mksquashfsCmd, debug)
+	if err := mksquashfsCmd.Run(); err != nil {
+		return fmt.Errorf("Error running command \"%s\". Error is \"%s\". Output is: \n%s",
+			mksquashfsCmd.String(), err.Error(), mksquashfsOutput.String())
+	}
+	return nil
+}
+
+// validateLayerNames ensures that every installer layer extends the previous
+// one by exactly one component, e.g. "minimal", "minimal.standard"
+func validateLayerNames(layers []string) error {
+	for i := 1; i < len(layers); i++ {
+		prefix := layers[i-1] + "."
+		if !strings.HasPrefix(layers[i], prefix) ||
+			strings.Contains(strings.TrimPrefix(layers[i], prefix), ".") {
+			return fmt.Errorf("Layer \"%s\" does not extend the previous layer \"%s\"",
+				layers[i], layers[i-1])
+		}
+	}
+	return nil
+}
+
+// readSeedPackages reads the list of packages from a seed file output by germinate
+func readSeedPackages(seedFilePath string) ([]string, error) {
+	seedFile, err := osOpen(seedFilePath)
+	if err != nil {
+		return nil, fmt.Errorf("Error opening seed file %s: \"%s\"", seedFilePath, err.Error())
+	}
+	defer seedFile.Close()
+
+	var packages []string
+	seedScanner := bufio.NewScanner(seedFile)
+	for seedScanner.Scan() {
+		seedLine := seedScanner.Bytes()
+		if seedVersionRegex.Match(seedLine) {
+			packages = append(packages, strings.Split(string(seedLine), " ")[0])
+		}
+	}
+	if err := seedScanner.Err(); err != nil {
+		return nil, fmt.Errorf("Error reading seed file %s: \"%s\"", seedFilePath, err.Error())
+	}
+	return packages, nil
+}
+
+// mountOverlay generates the commands to mount an overlay of
+// the lower directories at the specified mountpoint
+func mountOverlay(mountpoint string, lowerDirs []string, upperDir, workDir string) (mountCmds, umountCmds []*exec.Cmd) {
+	options := fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s",
+		strings.Join(lowerDirs, ":"), upperDir, workDir)
+	mountCmds = []*exec.Cmd{execCommand("mount", "-t", "overlay", "overlay", "-o", options, mountpoint)}
+	umountCmds = []*exec.Cmd{execCommand("umount", mountpoint)}
+	return mountCmds, umountCmds
+}
+
+// isoVolumeID returns the volume identifier of an ISO,
+// which is limited to 32 characters by ISO 9660
+func isoVolumeID(imageDef imagedefinition.ImageDefinition) string {
+	volumeID := imageDef.DisplayName
+	if volumeID == "" {
+		volumeID = imageDef.ImageName
+	}
+	if len(volumeID) > 32 {
+		volumeID = volumeID[:32]
+	}
+	return volumeID
+}
+
+// fileSHA256 returns the hex encoded sha256 sum of a file
+func fileSHA256(path string) (string, error) {
+	sum, err := helper.CalculateSHA256(path)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", sum), nil
+}
+
+// defaultQcow2Options are the options used to create qcow2 images when none
+// are given in an image definition. The images are compressed and use the
+// 0.10 compat level so they can be used by older versions of qemu
+var defaultQcow2Options = diskimage.Qcow2Options{
+	Compress: true,
+	Compat:   diskimage.Qcow2Compat010,
+}
+
+// qcow2Options returns the options used to create the given qcow2 artifact
+func qcow2Options(qcow2 imagedefinition.Qcow2) diskimage.Qcow2Options {
+	opts := defaultQcow2Options
+	if qcow2.Compression != nil {
+		opts.Compress = *qcow2.Compression
+	}
+	if qcow2.Compat != "" {
+		opts.Compat = qcow2.Compat
+	}
+	return opts
+}
+
+// convertImage converts a raw disk image to the given disk image format.
+// vhd and vhdx images are fixed, which is the format expected by most
+// hypervisors
+func (stateMachine *StateMachine) convertImage(src, dest, format string, qcow2Opts diskimage.Qcow2Options) error {
+	vhdOpts, vmdkOpts := stateMachine.diskImageOptions(dest)
+	var err error
+	switch format {
+	case "qcow2":
+		err = diskimageConvertToQcow2(src, dest, qcow2Opts)
+	case "vmdk":
+		err = diskimageConvertToVMDK(src, dest, vmdkOpts)
+	case "vhd":
+		err = diskimageConvertToVHD(src, dest, vhdOpts)
+	case "vhdx":
+		err = diskimageConvertToVHDX(src, dest, diskimage.VHDXOptions{UniqueID: vhdOpts.UniqueID})
+	default:
+		return fmt.Errorf("Unsupported disk image format \"%s\"", format)
+	}
+	if err != nil {
+		return fmt.Errorf("Error creating %s artifact %s: %s", format, dest, err.Error())
+	}
+	return nil
+}
+
+// writePackageManifest writes the package manifest of a rootfs, listing its
+// seeded snaps if snaps is true
+func writePackageManifest(rootfsDir, outputPath string, snaps, debug bool) error {
+	manifestBytes, err := packageManifest(rootfsDir, snaps, debug)
+	if err != nil {
+		return err
+	}
+
+	// write the output to a file on successful executions
+	manifest, err := osCreate(outputPath)
+	if err != nil {
+		return fmt.Errorf("Error creating manifest file: %s", err.Error())
+	}
+	defer manifest.Close()
+	_, err = manifest.Write(manifestBytes)
+	if err != nil {
+		return fmt.Errorf("error writing the manifest file: %w", err)
+	}
+	return nil
+}
+
+// packageManifest lists the packages installed in a rootfs and their
+// versions, followed by the snaps seeded in it and their revisions if snaps
+// is true. dpkg-query is run from the host against the dpkg database of the
+// rootfs, so it works for images of foreign architectures too
+func packageManifest(rootfsDir string, snaps, debug bool) ([]byte, error) {
+	cmd := execCommand("dpkg-query",
+		"--admindir="+filepath.Join(rootfsDir, "var", "lib", "dpkg"),
+		"-W", "--showformat=${Package} ${Version}\n")
+	cmdOutput := setCommandOutput(cmd, debug)
+
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("Error generating package manifest with command \"%s\". "+
+			"Error is \"%s\". Full output below:\n%s",
+			cmd.String(), err.Error(), cmdOutput.String())
+	}
+	if !snaps {
+		return cmdOutput.Bytes(), nil
+	}
+
+	// the seeded snaps are listed after the packages, the way
+	// livecd-rootfs lists them
+	seedSnaps, err := listSeedSnaps(filepath.Join(rootfsDir, "var", "lib", "snapd", "seed"), "")
+	if err != nil {
+		return nil, err
+	}
+	for _, snap := range seedSnaps {
+		fmt.Fprintf(cmdOutput, "%s%s %s\n", manifestSnapPrefix, snap.Name, snap.Revision)
+	}
+	return cmdOutput.Bytes(), nil
+}
+
+// writeFilelist writes the list of files in a rootfs. This is basically just a
+// wrapper around find (similar to what we do in livecd-rootfs). It is run from
+// the host in the rootfs, so it works for images of foreign architectures too.
+// The order in which find lists the files depends on the host filesystem, so
+// they are sorted when sorted is true
+func writeFilelist(rootfsDir, outputPath string, sorted, debug bool) error {
+	cmd := execCommand("find", "-xdev")
+	cmd.Dir = rootfsDir
+	cmdOutput := setCommandOutput(cmd, debug)
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("Error generating file list with command \"%s\". "+
+			"Error is \"%s\". Full output below:\n%s",
+			cmd.String(), err.Error(), cmdOutput.String())
+	}
+
+	// write the output to a file on successful executions
+	filelist, err := osCreate(outputPath)
+	if err != nil {
+		return fmt.Errorf("Error creating filelist file: %s", err.Error())
+	}
+	defer filelist.Close()
+	output := cmdOutput.Bytes()
+	if sorted {
+		files := strings.Split(strings.TrimSuffix(cmdOutput.String(), "\n"), "\n")
+		sort.Strings(files)
+		output = []byte(strings.Join(files, "\n") + "\n")
+	}
+	_, err = filelist.Write(output)
+	if err != nil {
+		return fmt.Errorf("error writing the filelist file: %w", err)
+	}
+	return nil
+}
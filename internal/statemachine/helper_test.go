@@ -1,6 +1,7 @@
 package statemachine
 
 import (
+	"bufio"
 	"bytes"
 	"crypto/rand"
 	"encoding/json"
@@ -15,7 +16,9 @@ import (
 	"runtime"
 	"strings"
 	"testing"
+	"time"
 
+	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
 	"github.com/google/uuid"
 	"github.com/snapcore/snapd/gadget"
 	"github.com/snapcore/snapd/gadget/quantity"
@@ -521,7 +524,7 @@ func TestGenerateUniqueDiskID(t *testing.T) {
 				randRead = rand.Read
 			}()
 
-			randomBytes, err := generateUniqueDiskID(&testCases[i].existing)
+			randomBytes, err := generateUniqueDiskID(&testCases[i].existing, randRead)
 			if tc.expectedErr {
 				asserter.AssertErrContains(err, "Failed to generate unique disk ID")
 			} else {
@@ -621,6 +624,186 @@ func TestGetQemuStaticForArch(t *testing.T) {
 	}
 }
 
+// foreignArchForTests returns an architecture supported by
+// getQemuStaticForArch that is foreign to the host
+func foreignArchForTests() string {
+	if getHostArch() == "arm64" {
+		return "armhf"
+	}
+	return "arm64"
+}
+
+// TestIsForeignArch unit tests the isForeignArch function
+func TestIsForeignArch(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	asserter.AssertEqual(false, isForeignArch(getHostArch()))
+	asserter.AssertEqual(false, isForeignArch(""))
+	asserter.AssertEqual(true, isForeignArch(foreignArchForTests()))
+}
+
+// TestCopyQemuStatic tests that the qemu-user-static binary is copied to and removed
+// from the chroot of foreign architecture images
+func TestCopyQemuStatic(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+
+	var stateMachine ClassicStateMachine
+	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+	stateMachine.parent = &stateMachine
+	stateMachine.ImageDef = imagedefinition.ImageDefinition{
+		Architecture: foreignArchForTests(),
+	}
+	qemuStatic := getQemuStaticForArch(stateMachine.ImageDef.Architecture)
+
+	// use fake host directories
+	qemuStaticDir = t.TempDir()
+	binfmtMiscDir = t.TempDir()
+	t.Cleanup(func() {
+		qemuStaticDir = "/usr/bin"
+		binfmtMiscDir = "/proc/sys/fs/binfmt_misc"
+	})
+	err := os.WriteFile(filepath.Join(qemuStaticDir, qemuStatic), []byte("qemu"), 0755)
+	asserter.AssertErrNil(err, true)
+	err = os.WriteFile(filepath.Join(binfmtMiscDir, strings.TrimSuffix(qemuStatic, "-static")),
+		[]byte("enabled"), 0644)
+	asserter.AssertErrNil(err, true)
+
+	chroot := t.TempDir()
+	err = stateMachine.copyQemuStatic(chroot)
+	asserter.AssertErrNil(err, true)
+
+	qemuStaticPath := filepath.Join(chroot, "usr", "bin", qemuStatic)
+	info, err := os.Stat(qemuStaticPath)
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual(os.FileMode(0755), info.Mode().Perm())
+
+	// copying it again is a no-op
+	err = stateMachine.copyQemuStatic(chroot)
+	asserter.AssertErrNil(err, true)
+
+	err = stateMachine.deleteQemuStatic(chroot)
+	asserter.AssertErrNil(err, true)
+	if osutil.FileExists(qemuStaticPath) {
+		t.Errorf("File \"%s\" should not exist, but does", qemuStaticPath)
+	}
+
+	// removing it again is fine too
+	err = stateMachine.deleteQemuStatic(chroot)
+	asserter.AssertErrNil(err, true)
+
+	// nothing is done for native builds
+	stateMachine.ImageDef.Architecture = getHostArch()
+	err = stateMachine.copyQemuStatic(chroot)
+	asserter.AssertErrNil(err, true)
+	if osutil.FileExists(qemuStaticPath) {
+		t.Errorf("File \"%s\" should not exist, but does", qemuStaticPath)
+	}
+}
+
+// TestQemuStaticSource tests that the path of the emulator on the host can be overridden
+func TestQemuStaticSource(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	t.Setenv("UBUNTU_IMAGE_QEMU_USER_STATIC_PATH", "")
+	asserter.AssertEqual("/usr/bin/qemu-aarch64-static", qemuStaticSource("qemu-aarch64-static"))
+
+	t.Setenv("UBUNTU_IMAGE_QEMU_USER_STATIC_PATH", "/opt/qemu/qemu-aarch64")
+	asserter.AssertEqual("/opt/qemu/qemu-aarch64", qemuStaticSource("qemu-aarch64-static"))
+}
+
+// TestFailedCopyQemuStatic tests failures in the copyQemuStatic function
+func TestFailedCopyQemuStatic(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+
+	var stateMachine ClassicStateMachine
+	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+	stateMachine.parent = &stateMachine
+	stateMachine.ImageDef = imagedefinition.ImageDefinition{
+		Architecture: "riscv64",
+	}
+	if getHostArch() == "riscv64" {
+		stateMachine.ImageDef.Architecture = "s390x"
+	}
+
+	qemuStaticDir = t.TempDir()
+	binfmtMiscDir = t.TempDir()
+	t.Cleanup(func() {
+		qemuStaticDir = "/usr/bin"
+		binfmtMiscDir = "/proc/sys/fs/binfmt_misc"
+	})
+
+	chroot := t.TempDir()
+
+	// architecture without a known emulator
+	err := stateMachine.copyQemuStatic(chroot)
+	asserter.AssertErrContains(err, "is not supported on")
+
+	// the emulator is not installed on the host
+	stateMachine.ImageDef.Architecture = foreignArchForTests()
+	err = stateMachine.copyQemuStatic(chroot)
+	asserter.AssertErrContains(err, "Install qemu-user-static")
+
+	// the binfmt handler can not be enabled
+	qemuStatic := getQemuStaticForArch(stateMachine.ImageDef.Architecture)
+	err = os.WriteFile(filepath.Join(qemuStaticDir, qemuStatic), []byte("qemu"), 0755)
+	asserter.AssertErrNil(err, true)
+
+	testCaseName = "TestFailedCopyQemuStatic"
+	execCommand = fakeExecCommand
+	t.Cleanup(func() { execCommand = exec.Command })
+	err = stateMachine.copyQemuStatic(chroot)
+	asserter.AssertErrContains(err, "Error enabling binfmt handler")
+	execCommand = exec.Command
+
+	// copying the emulator fails
+	err = os.WriteFile(filepath.Join(binfmtMiscDir, strings.TrimSuffix(qemuStatic, "-static")),
+		[]byte("enabled"), 0644)
+	asserter.AssertErrNil(err, true)
+	osutilCopyFile = mockCopyFile
+	t.Cleanup(func() { osutilCopyFile = osutil.CopyFile })
+	err = stateMachine.copyQemuStatic(chroot)
+	asserter.AssertErrContains(err, "Error copying")
+}
+
+// TestGenerateDebootstrapCmdForeign checks that only the first stage of
+// debootstrap is run for foreign architectures
+func TestGenerateDebootstrapCmdForeign(t *testing.T) {
+	imageDef := imagedefinition.ImageDefinition{
+		Architecture: foreignArchForTests(),
+		Series:       "jammy",
+		Rootfs: &imagedefinition.Rootfs{
+			Mirror: "http://ports.ubuntu.com/ubuntu-ports/",
+		},
+	}
+	debootstrapCmd := generateDebootstrapCmd(imageDef, "/tmp/chroot", nil)
+	if !strings.Contains(debootstrapCmd.String(), "--foreign") {
+		t.Errorf("Expected \"--foreign\" in debootstrap command \"%s\"", debootstrapCmd.String())
+	}
+
+	imageDef.Architecture = getHostArch()
+	debootstrapCmd = generateDebootstrapCmd(imageDef, "/tmp/chroot", nil)
+	if strings.Contains(debootstrapCmd.String(), "--foreign") {
+		t.Errorf("Did not expect \"--foreign\" in debootstrap command \"%s\"", debootstrapCmd.String())
+	}
+}
+
+// TestGenerateDebootstrapCmdProxy checks that debootstrap uses the apt proxy
+// of the image definition
+func TestGenerateDebootstrapCmdProxy(t *testing.T) {
+	imageDef := imagedefinition.ImageDefinition{
+		Architecture: getHostArch(),
+		Series:       "jammy",
+		Rootfs: &imagedefinition.Rootfs{
+			Mirror: "http://archive.ubuntu.com/ubuntu/",
+			Apt:    &imagedefinition.Apt{Proxy: "http://proxy.example.com:3128"},
+		},
+	}
+	debootstrapCmd := generateDebootstrapCmd(imageDef, "/tmp/chroot", nil)
+	for _, proxyVar := range []string{"http_proxy", "https_proxy"} {
+		if !helper.SliceHasElement(debootstrapCmd.Env, proxyVar+"=http://proxy.example.com:3128") {
+			t.Errorf("Expected %s to be set in the environment of debootstrap", proxyVar)
+		}
+	}
+}
+
 // TestGenerateGerminateCmd unit tests the generateGerminateCmd function
 func TestGenerateGerminateCmd(t *testing.T) {
 	testCases := []struct {
@@ -817,6 +1000,93 @@ func TestFailedManualExecute(t *testing.T) {
 	})
 }
 
+// TestManualExecuteCmd tests the commands used to run scripts in each sandbox
+func TestManualExecuteCmd(t *testing.T) {
+	testCases := []struct {
+		name         string
+		execute      imagedefinition.Execute
+		expectedArgs []string
+	}{
+		{
+			"chroot_default",
+			imagedefinition.Execute{ExecutePath: "/script"},
+			[]string{"chroot", "/chroot", "/script"},
+		},
+		{
+			"chroot_with_options",
+			imagedefinition.Execute{
+				ExecutePath: "/script",
+				Args:        []string{"--foo", "bar"},
+				Env:         map[string]string{"B": "2", "A": "1"},
+				WorkingDir:  "/tmp",
+				Sandbox:     "chroot",
+			},
+			[]string{"chroot", "/chroot", "/usr/bin/env", "--chdir=/tmp", "A=1", "B=2",
+				"/script", "--foo", "bar"},
+		},
+		{
+			"nspawn",
+			imagedefinition.Execute{
+				ExecutePath: "/script",
+				Args:        []string{"--foo"},
+				Env:         map[string]string{"A": "1"},
+				WorkingDir:  "/tmp",
+				Sandbox:     "nspawn",
+			},
+			[]string{"systemd-nspawn", "--quiet", "--register=no", "--as-pid2", "--private-network",
+				"--console=pipe", "--resolv-conf=off", "--timezone=off", "--link-journal=no",
+				"--directory=/chroot", "--chdir=/tmp", "--setenv=A=1", "--", "/script", "--foo"},
+		},
+		{
+			"unshare",
+			imagedefinition.Execute{
+				ExecutePath: "/script",
+				Args:        []string{"--foo"},
+				Env:         map[string]string{"A": "1"},
+				WorkingDir:  "/tmp",
+				Sandbox:     "unshare",
+			},
+			[]string{"unshare", "--mount", "--pid", "--net", "--ipc", "--uts", "--fork",
+				"--kill-child", "--mount-proc", "--root=/chroot", "--wd=/tmp",
+				"/usr/bin/env", "A=1", "/script", "--foo"},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run("test_manual_execute_cmd_"+tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			cmd, err := manualExecuteCmd(&tc.execute, "/chroot")
+			asserter.AssertErrNil(err, true)
+			asserter.AssertEqual(tc.expectedArgs, cmd.Args)
+		})
+	}
+
+	t.Run("test_manual_execute_cmd_unknown_sandbox", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		_, err := manualExecuteCmd(&imagedefinition.Execute{ExecutePath: "/script", Sandbox: "vm"}, "/chroot")
+		asserter.AssertErrContains(err, "Unknown sandbox")
+	})
+}
+
+// TestManualExecuteTimeout tests that scripts running for too long are killed
+func TestManualExecuteTimeout(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+
+	err := runWithTimeout(exec.Command("sleep", "10"), 100*time.Millisecond)
+	asserter.AssertErrContains(err, "timed out after 100ms")
+
+	err = runWithTimeout(exec.Command("true"), time.Minute)
+	asserter.AssertErrNil(err, true)
+
+	executes := []*imagedefinition.Execute{
+		{
+			ExecutePath: "/script",
+			Timeout:     "ten minutes",
+		},
+	}
+	err = manualExecute(executes, "fakedir", false)
+	asserter.AssertErrContains(err, "Error parsing timeout")
+}
+
 // TestFailedManualAddGroup tests the fail case of the manualAddGroup function
 func TestFailedManualAddGroup(t *testing.T) {
 	t.Run("test_failed_manual_add_group", func(t *testing.T) {
@@ -849,20 +1119,504 @@ func TestFailedManualAddUser(t *testing.T) {
 	})
 }
 
+// TestManualAddUser tests the commands and files used to provision users
+func TestManualAddUser(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	targetDir := t.TempDir()
+	mockCmder := NewMockExecCommand()
+	execCommand = mockCmder.Command
+	t.Cleanup(func() { execCommand = exec.Command })
+
+	stdout, restoreStdout, err := helper.CaptureStd(&os.Stdout)
+	asserter.AssertErrNil(err, true)
+	t.Cleanup(func() { restoreStdout() })
+
+	addUsers := []*imagedefinition.AddUser{
+		{
+			UserName:       "ubuntu.admin",
+			UserID:         "1000",
+			Password:       "$6$salt$hash",
+			ExpirePassword: helper.BoolPtr(true),
+			PrimaryGroup:   "users",
+			Groups:         []string{"adm", "sudo"},
+			Shell:          "/bin/bash",
+			Home:           "/home/admin",
+			CreateHome:     helper.BoolPtr(true),
+			AuthorizedKeys: []string{"ssh-ed25519 AAAA1 first", "ssh-ed25519 AAAA2 second"},
+			Sudo:           "ALL=(ALL) NOPASSWD:ALL",
+		},
+		{
+			UserName: "service",
+		},
+	}
+	err = manualAddUser(addUsers, targetDir, true)
+	asserter.AssertErrNil(err, true)
+
+	restoreStdout()
+	readStdout, err := io.ReadAll(stdout)
+	asserter.AssertErrNil(err, true)
+
+	expectedCmds := []string{
+		"chroot " + targetDir + " useradd ubuntu.admin --uid 1000 --gid users --groups adm,sudo " +
+			"--shell /bin/bash --home-dir /home/admin --create-home",
+		"chroot " + targetDir + " chpasswd --encrypted",
+		"chroot " + targetDir + " passwd --expire ubuntu.admin",
+		"chroot " + targetDir + " chown --recursive --no-dereference ubuntu.admin: /home/admin/.ssh",
+		"chroot " + targetDir + " visudo -c -f /etc/sudoers.d/ubuntu_admin.new",
+		"chroot " + targetDir + " useradd service\n",
+	}
+	for _, expectedCmd := range expectedCmds {
+		if !strings.Contains(string(readStdout), expectedCmd) {
+			t.Errorf("Expected command \"%s\" to be run. Output is:\n%s", expectedCmd, readStdout)
+		}
+	}
+	if strings.Contains(string(readStdout), "$6$salt$hash") {
+		t.Errorf("The password hash should not be part of any command")
+	}
+
+	authorizedKeys := filepath.Join(targetDir, "home", "admin", ".ssh", "authorized_keys")
+	content, err := os.ReadFile(authorizedKeys)
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual("ssh-ed25519 AAAA1 first\nssh-ed25519 AAAA2 second\n", string(content))
+	info, err := os.Stat(authorizedKeys)
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual(os.FileMode(0600), info.Mode().Perm())
+	info, err = os.Stat(filepath.Dir(authorizedKeys))
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual(os.FileMode(0700), info.Mode().Perm())
+
+	sudoers := filepath.Join(targetDir, "etc", "sudoers.d", "ubuntu_admin")
+	content, err = os.ReadFile(sudoers)
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual("ubuntu.admin ALL=(ALL) NOPASSWD:ALL\n", string(content))
+	info, err = os.Stat(sudoers)
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual(os.FileMode(0440), info.Mode().Perm())
+	_, err = os.Stat(sudoers + ".new")
+	if !os.IsNotExist(err) {
+		t.Errorf("Expected the unchecked sudo rule to be renamed")
+	}
+}
+
+// TestAddUserLinkToHost tests that the files of users are written in the
+// chroot when their directories are absolute symbolic links
+func TestAddUserLinkToHost(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	targetDir := t.TempDir()
+	hostDir := t.TempDir()
+	execCommand = NewMockExecCommand().Command
+	t.Cleanup(func() { execCommand = exec.Command })
+
+	links := map[string]string{
+		"/home/ubuntu":   filepath.Join(hostDir, "ubuntu"),
+		"/etc/sudoers.d": filepath.Join(hostDir, "sudoers.d"),
+	}
+	for link, target := range links {
+		err := os.MkdirAll(filepath.Join(targetDir, filepath.Dir(link)), 0755)
+		asserter.AssertErrNil(err, true)
+		err = os.Symlink(target, filepath.Join(targetDir, link))
+		asserter.AssertErrNil(err, true)
+	}
+
+	addUser := &imagedefinition.AddUser{
+		UserName:       "ubuntu",
+		Home:           "/home/ubuntu",
+		AuthorizedKeys: []string{"ssh-ed25519 AAAA"},
+		Sudo:           "ALL=(ALL) ALL",
+	}
+	err := addAuthorizedKeys(addUser, targetDir, false)
+	asserter.AssertErrNil(err, true)
+	err = addSudoRule(addUser, targetDir, false)
+	asserter.AssertErrNil(err, true)
+
+	entries, err := os.ReadDir(hostDir)
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual(0, len(entries))
+	for _, path := range []string{
+		filepath.Join(hostDir, "ubuntu", ".ssh", "authorized_keys"),
+		filepath.Join(hostDir, "sudoers.d", "ubuntu"),
+	} {
+		_, err := os.Stat(filepath.Join(targetDir, path))
+		asserter.AssertErrNil(err, true)
+	}
+}
+
+// TestFailedAddSudoRule tests that sudo rules rejected by visudo are not
+// installed
+func TestFailedAddSudoRule(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	targetDir := t.TempDir()
+	execCommand = fakeExecCommand
+	t.Cleanup(func() {
+		execCommand = exec.Command
+		testCaseName = ""
+	})
+	testCaseName = "TestFailedAddSudoRule"
+
+	addUser := &imagedefinition.AddUser{
+		UserName: "ubuntu",
+		Sudo:     "ALL=(ALL",
+	}
+	err := addSudoRule(addUser, targetDir, false)
+	asserter.AssertErrContains(err, "Error checking sudo rule of user \"ubuntu\"")
+	entries, err := os.ReadDir(filepath.Join(targetDir, "etc", "sudoers.d"))
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual(0, len(entries))
+
+	// the checked rule is installed
+	testCaseName = ""
+	execCommand = NewMockExecCommand().Command
+	osRename = mockRename
+	t.Cleanup(func() { osRename = os.Rename })
+	err = addSudoRule(addUser, targetDir, false)
+	asserter.AssertErrContains(err, "Error installing file")
+}
+
+// TestUserHome tests looking up the home directory of users in the chroot
+func TestUserHome(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	execCommand = fakeExecCommand
+	t.Cleanup(func() {
+		execCommand = exec.Command
+		testCaseName = ""
+	})
+
+	testCaseName = "TestUserHome"
+	home, err := userHome("ubuntu", "/chroot")
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual("/home/ubuntu", home)
+
+	testCaseName = "TestUserHomeBadEntry"
+	_, err = userHome("ubuntu", "/chroot")
+	asserter.AssertErrContains(err, "unexpected passwd entry")
+
+	// the home directory is needed to add authorized keys
+	testCaseName = "TestFailedUserHome"
+	addUsers := []*imagedefinition.AddUser{
+		{
+			UserName:       "ubuntu",
+			AuthorizedKeys: []string{"ssh-ed25519 AAAA"},
+		},
+	}
+	_, err = userHome("ubuntu", "/chroot")
+	asserter.AssertErrContains(err, "Error looking up user")
+	err = addAuthorizedKeys(addUsers[0], "/chroot", false)
+	asserter.AssertErrContains(err, "Error looking up user")
+}
+
+// TestManualWriteFile tests writing files with inline and templated content
+func TestManualWriteFile(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	targetDir := t.TempDir()
+	imageDef := imagedefinition.ImageDefinition{
+		Series:       "jammy",
+		Architecture: "arm64",
+	}
+
+	writeFiles := []*imagedefinition.WriteFile{
+		{
+			Path:        "/inline",
+			Content:     "{{.Series}}\n",
+			Permissions: 0600,
+		},
+		{
+			Path:        "/template",
+			Content:     "{{.Series}} on {{.Architecture}}\n",
+			Template:    true,
+			Permissions: 0755,
+		},
+	}
+	err := manualWriteFile(writeFiles, imageDef, targetDir, true)
+	asserter.AssertErrNil(err, true)
+
+	expected := map[string]struct {
+		content string
+		mode    os.FileMode
+	}{
+		"inline":   {"{{.Series}}\n", 0600},
+		"template": {"jammy on arm64\n", 0755},
+	}
+	for name, file := range expected {
+		content, err := os.ReadFile(filepath.Join(targetDir, name))
+		asserter.AssertErrNil(err, true)
+		asserter.AssertEqual(file.content, string(content))
+		info, err := os.Stat(filepath.Join(targetDir, name))
+		asserter.AssertErrNil(err, true)
+		asserter.AssertEqual(file.mode, info.Mode().Perm())
+	}
+}
+
+// TestFailedManualWriteFile tests the fail cases of the manualWriteFile function
+func TestFailedManualWriteFile(t *testing.T) {
+	testCases := []struct {
+		name        string
+		writeFile   imagedefinition.WriteFile
+		expectedErr string
+	}{
+		{
+			"bad_template",
+			imagedefinition.WriteFile{Path: "/file", Content: "{{.Series", Template: true},
+			"Error parsing template",
+		},
+		{
+			"unknown_field",
+			imagedefinition.WriteFile{Path: "/file", Content: "{{.Codename}}", Template: true},
+			"Error rendering template",
+		},
+		{
+			"missing_dir",
+			imagedefinition.WriteFile{Path: "/does/not/exist", Content: "test"},
+			"Error writing file",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run("test_failed_manual_write_file_"+tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			err := manualWriteFile([]*imagedefinition.WriteFile{&tc.writeFile},
+				imagedefinition.ImageDefinition{}, t.TempDir(), false)
+			asserter.AssertErrContains(err, tc.expectedErr)
+		})
+	}
+}
+
+// TestManualSymlink tests creating and replacing symbolic links
+func TestManualSymlink(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	targetDir := t.TempDir()
+	err := os.WriteFile(filepath.Join(targetDir, "localtime"), []byte("UTC"), 0644)
+	asserter.AssertErrNil(err, true)
+
+	symlinks := []*imagedefinition.Symlink{
+		{Path: "/localtime", Target: "/usr/share/zoneinfo/Europe/Paris"},
+		{Path: "/link", Target: "relative/target"},
+	}
+	err = manualSymlink(symlinks, targetDir, true)
+	asserter.AssertErrNil(err, true)
+
+	for _, symlink := range symlinks {
+		target, err := os.Readlink(filepath.Join(targetDir, symlink.Path))
+		asserter.AssertErrNil(err, true)
+		asserter.AssertEqual(symlink.Target, target)
+	}
+
+	err = manualSymlink([]*imagedefinition.Symlink{{Path: "/does/not/exist", Target: "/"}}, targetDir, false)
+	asserter.AssertErrContains(err, "Error creating symbolic link")
+}
+
+// TestManualChmod tests changing the permissions of files
+func TestManualChmod(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	targetDir := t.TempDir()
+	err := os.WriteFile(filepath.Join(targetDir, "file"), []byte("test"), 0644)
+	asserter.AssertErrNil(err, true)
+
+	err = manualChmod([]*imagedefinition.Chmod{{Path: "/file", Permissions: 0700}}, targetDir, true)
+	asserter.AssertErrNil(err, true)
+	info, err := os.Stat(filepath.Join(targetDir, "file"))
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual(os.FileMode(0700), info.Mode().Perm())
+
+	err = manualChmod([]*imagedefinition.Chmod{{Path: "/missing", Permissions: 0700}}, targetDir, false)
+	asserter.AssertErrContains(err, "Error changing permissions")
+}
+
+// TestManualLinkToHost tests that the manual customizations writing to a path
+// of the chroot which is an absolute symbolic link do not change the file of
+// the host with the same path
+func TestManualLinkToHost(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	targetDir := t.TempDir()
+	hostFile := filepath.Join(t.TempDir(), "localtime")
+	err := os.WriteFile(hostFile, []byte("host"), 0644)
+	asserter.AssertErrNil(err, true)
+	chrootFile := filepath.Join(targetDir, hostFile)
+	err = os.MkdirAll(filepath.Dir(chrootFile), 0755)
+	asserter.AssertErrNil(err, true)
+	err = os.Symlink(hostFile, filepath.Join(targetDir, "localtime"))
+	asserter.AssertErrNil(err, true)
+
+	writeFiles := []*imagedefinition.WriteFile{{Path: "/localtime", Content: "chroot", Permissions: 0644}}
+	err = manualWriteFile(writeFiles, imagedefinition.ImageDefinition{}, targetDir, false)
+	asserter.AssertErrNil(err, true)
+	err = manualChmod([]*imagedefinition.Chmod{{Path: "/localtime", Permissions: 0600}}, targetDir, false)
+	asserter.AssertErrNil(err, true)
+
+	content, err := os.ReadFile(hostFile)
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual("host", string(content))
+	info, err := os.Stat(hostFile)
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual(os.FileMode(0644), info.Mode().Perm())
+
+	content, err = os.ReadFile(chrootFile)
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual("chroot", string(content))
+	info, err = os.Stat(chrootFile)
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual(os.FileMode(0600), info.Mode().Perm())
+}
+
+// TestResolveInChroot tests resolving paths in a chroot containing symbolic links
+func TestResolveInChroot(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	targetDir := t.TempDir()
+	err := os.MkdirAll(filepath.Join(targetDir, "usr", "share", "zoneinfo"), 0755)
+	asserter.AssertErrNil(err, true)
+	links := map[string]string{
+		"etc":      "/usr/share",
+		"relative": "usr/share/zoneinfo",
+		"escape":   "../../../usr",
+		"loop":     "/loop",
+	}
+	for link, target := range links {
+		err := os.Symlink(target, filepath.Join(targetDir, link))
+		asserter.AssertErrNil(err, true)
+	}
+
+	testCases := []struct {
+		name     string
+		path     string
+		expected string
+	}{
+		{"no_link", "/usr/share/zoneinfo", "/usr/share/zoneinfo"},
+		{"absolute_link", "/etc/zoneinfo/UTC", "/usr/share/zoneinfo/UTC"},
+		{"relative_link", "/relative/UTC", "/usr/share/zoneinfo/UTC"},
+		{"parent_of_root", "/../../usr", "/usr"},
+		{"link_to_parent_of_root", "/escape/share", "/usr/share"},
+		{"missing", "/missing/../dir/file", "/dir/file"},
+	}
+	for _, tc := range testCases {
+		t.Run("test_resolve_in_chroot_"+tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			resolved, err := resolveInChroot(targetDir, tc.path)
+			asserter.AssertErrNil(err, true)
+			asserter.AssertEqual(filepath.Join(targetDir, tc.expected), resolved)
+		})
+	}
+
+	_, err = resolveInChroot(targetDir, "/loop/file")
+	asserter.AssertErrContains(err, "too many levels of symbolic links")
+}
+
+// TestManualChown tests the commands used to change the owner of files
+func TestManualChown(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	mockCmder := NewMockExecCommand()
+	execCommand = mockCmder.Command
+	t.Cleanup(func() { execCommand = exec.Command })
+
+	stdout, restoreStdout, err := helper.CaptureStd(&os.Stdout)
+	asserter.AssertErrNil(err, true)
+	t.Cleanup(func() { restoreStdout() })
+
+	chowns := []*imagedefinition.Chown{
+		{Path: "/home/ubuntu", Owner: "ubuntu:ubuntu", Recursive: true},
+		{Path: "/etc/file", Owner: "1000"},
+	}
+	err = manualChown(chowns, "/chroot", true)
+	asserter.AssertErrNil(err, true)
+	// an empty owner leaves the file untouched
+	err = chownInChroot("/chroot", "/etc/other", "", false, true)
+	asserter.AssertErrNil(err, true)
+
+	restoreStdout()
+	readStdout, err := io.ReadAll(stdout)
+	asserter.AssertErrNil(err, true)
+
+	expectedCmds := []string{
+		"chroot /chroot chown --recursive --no-dereference ubuntu:ubuntu /home/ubuntu",
+		"chroot /chroot chown --no-dereference 1000 /etc/file",
+	}
+	for _, expectedCmd := range expectedCmds {
+		if !strings.Contains(string(readStdout), expectedCmd) {
+			t.Errorf("Expected command \"%s\" to be run. Output is:\n%s", expectedCmd, readStdout)
+		}
+	}
+	if strings.Contains(string(readStdout), "/etc/other") {
+		t.Errorf("Did not expect the owner of /etc/other to be changed")
+	}
+
+	execCommand = fakeExecCommand
+	testCaseName = "TestFailedManualChown"
+	t.Cleanup(func() { testCaseName = "" })
+	err = manualChown(chowns, "/chroot", false)
+	asserter.AssertErrContains(err, "Error changing owner")
+}
+
+// TestManualRemovePath tests removing files and directories
+func TestManualRemovePath(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	targetDir := t.TempDir()
+	err := os.MkdirAll(filepath.Join(targetDir, "dir", "subdir"), 0755)
+	asserter.AssertErrNil(err, true)
+	err = os.WriteFile(filepath.Join(targetDir, "file"), []byte("test"), 0644)
+	asserter.AssertErrNil(err, true)
+
+	err = manualRemovePath([]*imagedefinition.RemovePath{{Path: "/dir"}}, targetDir, false)
+	asserter.AssertErrContains(err, "Error removing")
+
+	removePaths := []*imagedefinition.RemovePath{
+		{Path: "/file"},
+		{Path: "/dir", Recursive: true},
+	}
+	err = manualRemovePath(removePaths, targetDir, true)
+	asserter.AssertErrNil(err, true)
+	for _, removePath := range removePaths {
+		_, err := os.Lstat(filepath.Join(targetDir, removePath.Path))
+		if !os.IsNotExist(err) {
+			t.Errorf("Expected %s to be removed", removePath.Path)
+		}
+	}
+}
+
+// TestManualCopyTree tests copying the contents of a directory
+func TestManualCopyTree(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	confDefPath := t.TempDir()
+	targetDir := t.TempDir()
+	err := os.MkdirAll(filepath.Join(confDefPath, "tree", "subdir"), 0755)
+	asserter.AssertErrNil(err, true)
+	err = os.WriteFile(filepath.Join(confDefPath, "tree", "subdir", "file"), []byte("test"), 0600)
+	asserter.AssertErrNil(err, true)
+	err = os.Symlink("subdir/file", filepath.Join(confDefPath, "tree", "link"))
+	asserter.AssertErrNil(err, true)
+
+	copyTrees := []*imagedefinition.CopyTree{{Source: "tree", Dest: "/opt/tree"}}
+	err = manualCopyTree(copyTrees, confDefPath, targetDir, true)
+	asserter.AssertErrNil(err, true)
+
+	info, err := os.Stat(filepath.Join(targetDir, "opt", "tree", "subdir", "file"))
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual(os.FileMode(0600), info.Mode().Perm())
+	target, err := os.Readlink(filepath.Join(targetDir, "opt", "tree", "link"))
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual("subdir/file", target)
+
+	copyTrees = []*imagedefinition.CopyTree{{Source: "missing", Dest: "/opt/tree"}}
+	err = manualCopyTree(copyTrees, confDefPath, targetDir, false)
+	asserter.AssertErrContains(err, "Error reading directory")
+}
+
 // TestGenerateAptCmd unit tests the generateAptCmd function
 func TestGenerateAptCmds(t *testing.T) {
 	testCases := []struct {
-		name        string
-		targetDir   string
-		packageList []string
-		expected    string
+		name           string
+		targetDir      string
+		packageList    []string
+		aptOptions     []string
+		expected       string
+		expectedUpdate string
 	}{
-		{"one_package", "chroot1", []string{"test"}, "chroot chroot1 apt install --assume-yes --quiet --option=Dpkg::options::=--force-unsafe-io --option=Dpkg::Options::=--force-confold test"},
-		{"many_packages", "chroot2", []string{"test1", "test2"}, "chroot chroot2 apt install --assume-yes --quiet --option=Dpkg::options::=--force-unsafe-io --option=Dpkg::Options::=--force-confold test1 test2"},
+		{"one_package", "chroot1", []string{"test"}, nil, "chroot chroot1 apt install --assume-yes --quiet --option=Dpkg::options::=--force-unsafe-io --option=Dpkg::Options::=--force-confold test", "chroot chroot1 apt update"},
+		{"many_packages", "chroot2", []string{"test1", "test2"}, nil, "chroot chroot2 apt install --assume-yes --quiet --option=Dpkg::options::=--force-unsafe-io --option=Dpkg::Options::=--force-confold test1 test2", "chroot chroot2 apt update"},
+		{"apt_options", "chroot3", []string{"test"}, []string{"Acquire::Retries=3", "APT::Install-Recommends=false"}, "chroot chroot3 apt install --assume-yes --quiet --option=Dpkg::options::=--force-unsafe-io --option=Dpkg::Options::=--force-confold --option=Acquire::Retries=3 --option=APT::Install-Recommends=false test", "chroot chroot3 apt update --option=Acquire::Retries=3 --option=APT::Install-Recommends=false"},
 	}
 	for _, tc := range testCases {
 		t.Run("test_generate_apt_cmd_"+tc.name, func(t *testing.T) {
-			aptCmds := generateAptCmds(tc.targetDir, tc.packageList)
+			aptCmds := generateAptCmds(tc.targetDir, tc.packageList, tc.aptOptions)
+			if !strings.HasSuffix(aptCmds[0].String(), tc.expectedUpdate) {
+				t.Errorf("Expected apt command \"%s\" but got \"%s\"", tc.expectedUpdate, aptCmds[0].String())
+			}
 			if !strings.Contains(aptCmds[1].String(), tc.expected) {
 				t.Errorf("Expected apt command \"%s\" but got \"%s\"", tc.expected, aptCmds[1].String())
 			}
@@ -1037,7 +1791,7 @@ func TestImportPPAKeys(t *testing.T) {
 			asserter.AssertErrNil(err, true)
 
 			keyFilePath := filepath.Join(tmpTrustedDir, tc.keyFileName)
-			err = importPPAKeys(tc.ppa, tmpGPGDir, keyFilePath, false)
+			err = importPPAKeys(tc.ppa, tmpGPGDir, keyFilePath, "", false)
 			asserter.AssertErrNil(err, true)
 
 			keyData, err := os.ReadFile(keyFilePath)
@@ -1073,7 +1827,7 @@ func TestFailedImportPPAKeys(t *testing.T) {
 			Fingerprint: "testfakefingperint",
 		}
 
-		err = importPPAKeys(ppa, tmpGPGDir, keyFilePath, false)
+		err = importPPAKeys(ppa, tmpGPGDir, keyFilePath, "", false)
 		asserter.AssertErrContains(err, "Error running gpg command")
 
 		// now use a valid PPA and mock some functions
@@ -1086,7 +1840,7 @@ func TestFailedImportPPAKeys(t *testing.T) {
 		defer func() {
 			httpGet = http.Get
 		}()
-		err = importPPAKeys(ppa, tmpGPGDir, keyFilePath, false)
+		err = importPPAKeys(ppa, tmpGPGDir, keyFilePath, "", false)
 		asserter.AssertErrContains(err, "Error getting signing key")
 		httpGet = http.Get
 
@@ -1095,7 +1849,7 @@ func TestFailedImportPPAKeys(t *testing.T) {
 		defer func() {
 			ioReadAll = io.ReadAll
 		}()
-		err = importPPAKeys(ppa, tmpGPGDir, keyFilePath, false)
+		err = importPPAKeys(ppa, tmpGPGDir, keyFilePath, "", false)
 		asserter.AssertErrContains(err, "Error reading signing key")
 		ioReadAll = io.ReadAll
 
@@ -1104,7 +1858,7 @@ func TestFailedImportPPAKeys(t *testing.T) {
 		defer func() {
 			jsonUnmarshal = json.Unmarshal
 		}()
-		err = importPPAKeys(ppa, tmpGPGDir, keyFilePath, false)
+		err = importPPAKeys(ppa, tmpGPGDir, keyFilePath, "", false)
 		asserter.AssertErrContains(err, "Error unmarshalling launchpad API response")
 		jsonUnmarshal = json.Unmarshal
 	})
@@ -1534,3 +2288,192 @@ func TestStateMachine_setConfDefDir(t *testing.T) {
 		})
 	}
 }
+
+// TestValidateLayerNames tests that installer layers must extend the previous layer
+func TestValidateLayerNames(t *testing.T) {
+	testCases := []struct {
+		name          string
+		layers        []string
+		expectedError string
+	}{
+		{"single_layer", []string{"minimal"}, ""},
+		{"valid_layers", []string{"minimal", "minimal.standard", "minimal.standard.live"}, ""},
+		{"not_extending", []string{"minimal", "standard"}, "Layer \"standard\" does not extend the previous layer \"minimal\""},
+		{"skipping_a_layer", []string{"minimal", "minimal.standard.live"}, "does not extend the previous layer"},
+	}
+	for _, tc := range testCases {
+		t.Run("test_validate_layer_names_"+tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			err := validateLayerNames(tc.layers)
+			if tc.expectedError == "" {
+				asserter.AssertErrNil(err, true)
+			} else {
+				asserter.AssertErrContains(err, tc.expectedError)
+			}
+		})
+	}
+}
+
+// createGitGadgetRepo creates a local repository with a tagged first commit
+// adding a submodule, and a second commit. It returns the repository and
+// the SHAs of both commits
+func createGitGadgetRepo(t *testing.T) (string, string, string) {
+	t.Helper()
+	asserter := helper.Asserter{T: t}
+	runGit := func(dir string, args ...string) string {
+		gitCmd := exec.Command("git", append([]string{"-c", "protocol.file.allow=always"}, args...)...)
+		gitCmd.Dir = dir
+		gitCmd.Env = append(os.Environ(), "GIT_AUTHOR_NAME=test", "GIT_AUTHOR_EMAIL=test@example.com",
+			"GIT_COMMITTER_NAME=test", "GIT_COMMITTER_EMAIL=test@example.com")
+		output, err := gitCmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("Error running git %s: %s", strings.Join(args, " "), string(output))
+		}
+		return strings.TrimSpace(string(output))
+	}
+
+	submoduleDir := t.TempDir()
+	runGit(submoduleDir, "init", "-b", "main")
+	err := os.WriteFile(filepath.Join(submoduleDir, "firmware"), []byte("firmware\n"), 0644)
+	asserter.AssertErrNil(err, true)
+	runGit(submoduleDir, "add", "firmware")
+	runGit(submoduleDir, "commit", "-m", "firmware")
+
+	repoDir := t.TempDir()
+	runGit(repoDir, "init", "-b", "main")
+	err = os.WriteFile(filepath.Join(repoDir, "version"), []byte("1\n"), 0644)
+	asserter.AssertErrNil(err, true)
+	runGit(repoDir, "submodule", "add", submoduleDir, "firmware")
+	runGit(repoDir, "add", "version")
+	runGit(repoDir, "commit", "-m", "version 1")
+	runGit(repoDir, "tag", "-a", "v1", "-m", "v1")
+	firstCommit := runGit(repoDir, "rev-parse", "HEAD")
+
+	err = os.WriteFile(filepath.Join(repoDir, "version"), []byte("2\n"), 0644)
+	asserter.AssertErrNil(err, true)
+	runGit(repoDir, "commit", "-a", "-m", "version 2")
+	secondCommit := runGit(repoDir, "rev-parse", "HEAD")
+
+	return repoDir, firstCommit, secondCommit
+}
+
+// TestCloneGitRepo tests that git gadgets are checked out at their ref, along
+// with their submodules, and that the commit checked out is returned
+func TestCloneGitRepo(t *testing.T) {
+	repoDir, firstCommit, secondCommit := createGitGadgetRepo(t)
+	testCases := []struct {
+		name            string
+		ref             string
+		branch          string
+		submodules      bool
+		expectedVersion string
+		expectedCommit  string
+	}{
+		{"default_branch", "", "", false, "2\n", secondCommit},
+		{"branch", "", "main", false, "2\n", secondCommit},
+		{"tag", "v1", "", false, "1\n", firstCommit},
+		{"short_sha", firstCommit[:10], "main", false, "1\n", firstCommit},
+		{"submodules", "v1", "", true, "1\n", firstCommit},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			workDir := t.TempDir()
+			imageDef := imagedefinition.ImageDefinition{
+				Gadget: &imagedefinition.Gadget{
+					GadgetType:   "git",
+					GadgetURL:    "file://" + repoDir,
+					GadgetBranch: tc.branch,
+					Ref:          tc.ref,
+					Submodules:   tc.submodules,
+				},
+			}
+			commit, err := cloneGitRepo(imageDef, "", workDir)
+			asserter.AssertErrNil(err, true)
+			asserter.AssertEqual(tc.expectedCommit, commit)
+
+			version, err := os.ReadFile(filepath.Join(workDir, "version"))
+			asserter.AssertErrNil(err, true)
+			asserter.AssertEqual(tc.expectedVersion, string(version))
+
+			_, err = os.Stat(filepath.Join(workDir, "firmware", "firmware"))
+			if tc.submodules && err != nil {
+				t.Errorf("Expected the submodule to be checked out: %s", err.Error())
+			} else if !tc.submodules && err == nil {
+				t.Errorf("Expected the submodule not to be checked out")
+			}
+		})
+	}
+}
+
+// TestFailedCloneGitRepo tests the failures of cloning git gadgets
+func TestFailedCloneGitRepo(t *testing.T) {
+	repoDir, _, _ := createGitGadgetRepo(t)
+	confDefPath := t.TempDir()
+	err := os.WriteFile(filepath.Join(confDefPath, "bad-key"), []byte("not a key"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCases := []struct {
+		name          string
+		ref           string
+		auth          *imagedefinition.GadgetAuth
+		expectedError string
+	}{
+		{"missing_ref", "missing", nil, "Error resolving ref \"missing\""},
+		{"missing_token", "", &imagedefinition.GadgetAuth{TokenFile: "token"}, "Error reading token"},
+		{"bad_ssh_key", "", &imagedefinition.GadgetAuth{SSHKey: "bad-key"}, "Error reading SSH key"},
+		{"missing_passphrase", "", &imagedefinition.GadgetAuth{SSHKey: "bad-key", PassphraseFile: "passphrase"},
+			"Error reading SSH key passphrase"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			imageDef := imagedefinition.ImageDefinition{
+				Gadget: &imagedefinition.Gadget{
+					GadgetType: "git",
+					GadgetURL:  "file://" + repoDir,
+					Ref:        tc.ref,
+					Auth:       tc.auth,
+				},
+			}
+			_, err := cloneGitRepo(imageDef, confDefPath, t.TempDir())
+			asserter.AssertErrContains(err, tc.expectedError)
+		})
+	}
+}
+
+// TestGitAuth tests that tokens are read from files relative to the image
+// definition and used over HTTPS
+func TestGitAuth(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	confDefPath := t.TempDir()
+	err := os.WriteFile(filepath.Join(confDefPath, "token"), []byte("s3cr3t\n"), 0600)
+	asserter.AssertErrNil(err, true)
+
+	auth, err := gitAuth(&imagedefinition.GadgetAuth{TokenFile: "token"}, confDefPath)
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual(&githttp.BasicAuth{Username: "git", Password: "s3cr3t"}, auth)
+
+	auth, err = gitAuth(&imagedefinition.GadgetAuth{TokenFile: filepath.Join(confDefPath, "token"),
+		Username: "oauth2"}, "/nonexistent")
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual(&githttp.BasicAuth{Username: "oauth2", Password: "s3cr3t"}, auth)
+
+	auth, err = gitAuth(nil, confDefPath)
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual(nil, auth)
+}
+
+// TestFailedReadSeedPackages tests that the errors of reading a seed file
+// are returned
+func TestFailedReadSeedPackages(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	seedFile := filepath.Join(t.TempDir(), "minimal.manifest")
+	// a line longer than the buffer of the scanner can not be read
+	err := os.WriteFile(seedFile, []byte("hello 1.0\n"+strings.Repeat("a", bufio.MaxScanTokenSize)+"\n"), 0644)
+	asserter.AssertErrNil(err, true)
+
+	_, err = readSeedPackages(seedFile)
+	asserter.AssertErrContains(err, "Error reading seed file")
+}
@@ -0,0 +1,120 @@
+package statemachine
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// hooksDirectories returns the directories of the hook scripts: the ones of
+// the image definition of classic images, relative to it, then the ones
+// given with --hooks-dir
+func (stateMachine *StateMachine) hooksDirectories() []string {
+	var hooksDirs []string
+	if classicStateMachine, ok := stateMachine.parent.(*ClassicStateMachine); ok {
+		for _, hooksDir := range classicStateMachine.ImageDef.Hooks {
+			if !filepath.IsAbs(hooksDir) {
+				hooksDir = filepath.Join(stateMachine.ConfDefPath, hooksDir)
+			}
+			hooksDirs = append(hooksDirs, hooksDir)
+		}
+	}
+	return append(hooksDirs, stateMachine.commonFlags.HooksDirectories...)
+}
+
+// runHooks runs the hook scripts named hookName in every hooks directory.
+// The executables in the hookName.d directory are run first, in
+// alphabetical order, then the hookName executable itself
+func (stateMachine *StateMachine) runHooks(hookName string) error {
+	for _, hooksDir := range stateMachine.hooksDirectories() {
+		var hookScripts []string
+
+		// it is fine for hookName.d not to exist, but if it does
+		// every executable in it is run
+		hooksDird := filepath.Join(hooksDir, hookName+".d")
+		if entries, err := osReadDir(hooksDird); err == nil {
+			for _, entry := range entries {
+				info, err := entry.Info()
+				if err != nil || !isExecutableFile(info) {
+					continue
+				}
+				hookScripts = append(hookScripts, filepath.Join(hooksDird, entry.Name()))
+			}
+			sort.Strings(hookScripts)
+		}
+
+		hookScript := filepath.Join(hooksDir, hookName)
+		if info, err := os.Stat(hookScript); err == nil && isExecutableFile(info) {
+			hookScripts = append(hookScripts, hookScript)
+		}
+
+		for _, hookScript := range hookScripts {
+			if err := stateMachine.runHookScript(hookScript); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// isExecutableFile returns whether a hook script is run: the ones that are
+// not executable are ignored
+func isExecutableFile(info os.FileInfo) bool {
+	return !info.IsDir() && info.Mode()&0111 != 0
+}
+
+// runHookScript runs a hook script with the locations of the build in its
+// environment
+func (stateMachine *StateMachine) runHookScript(hookScript string) error {
+	if stateMachine.commonFlags.Debug {
+		stateMachine.printProgress("Running hook script: %s\n", hookScript)
+	}
+	hookCmd := execCommand(hookScript)
+	// the variables of the build come last so that they take precedence
+	hookCmd.Env = append(os.Environ(), stateMachine.hookEnvironment()...)
+	hookOutput := setCommandOutput(hookCmd, stateMachine.commonFlags.Debug)
+	if err := hookCmd.Run(); err != nil {
+		return fmt.Errorf("Error running hook script %s: %s. Output is:\n%s",
+			hookScript, err.Error(), hookOutput.String())
+	}
+	return nil
+}
+
+// hookEnvironment returns the variables giving the hook scripts the
+// locations of the build. The disk images are separated by spaces, and
+// may not exist yet
+func (stateMachine *StateMachine) hookEnvironment() []string {
+	volumeNames := make([]string, 0, len(stateMachine.VolumeNames))
+	for volumeName := range stateMachine.VolumeNames {
+		volumeNames = append(volumeNames, volumeName)
+	}
+	sort.Strings(volumeNames)
+	var images []string
+	for _, volumeName := range volumeNames {
+		images = append(images, filepath.Join(stateMachine.commonFlags.OutputDir,
+			stateMachine.VolumeNames[volumeName]))
+	}
+
+	return []string{
+		"UBUNTU_IMAGE_HOOK_WORKDIR=" + stateMachine.stateMachineFlags.WorkDir,
+		"UBUNTU_IMAGE_HOOK_ROOTFS=" + stateMachine.tempDirs.rootfs,
+		"UBUNTU_IMAGE_HOOK_CHROOT=" + stateMachine.tempDirs.chroot,
+		"UBUNTU_IMAGE_HOOK_UNPACK=" + stateMachine.tempDirs.unpack,
+		"UBUNTU_IMAGE_HOOK_VOLUMES=" + stateMachine.tempDirs.volumes,
+		"UBUNTU_IMAGE_HOOK_OUTPUT_DIR=" + stateMachine.commonFlags.OutputDir,
+		"UBUNTU_IMAGE_HOOK_IMAGES=" + strings.Join(images, " "),
+	}
+}
+
+// runState runs a state along with its pre- and post- hooks
+func (stateMachine *StateMachine) runState(stateFunc stateFunc) error {
+	if err := stateMachine.runHooks("pre-" + stateFunc.name); err != nil {
+		return err
+	}
+	if err := stateFunc.function(stateMachine); err != nil {
+		return err
+	}
+	return stateMachine.runHooks("post-" + stateFunc.name)
+}
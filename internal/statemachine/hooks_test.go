@@ -0,0 +1,138 @@
+package statemachine
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/canonical/ubuntu-image/internal/helper"
+	"github.com/canonical/ubuntu-image/internal/imagedefinition"
+)
+
+// TestHooks tests that the hook scripts of the hooks directories are run
+// after the state they are named for
+func TestHooks(t *testing.T) {
+	testCases := []struct {
+		name          string
+		hooksDir      string
+		expectedFiles []string
+	}{
+		{"hook_script", "good_hookscript", []string{"post-populate-rootfs-hookfile"}},
+		{"hooks_d", "good_hooksd", []string{"post-populate-rootfs-hookfile.d1", "post-populate-rootfs-hookfile.d2"}},
+		// hook scripts that are not executable are ignored
+		{"not_executable", "hooks_not_executable", nil},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			var stateMachine testStateMachine
+			stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+			stateMachine.commonFlags.HooksDirectories = []string{filepath.Join(testDataDir, tc.hooksDir)}
+			stateMachine.tempDirs.rootfs = t.TempDir()
+			stateMachine.states = []stateFunc{
+				{"populate-rootfs", func(stateMachine *StateMachine) error { return nil }},
+			}
+
+			err := stateMachine.Run()
+			asserter.AssertErrNil(err, true)
+			for _, expectedFile := range tc.expectedFiles {
+				if _, err := os.Stat(filepath.Join(stateMachine.tempDirs.rootfs, expectedFile)); err != nil {
+					t.Errorf("Expected the hook to create %s: %s", expectedFile, err.Error())
+				}
+			}
+		})
+	}
+}
+
+// TestHooksOrderAndEnvironment tests that the hooks run before and after the
+// states in order, with the locations of the build in their environment
+func TestHooksOrderAndEnvironment(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	outputDir := t.TempDir()
+	logFile := filepath.Join(t.TempDir(), "hooks.log")
+	hooksDirs := []string{t.TempDir(), t.TempDir()}
+	writeHook := func(path string, mode os.FileMode) {
+		err := os.MkdirAll(filepath.Dir(path), 0755)
+		asserter.AssertErrNil(err, true)
+		script := "#!/bin/sh\necho \"" + filepath.Base(path) + " $UBUNTU_IMAGE_HOOK_OUTPUT_DIR $UBUNTU_IMAGE_HOOK_IMAGES\" >> " +
+			logFile + "\n"
+		err = os.WriteFile(path, []byte(script), mode)
+		asserter.AssertErrNil(err, true)
+	}
+	writeHook(filepath.Join(hooksDirs[0], "pre-make_disk"), 0755)
+	writeHook(filepath.Join(hooksDirs[0], "post-make_disk.d", "02-second"), 0755)
+	writeHook(filepath.Join(hooksDirs[0], "post-make_disk.d", "01-first"), 0755)
+	writeHook(filepath.Join(hooksDirs[0], "post-make_disk.d", "03-not-executable"), 0644)
+	writeHook(filepath.Join(hooksDirs[1], "post-make_disk"), 0755)
+	writeHook(filepath.Join(hooksDirs[1], "pre-finish"), 0755)
+	writeHook(filepath.Join(hooksDirs[1], "post-finish"), 0644)
+
+	// the variables of the build replace the ones of the environment
+	t.Setenv("UBUNTU_IMAGE_HOOK_OUTPUT_DIR", "/nonexistent")
+
+	var stateMachine testStateMachine
+	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+	stateMachine.commonFlags.HooksDirectories = hooksDirs
+	stateMachine.commonFlags.OutputDir = outputDir
+	stateMachine.states = []stateFunc{
+		{"make_disk", func(stateMachine *StateMachine) error {
+			stateMachine.VolumeNames = map[string]string{"pc": "pc.img", "data": "data.img"}
+			return nil
+		}},
+		{"finish", (*StateMachine).finish},
+	}
+	err := stateMachine.Run()
+	asserter.AssertErrNil(err, true)
+
+	hooksLog, err := os.ReadFile(logFile)
+	asserter.AssertErrNil(err, true)
+	images := filepath.Join(outputDir, "data.img") + " " + filepath.Join(outputDir, "pc.img")
+	asserter.AssertEqual([]string{
+		"pre-make_disk " + outputDir + " ",
+		"01-first " + outputDir + " " + images,
+		"02-second " + outputDir + " " + images,
+		"post-make_disk " + outputDir + " " + images,
+		"pre-finish " + outputDir + " " + images,
+	}, strings.Split(strings.TrimSpace(string(hooksLog)), "\n"))
+}
+
+// TestFailedHooks tests that the failures of the hook scripts fail the build
+func TestFailedHooks(t *testing.T) {
+	testCases := []struct {
+		name     string
+		hooksDir string
+	}{
+		{"return_error", "hooks_return_error"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			var stateMachine testStateMachine
+			stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+			stateMachine.commonFlags.HooksDirectories = []string{filepath.Join(testDataDir, tc.hooksDir)}
+			stateMachine.states = []stateFunc{
+				{"populate-rootfs", func(stateMachine *StateMachine) error { return nil }},
+			}
+
+			err := stateMachine.Run()
+			asserter.AssertErrContains(err, "Error running hook script")
+			asserter.AssertEqual(0, len(stateMachine.StatesTaken))
+		})
+	}
+}
+
+// TestHooksDirectories tests that the hooks directories of image definitions
+// are relative to them and come before the ones given with --hooks-dir
+func TestHooksDirectories(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	var stateMachine ClassicStateMachine
+	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+	stateMachine.parent = &stateMachine
+	stateMachine.ConfDefPath = "/images"
+	stateMachine.ImageDef = imagedefinition.ImageDefinition{Hooks: []string{"hooks", "/usr/share/hooks"}}
+	stateMachine.commonFlags.HooksDirectories = []string{"local-hooks"}
+
+	asserter.AssertEqual([]string{"/images/hooks", "/usr/share/hooks", "local-hooks"},
+		stateMachine.hooksDirectories())
+}
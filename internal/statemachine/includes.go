@@ -0,0 +1,302 @@
+package statemachine
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// imageDefinitionVariableRegex matches the ${VAR} references of image
+// definitions, along with the $${VAR} escapes of literal references
+var imageDefinitionVariableRegex = regexp.MustCompile(`\$?\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// imageDefinitionVariableNameRegex matches the names of the variables
+// that can be given with --set
+var imageDefinitionVariableNameRegex = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// imageDefinitionIntegerRegex matches the values of variables that are
+// substituted as integers
+var imageDefinitionIntegerRegex = regexp.MustCompile(`^(0|-?[1-9][0-9]*)$`)
+
+// imageDefinitionPayloads are the keys of the free-form payloads of image
+// definitions, which are copied in the image as they are written. Their
+// ${VAR} references are left alone, as they are meant for the image
+var imageDefinitionPayloads = map[string]bool{
+	"customization:cloud-init":                true,
+	"customization:manual:write-file:content": true,
+}
+
+// imageDefinitionMerger reads an image definition along with the image
+// definitions it extends and includes, and merges them
+type imageDefinitionMerger struct {
+	variables map[string]string // values given with --set, which take precedence over the environment
+	sums      map[string]string // sha256 sums of the included files, by path
+	files     []string          // the files read, starting with the image definition
+	loading   []string          // files being loaded, to detect include cycles
+}
+
+// loadImageDefinition reads the image definition at path, merges it with
+// the image definitions it extends and includes and substitutes the
+// variables it references. It returns the merged image definition as YAML
+func (merger *imageDefinitionMerger) loadImageDefinition(path string) ([]byte, error) {
+	definition, err := merger.load(path)
+	if err != nil {
+		return nil, err
+	}
+	merged, err := yaml.Marshal(definition)
+	if err != nil {
+		return nil, fmt.Errorf("Error merging image definition \"%s\": %s", path, err.Error())
+	}
+	return merged, nil
+}
+
+// load reads an image definition and recursively merges the image
+// definitions it extends and includes into it
+func (merger *imageDefinitionMerger) load(path string) (yaml.MapSlice, error) {
+	path = filepath.Clean(path)
+	for _, loadingPath := range merger.loading {
+		if loadingPath == path {
+			return nil, fmt.Errorf("Error including image definition \"%s\": include cycle through %s",
+				path, strings.Join(append(merger.loading, path), " -> "))
+		}
+	}
+	merger.loading = append(merger.loading, path)
+	defer func() { merger.loading = merger.loading[:len(merger.loading)-1] }()
+
+	data, err := osReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Error opening image definition file: %s", err.Error())
+	}
+	merger.files = append(merger.files, path)
+	if len(merger.loading) > 1 {
+		merger.sums[path] = fmt.Sprintf("%x", sha256.Sum256(data))
+	}
+	// mappings are kept ordered, as the order of some keys matters
+	var definition yaml.MapSlice
+	if err := yaml.Unmarshal(data, &definition); err != nil {
+		return nil, err
+	}
+	substituted, err := merger.substitute(definition, path)
+	if err != nil {
+		return nil, err
+	}
+	definition = substituted.(yaml.MapSlice)
+
+	parents, err := definitionParents(definition, path)
+	if err != nil {
+		return nil, err
+	}
+	definition = removeKey(removeKey(definition, "extends"), "include")
+
+	merged := yaml.MapSlice{}
+	for _, parent := range parents {
+		if !filepath.IsAbs(parent) {
+			parent = filepath.Join(filepath.Dir(path), parent)
+		}
+		parentDefinition, err := merger.load(parent)
+		if err != nil {
+			return nil, err
+		}
+		merged = mergeImageDefinitions(merged, parentDefinition).(yaml.MapSlice)
+	}
+	return mergeImageDefinitions(merged, definition).(yaml.MapSlice), nil
+}
+
+// definitionParents returns the image definitions that an image definition
+// extends and includes, in the order they are merged
+func definitionParents(definition yaml.MapSlice, path string) ([]string, error) {
+	var parents []string
+	if i := keyIndex(definition, "extends"); i >= 0 {
+		extends := definition[i].Value
+		parent, ok := extends.(string)
+		if !ok {
+			return nil, fmt.Errorf("Error parsing image definition \"%s\": extends must be a file name", path)
+		}
+		parents = append(parents, parent)
+	}
+	var include interface{}
+	if i := keyIndex(definition, "include"); i >= 0 {
+		include = definition[i].Value
+	}
+	switch include := include.(type) {
+	case nil:
+	case string:
+		parents = append(parents, include)
+	case []interface{}:
+		for _, item := range include {
+			parent, ok := item.(string)
+			if !ok {
+				return nil, fmt.Errorf("Error parsing image definition \"%s\": include must be a list of file names", path)
+			}
+			parents = append(parents, parent)
+		}
+	default:
+		return nil, fmt.Errorf("Error parsing image definition \"%s\": include must be a list of file names", path)
+	}
+	return parents, nil
+}
+
+// substitute replaces the ${VAR} references in the values of an image
+// definition. A value that only references a variable holding an integer
+// or a boolean becomes an integer or a boolean, so that it can be used
+// for fields like revision. keys are the keys leading to value, without
+// the indexes of lists, which tell the payloads to leave alone
+func (merger *imageDefinitionMerger) substitute(value interface{}, path string, keys ...string) (interface{}, error) {
+	switch value := value.(type) {
+	case yaml.MapSlice:
+		for i, item := range value {
+			itemKeys := append(keys[:len(keys):len(keys)], fmt.Sprint(item.Key))
+			if imageDefinitionPayloads[strings.Join(itemKeys, ":")] {
+				continue
+			}
+			substituted, err := merger.substitute(item.Value, path, itemKeys...)
+			if err != nil {
+				return nil, err
+			}
+			value[i].Value = substituted
+		}
+	case []interface{}:
+		for i, item := range value {
+			substituted, err := merger.substitute(item, path, keys...)
+			if err != nil {
+				return nil, err
+			}
+			value[i] = substituted
+		}
+	case string:
+		var missing []string
+		substituted := imageDefinitionVariableRegex.ReplaceAllStringFunc(value, func(reference string) string {
+			if strings.HasPrefix(reference, "$$") {
+				return reference[1:]
+			}
+			name := imageDefinitionVariableRegex.FindStringSubmatch(reference)[1]
+			variable, found := merger.variables[name]
+			if !found {
+				variable, found = os.LookupEnv(name)
+			}
+			if !found {
+				missing = append(missing, name)
+			}
+			return variable
+		})
+		if len(missing) > 0 {
+			return nil, fmt.Errorf("Error parsing image definition \"%s\": variable %s is not set. "+
+				"Set it in the environment or with --set, or write $${%s} for a literal ${%s}",
+				path, missing[0], missing[0], missing[0])
+		}
+		if substituted == value {
+			return value, nil
+		}
+		if imageDefinitionVariableRegex.FindString(value) == value && !strings.HasPrefix(value, "$$") {
+			if imageDefinitionIntegerRegex.MatchString(substituted) {
+				integer, err := strconv.Atoi(substituted)
+				if err == nil {
+					return integer, nil
+				}
+			}
+			if substituted == "true" || substituted == "false" {
+				return substituted == "true", nil
+			}
+		}
+		return substituted, nil
+	}
+	return value, nil
+}
+
+// mergeImageDefinitions merges an image definition into the image definition
+// it extends or includes:
+//   - mappings are merged key by key, and a null value removes the key
+//   - lists of mappings that all have a name, like extra-packages, extra-snaps
+//     or extra-ppas, are merged by name: an item with the name of an existing
+//     item is merged into it and other items are appended
+//   - other lists and values replace the existing ones
+func mergeImageDefinitions(base, override interface{}) interface{} {
+	switch override := override.(type) {
+	case yaml.MapSlice:
+		baseMap, ok := base.(yaml.MapSlice)
+		if !ok {
+			return override
+		}
+		merged := append(yaml.MapSlice{}, baseMap...)
+		for _, item := range override {
+			if item.Value == nil {
+				merged = removeKey(merged, item.Key)
+				continue
+			}
+			if i := keyIndex(merged, item.Key); i >= 0 {
+				merged[i].Value = mergeImageDefinitions(merged[i].Value, item.Value)
+			} else {
+				merged = append(merged, item)
+			}
+		}
+		return merged
+	case []interface{}:
+		baseList, ok := base.([]interface{})
+		if !ok || !namedItems(baseList) || !namedItems(override) {
+			return override
+		}
+		merged := append([]interface{}{}, baseList...)
+		for _, item := range override {
+			name := itemName(item)
+			found := false
+			for i, baseItem := range merged {
+				if itemName(baseItem) == name {
+					merged[i] = mergeImageDefinitions(baseItem, item)
+					found = true
+					break
+				}
+			}
+			if !found {
+				merged = append(merged, item)
+			}
+		}
+		return merged
+	}
+	return override
+}
+
+// namedItems returns whether the items of a list are all mappings with a name
+func namedItems(list []interface{}) bool {
+	for _, item := range list {
+		if itemName(item) == nil {
+			return false
+		}
+	}
+	return true
+}
+
+// itemName returns the name of a list item, or nil if it has none
+func itemName(item interface{}) interface{} {
+	itemMap, ok := item.(yaml.MapSlice)
+	if !ok {
+		return nil
+	}
+	if i := keyIndex(itemMap, "name"); i >= 0 {
+		return itemMap[i].Value
+	}
+	return nil
+}
+
+// keyIndex returns the index of a key in a mapping, or -1 if it is not found
+func keyIndex(mapping yaml.MapSlice, key interface{}) int {
+	for i, item := range mapping {
+		if item.Key == key {
+			return i
+		}
+	}
+	return -1
+}
+
+// removeKey returns a mapping without the given key
+func removeKey(mapping yaml.MapSlice, key interface{}) yaml.MapSlice {
+	if i := keyIndex(mapping, key); i >= 0 {
+		return append(mapping[:i:i], mapping[i+1:]...)
+	}
+	return mapping
+}
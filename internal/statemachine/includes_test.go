@@ -0,0 +1,155 @@
+package statemachine
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/canonical/ubuntu-image/internal/helper"
+	"github.com/canonical/ubuntu-image/internal/imagedefinition"
+)
+
+// TestImageDefinitionIncludes tests that image definitions are merged with
+// the image definitions they extend and include, and that the variables
+// they reference are substituted
+func TestImageDefinitionIncludes(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	restoreCWD := helper.SaveCWD()
+	t.Cleanup(restoreCWD)
+	t.Setenv("ARCH", "arm64")
+	t.Setenv("SERIES", "focal")
+
+	var stateMachine ClassicStateMachine
+	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+	stateMachine.parent = &stateMachine
+	stateMachine.Args.ImageDefinition = filepath.Join("testdata", "image_definitions", "includes", "server.yaml")
+	stateMachine.Opts.Set = []string{"SERIES=jammy", "REVISION=3", "LXD_CHANNEL=5.0/stable"}
+	err := stateMachine.parseImageDefinition()
+	asserter.AssertErrNil(err, true)
+	imageDef := stateMachine.ImageDef
+
+	// --set takes precedence over the environment
+	asserter.AssertEqual("ubuntu-server-arm64", imageDef.ImageName)
+	asserter.AssertEqual("arm64", imageDef.Architecture)
+	asserter.AssertEqual("jammy", imageDef.Series)
+	asserter.AssertEqual("jammy", imageDef.Rootfs.Seed.SeedBranch)
+	asserter.AssertEqual(3, imageDef.Revision)
+
+	// lists of strings are replaced
+	asserter.AssertEqual([]string{"main"}, imageDef.Rootfs.Components)
+	asserter.AssertEqual([]string{"server", "minimal"}, imageDef.Rootfs.Seed.Names)
+
+	// lists of named items are merged by name, in the order of the includes
+	var packages []string
+	for _, extraPackage := range imageDef.Customization.ExtraPackages {
+		packages = append(packages, extraPackage.PackageName)
+	}
+	asserter.AssertEqual([]string{"hello", "ubuntu-minimal", "cloud-init"}, packages)
+	asserter.AssertEqual([]*imagedefinition.Snap{
+		{SnapName: "lxd", Channel: "5.0/stable", Store: "canonical", SnapRevision: 0},
+		{SnapName: "hello", Channel: "stable", Store: "canonical", SnapRevision: 0},
+		{SnapName: "core22", Channel: "stable", Store: "canonical", SnapRevision: 0},
+	}, imageDef.Customization.ExtraSnaps)
+
+	// escaped references are kept, and so are the references of the
+	// payloads written in the image
+	asserter.AssertEqual("Ubuntu Server ${ARCH}", imageDef.DisplayName)
+	asserter.AssertEqual("#cloud-config\nruncmd:\n  - echo \"${HOSTNAME}\" > \"${HOME}/hostname\"\n",
+		imageDef.Customization.CloudInit.UserData)
+	asserter.AssertEqual("Welcome to ${HOSTNAME}", imageDef.Customization.Manual.WriteFile[0].Content)
+
+	// null values remove the inherited keys
+	if imageDef.Artifacts.Qcow2 != nil {
+		t.Errorf("Expected the qcow2 artifact to be removed, got %v", *imageDef.Artifacts.Qcow2)
+	}
+	asserter.AssertEqual("pc-arm64.img", (*imageDef.Artifacts.Img)[0].ImgName)
+
+	// the included files are recorded to check them when resuming
+	includesDir := filepath.Join("testdata", "image_definitions", "includes")
+	baseSHA256, err := fileSHA256(filepath.Join(includesDir, "base.yaml"))
+	asserter.AssertErrNil(err, true)
+	cloudSHA256, err := fileSHA256(filepath.Join(includesDir, "cloud.yaml"))
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual(map[string]string{
+		filepath.Join(includesDir, "base.yaml"):  baseSHA256,
+		filepath.Join(includesDir, "cloud.yaml"): cloudSHA256,
+	}, stateMachine.ImageDefinitionIncludes)
+}
+
+// TestFailedImageDefinitionIncludes tests the failures of merging image
+// definitions and substituting their variables
+func TestFailedImageDefinitionIncludes(t *testing.T) {
+	restoreCWD := helper.SaveCWD()
+	t.Cleanup(restoreCWD)
+	t.Setenv("ARCH", "amd64")
+
+	testCases := []struct {
+		name            string
+		imageDefinition string
+		set             []string
+		expectedError   string
+	}{
+		{"include_cycle", "cycle.yaml", nil, "include cycle through"},
+		{"missing_include", "missing_include.yaml", nil, "Error opening image definition file"},
+		{"include_not_list", "bad_include.yaml", nil, "include must be a list of file names"},
+		{"extends_not_file", "bad_extends.yaml", nil, "extends must be a file name"},
+		{"variable_not_set", "server.yaml", []string{"REVISION=1", "LXD_CHANNEL=stable"}, "variable SERIES is not set"},
+		{"invalid_set", "server.yaml", []string{"SERIES"}, "Invalid --set \"SERIES\""},
+		{"invalid_set_name", "server.yaml", []string{"1SERIES=jammy"}, "Invalid --set \"1SERIES=jammy\""},
+		{"invalid_merged_definition", "server.yaml", []string{"SERIES=jammy", "REVISION=one", "LXD_CHANNEL=stable"},
+			"yaml: unmarshal errors"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			var stateMachine ClassicStateMachine
+			stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+			stateMachine.parent = &stateMachine
+			stateMachine.Args.ImageDefinition = filepath.Join("testdata", "image_definitions", "includes", tc.imageDefinition)
+			stateMachine.Opts.Set = tc.set
+			err := stateMachine.parseImageDefinition()
+			asserter.AssertErrContains(err, tc.expectedError)
+		})
+	}
+}
+
+// TestResumeChangedInclude tests that a partial build can not be resumed
+// once a file included by the image definition has changed
+func TestResumeChangedInclude(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	restoreCWD := helper.SaveCWD()
+	t.Cleanup(restoreCWD)
+
+	includesDir := t.TempDir()
+	for _, name := range []string{"base.yaml", "cloud.yaml", "server.yaml"} {
+		content, err := os.ReadFile(filepath.Join("testdata", "image_definitions", "includes", name))
+		asserter.AssertErrNil(err, true)
+		err = os.WriteFile(filepath.Join(includesDir, name), content, 0600)
+		asserter.AssertErrNil(err, true)
+	}
+	set := []string{"ARCH=amd64", "SERIES=jammy", "REVISION=3", "LXD_CHANNEL=stable"}
+	var partialStateMachine ClassicStateMachine
+	partialStateMachine.commonFlags, partialStateMachine.stateMachineFlags = helper.InitCommonOpts()
+	partialStateMachine.parent = &partialStateMachine
+	partialStateMachine.Args.ImageDefinition = filepath.Join(includesDir, "server.yaml")
+	partialStateMachine.Opts.Set = set
+	err := partialStateMachine.parseImageDefinition()
+	asserter.AssertErrNil(err, true)
+	metadata, err := json.Marshal(&partialStateMachine)
+	asserter.AssertErrNil(err, true)
+
+	var stateMachine ClassicStateMachine
+	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+	stateMachine.parent = &stateMachine
+	stateMachine.Args.ImageDefinition = partialStateMachine.Args.ImageDefinition
+	stateMachine.Opts.Set = set
+	err = stateMachine.loadClassicState(metadata, nil)
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual(partialStateMachine.ImageDef, stateMachine.ImageDef)
+
+	err = os.WriteFile(filepath.Join(includesDir, "cloud.yaml"), []byte("customization: {}\n"), 0600)
+	asserter.AssertErrNil(err, true)
+	err = stateMachine.loadClassicState(metadata, nil)
+	asserter.AssertErrContains(err, "cloud.yaml\" has changed since the partial build")
+}
@@ -0,0 +1,402 @@
+package statemachine
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/snapcore/snapd/asserts"
+	"github.com/snapcore/snapd/snap"
+	"github.com/snapcore/snapd/snap/snapfile"
+
+	"github.com/canonical/ubuntu-image/internal/helper"
+	"github.com/canonical/ubuntu-image/internal/imagedefinition"
+)
+
+// checkOfflineSources makes sure that everything an offline build needs is
+// available locally before anything is built. Every missing source is
+// reported at once
+func (stateMachine *StateMachine) checkOfflineSources() error {
+	classicStateMachine := stateMachine.parent.(*ClassicStateMachine)
+	imageDef := &classicStateMachine.ImageDef
+	opts := classicStateMachine.Opts
+	mirror := classicStateMachine.localMirror()
+
+	var missing []string
+	if tarball := imageDef.Rootfs.Tarball; tarball == nil {
+		suites := []string{imageDef.Series}
+		for _, source := range imageDef.GenerateLocalPocketList(mirror) {
+			suites = append(suites, strings.Fields(source)[2])
+		}
+		missing = append(missing, checkLocalMirror(mirror, suites)...)
+	} else {
+		for _, url := range []string{tarball.TarballURL, tarball.GPG} {
+			if isHTTPURL(url) {
+				missing = append(missing, fmt.Sprintf("rootfs tarball file \"%s\" is not a local file", url))
+			}
+		}
+	}
+	if imageDef.Rootfs.Seed != nil {
+		for _, seedURL := range imageDef.Rootfs.Seed.SeedURLs {
+			if !isLocalDir(seedURL) {
+				missing = append(missing, fmt.Sprintf("seed \"%s\" is not a local directory", seedURL))
+			}
+		}
+	}
+	if imageDef.Gadget != nil && imageDef.Gadget.GadgetType == "git" {
+		if !isLocalDir(imageDef.Gadget.GadgetURL) {
+			missing = append(missing, fmt.Sprintf("gadget repository \"%s\" is not a local directory",
+				imageDef.Gadget.GadgetURL))
+		}
+	}
+	if imageDef.Customization != nil {
+		for _, ppa := range imageDef.Customization.ExtraPPAs {
+			// the packages of the PPAs are read from their copies in the
+			// local mirror, which is already reported if it is not local
+			if strings.HasPrefix(mirror, "file://") {
+				missing = append(missing, checkLocalMirror(localPPAURL(mirror, ppa.PPAName),
+					[]string{imageDef.Series})...)
+			}
+			if ppa.Fingerprint == "" {
+				missing = append(missing, fmt.Sprintf("fingerprint of PPA \"%s\", which can not be looked up offline",
+					ppa.PPAName))
+			} else if _, err := localPPAKey(opts.KeysDir, ppa.Fingerprint); err != nil {
+				missing = append(missing, fmt.Sprintf("signing key of PPA \"%s\": %s", ppa.PPAName, err.Error()))
+			}
+		}
+		for _, extraSnap := range imageDef.Customization.ExtraSnaps {
+			if _, err := localSnapFile(opts.SnapsDir, extraSnap.SnapName, extraSnap.SnapRevision); err != nil {
+				missing = append(missing, err.Error())
+			}
+		}
+	}
+
+	if len(missing) > 0 {
+		return fmt.Errorf("Error checking the sources of the offline build. The following are missing:\n - %s",
+			strings.Join(missing, "\n - "))
+	}
+	return nil
+}
+
+// checkLocalMirror checks that mirror is the URL of a local archive mirror
+// providing the given suites, and returns what is missing otherwise
+func checkLocalMirror(mirror string, suites []string) []string {
+	if !strings.HasPrefix(mirror, "file://") {
+		return []string{fmt.Sprintf("mirror \"%s\" is not a local file:// URL, use --mirror-dir", mirror)}
+	}
+	var missing []string
+	for _, suite := range suites {
+		if !hasReleaseFile(filepath.Join(strings.TrimPrefix(mirror, "file://"), "dists", suite)) {
+			missing = append(missing, fmt.Sprintf("release file of suite \"%s\" in mirror \"%s\"", suite, mirror))
+		}
+	}
+	return missing
+}
+
+// hasReleaseFile checks whether a dists directory of a mirror has a release file
+func hasReleaseFile(dists string) bool {
+	for _, release := range []string{"InRelease", "Release"} {
+		if _, err := os.Stat(filepath.Join(dists, release)); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// localMirror returns the mirror the packages of offline builds are read
+// from: the mirror directory if one is given, the mirror of the image
+// definition otherwise. The image keeps the mirror of the image definition
+// in its sources
+func (classicStateMachine *ClassicStateMachine) localMirror() string {
+	if classicStateMachine.Opts.MirrorDir == "" {
+		return classicStateMachine.ImageDef.Rootfs.Mirror
+	}
+	return "file://" + classicStateMachine.Opts.MirrorDir
+}
+
+// localPPAURL returns the URL of the copy of a PPA in a local mirror. The
+// copies are in the ppa directory of the mirror, with the same layout as
+// on ppa.launchpadcontent.net
+func localPPAURL(mirror string, ppaName string) string {
+	return strings.TrimSuffix(mirror, "/") + "/ppa/" + ppaName + "/ubuntu"
+}
+
+// buildImageDef returns the image definition the tools creating the rootfs
+// are run with. Offline builds read their packages from the local mirror
+func (classicStateMachine *ClassicStateMachine) buildImageDef() imagedefinition.ImageDefinition {
+	imageDef := classicStateMachine.ImageDef
+	if classicStateMachine.Opts.Offline {
+		rootfs := *imageDef.Rootfs
+		rootfs.Mirror = classicStateMachine.localMirror()
+		imageDef.Rootfs = &rootfs
+	}
+	return imageDef
+}
+
+// makeMirrorMountpoint creates the directory the local mirror is mounted on
+// in the chroot. It returns a function removing the directories it created,
+// which only removes empty directories so that a mirror still mounted is
+// never touched
+func makeMirrorMountpoint(chroot string, mirrorDir string) (func() error, error) {
+	var created []string
+	for dir := mirrorDir; dir != "/" && dir != "."; dir = filepath.Dir(dir) {
+		if _, err := osLstat(filepath.Join(chroot, dir)); err == nil {
+			break
+		}
+		created = append(created, filepath.Join(chroot, dir))
+	}
+	if err := osMkdirAll(filepath.Join(chroot, mirrorDir), 0755); err != nil {
+		return nil, fmt.Errorf("Error creating mountpoint of the local mirror in the chroot: %s", err.Error())
+	}
+	return func() error {
+		for _, dir := range created {
+			if err := osRemove(dir); err != nil {
+				return fmt.Errorf("Error removing mountpoint of the local mirror from the chroot: %s", err.Error())
+			}
+		}
+		return nil
+	}, nil
+}
+
+// restoreAptSources points the apt sources of the rootfs of an offline build
+// back at the mirror of the image definition and at the PPAs kept enabled,
+// as they would be after a build with network access
+func (stateMachine *StateMachine) restoreAptSources() error {
+	classicStateMachine := stateMachine.parent.(*ClassicStateMachine)
+	imageDef := classicStateMachine.ImageDef
+	mirror := classicStateMachine.localMirror()
+
+	// the whole lines are replaced first, so that the security pocket
+	// goes back to its own mirror
+	localSources := imageDef.GenerateLocalPocketList(mirror)
+	sources := imageDef.GeneratePocketList()
+	var replacements []string
+	for i := range localSources {
+		replacements = append(replacements, localSources[i], sources[i])
+	}
+	// the line of the release pocket, written by debootstrap
+	replacements = append(replacements, "deb "+mirror+" ", "deb "+imageDef.Rootfs.Mirror+" ")
+	sourcesList := filepath.Join(stateMachine.tempDirs.chroot, "etc", "apt", "sources.list")
+	if err := replaceInFile(sourcesList, strings.NewReplacer(replacements...)); err != nil {
+		return err
+	}
+
+	if imageDef.Customization == nil {
+		return nil
+	}
+	sourcesListD := filepath.Join(stateMachine.tempDirs.chroot, "etc", "apt", "sources.list.d")
+	for _, ppa := range imageDef.Customization.ExtraPPAs {
+		ppaFileName, ppaFileContents := createPPAInfo(ppa, imageDef.Series)
+		ppaFile := filepath.Join(sourcesListD, ppaFileName)
+		// the sources of the PPAs which are not kept enabled are already removed
+		if _, err := osLstat(ppaFile); os.IsNotExist(err) {
+			continue
+		}
+		if err := osWriteFile(ppaFile, []byte(ppaFileContents), 0644); err != nil {
+			return fmt.Errorf("Error writing %s: %s", ppaFile, err.Error())
+		}
+	}
+	return nil
+}
+
+// replaceInFile rewrites a file with the given replacements. Missing files
+// are left alone
+func replaceInFile(path string, replacer *strings.Replacer) error {
+	content, err := osReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("Error reading %s: %s", path, err.Error())
+	}
+	if err := osWriteFile(path, []byte(replacer.Replace(string(content))), 0644); err != nil {
+		return fmt.Errorf("Error writing %s: %s", path, err.Error())
+	}
+	return nil
+}
+
+// isLocalDir checks whether a URL is a file:// URL or a path pointing to
+// an existing directory
+func isLocalDir(url string) bool {
+	if strings.Contains(url, "://") && !strings.HasPrefix(url, "file://") {
+		return false
+	}
+	info, err := os.Stat(strings.TrimPrefix(url, "file://"))
+	return err == nil && info.IsDir()
+}
+
+// localPPAKey finds the signing key of a PPA, named after its fingerprint,
+// in the keys directory
+func localPPAKey(keysDir string, fingerprint string) (string, error) {
+	if keysDir == "" {
+		return "", fmt.Errorf("no keys directory given with --keys-dir")
+	}
+	for _, extension := range []string{".gpg", ".asc"} {
+		keyFile := filepath.Join(keysDir, fingerprint+extension)
+		if _, err := os.Stat(keyFile); err == nil {
+			return keyFile, nil
+		}
+	}
+	return "", fmt.Errorf("no %s.gpg or %s.asc in \"%s\"", fingerprint, fingerprint, keysDir)
+}
+
+// localSnapFile finds the file of a snap in the snaps directory. The files
+// are named <name>_<revision>.snap, as downloaded by "snap download", and
+// the assertions of the snap must be next to it in <name>_<revision>.assert.
+// A revision of 0 selects the only revision of the snap in the directory
+func localSnapFile(snapsDir string, name string, revision int) (string, error) {
+	if snapsDir == "" {
+		return "", fmt.Errorf("snap \"%s\": no snaps directory given with --snaps-dir", name)
+	}
+	pattern := name + "_*.snap"
+	if revision != 0 {
+		pattern = name + "_" + strconv.Itoa(revision) + ".snap"
+	}
+	matches, err := filepath.Glob(filepath.Join(snapsDir, pattern))
+	if err != nil {
+		return "", fmt.Errorf("snap \"%s\": %s", name, err.Error())
+	}
+	switch len(matches) {
+	case 0:
+		return "", fmt.Errorf("snap \"%s\": no %s in \"%s\"", name, pattern, snapsDir)
+	case 1:
+	default:
+		return "", fmt.Errorf("snap \"%s\": several revisions in \"%s\", select one with the revision of the snap",
+			name, snapsDir)
+	}
+	assertFile := strings.TrimSuffix(matches[0], ".snap") + ".assert"
+	if _, err := os.Stat(assertFile); err != nil {
+		return "", fmt.Errorf("snap \"%s\": no assertions in \"%s\"", name, assertFile)
+	}
+	return matches[0], nil
+}
+
+// localSnapBase reads the base of a snap from its file in the snaps
+// directory, selected by revision like in localSnapFile
+func localSnapBase(snapsDir string, name string, revision int) (string, error) {
+	snapPath, err := localSnapFile(snapsDir, name, revision)
+	if err != nil {
+		return "", err
+	}
+	snapFile, err := snapfile.Open(snapPath)
+	if err != nil {
+		return "", err
+	}
+	info, err := snap.ReadInfoFromSnapFile(snapFile, nil)
+	if err != nil {
+		return "", err
+	}
+	return info.Base, nil
+}
+
+// localSnapPaths replaces the names of the snaps to stage with the paths of
+// their files in the snaps directory. The snapd snap is always needed to
+// seed snaps, so it is added if it is missing
+func localSnapPaths(snaps []string, revisions map[string]int, snapsDir string) ([]string, error) {
+	if len(snaps) > 0 && !helper.SliceHasElement(snaps, "snapd") {
+		snaps = append(snaps, "snapd")
+	}
+	var paths, missing []string
+	for _, name := range snaps {
+		snapPath, err := localSnapFile(snapsDir, name, revisions[name])
+		if err != nil {
+			missing = append(missing, err.Error())
+			continue
+		}
+		paths = append(paths, snapPath)
+	}
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("Error finding the snaps of the offline build. The following are missing:\n - %s",
+			strings.Join(missing, "\n - "))
+	}
+	return paths, nil
+}
+
+// readLocalAssertions decodes the assertions of all the .assert files of a
+// directory, indexed by their type and reduced primary key
+func readLocalAssertions(dir string) (map[string]asserts.Assertion, error) {
+	assertFiles, err := filepath.Glob(filepath.Join(dir, "*.assert"))
+	if err != nil {
+		return nil, err
+	}
+	assertions := make(map[string]asserts.Assertion)
+	for _, assertFile := range assertFiles {
+		f, err := osOpen(assertFile)
+		if err != nil {
+			return nil, fmt.Errorf("Error opening assertions file \"%s\": %s", assertFile, err.Error())
+		}
+		decoder := asserts.NewDecoder(f)
+		for {
+			assertion, err := decoder.Decode()
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				f.Close()
+				return nil, fmt.Errorf("Error decoding assertions file \"%s\": %s", assertFile, err.Error())
+			}
+			ref := assertion.Ref()
+			assertions[assertionPath(ref.Type, ref.PrimaryKey)] = assertion
+		}
+		f.Close()
+	}
+	return assertions, nil
+}
+
+// assertionPath returns the path of an assertion in the store API
+func assertionPath(assertType *asserts.AssertionType, primaryKey []string) string {
+	return "/v2/assertions/" + assertType.Name + "/" +
+		strings.Join(asserts.ReducePrimaryKey(assertType, primaryKey), "/")
+}
+
+// localAssertionsHandler answers the assertion requests of the store API
+// with local assertions
+func localAssertionsHandler(assertions map[string]asserts.Assertion) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if assertion, found := assertions[r.URL.Path]; found {
+			w.Header().Set("Content-Type", asserts.MediaType)
+			_, _ = w.Write(asserts.Encode(assertion))
+			return
+		}
+		// the error format of the store, which snapd turns into an
+		// assertion not found error
+		type storeError struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		_ = json.NewEncoder(w).Encode(map[string][]storeError{
+			"error-list": {{"not-found", "no local assertion at " + r.URL.Path}},
+		})
+	})
+}
+
+// serveLocalAssertions serves the assertions of the .assert files of a
+// directory with the store API, and points the store client of snapd at
+// this local store. The returned function stops the server and restores
+// the store configuration
+func serveLocalAssertions(dir string) (func(), error) {
+	assertions, err := readLocalAssertions(dir)
+	if err != nil {
+		return nil, err
+	}
+	listener, err := netListen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, fmt.Errorf("Error serving local assertions: %s", err.Error())
+	}
+	server := &http.Server{Handler: localAssertionsHandler(assertions)}
+	go func() { _ = server.Serve(listener) }()
+
+	restoreStoreEnv := setStoreEnv("http://"+listener.Addr().String()+"/", "")
+	return func() {
+		server.Close()
+		restoreStoreEnv()
+	}, nil
+}
@@ -0,0 +1,436 @@
+package statemachine
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/snapcore/snapd/asserts"
+	"github.com/snapcore/snapd/asserts/assertstest"
+	"github.com/snapcore/snapd/snap"
+
+	"github.com/canonical/ubuntu-image/internal/commands"
+	"github.com/canonical/ubuntu-image/internal/helper"
+	"github.com/canonical/ubuntu-image/internal/imagedefinition"
+)
+
+// createLocalSnap creates empty .snap and .assert files in the snaps directory
+func createLocalSnap(t *testing.T, snapsDir string, fileName string) {
+	t.Helper()
+	for _, extension := range []string{".snap", ".assert"} {
+		err := os.WriteFile(filepath.Join(snapsDir, fileName+extension), nil, 0644)
+		if err != nil {
+			t.Fatalf("Error creating %s%s: %s", fileName, extension, err.Error())
+		}
+	}
+}
+
+// TestCheckOfflineSources tests that offline builds check their local sources
+func TestCheckOfflineSources(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	mirrorDir := t.TempDir()
+	seedDir := t.TempDir()
+	gadgetDir := t.TempDir()
+	snapsDir := t.TempDir()
+	keysDir := t.TempDir()
+	for _, dists := range []string{
+		filepath.Join(mirrorDir, "dists", "jammy"),
+		filepath.Join(mirrorDir, "dists", "jammy-security"),
+		filepath.Join(mirrorDir, "ppa", "canonical-foundations", "ubuntu-image", "ubuntu", "dists", "jammy"),
+	} {
+		err := os.MkdirAll(dists, 0755)
+		asserter.AssertErrNil(err, true)
+		err = os.WriteFile(filepath.Join(dists, "InRelease"), nil, 0644)
+		asserter.AssertErrNil(err, true)
+	}
+	err := os.WriteFile(filepath.Join(keysDir, "CDE5112BD4104F975FC8A53FD4C0B668FD4C9139.asc"), nil, 0644)
+	asserter.AssertErrNil(err, true)
+	createLocalSnap(t, snapsDir, "lxd_123")
+
+	var stateMachine ClassicStateMachine
+	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+	stateMachine.parent = &stateMachine
+	stateMachine.Opts = commands.ClassicOpts{
+		Offline:   true,
+		MirrorDir: mirrorDir,
+		SnapsDir:  snapsDir,
+		KeysDir:   keysDir,
+	}
+	stateMachine.ImageDef = imagedefinition.ImageDefinition{
+		Architecture: "amd64",
+		Series:       "jammy",
+		Gadget: &imagedefinition.Gadget{
+			GadgetType: "git",
+			GadgetURL:  "file://" + gadgetDir,
+		},
+		Rootfs: &imagedefinition.Rootfs{
+			Mirror:     "http://archive.ubuntu.com/ubuntu/",
+			Pocket:     "security",
+			Components: []string{"main"},
+			Seed: &imagedefinition.Seed{
+				SeedURLs: []string{"file://" + seedDir, seedDir},
+			},
+		},
+		Customization: &imagedefinition.Customization{
+			ExtraPPAs: []*imagedefinition.PPA{
+				{
+					PPAName:     "canonical-foundations/ubuntu-image",
+					Fingerprint: "CDE5112BD4104F975FC8A53FD4C0B668FD4C9139",
+				},
+			},
+			ExtraSnaps: []*imagedefinition.Snap{
+				{SnapName: "lxd"},
+			},
+		},
+	}
+
+	err = stateMachine.checkOfflineSources()
+	asserter.AssertErrNil(err, true)
+	// the image keeps the mirror of the image definition
+	asserter.AssertEqual("http://archive.ubuntu.com/ubuntu/", stateMachine.ImageDef.Rootfs.Mirror)
+	asserter.AssertEqual("file://"+mirrorDir, stateMachine.buildImageDef().Rootfs.Mirror)
+
+	// now break every source and make sure they are all reported
+	stateMachine.Opts.MirrorDir = ""
+	stateMachine.ImageDef.Rootfs.Mirror = "file://" + mirrorDir
+	stateMachine.ImageDef.Rootfs.Pocket = "updates"
+	stateMachine.ImageDef.Rootfs.Seed.SeedURLs = append(stateMachine.ImageDef.Rootfs.Seed.SeedURLs,
+		"git://git.launchpad.net/~ubuntu-core-dev/ubuntu-seeds/+git/")
+	stateMachine.ImageDef.Gadget.GadgetURL = "https://github.com/snapcore/pc-gadget.git"
+	stateMachine.ImageDef.Customization.ExtraPPAs = append(stateMachine.ImageDef.Customization.ExtraPPAs,
+		&imagedefinition.PPA{PPAName: "test/no-fingerprint"},
+		&imagedefinition.PPA{PPAName: "test/no-key", Fingerprint: "ABCD"},
+	)
+	stateMachine.ImageDef.Customization.ExtraSnaps = append(stateMachine.ImageDef.Customization.ExtraSnaps,
+		&imagedefinition.Snap{SnapName: "lxd", SnapRevision: 456},
+	)
+	stateMachine.ImageDef.Series = "noble"
+	err = stateMachine.checkOfflineSources()
+	expectedErrors := []string{
+		"release file of suite \"noble\" in mirror \"file://" + mirrorDir + "\"",
+		"release file of suite \"noble-updates\" in mirror \"file://" + mirrorDir + "\"",
+		"release file of suite \"noble\" in mirror \"file://" + mirrorDir + "/ppa/test/no-key/ubuntu\"",
+		"seed \"git://git.launchpad.net/~ubuntu-core-dev/ubuntu-seeds/+git/\" is not a local directory",
+		"gadget repository \"https://github.com/snapcore/pc-gadget.git\" is not a local directory",
+		"fingerprint of PPA \"test/no-fingerprint\"",
+		"signing key of PPA \"test/no-key\": no ABCD.gpg or ABCD.asc",
+		"snap \"lxd\": no lxd_456.snap",
+	}
+	for _, expectedError := range expectedErrors {
+		asserter.AssertErrContains(err, expectedError)
+	}
+
+	stateMachine.ImageDef.Rootfs.Mirror = "http://archive.ubuntu.com/ubuntu/"
+	err = stateMachine.checkOfflineSources()
+	asserter.AssertErrContains(err, "is not a local file:// URL, use --mirror-dir")
+}
+
+// TestOfflineStates tests the states and options of offline builds
+func TestOfflineStates(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	restoreCWD := helper.SaveCWD()
+	t.Cleanup(restoreCWD)
+
+	var stateMachine ClassicStateMachine
+	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+	stateMachine.Args.ImageDefinition = filepath.Join("testdata", "image_definitions", "test_amd64.yaml")
+	stateMachine.Opts.SnapsDir = t.TempDir()
+	err := stateMachine.Setup()
+	asserter.AssertErrContains(err, "can only be used with --offline")
+
+	stateMachine.Opts.Offline = true
+	err = stateMachine.Setup()
+	asserter.AssertErrNil(err, true)
+	err = stateMachine.parseImageDefinition()
+	asserter.AssertErrNil(err, true)
+	err = stateMachine.calculateStates()
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual("check_offline_sources", stateMachine.states[len(startingClassicStates)].name)
+	// the sources are restored before the rootfs is cleaned
+	restored := false
+	for i, state := range stateMachine.states {
+		if state.name == "restore_apt_sources" {
+			restored = true
+			asserter.AssertEqual("clean_rootfs", stateMachine.states[i+1].name)
+		}
+	}
+	if !restored {
+		t.Errorf("Expected the apt sources of the offline build to be restored")
+	}
+
+	// the snaps of offline builds can not come from a store
+	stateMachine.ImageDef.Store = &imagedefinition.Store{StoreID: "brand"}
+	err = stateMachine.calculateStates()
+	asserter.AssertErrContains(err, "can not be used with --offline")
+}
+
+// TestRestoreAptSources tests that the sources of offline builds point at
+// the mirror of the image definition and at the PPAs once the packages are
+// installed
+func TestRestoreAptSources(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	var stateMachine ClassicStateMachine
+	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+	stateMachine.parent = &stateMachine
+	stateMachine.tempDirs.chroot = t.TempDir()
+	stateMachine.Opts = commands.ClassicOpts{Offline: true, MirrorDir: "/srv/mirror"}
+	stateMachine.ImageDef = imagedefinition.ImageDefinition{
+		Architecture: "amd64",
+		Series:       "jammy",
+		Rootfs: &imagedefinition.Rootfs{
+			Mirror:     "http://archive.ubuntu.com/ubuntu/",
+			Pocket:     "updates",
+			Components: []string{"main"},
+		},
+		Customization: &imagedefinition.Customization{
+			ExtraPPAs: []*imagedefinition.PPA{
+				{PPAName: "kept/ppa"},
+				{PPAName: "removed/ppa"},
+			},
+		},
+	}
+	aptDir := filepath.Join(stateMachine.tempDirs.chroot, "etc", "apt")
+	err := os.MkdirAll(filepath.Join(aptDir, "sources.list.d"), 0755)
+	asserter.AssertErrNil(err, true)
+	err = os.WriteFile(filepath.Join(aptDir, "sources.list"), []byte(
+		"deb file:///srv/mirror jammy main\n"+
+			"deb file:///srv/mirror jammy-updates main\n"+
+			"deb file:///srv/mirror jammy-security main\n"), 0644)
+	asserter.AssertErrNil(err, true)
+	keptPPA := filepath.Join(aptDir, "sources.list.d", "kept-ubuntu-ppa-jammy.list")
+	err = os.WriteFile(keptPPA, []byte("deb file:///srv/mirror/ppa/kept/ppa/ubuntu jammy main"), 0644)
+	asserter.AssertErrNil(err, true)
+
+	err = stateMachine.restoreAptSources()
+	asserter.AssertErrNil(err, true)
+
+	sourcesList, err := os.ReadFile(filepath.Join(aptDir, "sources.list"))
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual("deb http://archive.ubuntu.com/ubuntu/ jammy main\n"+
+		"deb http://archive.ubuntu.com/ubuntu/ jammy-updates main\n"+
+		"deb http://security.ubuntu.com/ubuntu/ jammy-security main\n", string(sourcesList))
+	ppaSources, err := os.ReadFile(keptPPA)
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual("deb https://ppa.launchpadcontent.net/kept/ppa/ubuntu jammy main", string(ppaSources))
+	_, err = os.Stat(filepath.Join(aptDir, "sources.list.d", "removed-ubuntu-ppa-jammy.list"))
+	if !os.IsNotExist(err) {
+		t.Errorf("Did not expect the sources of the removed PPA to be written")
+	}
+}
+
+// TestMakeMirrorMountpoint tests that only the directories created for the
+// mountpoint of the local mirror are removed
+func TestMakeMirrorMountpoint(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	chroot := t.TempDir()
+	err := os.Mkdir(filepath.Join(chroot, "srv"), 0755)
+	asserter.AssertErrNil(err, true)
+
+	removeMountpoint, err := makeMirrorMountpoint(chroot, "/srv/mirrors/ubuntu")
+	asserter.AssertErrNil(err, true)
+	_, err = os.Stat(filepath.Join(chroot, "srv", "mirrors", "ubuntu"))
+	asserter.AssertErrNil(err, true)
+
+	err = removeMountpoint()
+	asserter.AssertErrNil(err, true)
+	_, err = os.Stat(filepath.Join(chroot, "srv", "mirrors"))
+	if !os.IsNotExist(err) {
+		t.Errorf("Expected the mountpoint of the mirror to be removed")
+	}
+	_, err = os.Stat(filepath.Join(chroot, "srv"))
+	asserter.AssertErrNil(err, true)
+
+	// a directory which is not empty, like a mirror still mounted, is kept
+	removeMountpoint, err = makeMirrorMountpoint(chroot, "/srv/mirror")
+	asserter.AssertErrNil(err, true)
+	err = os.WriteFile(filepath.Join(chroot, "srv", "mirror", "file"), nil, 0644)
+	asserter.AssertErrNil(err, true)
+	err = removeMountpoint()
+	asserter.AssertErrContains(err, "Error removing mountpoint of the local mirror")
+}
+
+// TestLocalSnapFile tests finding the files of snaps in the snaps directory
+func TestLocalSnapFile(t *testing.T) {
+	snapsDir := t.TempDir()
+	createLocalSnap(t, snapsDir, "core22_100")
+	createLocalSnap(t, snapsDir, "lxd_1")
+	createLocalSnap(t, snapsDir, "lxd_2")
+	err := os.WriteFile(filepath.Join(snapsDir, "snapd_3.snap"), nil, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		name         string
+		snapsDir     string
+		snapName     string
+		revision     int
+		expectedFile string
+		expectedErr  string
+	}{
+		{"only_revision", snapsDir, "core22", 0, "core22_100.snap", ""},
+		{"selected_revision", snapsDir, "lxd", 2, "lxd_2.snap", ""},
+		{"several_revisions", snapsDir, "lxd", 0, "", "several revisions"},
+		{"missing_revision", snapsDir, "core22", 101, "", "no core22_101.snap"},
+		{"missing_snap", snapsDir, "core", 0, "", "no core_*.snap"},
+		{"missing_assertions", snapsDir, "snapd", 0, "", "no assertions"},
+		{"no_snaps_dir", "", "lxd", 0, "", "no snaps directory given"},
+	}
+	for _, tc := range testCases {
+		t.Run("test_local_snap_file_"+tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			snapFile, err := localSnapFile(tc.snapsDir, tc.snapName, tc.revision)
+			if tc.expectedErr != "" {
+				asserter.AssertErrContains(err, tc.expectedErr)
+				return
+			}
+			asserter.AssertErrNil(err, true)
+			asserter.AssertEqual(filepath.Join(snapsDir, tc.expectedFile), snapFile)
+		})
+	}
+}
+
+// TestLocalSnapPaths tests that the snaps to stage are replaced with their files
+func TestLocalSnapPaths(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	snapsDir := t.TempDir()
+	createLocalSnap(t, snapsDir, "lxd_1")
+	createLocalSnap(t, snapsDir, "lxd_2")
+	createLocalSnap(t, snapsDir, "snapd_3")
+
+	paths, err := localSnapPaths([]string{"lxd"}, map[string]int{"lxd": 2}, snapsDir)
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual([]string{
+		filepath.Join(snapsDir, "lxd_2.snap"),
+		filepath.Join(snapsDir, "snapd_3.snap"),
+	}, paths)
+
+	paths, err = localSnapPaths(nil, nil, snapsDir)
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual(0, len(paths))
+
+	_, err = localSnapPaths([]string{"lxd", "core22", "core"}, nil, snapsDir)
+	asserter.AssertErrContains(err, "snap \"lxd\": several revisions")
+	asserter.AssertErrContains(err, "snap \"core22\": no core22_*.snap")
+	asserter.AssertErrContains(err, "snap \"core\": no core_*.snap")
+}
+
+// TestLocalSnapBase tests that the base of a snap is read from the file of
+// its selected revision
+func TestLocalSnapBase(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	// set like when preparing the image
+	snap.SanitizePlugsSlots = func(snapInfo *snap.Info) {}
+	snapsDir := t.TempDir()
+	// unpacked snaps are read like snap files
+	for revision, base := range map[string]string{"1": "core20", "2": "core22"} {
+		metaDir := filepath.Join(snapsDir, "lxd_"+revision+".snap", "meta")
+		err := os.MkdirAll(metaDir, 0755)
+		asserter.AssertErrNil(err, true)
+		err = os.WriteFile(filepath.Join(metaDir, "snap.yaml"),
+			[]byte("name: lxd\nversion: \""+revision+"\"\nbase: "+base+"\n"), 0644)
+		asserter.AssertErrNil(err, true)
+		err = os.WriteFile(filepath.Join(snapsDir, "lxd_"+revision+".assert"), nil, 0644)
+		asserter.AssertErrNil(err, true)
+	}
+
+	base, err := localSnapBase(snapsDir, "lxd", 1)
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual("core20", base)
+	base, err = localSnapBase(snapsDir, "lxd", 2)
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual("core22", base)
+
+	_, err = localSnapBase(snapsDir, "lxd", 0)
+	asserter.AssertErrContains(err, "several revisions")
+}
+
+// TestServeLocalAssertions tests that local assertions are served with the store API
+func TestServeLocalAssertions(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	storeStack := assertstest.NewStoreStack("canonical", nil)
+	snapsDir := t.TempDir()
+	assertions := asserts.Encode(storeStack.StoreAccountKey(""))
+	assertions = append(assertions, '\n')
+	assertions = append(assertions, asserts.Encode(storeStack.TrustedAccount)...)
+	err := os.WriteFile(filepath.Join(snapsDir, "test_1.assert"), assertions, 0644)
+	asserter.AssertErrNil(err, true)
+
+	t.Setenv("UBUNTU_STORE_URL", "https://store.example.com/")
+	stop, err := serveLocalAssertions(snapsDir)
+	asserter.AssertErrNil(err, true)
+	storeURL := strings.TrimSuffix(os.Getenv("UBUNTU_STORE_URL"), "/")
+	t.Cleanup(stop)
+
+	// the store API URLs of the assertions
+	accountKey := storeStack.StoreAccountKey("")
+	for _, assertion := range []asserts.Assertion{accountKey, storeStack.TrustedAccount} {
+		ref := assertion.Ref()
+		resp, err := http.Get(storeURL + assertionPath(ref.Type, ref.PrimaryKey) + "?max-format=1")
+		asserter.AssertErrNil(err, true)
+		asserter.AssertEqual(http.StatusOK, resp.StatusCode)
+		asserter.AssertEqual(asserts.MediaType, resp.Header.Get("Content-Type"))
+		decoded, err := asserts.NewDecoder(resp.Body).Decode()
+		resp.Body.Close()
+		asserter.AssertErrNil(err, true)
+		asserter.AssertEqual(ref.Unique(), decoded.Ref().Unique())
+	}
+
+	resp, err := http.Get(storeURL + "/v2/assertions/account/missing")
+	asserter.AssertErrNil(err, true)
+	defer resp.Body.Close()
+	asserter.AssertEqual(http.StatusNotFound, resp.StatusCode)
+	var storeError struct {
+		ErrorList []struct {
+			Code string `json:"code"`
+		} `json:"error-list"`
+	}
+	body, err := io.ReadAll(resp.Body)
+	asserter.AssertErrNil(err, true)
+	err = json.Unmarshal(body, &storeError)
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual("not-found", storeError.ErrorList[0].Code)
+
+	stop()
+	asserter.AssertEqual("https://store.example.com/", os.Getenv("UBUNTU_STORE_URL"))
+
+	// invalid assertions are reported
+	err = os.WriteFile(filepath.Join(snapsDir, "bad_1.assert"), []byte("not an assertion"), 0644)
+	asserter.AssertErrNil(err, true)
+	_, err = serveLocalAssertions(snapsDir)
+	asserter.AssertErrContains(err, "Error decoding assertions file")
+}
+
+// TestImportLocalPPAKey tests importing the key of a PPA from a local file
+func TestImportLocalPPAKey(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	mockCmder := NewMockExecCommand()
+	execCommand = mockCmder.Command
+	t.Cleanup(func() { execCommand = exec.Command })
+
+	stdout, restoreStdout, err := helper.CaptureStd(&os.Stdout)
+	asserter.AssertErrNil(err, true)
+	t.Cleanup(func() { restoreStdout() })
+
+	ppa := &imagedefinition.PPA{
+		PPAName:     "canonical-foundations/ubuntu-image",
+		Fingerprint: "CDE5112BD4104F975FC8A53FD4C0B668FD4C9139",
+	}
+	err = importPPAKeys(ppa, "/tmp/gpg", "/chroot/key.gpg", "/keys/CDE5112BD4104F975FC8A53FD4C0B668FD4C9139.asc", true)
+	asserter.AssertErrNil(err, true)
+
+	restoreStdout()
+	readStdout, err := io.ReadAll(stdout)
+	asserter.AssertErrNil(err, true)
+	if !strings.Contains(string(readStdout), "--import /keys/CDE5112BD4104F975FC8A53FD4C0B668FD4C9139.asc") {
+		t.Errorf("Expected the key to be imported from the local file. Output is:\n%s", readStdout)
+	}
+	if strings.Contains(string(readStdout), "keyserver") {
+		t.Errorf("Did not expect the keyserver to be used. Output is:\n%s", readStdout)
+	}
+}
@@ -1,8 +1,6 @@
 package statemachine
 
 import (
-	"fmt"
-
 	"github.com/canonical/ubuntu-image/internal/commands"
 )
 
@@ -17,7 +15,6 @@ var packStates = []stateFunc{
 	{"populate_prepare_partitions", (*StateMachine).populatePreparePartitions},
 	{"make_disk", (*StateMachine).makeDisk},
 	{"update_bootloader", (*StateMachine).updateBootloader},
-	{"finish", (*StateMachine).finish},
 }
 
 // PackStateMachine embeds StateMachine and adds the command line flags specific to pack images
@@ -28,13 +25,34 @@ type PackStateMachine struct {
 
 // Setup assigns variables and calls other functions that must be executed before Run()
 func (packStateMachine *PackStateMachine) Setup() error {
-	fmt.Print("WARNING: this is an experimental feature.\n")
-
 	// set the parent pointer of the embedded struct
 	packStateMachine.parent = packStateMachine
 
-	// set the beginning states that will be used by all pack image builds
-	packStateMachine.states = packStates
+	// set the states that will be used by all pack image builds, followed
+	// by the states for the additional artifacts requested
+	packStateMachine.states = make([]stateFunc, len(packStates))
+	copy(packStateMachine.states, packStates)
+
+	if packStateMachine.Opts.ArtifactType != "" && packStateMachine.Opts.ArtifactType != "raw" {
+		packStateMachine.states = append(packStateMachine.states,
+			stateFunc{"convert_disk_images", (*StateMachine).convertDiskImages})
+	}
+	if packStateMachine.Opts.ManifestName != "" {
+		packStateMachine.states = append(packStateMachine.states,
+			stateFunc{"generate_manifest", (*StateMachine).generatePackManifest})
+	}
+	if packStateMachine.Opts.FilelistName != "" {
+		packStateMachine.states = append(packStateMachine.states,
+			stateFunc{"generate_filelist", (*StateMachine).generatePackFilelist})
+	}
+	if packStateMachine.Opts.SignKey != "" {
+		packStateMachine.states = append(packStateMachine.states,
+			stateFunc{"sign_artifacts", (*StateMachine).signArtifacts})
+	}
+
+	// add the no-op "finish" state
+	packStateMachine.states = append(packStateMachine.states,
+		stateFunc{"finish", (*StateMachine).finish})
 
 	// do the validation common to all image types
 	if err := packStateMachine.validateInput(); err != nil {
@@ -54,3 +54,41 @@ func (stateMachine *StateMachine) populateTemporaryDirectories() error {
 
 	return nil
 }
+
+// convertDiskImages converts the raw disk images created by makeDisk to the
+// requested artifact type. The raw images are removed once converted
+func (stateMachine *StateMachine) convertDiskImages() error {
+	packStateMachine := stateMachine.parent.(*PackStateMachine)
+
+	for volumeName, imgName := range stateMachine.VolumeNames {
+		rawImg := filepath.Join(stateMachine.commonFlags.OutputDir, imgName)
+		convertedImg := filepath.Join(stateMachine.commonFlags.OutputDir,
+			volumeName+"."+packStateMachine.Opts.ArtifactType)
+		if err := stateMachine.convertImage(rawImg, convertedImg, packStateMachine.Opts.ArtifactType,
+			defaultQcow2Options); err != nil {
+			return err
+		}
+		if err := osRemove(rawImg); err != nil {
+			return fmt.Errorf("Error removing raw disk image %s: %s", rawImg, err.Error())
+		}
+		stateMachine.VolumeNames[volumeName] = filepath.Base(convertedImg)
+	}
+	return nil
+}
+
+// generatePackManifest generates the manifest of the packages installed in the rootfs
+func (stateMachine *StateMachine) generatePackManifest() error {
+	packStateMachine := stateMachine.parent.(*PackStateMachine)
+
+	outputPath := filepath.Join(stateMachine.commonFlags.OutputDir, packStateMachine.Opts.ManifestName)
+	return writePackageManifest(stateMachine.tempDirs.rootfs, outputPath, false, stateMachine.commonFlags.Debug)
+}
+
+// generatePackFilelist generates the list of files in the rootfs
+func (stateMachine *StateMachine) generatePackFilelist() error {
+	packStateMachine := stateMachine.parent.(*PackStateMachine)
+
+	outputPath := filepath.Join(stateMachine.commonFlags.OutputDir, packStateMachine.Opts.FilelistName)
+	return writeFilelist(stateMachine.tempDirs.rootfs, outputPath,
+		stateMachine.reproducible(), stateMachine.commonFlags.Debug)
+}
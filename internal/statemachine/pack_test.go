@@ -29,6 +29,55 @@ func TestPack_Setup(t *testing.T) {
 	})
 }
 
+// TestPack_Setup_states tests that the states needed for the requested artifacts are added
+func TestPack_Setup_states(t *testing.T) {
+	testCases := []struct {
+		name           string
+		opts           commands.PackOpts
+		expectedStates []string
+	}{
+		{
+			name:           "raw",
+			opts:           commands.PackOpts{ArtifactType: "raw"},
+			expectedStates: []string{"make_disk", "update_bootloader", "finish"},
+		},
+		{
+			name:           "qcow2",
+			opts:           commands.PackOpts{ArtifactType: "qcow2"},
+			expectedStates: []string{"make_disk", "update_bootloader", "convert_disk_images", "finish"},
+		},
+		{
+			name: "vhd_with_manifest_and_filelist",
+			opts: commands.PackOpts{
+				ArtifactType: "vhd",
+				ManifestName: "pc.manifest",
+				FilelistName: "pc.filelist",
+			},
+			expectedStates: []string{"make_disk", "update_bootloader", "convert_disk_images",
+				"generate_manifest", "generate_filelist", "finish"},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run("test_pack_setup_states_"+tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+
+			var stateMachine PackStateMachine
+			stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+			stateMachine.parent = &stateMachine
+			stateMachine.Opts = tc.opts
+
+			err := stateMachine.Setup()
+			asserter.AssertErrNil(err, true)
+
+			var stateNames []string
+			for _, state := range stateMachine.states {
+				stateNames = append(stateNames, state.name)
+			}
+			asserter.AssertEqual(tc.expectedStates, stateNames[len(stateNames)-len(tc.expectedStates):])
+		})
+	}
+}
+
 // TestPack_validateInput_fail tests a failure in the Setup() function when validating common input
 func TestPack_validateInput_fail(t *testing.T) {
 	testCases := []struct {
@@ -411,3 +460,99 @@ func TestPackStateMachine_SuccessfulRun(t *testing.T) {
 		}
 	})
 }
+
+// TestPack_convertDiskImages tests that the raw disk images are replaced with converted ones
+func TestPack_convertDiskImages(t *testing.T) {
+	testCases := []struct {
+		artifactType string
+		magic        string
+	}{
+		{"vmdk", "KDMV"},
+		{"vhdx", "vhdxfile"},
+	}
+	for _, tc := range testCases {
+		t.Run("test_pack_convert_disk_images_"+tc.artifactType, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+
+			var stateMachine PackStateMachine
+			stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+			stateMachine.parent = &stateMachine
+			stateMachine.commonFlags.OutputDir = t.TempDir()
+			stateMachine.Opts.ArtifactType = tc.artifactType
+			stateMachine.VolumeNames = map[string]string{"pc": "pc.img"}
+
+			rawImg := filepath.Join(stateMachine.commonFlags.OutputDir, "pc.img")
+			err := os.WriteFile(rawImg, []byte("disk"), 0644)
+			asserter.AssertErrNil(err, true)
+
+			err = stateMachine.convertDiskImages()
+			asserter.AssertErrNil(err, true)
+
+			convertedImg := "pc." + tc.artifactType
+			imgBytes, err := os.ReadFile(filepath.Join(stateMachine.commonFlags.OutputDir, convertedImg))
+			asserter.AssertErrNil(err, true)
+			asserter.AssertEqual(tc.magic, string(imgBytes[:len(tc.magic)]))
+			asserter.AssertEqual(convertedImg, stateMachine.VolumeNames["pc"])
+
+			if osutil.FileExists(rawImg) {
+				t.Errorf("File \"%s\" should not exist, but does", rawImg)
+			}
+		})
+	}
+}
+
+// TestPack_convertDiskImages_fail tests failures in the convertDiskImages function
+func TestPack_convertDiskImages_fail(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+
+	var stateMachine PackStateMachine
+	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+	stateMachine.parent = &stateMachine
+	stateMachine.commonFlags.OutputDir = t.TempDir()
+	stateMachine.Opts.ArtifactType = "qcow2"
+	stateMachine.VolumeNames = map[string]string{"pc": "pc.img"}
+
+	// the raw image does not exist
+	err := stateMachine.convertDiskImages()
+	asserter.AssertErrContains(err, "Error creating qcow2 artifact")
+
+	// the raw image can not be removed
+	err = os.WriteFile(filepath.Join(stateMachine.commonFlags.OutputDir, "pc.img"), []byte("disk"), 0644)
+	asserter.AssertErrNil(err, true)
+	osRemove = mockRemove
+	t.Cleanup(func() { osRemove = os.Remove })
+
+	err = stateMachine.convertDiskImages()
+	asserter.AssertErrContains(err, "Error removing raw disk image")
+}
+
+// TestPack_generateManifestAndFilelist tests that the manifest and filelist
+// are generated from the rootfs
+func TestPack_generateManifestAndFilelist(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+
+	var stateMachine PackStateMachine
+	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+	stateMachine.parent = &stateMachine
+	stateMachine.commonFlags.OutputDir = t.TempDir()
+	stateMachine.tempDirs.rootfs = t.TempDir()
+	stateMachine.Opts.ManifestName = "pc.manifest"
+	stateMachine.Opts.FilelistName = "pc.filelist"
+
+	execCommand = fakeExecCommand
+	t.Cleanup(func() { execCommand = exec.Command })
+
+	testCaseName = "TestGeneratePackageManifest"
+	err := stateMachine.generatePackManifest()
+	asserter.AssertErrNil(err, true)
+	manifestBytes, err := os.ReadFile(filepath.Join(stateMachine.commonFlags.OutputDir, "pc.manifest"))
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual("foo 1.2\nbar 1.4-1ubuntu4.1\nlibbaz 0.1.3ubuntu2\n", string(manifestBytes))
+
+	testCaseName = "TestGenerateFilelist"
+	err = stateMachine.generatePackFilelist()
+	asserter.AssertErrNil(err, true)
+	filelistBytes, err := os.ReadFile(filepath.Join(stateMachine.commonFlags.OutputDir, "pc.filelist"))
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual("/root\n/home\n/var", string(filelistBytes))
+}
@@ -0,0 +1,301 @@
+package statemachine
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/snapcore/snapd/gadget/quantity"
+
+	"github.com/canonical/ubuntu-image/internal/helper"
+)
+
+// the states run by --dry-run. They only read the image definition and the
+// gadget and resolve what the build would install, and their results are
+// all that is needed to plan the build
+var (
+	classicPlanningStates = []string{
+		"parse_image_definition",
+		"calculate_states",
+		"make_temporary_directories",
+		"determine_output_directory",
+		"check_offline_sources",
+		"build_gadget_tree",
+		"prepare_gadget_tree",
+		"load_gadget_yaml",
+		"verify_artifact_names",
+		"germinate",
+	}
+	snapPlanningStates = []string{
+		"make_temporary_directories",
+		"determine_output_directory",
+		"prepare_image",
+		"load_gadget_yaml",
+		"set_artifact_names",
+	}
+	packPlanningStates = []string{
+		"prepare_pack",
+		"make_temporary_directories",
+		"load_gadget_yaml",
+		"set_artifact_names",
+	}
+)
+
+// buildPlan is what a build would do and generate, as printed by --dry-run
+type buildPlan struct {
+	States    []string        `json:"states"`
+	Packages  []string        `json:"packages,omitempty"`
+	Snaps     []plannedSnap   `json:"snaps,omitempty"`
+	Volumes   []plannedVolume `json:"volumes,omitempty"`
+	Artifacts []string        `json:"artifacts,omitempty"`
+}
+
+// plannedSnap is a snap the image would contain. The revision is only known
+// once the snap was resolved by the store
+type plannedSnap struct {
+	Name     string `json:"name"`
+	Channel  string `json:"channel,omitempty"`
+	Revision string `json:"revision,omitempty"`
+}
+
+// plannedVolume is the layout of a disk image the build would create
+type plannedVolume struct {
+	Name       string             `json:"name"`
+	Image      string             `json:"image,omitempty"`
+	Schema     string             `json:"schema,omitempty"`
+	Bootloader string             `json:"bootloader,omitempty"`
+	Size       uint64             `json:"size"`
+	Structures []plannedStructure `json:"structures"`
+}
+
+// plannedStructure is a structure of a volume, with its offset and size in bytes
+type plannedStructure struct {
+	Name       string  `json:"name,omitempty"`
+	Role       string  `json:"role,omitempty"`
+	Type       string  `json:"type"`
+	Filesystem string  `json:"filesystem,omitempty"`
+	Offset     *uint64 `json:"offset,omitempty"`
+	Size       uint64  `json:"size"`
+}
+
+// planningStates returns the names of the states run by --dry-run
+func (stateMachine *StateMachine) planningStates() []string {
+	switch stateMachine.parent.(type) {
+	case *ClassicStateMachine:
+		return classicPlanningStates
+	case *SnapStateMachine:
+		return snapPlanningStates
+	case *PackStateMachine:
+		return packPlanningStates
+	}
+	return nil
+}
+
+// skipState returns whether a state is skipped because only the plan of
+// the build was requested
+func (stateMachine *StateMachine) skipState(name string) bool {
+	return stateMachine.stateMachineFlags.DryRun && !helper.SliceHasElement(stateMachine.planningStates(), name)
+}
+
+// plan returns the plan of the build, from the results of the planning states
+func (stateMachine *StateMachine) plan() (*buildPlan, error) {
+	plan := &buildPlan{States: stateMachine.stateNames()}
+
+	switch parent := stateMachine.parent.(type) {
+	case *ClassicStateMachine:
+		plan.Packages = append(append([]string{}, parent.Packages...), parent.extraPackages()...)
+		plan.Snaps = parent.plannedSnaps()
+	case *SnapStateMachine:
+		snaps, err := stateMachine.plannedSeedSnaps()
+		if err != nil {
+			return nil, err
+		}
+		plan.Snaps = snaps
+	}
+
+	// pack images of other types are converted from the raw disk images,
+	// under the names of their volumes
+	volumeNames := stateMachine.VolumeNames
+	if packStateMachine, ok := stateMachine.parent.(*PackStateMachine); ok &&
+		packStateMachine.Opts.ArtifactType != "" && packStateMachine.Opts.ArtifactType != "raw" {
+		volumeNames = make(map[string]string)
+		for volumeName := range stateMachine.VolumeNames {
+			volumeNames[volumeName] = volumeName + "." + packStateMachine.Opts.ArtifactType
+		}
+	}
+
+	if stateMachine.GadgetInfo != nil {
+		for _, volumeName := range stateMachine.VolumeOrder {
+			volume, found := stateMachine.GadgetInfo.Volumes[volumeName]
+			if !found {
+				continue
+			}
+			size := volume.MinSize()
+			if imageSize, found := stateMachine.ImageSizes[volumeName]; found && imageSize > size {
+				size = imageSize
+			}
+			plannedVol := plannedVolume{
+				Name:       volumeName,
+				Image:      volumeNames[volumeName],
+				Schema:     volume.Schema,
+				Bootloader: volume.Bootloader,
+				Size:       uint64(size),
+				Structures: []plannedStructure{},
+			}
+			for _, structure := range volume.Structure {
+				plannedStruct := plannedStructure{
+					Name:       structure.Name,
+					Role:       structure.Role,
+					Type:       structure.Type,
+					Filesystem: structure.Filesystem,
+					Size:       uint64(structure.Size),
+				}
+				if structure.Offset != nil {
+					offset := uint64(*structure.Offset)
+					plannedStruct.Offset = &offset
+				}
+				plannedVol.Structures = append(plannedVol.Structures, plannedStruct)
+			}
+			plan.Volumes = append(plan.Volumes, plannedVol)
+		}
+	}
+
+	originalVolumeNames := stateMachine.VolumeNames
+	stateMachine.VolumeNames = volumeNames
+	plan.Artifacts = stateMachine.artifacts()
+	stateMachine.VolumeNames = originalVolumeNames
+
+	return plan, nil
+}
+
+// plannedSnaps returns the snaps of a classic image: the ones of the seeds
+// along with the extra snaps, whose channels take precedence
+func (classicStateMachine *ClassicStateMachine) plannedSnaps() []plannedSnap {
+	var snaps []plannedSnap
+	indexes := make(map[string]int)
+	addSnap := func(snap plannedSnap) {
+		if i, found := indexes[snap.Name]; found {
+			snaps[i] = snap
+			return
+		}
+		indexes[snap.Name] = len(snaps)
+		snaps = append(snaps, snap)
+	}
+	for _, seededSnap := range classicStateMachine.Snaps {
+		name, channel, _ := strings.Cut(seededSnap, "=")
+		addSnap(plannedSnap{Name: name, Channel: channel})
+	}
+	if classicStateMachine.ImageDef.Customization != nil {
+		for _, extraSnap := range classicStateMachine.ImageDef.Customization.ExtraSnaps {
+			snap := plannedSnap{Name: extraSnap.SnapName, Channel: extraSnap.Channel}
+			if extraSnap.SnapRevision != 0 {
+				snap.Revision = fmt.Sprint(extraSnap.SnapRevision)
+			}
+			addSnap(snap)
+		}
+	}
+	return snaps
+}
+
+// plannedSeedSnaps returns the snaps seeded by prepare_image in a snap image
+func (stateMachine *StateMachine) plannedSeedSnaps() ([]plannedSnap, error) {
+	seedDir := filepath.Join(stateMachine.tempDirs.unpack, "image", "var", "lib", "snapd", "seed")
+	label := ""
+	if stateMachine.IsSeeded {
+		seedDir = filepath.Join(stateMachine.tempDirs.unpack, "system-seed")
+		var err error
+		if label, err = seedSystemLabel(seedDir); err != nil {
+			return nil, err
+		}
+	}
+	seededSnaps, err := listSeedSnaps(seedDir, label)
+	if err != nil {
+		return nil, err
+	}
+	var snaps []plannedSnap
+	for _, seededSnap := range seededSnaps {
+		snaps = append(snaps, plannedSnap{
+			Name:     seededSnap.Name,
+			Channel:  seededSnap.Channel,
+			Revision: seededSnap.Revision,
+		})
+	}
+	return snaps, nil
+}
+
+// reportPlan prints the plan of the build and reports it in the progress stream
+func (stateMachine *StateMachine) reportPlan() error {
+	plan, err := stateMachine.plan()
+	if err != nil {
+		return err
+	}
+	if !progress.toStdout {
+		writePlan(os.Stdout, plan)
+	}
+	progress.emit(progressEvent{Type: progressPlan, Plan: plan})
+	return nil
+}
+
+// writePlan writes the plan of a build as text
+func writePlan(out io.Writer, plan *buildPlan) {
+	fmt.Fprintf(out, "States:\n")
+	for i, state := range plan.States {
+		fmt.Fprintf(out, "  [%d] %s\n", i, state)
+	}
+	if len(plan.Packages) > 0 {
+		fmt.Fprintf(out, "Packages:\n")
+		for _, packageName := range plan.Packages {
+			fmt.Fprintf(out, "  %s\n", packageName)
+		}
+	}
+	if len(plan.Snaps) > 0 {
+		fmt.Fprintf(out, "Snaps:\n")
+		writer := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+		for _, snap := range plan.Snaps {
+			fmt.Fprintf(writer, "  %s\t%s\t%s\n", snap.Name, snap.Channel, snap.Revision)
+		}
+		writer.Flush()
+	}
+	for _, volume := range plan.Volumes {
+		fmt.Fprintf(out, "Volume %s:\n", volume.Name)
+		fmt.Fprintf(out, "  size: %s\n", quantity.Size(volume.Size).IECString())
+		if volume.Schema != "" {
+			fmt.Fprintf(out, "  schema: %s\n", volume.Schema)
+		}
+		if volume.Bootloader != "" {
+			fmt.Fprintf(out, "  bootloader: %s\n", volume.Bootloader)
+		}
+		if volume.Image != "" {
+			fmt.Fprintf(out, "  image: %s\n", volume.Image)
+		}
+		writer := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+		fmt.Fprintf(writer, "  NAME\tROLE\tTYPE\tFILESYSTEM\tOFFSET\tSIZE\n")
+		for _, structure := range volume.Structures {
+			offset := "-"
+			if structure.Offset != nil {
+				offset = fmt.Sprint(*structure.Offset)
+			}
+			fmt.Fprintf(writer, "  %s\t%s\t%s\t%s\t%s\t%s\n", valueOrDash(structure.Name),
+				valueOrDash(structure.Role), structure.Type, valueOrDash(structure.Filesystem), offset,
+				quantity.Size(structure.Size).IECString())
+		}
+		writer.Flush()
+	}
+	if len(plan.Artifacts) > 0 {
+		fmt.Fprintf(out, "Artifacts:\n")
+		for _, artifact := range plan.Artifacts {
+			fmt.Fprintf(out, "  %s\n", artifact)
+		}
+	}
+}
+
+// valueOrDash returns a value, or a dash to keep the columns of empty values aligned
+func valueOrDash(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
@@ -0,0 +1,157 @@
+package statemachine
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/canonical/ubuntu-image/internal/commands"
+	"github.com/canonical/ubuntu-image/internal/helper"
+	"github.com/canonical/ubuntu-image/internal/imagedefinition"
+)
+
+// TestDryRun tests that --dry-run only runs the states needed to plan the
+// build, reports the plan and does not generate anything
+func TestDryRun(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	restoreCWD := helper.SaveCWD()
+	t.Cleanup(restoreCWD)
+	outputDir := t.TempDir()
+	progressFile := filepath.Join(t.TempDir(), "progress.json")
+
+	var stateMachine PackStateMachine
+	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+	stateMachine.parent = &stateMachine
+	stateMachine.stateMachineFlags.DryRun = true
+	stateMachine.commonFlags.OutputDir = outputDir
+	stateMachine.commonFlags.Size = "pc:100M"
+	stateMachine.Opts = commands.PackOpts{
+		RootfsDir:    t.TempDir(),
+		GadgetDir:    filepath.Join("testdata", "gadget_tree"),
+		ArtifactType: "qcow2",
+		ManifestName: "pc.manifest",
+	}
+	stateMachine.commonFlags.ProgressFormat = "json"
+	stateMachine.commonFlags.ProgressFile = progressFile
+	err := stateMachine.Setup()
+	asserter.AssertErrNil(err, true)
+	stdout, restoreStdout, err := helper.CaptureStd(&os.Stdout)
+	asserter.AssertErrNil(err, true)
+	err = stateMachine.Run()
+	restoreStdout()
+	asserter.AssertErrNil(err, true)
+	err = stateMachine.Teardown()
+	asserter.AssertErrNil(err, true)
+
+	asserter.AssertEqual(packPlanningStates, stateMachine.StatesTaken)
+	outputFiles, err := os.ReadDir(outputDir)
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual(0, len(outputFiles))
+	if _, err := os.Stat(stateMachine.stateMachineFlags.WorkDir); !os.IsNotExist(err) {
+		t.Errorf("Expected the work directory %s to be removed", stateMachine.stateMachineFlags.WorkDir)
+	}
+
+	// the plan is printed as text too
+	readStdout, err := io.ReadAll(stdout)
+	asserter.AssertErrNil(err, true)
+	for _, expected := range []string{
+		"  [10] convert_disk_images\n",
+		"Volume pc:\n  size: 100 MiB\n  schema: gpt\n  bootloader: grub\n  image: pc.qcow2\n",
+		"  EFI System  -            EF,C12A7328-F81F-11D2-BA4B-00A0C93EC93B  vfat        2097152   50 MiB\n",
+		"Artifacts:\n  " + filepath.Join(outputDir, "pc.qcow2") + "\n  " + filepath.Join(outputDir, "pc.manifest") + "\n",
+	} {
+		if !strings.Contains(string(readStdout), expected) {
+			t.Errorf("Expected the plan to contain %q, got:\n%s", expected, string(readStdout))
+		}
+	}
+
+	f, err := os.Open(progressFile)
+	asserter.AssertErrNil(err, true)
+	defer f.Close()
+	var plan *buildPlan
+	for _, event := range readProgressEvents(t, f) {
+		if event.Type == progressPlan {
+			plan = event.Plan
+		}
+		if event.Type == progressArtifact {
+			t.Errorf("Expected no artifact to be reported, got %s", event.Path)
+		}
+	}
+	if plan == nil {
+		t.Fatalf("Expected the plan to be reported in the progress stream")
+	}
+	asserter.AssertEqual(stateMachine.stateNames(), plan.States)
+	asserter.AssertEqual(1, len(plan.Volumes))
+	asserter.AssertEqual("pc.qcow2", plan.Volumes[0].Image)
+	asserter.AssertEqual(uint64(100*1024*1024), plan.Volumes[0].Size)
+	asserter.AssertEqual(4, len(plan.Volumes[0].Structures))
+	asserter.AssertEqual(uint64(1024*1024), *plan.Volumes[0].Structures[1].Offset)
+	asserter.AssertEqual([]string{filepath.Join(outputDir, "pc.qcow2"), filepath.Join(outputDir, "pc.manifest")},
+		plan.Artifacts)
+	// the names of the artifacts are only changed in the plan
+	asserter.AssertEqual(map[string]string{"pc": "pc.img"}, stateMachine.VolumeNames)
+}
+
+// TestClassicPlan tests the packages and snaps planned for classic images
+func TestClassicPlan(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	var stateMachine ClassicStateMachine
+	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+	stateMachine.parent = &stateMachine
+	stateMachine.Packages = []string{"ubuntu-minimal", "grub-pc"}
+	stateMachine.Snaps = []string{"core22=stable", "lxd=5.0/stable", "snapd"}
+	stateMachine.ImageDef = imagedefinition.ImageDefinition{
+		Kernel: "linux-image-generic",
+		Customization: &imagedefinition.Customization{
+			ExtraPackages: []*imagedefinition.Package{{PackageName: "hello"}},
+			ExtraSnaps: []*imagedefinition.Snap{
+				{SnapName: "lxd", Channel: "latest/edge", SnapRevision: 42},
+				{SnapName: "hello", Channel: "stable"},
+			},
+		},
+	}
+
+	plan, err := stateMachine.plan()
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual([]string{"ubuntu-minimal", "grub-pc", "hello", "linux-image-generic"}, plan.Packages)
+	asserter.AssertEqual([]plannedSnap{
+		{Name: "core22", Channel: "stable"},
+		{Name: "lxd", Channel: "latest/edge", Revision: "42"},
+		{Name: "snapd"},
+		{Name: "hello", Channel: "stable"},
+	}, plan.Snaps)
+	// the packages of the build are left untouched
+	asserter.AssertEqual([]string{"ubuntu-minimal", "grub-pc"}, stateMachine.Packages)
+}
+
+// TestFailedDryRun tests that --dry-run can not be used with the flags
+// stopping, resuming or repeating the build
+func TestFailedDryRun(t *testing.T) {
+	testCases := []struct {
+		name  string
+		setup func(*StateMachine)
+	}{
+		{"until", func(stateMachine *StateMachine) { stateMachine.stateMachineFlags.Until = "make_disk" }},
+		{"thru", func(stateMachine *StateMachine) { stateMachine.stateMachineFlags.Thru = "make_disk" }},
+		{"resume", func(stateMachine *StateMachine) {
+			stateMachine.stateMachineFlags.Resume = true
+			stateMachine.stateMachineFlags.WorkDir = "/tmp"
+		}},
+		{"verify_reproducible", func(stateMachine *StateMachine) {
+			stateMachine.commonFlags.VerifyReproducible = true
+		}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			var stateMachine StateMachine
+			stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+			stateMachine.stateMachineFlags.DryRun = true
+			tc.setup(&stateMachine)
+			err := stateMachine.validateInput()
+			asserter.AssertErrContains(err, "--dry-run can not be used with")
+		})
+	}
+}
@@ -0,0 +1,338 @@
+package statemachine
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/canonical/ubuntu-image/internal/commands"
+	"github.com/canonical/ubuntu-image/internal/helper"
+)
+
+// the types of the events of the JSON progress stream
+const (
+	progressBuildStart  = "build-start"
+	progressBuildFinish = "build-finish"
+	progressStateStart  = "state-start"
+	progressStateFinish = "state-finish"
+	progressOutput      = "output"
+	progressWarning     = "warning"
+	progressArtifact    = "artifact"
+	progressPlan        = "plan"
+)
+
+// progressEvent is an event of the JSON progress stream. Only the fields
+// relevant to the type of the event are set
+type progressEvent struct {
+	Time     string     `json:"time"`
+	Type     string     `json:"type"`
+	Index    *int       `json:"index,omitempty"`
+	State    string     `json:"state,omitempty"`
+	States   []string   `json:"states,omitempty"`
+	Duration *float64   `json:"duration,omitempty"`
+	Command  string     `json:"command,omitempty"`
+	Line     string     `json:"line,omitempty"`
+	Message  string     `json:"message,omitempty"`
+	Error    string     `json:"error,omitempty"`
+	Path     string     `json:"path,omitempty"`
+	Size     *int64     `json:"size,omitempty"`
+	SHA256   string     `json:"sha256,omitempty"`
+	Plan     *buildPlan `json:"plan,omitempty"`
+}
+
+// progressReporter writes the JSON progress events of a build, one per line.
+// It is shared by the whole package so that the commands run by the helper
+// functions can report their output too
+type progressReporter struct {
+	mutex    sync.Mutex
+	out      io.Writer
+	closer   io.Closer
+	toStdout bool   // the events replace the text output of the build
+	state    string // the state currently running
+	outputs  []*progressOutputWriter
+}
+
+// progress is the reporter of the running build. It does nothing unless
+// --progress-format=json is used
+var progress = &progressReporter{}
+
+// start enables the reporter if the JSON progress stream was requested
+func (reporter *progressReporter) start(commonFlags *commands.CommonOpts) error {
+	if commonFlags.ProgressFormat != "json" {
+		return nil
+	}
+	if commonFlags.ProgressFile == "" || commonFlags.ProgressFile == "-" {
+		reporter.out = os.Stdout
+		reporter.toStdout = true
+		return nil
+	}
+	progressFile, err := osOpenFile(commonFlags.ProgressFile, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("Error opening progress file: %s", err.Error())
+	}
+	reporter.out = progressFile
+	reporter.closer = progressFile
+	return nil
+}
+
+// stop flushes the pending command output and disables the reporter
+func (reporter *progressReporter) stop() {
+	reporter.flushOutputs()
+	if reporter.closer != nil {
+		reporter.closer.Close()
+	}
+	reporter.out = nil
+	reporter.closer = nil
+	reporter.toStdout = false
+	reporter.state = ""
+}
+
+// enabled returns whether the events are reported
+func (reporter *progressReporter) enabled() bool {
+	return reporter.out != nil
+}
+
+// emit writes an event to the progress stream
+func (reporter *progressReporter) emit(event progressEvent) {
+	reporter.mutex.Lock()
+	defer reporter.mutex.Unlock()
+	if reporter.out == nil {
+		return
+	}
+	event.Time = timeNow().UTC().Format(time.RFC3339Nano)
+	if event.State == "" && event.Type != progressBuildStart && event.Type != progressBuildFinish {
+		event.State = reporter.state
+	}
+	encoded, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+	_, _ = reporter.out.Write(append(encoded, '\n'))
+}
+
+// stateStarted reports the start of a state
+func (reporter *progressReporter) stateStarted(index int, name string) {
+	reporter.mutex.Lock()
+	reporter.state = name
+	reporter.mutex.Unlock()
+	reporter.emit(progressEvent{Type: progressStateStart, Index: &index, State: name})
+}
+
+// stateFinished reports the end of a state, once all the output of its
+// commands has been reported
+func (reporter *progressReporter) stateFinished(index int, name string, duration time.Duration, err error) {
+	reporter.flushOutputs()
+	seconds := duration.Seconds()
+	event := progressEvent{Type: progressStateFinish, Index: &index, State: name, Duration: &seconds}
+	if err != nil {
+		event.Error = err.Error()
+	}
+	reporter.emit(event)
+	reporter.mutex.Lock()
+	reporter.state = ""
+	reporter.mutex.Unlock()
+}
+
+// commandOutput returns a writer reporting the output of a command line by line
+func (reporter *progressReporter) commandOutput(command string) io.Writer {
+	writer := &progressOutputWriter{reporter: reporter, command: command}
+	reporter.mutex.Lock()
+	reporter.outputs = append(reporter.outputs, writer)
+	reporter.mutex.Unlock()
+	return writer
+}
+
+// flushOutputs reports the last lines of the commands not ending with a newline
+func (reporter *progressReporter) flushOutputs() {
+	reporter.mutex.Lock()
+	outputs := reporter.outputs
+	reporter.outputs = nil
+	reporter.mutex.Unlock()
+	for _, output := range outputs {
+		output.flush()
+	}
+}
+
+// progressOutputWriter splits the output of a command into output events
+type progressOutputWriter struct {
+	reporter *progressReporter
+	command  string
+	partial  []byte
+}
+
+// Write reports every complete line and keeps the rest for later
+func (writer *progressOutputWriter) Write(p []byte) (int, error) {
+	writer.partial = append(writer.partial, p...)
+	for {
+		newline := bytes.IndexByte(writer.partial, '\n')
+		if newline < 0 {
+			break
+		}
+		writer.emitLine(writer.partial[:newline])
+		writer.partial = writer.partial[newline+1:]
+	}
+	return len(p), nil
+}
+
+// flush reports the last line of the output
+func (writer *progressOutputWriter) flush() {
+	if len(writer.partial) > 0 {
+		writer.emitLine(writer.partial)
+		writer.partial = nil
+	}
+}
+
+func (writer *progressOutputWriter) emitLine(line []byte) {
+	trimmed := strings.TrimRight(string(line), "\r")
+	if trimmed == "" {
+		return
+	}
+	writer.reporter.emit(progressEvent{Type: progressOutput, Command: writer.command, Line: trimmed})
+}
+
+// setCommandOutput sets the output of a command like helper.SetCommandOutput
+// does, and also reports it in the progress stream. The live output of
+// --debug is not printed when the progress stream is written to stdout
+func setCommandOutput(cmd *exec.Cmd, liveOutput bool) *bytes.Buffer {
+	if !progress.enabled() {
+		return helper.SetCommandOutput(cmd, liveOutput)
+	}
+	cmdOutput := helper.SetCommandOutput(cmd, liveOutput && !progress.toStdout)
+	// stdout and stderr must stay the same writer so that exec writes
+	// to it from a single goroutine
+	writer := io.MultiWriter(cmd.Stdout, progress.commandOutput(cmd.String()))
+	cmd.Stdout = writer
+	cmd.Stderr = writer
+	return cmdOutput
+}
+
+// warn prints a warning and reports it in the progress stream
+func (stateMachine *StateMachine) warn(format string, args ...interface{}) {
+	message := fmt.Sprintf(format, args...)
+	if !stateMachine.commonFlags.Quiet && !progress.toStdout {
+		fmt.Printf("WARNING: %s\n", message)
+	}
+	progress.emit(progressEvent{Type: progressWarning, Message: message})
+}
+
+// printProgress prints the text progress of the build, unless the JSON
+// progress stream replaces it
+func (stateMachine *StateMachine) printProgress(format string, args ...interface{}) {
+	if !progress.toStdout {
+		fmt.Printf(format, args...)
+	}
+}
+
+// printDebug prints the --debug output of the functions that are not
+// states, unless the JSON progress stream replaces it
+func printDebug(format string, args ...interface{}) {
+	if !progress.toStdout {
+		fmt.Printf(format, args...)
+	}
+}
+
+// reportArtifacts reports the files generated in the output directory by
+// the build, with their size and SHA256 sum
+func (stateMachine *StateMachine) reportArtifacts() error {
+	for _, artifact := range stateMachine.artifacts() {
+		info, err := os.Stat(artifact)
+		if err != nil {
+			continue
+		}
+		sum, err := helper.CalculateSHA256(artifact)
+		if err != nil {
+			return err
+		}
+		size := info.Size()
+		progress.emit(progressEvent{
+			Type:   progressArtifact,
+			Path:   artifact,
+			Size:   &size,
+			SHA256: fmt.Sprintf("%x", sum),
+		})
+	}
+	return nil
+}
+
+// artifacts returns the paths of the files the build generates in the
+// output directory, including the sums and signatures of signed builds.
+// Files that were not generated are included too
+func (stateMachine *StateMachine) artifacts() []string {
+	paths := stateMachine.outputArtifacts()
+	if signing := stateMachine.signing(); signing != nil {
+		paths = append(paths, stateMachine.signatureArtifacts(paths, signing.Method)...)
+	}
+	return paths
+}
+
+// outputArtifacts returns the paths of the images, manifests and other
+// files the build generates in the output directory
+func (stateMachine *StateMachine) outputArtifacts() []string {
+	var names []string
+	volumeNames := make([]string, 0, len(stateMachine.VolumeNames))
+	for volumeName := range stateMachine.VolumeNames {
+		volumeNames = append(volumeNames, volumeName)
+	}
+	sort.Strings(volumeNames)
+	for _, volumeName := range volumeNames {
+		names = append(names, stateMachine.VolumeNames[volumeName])
+	}
+
+	switch parent := stateMachine.parent.(type) {
+	case *ClassicStateMachine:
+		if artifacts := parent.ImageDef.Artifacts; artifacts != nil {
+			if artifacts.Qcow2 != nil {
+				for _, qcow2 := range *artifacts.Qcow2 {
+					names = append(names, qcow2.Qcow2Name)
+				}
+			}
+			if artifacts.Iso != nil {
+				for _, iso := range *artifacts.Iso {
+					names = append(names, iso.IsoName)
+				}
+			}
+			if artifacts.Manifest != nil {
+				names = append(names, artifacts.Manifest.ManifestName)
+			}
+			if artifacts.Filelist != nil {
+				names = append(names, artifacts.Filelist.FilelistName)
+			}
+			if artifacts.Changelog != nil {
+				names = append(names, artifacts.Changelog.ChangelogName)
+			}
+			if artifacts.RootfsTar != nil {
+				names = append(names, artifacts.RootfsTar.RootfsTarName)
+			}
+			if artifacts.SBOM != nil {
+				names = append(names, artifacts.SBOM.SBOMName)
+			}
+			if artifacts.Report != nil {
+				names = append(names, artifacts.Report.ReportName)
+			}
+		}
+	case *SnapStateMachine:
+		names = append(names, "seed.manifest", "snaps.manifest", parent.Opts.SBOM)
+	case *PackStateMachine:
+		names = append(names, parent.Opts.ManifestName, parent.Opts.FilelistName)
+	}
+
+	var paths []string
+	for _, name := range names {
+		if name == "" {
+			continue
+		}
+		path := filepath.Join(stateMachine.commonFlags.OutputDir, name)
+		if !helper.SliceHasElement(paths, path) {
+			paths = append(paths, path)
+		}
+	}
+	return paths
+}
@@ -0,0 +1,159 @@
+package statemachine
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/canonical/ubuntu-image/internal/helper"
+	"github.com/canonical/ubuntu-image/internal/imagedefinition"
+)
+
+// readProgressEvents decodes the events of a JSON progress stream
+func readProgressEvents(t *testing.T, r io.Reader) []progressEvent {
+	t.Helper()
+	var events []progressEvent
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		var event progressEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			t.Fatalf("Invalid progress event %q: %s", scanner.Text(), err.Error())
+		}
+		if event.Time == "" {
+			t.Errorf("Progress event %q has no time", scanner.Text())
+		}
+		events = append(events, event)
+	}
+	return events
+}
+
+// TestProgressJSON tests the JSON progress stream of a successful build
+func TestProgressJSON(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	outputDir := t.TempDir()
+	progressFile := filepath.Join(t.TempDir(), "progress.json")
+	err := os.WriteFile(filepath.Join(outputDir, "pc.img"), []byte("test image"), 0644)
+	asserter.AssertErrNil(err, true)
+
+	var stateMachine testStateMachine
+	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+	stateMachine.commonFlags.ProgressFormat = "json"
+	stateMachine.commonFlags.ProgressFile = progressFile
+	stateMachine.commonFlags.OutputDir = outputDir
+	stateMachine.VolumeNames = map[string]string{"pc": "pc.img", "missing": "missing.img"}
+	stateMachine.states = []stateFunc{
+		{"run_command", func(stateMachine *StateMachine) error {
+			cmd := exec.Command("sh", "-c", "echo first; echo second >&2; printf last")
+			setCommandOutput(cmd, false)
+			return cmd.Run()
+		}},
+		{"warn", func(stateMachine *StateMachine) error {
+			stateMachine.warn("test warning %d", 1)
+			return nil
+		}},
+	}
+
+	stdout, restoreStdout, err := helper.CaptureStd(&os.Stdout)
+	asserter.AssertErrNil(err, true)
+	err = stateMachine.Run()
+	restoreStdout()
+	asserter.AssertErrNil(err, true)
+	readStdout, err := io.ReadAll(stdout)
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual(true, strings.Contains(string(readStdout), "[0] run_command"))
+	asserter.AssertEqual(true, strings.Contains(string(readStdout), "WARNING: test warning 1"))
+	asserter.AssertEqual(false, progress.enabled())
+
+	f, err := os.Open(progressFile)
+	asserter.AssertErrNil(err, true)
+	defer f.Close()
+	events := readProgressEvents(t, f)
+
+	var summary []string
+	for _, event := range events {
+		summary = append(summary, strings.TrimSpace(fmt.Sprintf("%s %s %s%s%s",
+			event.Type, event.State, event.Line, event.Message, filepath.Base(event.Path))))
+	}
+	asserter.AssertEqual([]string{
+		"build-start  .",
+		"state-start run_command .",
+		"output run_command first.",
+		"output run_command second.",
+		"output run_command last.",
+		"state-finish run_command .",
+		"state-start warn .",
+		"warning warn test warning 1.",
+		"state-finish warn .",
+		"artifact  pc.img",
+		"build-finish  .",
+	}, summary)
+
+	asserter.AssertEqual([]string{"run_command", "warn"}, events[0].States)
+	asserter.AssertEqual(1, *events[6].Index)
+	if events[5].Duration == nil || events[10].Duration == nil {
+		t.Errorf("Expected the durations of the states and the build to be reported")
+	}
+	asserter.AssertEqual(true, strings.HasSuffix(events[2].Command, "sh -c echo first; echo second >&2; printf last"))
+	asserter.AssertEqual(int64(10), *events[9].Size)
+	asserter.AssertEqual("1187327c6d0f0b0b19b33ab211a549023aa9a41f359c6d0a827d7bd99f8d5994", events[9].SHA256)
+}
+
+// TestProgressJSONStdout tests that the JSON progress stream replaces the
+// text output when it is written to stdout, and reports failed builds
+func TestProgressJSONStdout(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+
+	var stateMachine testStateMachine
+	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+	stateMachine.commonFlags.ProgressFormat = "json"
+	stateMachine.commonFlags.Debug = true
+	chroot := t.TempDir()
+	stateMachine.states = []stateFunc{
+		{"test_fail", func(stateMachine *StateMachine) error {
+			// the --debug output is not mixed with the JSON progress stream
+			err := manualMakeDirs([]*imagedefinition.MakeDirs{{Path: "/etc/test", Permissions: 0755}},
+				chroot, stateMachine.commonFlags.Debug)
+			if err != nil {
+				return err
+			}
+			stateMachine.warn("test warning")
+			return fmt.Errorf("Test Error")
+		}},
+	}
+
+	stdout, restoreStdout, err := helper.CaptureStd(&os.Stdout)
+	asserter.AssertErrNil(err, true)
+	err = stateMachine.Run()
+	restoreStdout()
+	asserter.AssertErrContains(err, "Test Error")
+
+	events := readProgressEvents(t, stdout)
+	asserter.AssertEqual(5, len(events))
+	asserter.AssertEqual(progressWarning, events[2].Type)
+	asserter.AssertEqual("Test Error", events[3].Error)
+	asserter.AssertEqual(progressBuildFinish, events[4].Type)
+	asserter.AssertEqual("Test Error", events[4].Error)
+}
+
+// TestFailedProgressJSON tests the failures of the JSON progress stream
+func TestFailedProgressJSON(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+
+	var stateMachine testStateMachine
+	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+	stateMachine.commonFlags.ProgressFile = filepath.Join(t.TempDir(), "progress.json")
+	err := stateMachine.validateInput()
+	asserter.AssertErrContains(err, "--progress-file can only be used with --progress-format=json")
+
+	stateMachine.commonFlags.ProgressFormat = "json"
+	stateMachine.commonFlags.ProgressFile = filepath.Join(t.TempDir(), "missing", "progress.json")
+	stateMachine.states = testStates
+	err = stateMachine.Run()
+	asserter.AssertErrContains(err, "Error opening progress file")
+}
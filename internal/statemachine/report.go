@@ -0,0 +1,124 @@
+package statemachine
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"gopkg.in/yaml.v2"
+)
+
+// UbuntuImageVersion is the version of ubuntu-image recorded in the build
+// report. It is set by the ubuntu-image command
+var UbuntuImageVersion string
+
+// buildReport is the document written by the report artifact
+type buildReport struct {
+	UbuntuImageVersion    string           `json:"ubuntu-image-version"    yaml:"ubuntu-image-version"`
+	ImageDefinition       string           `json:"image-definition"        yaml:"image-definition"`
+	ImageDefinitionSHA256 string           `json:"image-definition-sha256" yaml:"image-definition-sha256"`
+	Series                string           `json:"series"                  yaml:"series"`
+	Architecture          string           `json:"architecture"            yaml:"architecture"`
+	Mirror                string           `json:"mirror,omitempty"        yaml:"mirror,omitempty"`
+	Pocket                string           `json:"pocket,omitempty"        yaml:"pocket,omitempty"`
+	Gadget                *reportGadget    `json:"gadget,omitempty"        yaml:"gadget,omitempty"`
+	Artifacts             []reportArtifact `json:"artifacts"               yaml:"artifacts"`
+	States                []reportState    `json:"states"                  yaml:"states"`
+}
+
+// reportGadget describes the source of the gadget tree
+type reportGadget struct {
+	Type   string `json:"type"             yaml:"type"`
+	URL    string `json:"url,omitempty"    yaml:"url,omitempty"`
+	Branch string `json:"branch,omitempty" yaml:"branch,omitempty"`
+	Ref    string `json:"ref,omitempty"    yaml:"ref,omitempty"`
+	Commit string `json:"commit,omitempty" yaml:"commit,omitempty"`
+}
+
+// reportArtifact describes a file generated in the output directory
+type reportArtifact struct {
+	Name   string `json:"name"   yaml:"name"`
+	Size   int64  `json:"size"   yaml:"size"`
+	SHA256 string `json:"sha256" yaml:"sha256"`
+}
+
+// reportState records how long a state took to run, in seconds
+type reportState struct {
+	Name     string  `json:"name"     yaml:"name"`
+	Duration float64 `json:"duration" yaml:"duration"`
+}
+
+// generateReport writes the report of the build, listing the artifacts
+// generated so far with their sums and the sources they were built from
+func (stateMachine *StateMachine) generateReport() error {
+	classicStateMachine := stateMachine.parent.(*ClassicStateMachine)
+	imageDef := classicStateMachine.ImageDef
+	reportArtifactDef := imageDef.Artifacts.Report
+	reportPath := filepath.Join(stateMachine.commonFlags.OutputDir, reportArtifactDef.ReportName)
+
+	report := buildReport{
+		UbuntuImageVersion:    UbuntuImageVersion,
+		ImageDefinition:       filepath.Base(classicStateMachine.Args.ImageDefinition),
+		ImageDefinitionSHA256: classicStateMachine.ImageDefinitionSHA256,
+		Series:                imageDef.Series,
+		Architecture:          imageDef.Architecture,
+		Artifacts:             []reportArtifact{},
+		States:                []reportState{},
+	}
+	if imageDef.Rootfs != nil && imageDef.Rootfs.Tarball == nil {
+		report.Mirror = imageDef.Rootfs.Mirror
+		report.Pocket = imageDef.Rootfs.Pocket
+	}
+	if imageDef.Gadget != nil {
+		report.Gadget = &reportGadget{
+			Type:   imageDef.Gadget.GadgetType,
+			URL:    imageDef.Gadget.GadgetURL,
+			Branch: imageDef.Gadget.GadgetBranch,
+			Ref:    imageDef.Gadget.Ref,
+			Commit: classicStateMachine.GadgetCommit,
+		}
+	}
+
+	// the sums and signatures of signed builds are written after the report
+	for _, artifact := range stateMachine.outputArtifacts() {
+		if artifact == reportPath {
+			continue
+		}
+		info, err := os.Stat(artifact)
+		if err != nil {
+			continue
+		}
+		sum, err := fileSHA256(artifact)
+		if err != nil {
+			return fmt.Errorf("Error generating the report: %s", err.Error())
+		}
+		report.Artifacts = append(report.Artifacts, reportArtifact{
+			Name:   filepath.Base(artifact),
+			Size:   info.Size(),
+			SHA256: sum,
+		})
+	}
+	// how long the states took is not reproducible
+	if !stateMachine.reproducible() {
+		for _, timing := range stateMachine.StateTimings {
+			report.States = append(report.States, reportState{timing.Name, timing.Duration.Seconds()})
+		}
+	}
+
+	var encoded []byte
+	var err error
+	if reportArtifactDef.Format == "yaml" {
+		encoded, err = yaml.Marshal(report)
+	} else {
+		encoded, err = json.MarshalIndent(report, "", "  ")
+		encoded = append(encoded, '\n')
+	}
+	if err != nil {
+		return fmt.Errorf("Error encoding the report: %s", err.Error())
+	}
+	if err := osWriteFile(reportPath, encoded, 0644); err != nil {
+		return fmt.Errorf("Error writing the report: %s", err.Error())
+	}
+	return nil
+}
@@ -0,0 +1,163 @@
+package statemachine
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/canonical/ubuntu-image/internal/helper"
+	"github.com/canonical/ubuntu-image/internal/imagedefinition"
+)
+
+// TestGenerateReport tests that the report lists the artifacts and the sources of the build
+func TestGenerateReport(t *testing.T) {
+	testCases := []struct {
+		name      string
+		format    string
+		unmarshal func([]byte, interface{}) error
+	}{
+		{"json", "json", json.Unmarshal},
+		{"default", "", json.Unmarshal},
+		{"yaml", "yaml", yaml.Unmarshal},
+	}
+	for _, tc := range testCases {
+		t.Run("test_generate_report_"+tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			outputDir := t.TempDir()
+			err := os.WriteFile(filepath.Join(outputDir, "pc.img"), []byte("test image"), 0644)
+			asserter.AssertErrNil(err, true)
+			err = os.WriteFile(filepath.Join(outputDir, "pc.manifest"), []byte("hello 1.0\n"), 0644)
+			asserter.AssertErrNil(err, true)
+			// the report of a previous build is not listed in the new one
+			err = os.WriteFile(filepath.Join(outputDir, "pc.report"), []byte("old report"), 0644)
+			asserter.AssertErrNil(err, true)
+
+			saveVersion := UbuntuImageVersion
+			UbuntuImageVersion = "3.0+test"
+			t.Cleanup(func() { UbuntuImageVersion = saveVersion })
+
+			var stateMachine ClassicStateMachine
+			stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+			stateMachine.parent = &stateMachine
+			stateMachine.commonFlags.OutputDir = outputDir
+			stateMachine.Args.ImageDefinition = filepath.Join("testdata", "image_definitions", "test_report.yaml")
+			stateMachine.ImageDefinitionSHA256 = "1234"
+			stateMachine.GadgetCommit = "0123456789abcdef0123456789abcdef01234567"
+			stateMachine.VolumeNames = map[string]string{"pc": "pc.img"}
+			stateMachine.StateTimings = []stateTiming{
+				{"parse_image_definition", 1500 * time.Millisecond},
+				{"make_disk", 2 * time.Second},
+			}
+			stateMachine.ImageDef = imagedefinition.ImageDefinition{
+				Series:       "jammy",
+				Architecture: "amd64",
+				Gadget: &imagedefinition.Gadget{
+					GadgetType:   "git",
+					GadgetURL:    "https://github.com/snapcore/pc-gadget.git",
+					GadgetBranch: "classic",
+				},
+				Rootfs: &imagedefinition.Rootfs{
+					Mirror: "http://archive.ubuntu.com/ubuntu/",
+					Pocket: "updates",
+				},
+				Artifacts: &imagedefinition.Artifact{
+					Manifest: &imagedefinition.Manifest{ManifestName: "pc.manifest"},
+					Filelist: &imagedefinition.Filelist{FilelistName: "pc.filelist"},
+					Report:   &imagedefinition.Report{ReportName: "pc.report", Format: tc.format},
+				},
+			}
+
+			// the report is an artifact of the build like the ones it lists
+			if !helper.SliceHasElement(stateMachine.outputArtifacts(), filepath.Join(outputDir, "pc.report")) {
+				t.Errorf("Expected the report in the artifacts %v", stateMachine.outputArtifacts())
+			}
+
+			err = stateMachine.generateReport()
+			asserter.AssertErrNil(err, true)
+
+			reportData, err := os.ReadFile(filepath.Join(outputDir, "pc.report"))
+			asserter.AssertErrNil(err, true)
+			var report buildReport
+			err = tc.unmarshal(reportData, &report)
+			asserter.AssertErrNil(err, true)
+
+			asserter.AssertEqual(buildReport{
+				UbuntuImageVersion:    "3.0+test",
+				ImageDefinition:       "test_report.yaml",
+				ImageDefinitionSHA256: "1234",
+				Series:                "jammy",
+				Architecture:          "amd64",
+				Mirror:                "http://archive.ubuntu.com/ubuntu/",
+				Pocket:                "updates",
+				Gadget: &reportGadget{
+					Type:   "git",
+					URL:    "https://github.com/snapcore/pc-gadget.git",
+					Branch: "classic",
+					Commit: "0123456789abcdef0123456789abcdef01234567",
+				},
+				Artifacts: []reportArtifact{
+					{"pc.img", 10, "1187327c6d0f0b0b19b33ab211a549023aa9a41f359c6d0a827d7bd99f8d5994"},
+					{"pc.manifest", 10, "4e62a82a79a788ea0db991e268b6e2488afd22a5b556fff4b36b2c1973b2f31b"},
+				},
+				States: []reportState{
+					{"parse_image_definition", 1.5},
+					{"make_disk", 2},
+				},
+			}, report)
+		})
+	}
+}
+
+// TestGenerateReportLast tests that the report is generated after the other artifacts
+func TestGenerateReportLast(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	restoreCWD := helper.SaveCWD()
+	t.Cleanup(restoreCWD)
+
+	var stateMachine ClassicStateMachine
+	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+	stateMachine.parent = &stateMachine
+	stateMachine.Args.ImageDefinition = filepath.Join("testdata", "image_definitions", "test_report.yaml")
+	err := stateMachine.parseImageDefinition()
+	asserter.AssertErrNil(err, true)
+	err = stateMachine.calculateStates()
+	asserter.AssertErrNil(err, true)
+
+	stateNames := stateMachine.stateNames()
+	asserter.AssertEqual([]string{"generate_sbom", "generate_report", "finish"}, stateNames[len(stateNames)-3:])
+	asserter.AssertEqual("yaml", stateMachine.ImageDef.Artifacts.Report.Format)
+	asserter.AssertEqual("spdx", stateMachine.ImageDef.Artifacts.SBOM.Format)
+}
+
+// TestFailedGenerateReport tests the failures of generating the report
+func TestFailedGenerateReport(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	outputDir := t.TempDir()
+
+	var stateMachine ClassicStateMachine
+	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+	stateMachine.parent = &stateMachine
+	stateMachine.commonFlags.OutputDir = outputDir
+	stateMachine.ImageDef = imagedefinition.ImageDefinition{
+		Artifacts: &imagedefinition.Artifact{
+			Report: &imagedefinition.Report{ReportName: "pc.report", Format: "json"},
+		},
+	}
+
+	osWriteFile = mockWriteFile
+	t.Cleanup(func() { osWriteFile = os.WriteFile })
+	err := stateMachine.generateReport()
+	asserter.AssertErrContains(err, "Error writing the report")
+	osWriteFile = os.WriteFile
+
+	// the artifacts that can not be read can not be listed
+	err = os.Mkdir(filepath.Join(outputDir, "pc.img"), 0755)
+	asserter.AssertErrNil(err, true)
+	stateMachine.VolumeNames = map[string]string{"pc": "pc.img"}
+	err = stateMachine.generateReport()
+	asserter.AssertErrContains(err, "Error generating the report")
+}
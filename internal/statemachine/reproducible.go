@@ -0,0 +1,285 @@
+package statemachine
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/diskfs/go-diskfs/partition"
+	"github.com/diskfs/go-diskfs/partition/gpt"
+	"github.com/google/uuid"
+	"github.com/snapcore/snapd/gadget/quantity"
+	"github.com/snapcore/snapd/strutil/shlex"
+
+	"github.com/canonical/ubuntu-image/internal/diskimage"
+)
+
+// sourceDateEpochEnv is the environment variable holding the time used by
+// reproducible builds, see https://reproducible-builds.org/specs/source-date-epoch/
+const sourceDateEpochEnv = "SOURCE_DATE_EPOCH"
+
+// reproducibleNamespace is the namespace of the UUIDs derived from the seed
+// of reproducible builds
+var reproducibleNamespace = uuid.NewSHA1(uuid.NameSpaceURL, []byte("https://github.com/canonical/ubuntu-image"))
+
+// reproducible returns whether the build must be reproducible
+func (stateMachine *StateMachine) reproducible() bool {
+	return stateMachine.commonFlags.Reproducible || stateMachine.commonFlags.VerifyReproducible
+}
+
+// setupReproducibility reads the time and the seed of reproducible builds
+func (stateMachine *StateMachine) setupReproducibility() error {
+	if !stateMachine.reproducible() {
+		if stateMachine.commonFlags.ReproducibleSeed != "" {
+			return fmt.Errorf("--reproducible-seed can only be used with --reproducible")
+		}
+		return nil
+	}
+	if stateMachine.commonFlags.VerifyReproducible &&
+		(stateMachine.stateMachineFlags.Until != "" || stateMachine.stateMachineFlags.Thru != "" ||
+			stateMachine.stateMachineFlags.Resume) {
+		return fmt.Errorf("--verify-reproducible can not be used with --until, --thru or --resume")
+	}
+
+	epoch, found := os.LookupEnv(sourceDateEpochEnv)
+	if !found {
+		return fmt.Errorf("%s must be set to build reproducibly", sourceDateEpochEnv)
+	}
+	seconds, err := strconv.ParseInt(epoch, 10, 64)
+	if err != nil || seconds < 0 {
+		return fmt.Errorf("Error parsing %s: \"%s\" is not a number of seconds since the epoch",
+			sourceDateEpochEnv, epoch)
+	}
+	stateMachine.sourceDateEpoch = time.Unix(seconds, 0).UTC()
+
+	stateMachine.reproducibleSeed = stateMachine.commonFlags.ReproducibleSeed
+	if stateMachine.reproducibleSeed == "" {
+		stateMachine.reproducibleSeed = epoch
+	}
+	return nil
+}
+
+// buildTime returns the time recorded in the artifacts
+func (stateMachine *StateMachine) buildTime() time.Time {
+	if stateMachine.reproducible() {
+		return stateMachine.sourceDateEpoch
+	}
+	return timeNow()
+}
+
+// reproducibleUUID derives a UUID from the seed of the build and the given
+// names, which identify what the UUID is used for
+func (stateMachine *StateMachine) reproducibleUUID(names ...string) uuid.UUID {
+	return uuid.NewSHA1(reproducibleNamespace,
+		[]byte(stateMachine.reproducibleSeed+"\x00"+strings.Join(names, "\x00")))
+}
+
+// reproducibleReader returns a function reading bytes derived from the seed
+// of the build, standing in for rand.Read. Every read returns new bytes
+func (stateMachine *StateMachine) reproducibleReader(names ...string) func([]byte) (int, error) {
+	reads := 0
+	return func(b []byte) (int, error) {
+		n := 0
+		for n < len(b) {
+			blockNames := append(append([]string{}, names...), strconv.Itoa(reads))
+			id := stateMachine.reproducibleUUID(blockNames...)
+			n += copy(b[n:], id[:])
+			reads++
+		}
+		return n, nil
+	}
+}
+
+// setReproducibleGUIDs derives the GUIDs of a GPT disk and of its partitions
+// from the seed of the build. MBR disks are left untouched
+func (stateMachine *StateMachine) setReproducibleGUIDs(volumeName string, partitionTable partition.Table) {
+	gptTable, ok := partitionTable.(*gpt.Table)
+	if !ok {
+		return
+	}
+	gptTable.GUID = strings.ToUpper(stateMachine.reproducibleUUID("gpt-disk", volumeName).String())
+	for i, gptPartition := range gptTable.Partitions {
+		gptPartition.GUID = strings.ToUpper(stateMachine.reproducibleUUID("gpt-partition",
+			volumeName, strconv.Itoa(i)).String())
+	}
+}
+
+// diskImageOptions returns the options used to convert a raw disk image to
+// the VHD, VHDX and VMDK formats. The ids and the timestamps of reproducible builds
+// are derived from the seed and SOURCE_DATE_EPOCH
+func (stateMachine *StateMachine) diskImageOptions(dest string) (diskimage.VHDOptions, diskimage.VMDKOptions) {
+	var vhdOpts diskimage.VHDOptions
+	var vmdkOpts diskimage.VMDKOptions
+	if stateMachine.reproducible() {
+		name := filepath.Base(dest)
+		uniqueID := stateMachine.reproducibleUUID("vhd-unique-id", name)
+		vhdOpts.Timestamp = stateMachine.sourceDateEpoch
+		vhdOpts.UniqueID = uniqueID[:]
+		contentID := stateMachine.reproducibleUUID("vmdk-content-id", name)
+		// a zero content id would be replaced by a random one
+		vmdkOpts.ContentID = binary.LittleEndian.Uint32(contentID[:4]) | 1
+	}
+	return vhdOpts, vmdkOpts
+}
+
+// makeFilesystem creates a filesystem with the mkfs functions of snapd,
+// populated with the contents of contentRoot if it is not empty. The names
+// identify the filesystem in reproducible builds: their filesystems get a
+// UUID derived from the seed and the modification times of their contents
+// are clamped to SOURCE_DATE_EPOCH
+func (stateMachine *StateMachine) makeFilesystem(typ, img, label, contentRoot string,
+	size quantity.Size, names ...string) error {
+	if !stateMachine.reproducible() {
+		if contentRoot == "" {
+			return mkfsMake(typ, img, label, size, stateMachine.SectorSize)
+		}
+		return mkfsMakeWithContent(typ, img, label, contentRoot, size, stateMachine.SectorSize)
+	}
+
+	if contentRoot != "" {
+		if err := stateMachine.clampModificationTimes(contentRoot); err != nil {
+			return err
+		}
+	}
+	fsUUID := stateMachine.reproducibleUUID(append([]string{"filesystem"}, names...)...)
+	if typ == "ext4" {
+		hashSeed := stateMachine.reproducibleUUID(append([]string{"filesystem-hash-seed"}, names...)...)
+		return stateMachine.mkfsExt4(img, label, contentRoot, size, fsUUID, hashSeed)
+	}
+	if err := mkfsMakeWithContent(typ, img, label, contentRoot, size, stateMachine.SectorSize); err != nil {
+		return err
+	}
+	return setVfatVolumeID(img, fsUUID[:4])
+}
+
+// mkfsExt4 creates an ext4 filesystem with the same options as snapd, plus
+// the given UUID and directory hash seed, which mke2fs otherwise generates
+// randomly. The timestamps of the filesystem are set to SOURCE_DATE_EPOCH
+func (stateMachine *StateMachine) mkfsExt4(img, label, contentRoot string, size quantity.Size,
+	fsUUID, hashSeed uuid.UUID) error {
+	mkfsArgs := []string{"mkfs.ext4"}
+	// small filesystems use 1k blocks, unless the sectors are larger
+	if size != 0 && size <= 32*quantity.SizeMiB {
+		blockSize := quantity.SizeKiB
+		if stateMachine.SectorSize > blockSize {
+			blockSize = stateMachine.SectorSize
+		}
+		mkfsArgs = append(mkfsArgs, "-b", blockSize.String())
+	}
+	if contentRoot != "" {
+		mkfsArgs = append(mkfsArgs, "-d", contentRoot)
+	}
+	if label != "" {
+		mkfsArgs = append(mkfsArgs, "-L", label)
+	}
+	mkfsArgs = append(mkfsArgs, "-U", fsUUID.String(), "-E", "hash_seed="+hashSeed.String(), img)
+	// run through fakeroot so that files are owned by root
+	if osGeteuid() != 0 {
+		// the snap of ubuntu-image gives the location of its libfakeroot,
+		// which would be loaded from the host otherwise
+		if fakerootFlags := os.Getenv("FAKEROOT_FLAGS"); fakerootFlags != "" {
+			flags, err := shlex.Split(fakerootFlags)
+			if err != nil {
+				return fmt.Errorf("Error splitting FAKEROOT_FLAGS: %s", err.Error())
+			}
+			mkfsArgs = append(append(flags, "--"), mkfsArgs...)
+		}
+		mkfsArgs = append([]string{"fakeroot"}, mkfsArgs...)
+	}
+
+	mkfsCmd := execCommand(mkfsArgs[0], mkfsArgs[1:]...)
+	// Env is sometimes used for mocking command calls in tests,
+	// so only overwrite env if it is nil
+	if mkfsCmd.Env == nil {
+		mkfsCmd.Env = os.Environ()
+	}
+	mkfsCmd.Env = append(mkfsCmd.Env,
+		"E2FSPROGS_FAKE_TIME="+strconv.FormatInt(stateMachine.sourceDateEpoch.Unix(), 10))
+	mkfsOutput := setCommandOutput(mkfsCmd, stateMachine.commonFlags.Debug)
+	if err := mkfsCmd.Run(); err != nil {
+		return fmt.Errorf("Error running command \"%s\". Error is \"%s\". Full output below:\n%s",
+			mkfsCmd.String(), err.Error(), mkfsOutput.String())
+	}
+	return nil
+}
+
+// setVfatVolumeID writes the volume ID of a FAT filesystem, which mkfs.vfat
+// derives from the current time
+func setVfatVolumeID(img string, volumeID []byte) error {
+	fsImg, err := osOpenFile(img, os.O_RDWR, 0644)
+	if err != nil {
+		return fmt.Errorf("Error opening FAT filesystem: %s", err.Error())
+	}
+	defer fsImg.Close()
+
+	// FAT32 filesystems have a zero 16 bits FAT size and an extended boot
+	// record which moves the volume ID further in the boot sector
+	fatSize16 := make([]byte, 2)
+	if _, err := fsImg.ReadAt(fatSize16, 22); err != nil {
+		return fmt.Errorf("Error reading FAT boot sector: %s", err.Error())
+	}
+	var offset int64 = 39
+	if binary.LittleEndian.Uint16(fatSize16) == 0 {
+		offset = 67
+	}
+	if _, err := fsImg.WriteAt(volumeID, offset); err != nil {
+		return fmt.Errorf("Error writing FAT volume ID: %s", err.Error())
+	}
+	return nil
+}
+
+// clampModificationTimes sets the modification times of the files of a
+// directory that are newer than SOURCE_DATE_EPOCH to SOURCE_DATE_EPOCH
+func (stateMachine *StateMachine) clampModificationTimes(dir string) error {
+	epoch := "@" + strconv.FormatInt(stateMachine.sourceDateEpoch.Unix(), 10)
+	clampCmd := execCommand("find", dir, "-newermt", epoch,
+		"-exec", "touch", "--no-dereference", "--date="+epoch, "{}", "+")
+	clampOutput := setCommandOutput(clampCmd, stateMachine.commonFlags.Debug)
+	if err := clampCmd.Run(); err != nil {
+		return fmt.Errorf("Error clamping modification times with command \"%s\". "+
+			"Error is \"%s\". Full output below:\n%s",
+			clampCmd.String(), err.Error(), clampOutput.String())
+	}
+	return nil
+}
+
+// reproducibleTime returns SOURCE_DATE_EPOCH for reproducible builds, nil otherwise
+func (stateMachine *StateMachine) reproducibleTime() *time.Time {
+	if !stateMachine.reproducible() {
+		return nil
+	}
+	return &stateMachine.sourceDateEpoch
+}
+
+// CompareArtifacts checks that every file in rebuildDir is identical to the
+// file of the same name in outputDir. It is used to verify that a build is
+// reproducible, by building the image a second time in rebuildDir
+func CompareArtifacts(outputDir, rebuildDir string) error {
+	entries, err := osReadDir(rebuildDir)
+	if err != nil {
+		return fmt.Errorf("Error listing the rebuilt artifacts: %s", err.Error())
+	}
+	var differences []string
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() {
+			continue
+		}
+		rebuiltSum, err := fileSHA256(filepath.Join(rebuildDir, entry.Name()))
+		if err != nil {
+			return fmt.Errorf("Error comparing the artifacts: %s", err.Error())
+		}
+		originalSum, err := fileSHA256(filepath.Join(outputDir, entry.Name()))
+		if err != nil || originalSum != rebuiltSum {
+			differences = append(differences, entry.Name())
+		}
+	}
+	if len(differences) > 0 {
+		return fmt.Errorf("The build is not reproducible, these artifacts differ between two builds: %s",
+			strings.Join(differences, ", "))
+	}
+	return nil
+}
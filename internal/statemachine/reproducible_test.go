@@ -0,0 +1,426 @@
+package statemachine
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/diskfs/go-diskfs/partition"
+	"github.com/diskfs/go-diskfs/partition/gpt"
+	"github.com/snapcore/snapd/gadget/quantity"
+
+	"github.com/canonical/ubuntu-image/internal/helper"
+	"github.com/canonical/ubuntu-image/internal/imagedefinition"
+)
+
+// TestSetupReproducibility tests that reproducible builds read SOURCE_DATE_EPOCH and their seed
+func TestSetupReproducibility(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	t.Setenv(sourceDateEpochEnv, "1697414400")
+	var stateMachine StateMachine
+	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+	stateMachine.commonFlags.Reproducible = true
+	err := stateMachine.setupReproducibility()
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual(time.Date(2023, time.October, 16, 0, 0, 0, 0, time.UTC), stateMachine.sourceDateEpoch)
+	asserter.AssertEqual(stateMachine.sourceDateEpoch, stateMachine.buildTime())
+	asserter.AssertEqual("1697414400", stateMachine.reproducibleSeed)
+
+	stateMachine.commonFlags.ReproducibleSeed = "pc-2023"
+	err = stateMachine.setupReproducibility()
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual("pc-2023", stateMachine.reproducibleSeed)
+
+	// --verify-reproducible implies --reproducible
+	stateMachine.commonFlags.Reproducible = false
+	stateMachine.commonFlags.VerifyReproducible = true
+	err = stateMachine.setupReproducibility()
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual(true, stateMachine.reproducible())
+}
+
+// TestFailedSetupReproducibility tests the failures of setting up reproducible builds
+func TestFailedSetupReproducibility(t *testing.T) {
+	testCases := []struct {
+		name        string
+		epoch       string
+		setFlags    func(*StateMachine)
+		expectedErr string
+	}{
+		{"seed_without_reproducible", "1", func(sm *StateMachine) {
+			sm.commonFlags.ReproducibleSeed = "seed"
+		}, "--reproducible-seed can only be used with --reproducible"},
+		{"missing_epoch", "", func(sm *StateMachine) {
+			sm.commonFlags.Reproducible = true
+		}, "SOURCE_DATE_EPOCH must be set"},
+		{"invalid_epoch", "yesterday", func(sm *StateMachine) {
+			sm.commonFlags.Reproducible = true
+		}, "\"yesterday\" is not a number of seconds"},
+		{"negative_epoch", "-1", func(sm *StateMachine) {
+			sm.commonFlags.Reproducible = true
+		}, "\"-1\" is not a number of seconds"},
+		{"verify_until", "1", func(sm *StateMachine) {
+			sm.commonFlags.VerifyReproducible = true
+			sm.stateMachineFlags.Until = "make_disk"
+		}, "--verify-reproducible can not be used with --until, --thru or --resume"},
+	}
+	for _, tc := range testCases {
+		t.Run("test_failed_setup_reproducibility_"+tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			if tc.epoch != "" {
+				t.Setenv(sourceDateEpochEnv, tc.epoch)
+			} else {
+				t.Setenv(sourceDateEpochEnv, "")
+				os.Unsetenv(sourceDateEpochEnv)
+			}
+			var stateMachine StateMachine
+			stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+			tc.setFlags(&stateMachine)
+			err := stateMachine.validateInput()
+			asserter.AssertErrContains(err, tc.expectedErr)
+		})
+	}
+}
+
+// TestReproducibleIDs tests that the ids of reproducible builds only depend on their seed
+func TestReproducibleIDs(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	var first, second, other StateMachine
+	for _, stateMachine := range []*StateMachine{&first, &second, &other} {
+		stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+		stateMachine.commonFlags.Reproducible = true
+	}
+	t.Setenv(sourceDateEpochEnv, "1697414400")
+	err := first.setupReproducibility()
+	asserter.AssertErrNil(err, true)
+	err = second.setupReproducibility()
+	asserter.AssertErrNil(err, true)
+	t.Setenv(sourceDateEpochEnv, "1697500800")
+	err = other.setupReproducibility()
+	asserter.AssertErrNil(err, true)
+
+	asserter.AssertEqual(first.reproducibleUUID("filesystem", "pc", "1"),
+		second.reproducibleUUID("filesystem", "pc", "1"))
+	if first.reproducibleUUID("filesystem", "pc", "1") == first.reproducibleUUID("filesystem", "pc", "2") {
+		t.Errorf("Different filesystems have the same UUID")
+	}
+	if first.reproducibleUUID("filesystem", "pc", "1") == other.reproducibleUUID("filesystem", "pc", "1") {
+		t.Errorf("Builds with different seeds have the same UUID")
+	}
+
+	// every read of a reader returns new bytes, the same for every build
+	var existing, otherExisting [][]byte
+	firstID, err := generateUniqueDiskID(&existing, first.reproducibleReader("mbr-disk-id", "pc"))
+	asserter.AssertErrNil(err, true)
+	secondID, err := generateUniqueDiskID(&existing, first.reproducibleReader("mbr-disk-id", "pc"))
+	asserter.AssertErrNil(err, true)
+	if bytes.Equal(firstID, secondID) {
+		t.Errorf("Disk ID %v is not unique", secondID)
+	}
+	otherID, err := generateUniqueDiskID(&otherExisting, second.reproducibleReader("mbr-disk-id", "pc"))
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual(firstID, otherID)
+
+	// the GUIDs of GPT disks and partitions are set
+	var table partition.Table = &gpt.Table{Partitions: []*gpt.Partition{{Name: "ESP"}, {Name: "writable"}}}
+	first.setReproducibleGUIDs("pc", table)
+	gptTable := table.(*gpt.Table)
+	asserter.AssertEqual(strings.ToUpper(first.reproducibleUUID("gpt-disk", "pc").String()), gptTable.GUID)
+	asserter.AssertEqual(strings.ToUpper(first.reproducibleUUID("gpt-partition", "pc", "1").String()),
+		gptTable.Partitions[1].GUID)
+
+	vhdOpts, vmdkOpts := first.diskImageOptions("/tmp/pc.vhd")
+	asserter.AssertEqual(first.sourceDateEpoch, vhdOpts.Timestamp)
+	asserter.AssertEqual(16, len(vhdOpts.UniqueID))
+	if vmdkOpts.ContentID == 0 {
+		t.Errorf("VMDK content id must not be zero")
+	}
+
+	// builds that are not reproducible keep random ids
+	var stateMachine StateMachine
+	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+	vhdOpts, vmdkOpts = stateMachine.diskImageOptions("/tmp/pc.vhd")
+	asserter.AssertEqual(true, vhdOpts.Timestamp.IsZero())
+	asserter.AssertEqual(0, len(vhdOpts.UniqueID))
+	asserter.AssertEqual(uint32(0), vmdkOpts.ContentID)
+}
+
+// TestReproducibleExt4 tests that the ext4 filesystems built twice from the same content are identical
+func TestReproducibleExt4(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	t.Setenv(sourceDateEpochEnv, "1697414400")
+	var stateMachine StateMachine
+	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+	stateMachine.commonFlags.Reproducible = true
+	stateMachine.SectorSize = quantity.Size(512)
+	err := stateMachine.setupReproducibility()
+	asserter.AssertErrNil(err, true)
+
+	var images [][]byte
+	for _, name := range []string{"first", "second"} {
+		contentDir := filepath.Join(t.TempDir(), "content")
+		err := os.MkdirAll(filepath.Join(contentDir, "etc"), 0755)
+		asserter.AssertErrNil(err, true)
+		err = os.WriteFile(filepath.Join(contentDir, "etc", "hostname"), []byte("ubuntu\n"), 0644)
+		asserter.AssertErrNil(err, true)
+		err = os.Symlink("hostname", filepath.Join(contentDir, "etc", "name"))
+		asserter.AssertErrNil(err, true)
+
+		img := filepath.Join(t.TempDir(), name+".img")
+		err = os.WriteFile(img, nil, 0644)
+		asserter.AssertErrNil(err, true)
+		err = os.Truncate(img, int64(8*quantity.SizeMiB))
+		asserter.AssertErrNil(err, true)
+		err = stateMachine.makeFilesystem("ext4", img, "writable", contentDir, 8*quantity.SizeMiB, "pc", "2")
+		asserter.AssertErrNil(err, true)
+
+		// the modification times of the content are clamped
+		info, err := os.Lstat(filepath.Join(contentDir, "etc", "name"))
+		asserter.AssertErrNil(err, true)
+		asserter.AssertEqual(stateMachine.sourceDateEpoch, info.ModTime().UTC())
+
+		image, err := os.ReadFile(img)
+		asserter.AssertErrNil(err, true)
+		images = append(images, image)
+	}
+	if !bytes.Equal(images[0], images[1]) {
+		t.Errorf("The ext4 filesystems differ")
+	}
+}
+
+// TestMkfsExt4FakerootFlags tests that the fakeroot flags of the snap are
+// honored like snapd does when building ext4 filesystems as a user
+func TestMkfsExt4FakerootFlags(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	t.Setenv(sourceDateEpochEnv, "1697414400")
+	t.Setenv("FAKEROOT_FLAGS", "--lib '/snap/ubuntu-image/current/usr/lib/libfakeroot.so' --faked /snap/bin/faked")
+	var stateMachine StateMachine
+	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+	stateMachine.commonFlags.Reproducible = true
+	stateMachine.commonFlags.Debug = true
+	err := stateMachine.setupReproducibility()
+	asserter.AssertErrNil(err, true)
+	fsUUID := stateMachine.reproducibleUUID("filesystem")
+
+	osGeteuid = func() int { return 1000 }
+	t.Cleanup(func() { osGeteuid = os.Geteuid })
+	mockCmder := NewMockExecCommand()
+	execCommand = mockCmder.Command
+	t.Cleanup(func() { execCommand = exec.Command })
+
+	stdout, restoreStdout, err := helper.CaptureStd(&os.Stdout)
+	asserter.AssertErrNil(err, true)
+	t.Cleanup(func() { restoreStdout() })
+
+	err = stateMachine.mkfsExt4("part.img", "writable", "", 0, fsUUID, fsUUID)
+	asserter.AssertErrNil(err, true)
+
+	restoreStdout()
+	readStdout, err := io.ReadAll(stdout)
+	asserter.AssertErrNil(err, true)
+	expectedCmd := "fakeroot --lib /snap/ubuntu-image/current/usr/lib/libfakeroot.so --faked /snap/bin/faked -- mkfs.ext4 "
+	if !strings.HasPrefix(string(readStdout), expectedCmd) {
+		t.Errorf("Expected command \"%s\" to be run. Output is:\n%s", expectedCmd, readStdout)
+	}
+
+	t.Setenv("FAKEROOT_FLAGS", "--lib 'unterminated")
+	err = stateMachine.mkfsExt4("part.img", "writable", "", 0, fsUUID, fsUUID)
+	asserter.AssertErrContains(err, "Error splitting FAKEROOT_FLAGS")
+}
+
+// TestFailedReproducibleFilesystem tests the failures of making filesystems reproducibly
+func TestFailedReproducibleFilesystem(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	t.Setenv(sourceDateEpochEnv, "1697414400")
+	var stateMachine StateMachine
+	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+	stateMachine.commonFlags.Reproducible = true
+	stateMachine.SectorSize = quantity.Size(512)
+	err := stateMachine.setupReproducibility()
+	asserter.AssertErrNil(err, true)
+	contentDir := t.TempDir()
+	img := filepath.Join(t.TempDir(), "part.img")
+
+	testCaseName = "TestFailedReproducibleFilesystem"
+	execCommand = fakeExecCommand
+	t.Cleanup(func() { execCommand = exec.Command })
+	err = stateMachine.makeFilesystem("ext4", img, "writable", contentDir, 8*quantity.SizeMiB, "pc", "2")
+	asserter.AssertErrContains(err, "Error clamping modification times")
+	err = stateMachine.makeFilesystem("ext4", img, "writable", "", 8*quantity.SizeMiB, "pc", "2")
+	asserter.AssertErrContains(err, "Error running command \"")
+	execCommand = exec.Command
+
+	osOpenFile = mockOpenFile
+	t.Cleanup(func() { osOpenFile = os.OpenFile })
+	err = setVfatVolumeID(img, []byte{1, 2, 3, 4})
+	asserter.AssertErrContains(err, "Error opening FAT filesystem")
+	osOpenFile = os.OpenFile
+
+	err = os.WriteFile(img, []byte("short"), 0644)
+	asserter.AssertErrNil(err, true)
+	err = setVfatVolumeID(img, []byte{1, 2, 3, 4})
+	asserter.AssertErrContains(err, "Error reading FAT boot sector")
+}
+
+// TestSetVfatVolumeID tests that the volume ID is written where FAT16 and FAT32 expect it
+func TestSetVfatVolumeID(t *testing.T) {
+	testCases := []struct {
+		name      string
+		fatSize16 byte
+		offset    int
+	}{
+		{"fat16", 32, 39},
+		{"fat32", 0, 67},
+	}
+	for _, tc := range testCases {
+		t.Run("test_set_vfat_volume_id_"+tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			img := filepath.Join(t.TempDir(), "esp.img")
+			bootSector := make([]byte, 512)
+			bootSector[22] = tc.fatSize16
+			err := os.WriteFile(img, bootSector, 0644)
+			asserter.AssertErrNil(err, true)
+
+			err = setVfatVolumeID(img, []byte{1, 2, 3, 4})
+			asserter.AssertErrNil(err, true)
+			written, err := os.ReadFile(img)
+			asserter.AssertErrNil(err, true)
+			asserter.AssertEqual([]byte{1, 2, 3, 4}, written[tc.offset:tc.offset+4])
+		})
+	}
+}
+
+// TestReproducibleTarArchive tests that the tarballs of the same content are identical
+func TestReproducibleTarArchive(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	t.Setenv(sourceDateEpochEnv, "1697414400")
+	var stateMachine StateMachine
+	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+	stateMachine.commonFlags.Reproducible = true
+	err := stateMachine.setupReproducibility()
+	asserter.AssertErrNil(err, true)
+
+	var tarballs [][]byte
+	for i, name := range []string{"first", "second"} {
+		srcDir := t.TempDir()
+		// create the files in a different order each time
+		files := []string{"b", "a", "c"}
+		if i == 1 {
+			files = []string{"c", "b", "a"}
+		}
+		for _, file := range files {
+			err := os.WriteFile(filepath.Join(srcDir, file), []byte(file), 0644)
+			asserter.AssertErrNil(err, true)
+		}
+		// files not owned by root, like /etc/shadow, keep their owner
+		if os.Geteuid() == 0 {
+			err := os.Chown(filepath.Join(srcDir, "a"), 0, 42)
+			asserter.AssertErrNil(err, true)
+		}
+		dest := filepath.Join(t.TempDir(), name+".tar.gz")
+		err := helper.CreateTarArchive(srcDir, dest, "gzip", false, false, stateMachine.reproducibleTime())
+		asserter.AssertErrNil(err, true)
+		tarball, err := os.ReadFile(dest)
+		asserter.AssertErrNil(err, true)
+		tarballs = append(tarballs, tarball)
+	}
+	if !bytes.Equal(tarballs[0], tarballs[1]) {
+		t.Errorf("The tarballs differ")
+	}
+
+	if os.Geteuid() != 0 {
+		return
+	}
+	gzipReader, err := gzip.NewReader(bytes.NewReader(tarballs[0]))
+	asserter.AssertErrNil(err, true)
+	tarReader := tar.NewReader(gzipReader)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			t.Errorf("./a is missing from the tarball")
+			break
+		}
+		asserter.AssertErrNil(err, true)
+		if header.Name == "./a" {
+			asserter.AssertEqual(42, header.Gid)
+			break
+		}
+	}
+}
+
+// TestReproducibleFilelist tests that the filelist of reproducible builds is sorted
+func TestReproducibleFilelist(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	testCaseName = "TestGenerateFilelist"
+	execCommand = fakeExecCommand
+	t.Cleanup(func() { execCommand = exec.Command })
+
+	outputPath := filepath.Join(t.TempDir(), "filesystem.filelist")
+	err := writeFilelist(t.TempDir(), outputPath, true, false)
+	asserter.AssertErrNil(err, true)
+	filelist, err := os.ReadFile(outputPath)
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual("/home\n/root\n/var\n", string(filelist))
+}
+
+// TestReproducibleReport tests that the report of reproducible builds leaves out how long the states took
+func TestReproducibleReport(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	t.Setenv(sourceDateEpochEnv, "1697414400")
+	var stateMachine ClassicStateMachine
+	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+	stateMachine.parent = &stateMachine
+	stateMachine.commonFlags.Reproducible = true
+	stateMachine.commonFlags.OutputDir = t.TempDir()
+	stateMachine.StateTimings = []stateTiming{{"make_disk", 2 * time.Second}}
+	stateMachine.ImageDef = imagedefinition.ImageDefinition{
+		Artifacts: &imagedefinition.Artifact{
+			Report: &imagedefinition.Report{ReportName: "pc.report"},
+		},
+	}
+	err := stateMachine.setupReproducibility()
+	asserter.AssertErrNil(err, true)
+
+	err = stateMachine.generateReport()
+	asserter.AssertErrNil(err, true)
+	report, err := os.ReadFile(filepath.Join(stateMachine.commonFlags.OutputDir, "pc.report"))
+	asserter.AssertErrNil(err, true)
+	if !strings.Contains(string(report), `"states": []`) {
+		t.Errorf("The report of a reproducible build records the durations of the states:\n%s", report)
+	}
+}
+
+// TestCompareArtifacts tests that the artifacts of two builds are compared
+func TestCompareArtifacts(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	outputDir := t.TempDir()
+	rebuildDir := t.TempDir()
+	for _, dir := range []string{outputDir, rebuildDir} {
+		err := os.WriteFile(filepath.Join(dir, "pc.img"), []byte("test image"), 0644)
+		asserter.AssertErrNil(err, true)
+	}
+	// directories are not artifacts
+	err := os.Mkdir(filepath.Join(rebuildDir, "scratch"), 0755)
+	asserter.AssertErrNil(err, true)
+	err = CompareArtifacts(outputDir, rebuildDir)
+	asserter.AssertErrNil(err, true)
+
+	err = os.WriteFile(filepath.Join(rebuildDir, "pc.manifest"), []byte("hello 1.0\n"), 0644)
+	asserter.AssertErrNil(err, true)
+	err = os.WriteFile(filepath.Join(rebuildDir, "pc.img"), []byte("other image"), 0644)
+	asserter.AssertErrNil(err, true)
+	err = CompareArtifacts(outputDir, rebuildDir)
+	asserter.AssertErrContains(err, "these artifacts differ between two builds: pc.img, pc.manifest")
+
+	osReadDir = mockReadDir
+	t.Cleanup(func() { osReadDir = os.ReadDir })
+	err = CompareArtifacts(outputDir, rebuildDir)
+	asserter.AssertErrContains(err, "Error listing the rebuilt artifacts")
+}
@@ -0,0 +1,545 @@
+package statemachine
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/snapcore/snapd/asserts"
+	"github.com/snapcore/snapd/seed"
+	"github.com/snapcore/snapd/timings"
+
+	"github.com/canonical/ubuntu-image/internal/helper"
+)
+
+// the formats of the SBOM
+const (
+	sbomFormatSPDX      = "spdx"
+	sbomFormatCycloneDX = "cyclonedx"
+)
+
+// sbomPackage is a Debian package installed in an image
+type sbomPackage struct {
+	Name          string
+	Version       string
+	Architecture  string
+	Source        string
+	SourceVersion string
+	// the licenses declared in the copyright file of the package
+	Licenses []string
+}
+
+// sbomSnap is a snap seeded in an image
+type sbomSnap struct {
+	Name      string
+	Revision  string
+	Channel   string
+	Publisher string
+}
+
+// sbomContents is what an image is made of
+type sbomContents struct {
+	Name     string
+	Created  time.Time
+	Series   string
+	Packages []sbomPackage
+	Snaps    []sbomSnap
+}
+
+// generateClassicSBOM writes the SBOM of a classic image
+func (stateMachine *StateMachine) generateClassicSBOM() error {
+	classicStateMachine := stateMachine.parent.(*ClassicStateMachine)
+	sbomArtifact := classicStateMachine.ImageDef.Artifacts.SBOM
+
+	packages, err := listPackages(stateMachine.tempDirs.rootfs, stateMachine.commonFlags.Debug)
+	if err != nil {
+		return err
+	}
+	snaps, err := listSeedSnaps(filepath.Join(stateMachine.tempDirs.rootfs, "var", "lib", "snapd", "seed"), "")
+	if err != nil {
+		return err
+	}
+	contents := sbomContents{
+		Name:     classicStateMachine.ImageDef.ImageName,
+		Series:   classicStateMachine.ImageDef.Series,
+		Packages: packages,
+		Snaps:    snaps,
+		Created:  stateMachine.buildTime(),
+	}
+	outputPath := filepath.Join(stateMachine.commonFlags.OutputDir, sbomArtifact.SBOMName)
+	return writeSBOM(contents, sbomArtifact.Format, outputPath)
+}
+
+// generateSnapSBOM writes the SBOM of a snap based image, listing the
+// snaps of its seed
+func (stateMachine *StateMachine) generateSnapSBOM() error {
+	snapStateMachine := stateMachine.parent.(*SnapStateMachine)
+
+	seedDir := filepath.Join(stateMachine.tempDirs.rootfs, "system-data", "var", "lib", "snapd", "seed")
+	label := ""
+	if stateMachine.IsSeeded {
+		// the rootfs of seeded images is the seed itself
+		seedDir = stateMachine.tempDirs.rootfs
+		var err error
+		if label, err = seedSystemLabel(seedDir); err != nil {
+			return err
+		}
+	}
+	snaps, err := listSeedSnaps(seedDir, label)
+	if err != nil {
+		return err
+	}
+	modelName := filepath.Base(snapStateMachine.Args.ModelAssertion)
+	contents := sbomContents{
+		Name:    strings.TrimSuffix(modelName, filepath.Ext(modelName)),
+		Snaps:   snaps,
+		Created: stateMachine.buildTime(),
+	}
+	outputPath := filepath.Join(stateMachine.commonFlags.OutputDir, snapStateMachine.Opts.SBOM)
+	return writeSBOM(contents, snapStateMachine.Opts.SBOMFormat, outputPath)
+}
+
+// listPackages lists the Debian packages installed in a rootfs, with their
+// source package and their licenses
+func listPackages(rootfsDir string, debug bool) ([]sbomPackage, error) {
+	cmd := execCommand("dpkg-query",
+		"--admindir="+filepath.Join(rootfsDir, "var", "lib", "dpkg"),
+		"-W", "--showformat=${db:Status-Status}\t${Package}\t${Version}\t${Architecture}\t"+
+			"${source:Package}\t${source:Version}\n")
+	cmdOutput := setCommandOutput(cmd, debug)
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("Error listing the packages with command \"%s\". "+
+			"Error is \"%s\". Full output below:\n%s",
+			cmd.String(), err.Error(), cmdOutput.String())
+	}
+
+	var packages []sbomPackage
+	scanner := bufio.NewScanner(cmdOutput)
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), "\t")
+		if len(fields) != 6 || fields[0] != "installed" {
+			continue
+		}
+		licenses, err := readCopyrightLicenses(filepath.Join(rootfsDir, "usr", "share", "doc", fields[1], "copyright"))
+		if err != nil {
+			return nil, err
+		}
+		packages = append(packages, sbomPackage{
+			Name:          fields[1],
+			Version:       fields[2],
+			Architecture:  fields[3],
+			Source:        fields[4],
+			SourceVersion: fields[5],
+			Licenses:      licenses,
+		})
+	}
+	return packages, nil
+}
+
+// readCopyrightLicenses reads the licenses declared in a machine-readable
+// Debian copyright file. Nothing is returned for missing files and files in
+// any other format
+func readCopyrightLicenses(copyrightPath string) ([]string, error) {
+	copyright, err := osReadFile(copyrightPath)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("Error reading copyright file: %s", err.Error())
+	}
+	firstLine, _, _ := strings.Cut(string(copyright), "\n")
+	if !strings.HasPrefix(firstLine, "Format:") {
+		return nil, nil
+	}
+
+	var licenses []string
+	scanner := bufio.NewScanner(bytes.NewReader(copyright))
+	scanner.Buffer(nil, len(copyright)+1)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "License:") {
+			continue
+		}
+		license := strings.TrimSpace(strings.TrimPrefix(line, "License:"))
+		if license != "" && !helper.SliceHasElement(licenses, license) {
+			licenses = append(licenses, license)
+		}
+	}
+	return licenses, nil
+}
+
+// seedSystemLabel returns the label of the only system of a UC20+ seed
+func seedSystemLabel(seedDir string) (string, error) {
+	systems, err := osReadDir(filepath.Join(seedDir, "systems"))
+	if err != nil {
+		return "", fmt.Errorf("Error reading the systems of the seed: %s", err.Error())
+	}
+	if len(systems) != 1 {
+		return "", fmt.Errorf("Error reading the systems of the seed: expected one system, found %d", len(systems))
+	}
+	return systems[0].Name(), nil
+}
+
+// listSeedSnaps lists the snaps of a seed with their publisher. Nothing is
+// returned if there is no seed
+func listSeedSnaps(seedDir string, label string) ([]sbomSnap, error) {
+	if _, err := os.Stat(seedDir); err != nil {
+		return nil, nil
+	}
+	imageSeed, err := seedOpen(seedDir, label)
+	if err != nil {
+		return nil, fmt.Errorf("Error opening the seed: %s", err.Error())
+	}
+	if err := imageSeed.LoadAssertions(nil, nil); err != nil {
+		return nil, fmt.Errorf("Error loading the assertions of the seed: %s", err.Error())
+	}
+	if err := imageSeed.LoadMeta(seed.AllModes, nil, timings.New(nil)); err != nil {
+		return nil, fmt.Errorf("Error loading the snaps of the seed: %s", err.Error())
+	}
+	publishers, err := seedPublishers(seedDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var snaps []sbomSnap
+	err = imageSeed.Iter(func(sn *seed.Snap) error {
+		// unasserted snaps have a local revision and no publisher
+		snaps = append(snaps, sbomSnap{
+			Name:      sn.SnapName(),
+			Revision:  sn.SideInfo.Revision.String(),
+			Channel:   sn.Channel,
+			Publisher: publishers[sn.ID()],
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Error listing the snaps of the seed: %s", err.Error())
+	}
+	return snaps, nil
+}
+
+// seedPublishers maps the snap IDs of the snaps of a seed to the username
+// of their publisher, using the assertions of the seed
+func seedPublishers(seedDir string) (map[string]string, error) {
+	publisherIDs := make(map[string]string)
+	usernames := make(map[string]string)
+	err := filepath.WalkDir(seedDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !strings.Contains(path, string(filepath.Separator)+"assertions"+string(filepath.Separator)) {
+			return nil
+		}
+		f, err := osOpen(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		decoder := asserts.NewDecoder(f)
+		for {
+			assertion, err := decoder.Decode()
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			if err != nil {
+				return fmt.Errorf("cannot decode \"%s\": %s", path, err.Error())
+			}
+			switch a := assertion.(type) {
+			case *asserts.SnapDeclaration:
+				publisherIDs[a.SnapID()] = a.PublisherID()
+			case *asserts.Account:
+				usernames[a.AccountID()] = a.Username()
+			}
+		}
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Error reading the assertions of the seed: %s", err.Error())
+	}
+
+	publishers := make(map[string]string)
+	for snapID, publisherID := range publisherIDs {
+		publishers[snapID] = publisherID
+		if username, found := usernames[publisherID]; found {
+			publishers[snapID] = username
+		}
+	}
+	return publishers, nil
+}
+
+// writeSBOM writes the SBOM of an image in the given format
+func writeSBOM(contents sbomContents, format string, outputPath string) error {
+	var document interface{}
+	if format == sbomFormatCycloneDX {
+		document = cycloneDXDocument(contents)
+	} else {
+		document = spdxDocument(contents)
+	}
+	encoded, err := json.MarshalIndent(document, "", "  ")
+	if err != nil {
+		return fmt.Errorf("Error encoding the SBOM: %s", err.Error())
+	}
+	if err := osWriteFile(outputPath, append(encoded, '\n'), 0644); err != nil {
+		return fmt.Errorf("Error writing the SBOM: %s", err.Error())
+	}
+	return nil
+}
+
+// sbomTimestamp returns the creation time of the SBOM
+func sbomTimestamp(contents sbomContents) string {
+	return contents.Created.UTC().Format(time.RFC3339)
+}
+
+// debPURL returns the package URL of a Debian package
+func debPURL(pkg sbomPackage, series string) string {
+	qualifiers := url.Values{}
+	qualifiers.Set("arch", pkg.Architecture)
+	if series != "" {
+		qualifiers.Set("distro", series)
+	}
+	return fmt.Sprintf("pkg:deb/ubuntu/%s@%s?%s", url.PathEscape(pkg.Name), url.PathEscape(pkg.Version),
+		qualifiers.Encode())
+}
+
+// spdxLicenses maps the license short names of Debian copyright files to
+// their SPDX identifiers
+var spdxLicenses = map[string]string{
+	"apache-2.0":   "Apache-2.0",
+	"artistic":     "Artistic-1.0",
+	"artistic-2.0": "Artistic-2.0",
+	"bsd-2-clause": "BSD-2-Clause",
+	"bsd-3-clause": "BSD-3-Clause",
+	"bsd-4-clause": "BSD-4-Clause",
+	"cc0-1.0":      "CC0-1.0",
+	"expat":        "MIT",
+	"mit":          "MIT",
+	"gpl-1":        "GPL-1.0-only",
+	"gpl-1+":       "GPL-1.0-or-later",
+	"gpl-2":        "GPL-2.0-only",
+	"gpl-2+":       "GPL-2.0-or-later",
+	"gpl-3":        "GPL-3.0-only",
+	"gpl-3+":       "GPL-3.0-or-later",
+	"lgpl-2":       "LGPL-2.0-only",
+	"lgpl-2+":      "LGPL-2.0-or-later",
+	"lgpl-2.1":     "LGPL-2.1-only",
+	"lgpl-2.1+":    "LGPL-2.1-or-later",
+	"lgpl-3":       "LGPL-3.0-only",
+	"lgpl-3+":      "LGPL-3.0-or-later",
+	"isc":          "ISC",
+	"mpl-1.1":      "MPL-1.1",
+	"mpl-2.0":      "MPL-2.0",
+	"zlib":         "Zlib",
+}
+
+// spdxLicense returns the SPDX identifier of a Debian license short name
+func spdxLicense(license string) (string, bool) {
+	id, found := spdxLicenses[strings.ToLower(license)]
+	return id, found
+}
+
+// spdxIDChars are the characters that can not be used in SPDX identifiers
+var spdxIDChars = regexp.MustCompile(`[^A-Za-z0-9.-]`)
+
+// spdxID returns a valid SPDX identifier built from the given parts
+func spdxID(parts ...string) string {
+	return "SPDXRef-" + spdxIDChars.ReplaceAllString(strings.Join(parts, "-"), "-")
+}
+
+// spdxDocument returns the SPDX 2.3 document describing an image. The image
+// itself is a package containing the Debian packages and the snaps
+func spdxDocument(contents sbomContents) map[string]interface{} {
+	imageID := spdxID("image")
+	packages := []map[string]interface{}{
+		{
+			"name":                  contents.Name,
+			"SPDXID":                imageID,
+			"downloadLocation":      "NOASSERTION",
+			"filesAnalyzed":         false,
+			"primaryPackagePurpose": "OPERATING-SYSTEM",
+		},
+	}
+	relationships := []map[string]string{
+		{"spdxElementId": "SPDXRef-DOCUMENT", "relationshipType": "DESCRIBES", "relatedSpdxElement": imageID},
+	}
+
+	for _, pkg := range contents.Packages {
+		id := spdxID("deb", pkg.Name, pkg.Architecture)
+		declared := "NOASSERTION"
+		var ids []string
+		for _, license := range pkg.Licenses {
+			if licenseID, found := spdxLicense(license); found && !helper.SliceHasElement(ids, licenseID) {
+				ids = append(ids, licenseID)
+			}
+		}
+		if len(ids) > 0 && len(ids) == len(pkg.Licenses) {
+			declared = strings.Join(ids, " AND ")
+		}
+		spdxPackage := map[string]interface{}{
+			"name":             pkg.Name,
+			"SPDXID":           id,
+			"versionInfo":      pkg.Version,
+			"downloadLocation": "NOASSERTION",
+			"filesAnalyzed":    false,
+			"licenseConcluded": "NOASSERTION",
+			"licenseDeclared":  declared,
+			"copyrightText":    "NOASSERTION",
+			"sourceInfo":       fmt.Sprintf("built from source package %s %s", pkg.Source, pkg.SourceVersion),
+			"externalRefs": []map[string]string{
+				{
+					"referenceCategory": "PACKAGE-MANAGER",
+					"referenceType":     "purl",
+					"referenceLocator":  debPURL(pkg, contents.Series),
+				},
+			},
+		}
+		if len(pkg.Licenses) > 0 {
+			spdxPackage["licenseComments"] = "Licenses declared in the copyright file: " +
+				strings.Join(pkg.Licenses, ", ")
+		}
+		packages = append(packages, spdxPackage)
+		relationships = append(relationships, map[string]string{
+			"spdxElementId": imageID, "relationshipType": "CONTAINS", "relatedSpdxElement": id,
+		})
+	}
+
+	for _, sn := range contents.Snaps {
+		id := spdxID("snap", sn.Name)
+		spdxPackage := map[string]interface{}{
+			"name":             sn.Name,
+			"SPDXID":           id,
+			"downloadLocation": "NOASSERTION",
+			"filesAnalyzed":    false,
+			"licenseConcluded": "NOASSERTION",
+			"licenseDeclared":  "NOASSERTION",
+			"copyrightText":    "NOASSERTION",
+			"supplier":         "NOASSERTION",
+		}
+		if sn.Revision != "" {
+			spdxPackage["versionInfo"] = sn.Revision
+		}
+		if sn.Publisher != "" {
+			spdxPackage["supplier"] = "Organization: " + sn.Publisher
+		}
+		if sn.Channel != "" {
+			spdxPackage["comment"] = "channel: " + sn.Channel
+		}
+		packages = append(packages, spdxPackage)
+		relationships = append(relationships, map[string]string{
+			"spdxElementId": imageID, "relationshipType": "CONTAINS", "relatedSpdxElement": id,
+		})
+	}
+
+	return map[string]interface{}{
+		"spdxVersion":       "SPDX-2.3",
+		"dataLicense":       "CC0-1.0",
+		"SPDXID":            "SPDXRef-DOCUMENT",
+		"name":              contents.Name,
+		"documentNamespace": spdxNamespace(contents),
+		"creationInfo": map[string]interface{}{
+			"created":  sbomTimestamp(contents),
+			"creators": []string{"Tool: ubuntu-image-" + UbuntuImageVersion},
+		},
+		"packages":      packages,
+		"relationships": relationships,
+	}
+}
+
+// spdxNamespace returns the unique namespace of an SPDX document. It is
+// derived from the contents of the image so that the same image always
+// gets the same namespace
+func spdxNamespace(contents sbomContents) string {
+	hasher := sha256.New()
+	for _, pkg := range contents.Packages {
+		fmt.Fprintf(hasher, "deb %s %s %s\n", pkg.Name, pkg.Version, pkg.Architecture)
+	}
+	for _, sn := range contents.Snaps {
+		fmt.Fprintf(hasher, "snap %s %s %s\n", sn.Name, sn.Revision, sn.Channel)
+	}
+	return fmt.Sprintf("https://ubuntu.com/spdx/ubuntu-image/%s-%x",
+		url.PathEscape(contents.Name), hasher.Sum(nil))
+}
+
+// cycloneDXDocument returns the CycloneDX 1.5 document describing an image
+func cycloneDXDocument(contents sbomContents) map[string]interface{} {
+	components := []map[string]interface{}{}
+	for _, pkg := range contents.Packages {
+		purl := debPURL(pkg, contents.Series)
+		component := map[string]interface{}{
+			"type":    "library",
+			"bom-ref": purl,
+			"name":    pkg.Name,
+			"version": pkg.Version,
+			"purl":    purl,
+			"properties": []map[string]string{
+				{"name": "ubuntu-image:architecture", "value": pkg.Architecture},
+				{"name": "ubuntu-image:source-package", "value": pkg.Source},
+				{"name": "ubuntu-image:source-version", "value": pkg.SourceVersion},
+			},
+		}
+		var licenses []map[string]interface{}
+		for _, license := range pkg.Licenses {
+			if licenseID, found := spdxLicense(license); found {
+				licenses = append(licenses, map[string]interface{}{"license": map[string]string{"id": licenseID}})
+			} else {
+				licenses = append(licenses, map[string]interface{}{"license": map[string]string{"name": license}})
+			}
+		}
+		if len(licenses) > 0 {
+			component["licenses"] = licenses
+		}
+		components = append(components, component)
+	}
+
+	for _, sn := range contents.Snaps {
+		component := map[string]interface{}{
+			"type":    "application",
+			"bom-ref": "snap:" + sn.Name,
+			"name":    sn.Name,
+		}
+		if sn.Revision != "" {
+			component["version"] = sn.Revision
+		}
+		if sn.Publisher != "" {
+			component["publisher"] = sn.Publisher
+			component["supplier"] = map[string]string{"name": sn.Publisher}
+		}
+		if sn.Channel != "" {
+			component["properties"] = []map[string]string{
+				{"name": "ubuntu-image:channel", "value": sn.Channel},
+			}
+		}
+		components = append(components, component)
+	}
+	sort.SliceStable(components, func(i, j int) bool {
+		return components[i]["type"].(string) > components[j]["type"].(string)
+	})
+
+	return map[string]interface{}{
+		"bomFormat":   "CycloneDX",
+		"specVersion": "1.5",
+		"version":     1,
+		"metadata": map[string]interface{}{
+			"timestamp": sbomTimestamp(contents),
+			"tools": []map[string]string{
+				{"vendor": "Canonical", "name": "ubuntu-image", "version": UbuntuImageVersion},
+			},
+			"component": map[string]string{
+				"type":    "operating-system",
+				"bom-ref": "image",
+				"name":    contents.Name,
+			},
+		},
+		"components": components,
+	}
+}
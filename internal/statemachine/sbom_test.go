@@ -0,0 +1,403 @@
+package statemachine
+
+import (
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/snapcore/snapd/asserts"
+	"github.com/snapcore/snapd/asserts/assertstest"
+	"github.com/snapcore/snapd/seed"
+	"github.com/snapcore/snapd/snap"
+	"github.com/snapcore/snapd/timings"
+
+	"github.com/canonical/ubuntu-image/internal/helper"
+	"github.com/canonical/ubuntu-image/internal/imagedefinition"
+)
+
+// fakeSeed is a seed with a fixed list of snaps
+type fakeSeed struct {
+	seed.Seed
+	snaps []*seed.Snap
+}
+
+func (s *fakeSeed) LoadAssertions(db asserts.RODatabase, commitTo func(*asserts.Batch) error) error {
+	return nil
+}
+
+func (s *fakeSeed) LoadMeta(mode string, handler seed.SnapHandler, tm timings.Measurer) error {
+	return nil
+}
+
+func (s *fakeSeed) Iter(f func(sn *seed.Snap) error) error {
+	for _, sn := range s.snaps {
+		if err := f(sn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mockFakeSeedOpen makes seedOpen return a fake seed with a core22 snap
+// from the store and a local snap, and records the label it was opened with
+func mockFakeSeedOpen(t *testing.T, openedLabel *string) {
+	t.Helper()
+	seedOpen = func(seedDir, label string) (seed.Seed, error) {
+		*openedLabel = label
+		return &fakeSeed{snaps: []*seed.Snap{
+			{
+				SideInfo: &snap.SideInfo{RealName: "core22", SnapID: "core22-id", Revision: snap.R(864)},
+				Channel:  "latest/stable",
+			},
+			{
+				SideInfo: &snap.SideInfo{RealName: "local", Revision: snap.R(-1)},
+			},
+		}}, nil
+	}
+	t.Cleanup(func() { seedOpen = seed.Open })
+}
+
+// writeSeedAssertions writes the account and snap declaration of the core22
+// snap in the assertions directory of a seed
+func writeSeedAssertions(t *testing.T, seedDir string) {
+	t.Helper()
+	storeStack := assertstest.NewStoreStack("canonical", nil)
+	account := assertstest.NewAccount(storeStack, "acme", map[string]interface{}{
+		"account-id": "acme-id",
+	}, "")
+	declaration, err := storeStack.Sign(asserts.SnapDeclarationType, map[string]interface{}{
+		"series":       "16",
+		"snap-id":      "core22-id",
+		"snap-name":    "core22",
+		"publisher-id": "acme-id",
+		"timestamp":    time.Now().UTC().Format(time.RFC3339),
+	}, nil, "")
+	if err != nil {
+		t.Fatalf("Error signing the snap declaration: %s", err.Error())
+	}
+	assertionsDir := filepath.Join(seedDir, "assertions")
+	if err := os.MkdirAll(assertionsDir, 0755); err != nil {
+		t.Fatalf("Error creating the assertions directory: %s", err.Error())
+	}
+	encoded := append(asserts.Encode(account), '\n')
+	encoded = append(encoded, asserts.Encode(declaration)...)
+	if err := os.WriteFile(filepath.Join(assertionsDir, "core22.assert"), encoded, 0644); err != nil {
+		t.Fatalf("Error writing the assertions: %s", err.Error())
+	}
+}
+
+// writeCopyright writes the copyright file of a package in a rootfs
+func writeCopyright(t *testing.T, rootfs string, pkg string, copyright string) {
+	t.Helper()
+	docDir := filepath.Join(rootfs, "usr", "share", "doc", pkg)
+	if err := os.MkdirAll(docDir, 0755); err != nil {
+		t.Fatalf("Error creating the doc directory: %s", err.Error())
+	}
+	if err := os.WriteFile(filepath.Join(docDir, "copyright"), []byte(copyright), 0644); err != nil {
+		t.Fatalf("Error writing the copyright file: %s", err.Error())
+	}
+}
+
+// findByName returns the element of a decoded JSON list with the given name
+func findByName(t *testing.T, list interface{}, name string) map[string]interface{} {
+	t.Helper()
+	for _, element := range list.([]interface{}) {
+		if element.(map[string]interface{})["name"] == name {
+			return element.(map[string]interface{})
+		}
+	}
+	t.Fatalf("%s not found in %v", name, list)
+	return nil
+}
+
+// writeSBOMRootfs writes the copyright files of the packages and the seed
+// of the rootfs listed in the SBOM of classic images
+func writeSBOMRootfs(t *testing.T, rootfsDir string) {
+	t.Helper()
+	writeCopyright(t, rootfsDir, "foo", "Format: https://www.debian.org/doc/packaging-manuals/copyright-format/1.0/\n\n"+
+		"Files: *\nLicense: GPL-2+\n\nFiles: lib/*\nLicense: Expat\n\nLicense: GPL-2+\n On Debian systems...\n")
+	writeCopyright(t, rootfsDir, "bar", "Format: https://www.debian.org/doc/packaging-manuals/copyright-format/1.0/\n\n"+
+		"Files: *\nLicense: Bar-Custom\n")
+	writeCopyright(t, rootfsDir, "libbaz", "This is libbaz, licensed under the GPL.\nLicense: GPL\n")
+	writeSeedAssertions(t, filepath.Join(rootfsDir, "var", "lib", "snapd", "seed"))
+}
+
+// TestGenerateSPDXSBOM tests that the SPDX SBOM lists the packages and the snaps of a classic image
+func TestGenerateSPDXSBOM(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	var openedLabel string
+	mockFakeSeedOpen(t, &openedLabel)
+	saveVersion := UbuntuImageVersion
+	UbuntuImageVersion = "3.0+test"
+	t.Cleanup(func() { UbuntuImageVersion = saveVersion })
+
+	var stateMachine ClassicStateMachine
+	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+	stateMachine.parent = &stateMachine
+	stateMachine.commonFlags.OutputDir = t.TempDir()
+	stateMachine.tempDirs.rootfs = t.TempDir()
+	stateMachine.ImageDef = imagedefinition.ImageDefinition{
+		ImageName: "ubuntu-server",
+		Series:    "jammy",
+		Artifacts: &imagedefinition.Artifact{
+			SBOM: &imagedefinition.SBOM{SBOMName: "pc.sbom.json", Format: ""},
+		},
+	}
+	writeSBOMRootfs(t, stateMachine.tempDirs.rootfs)
+
+	testCaseName = "TestGenerateSBOM"
+	execCommand = fakeExecCommand
+	t.Cleanup(func() { execCommand = exec.Command })
+	timeNow = func() time.Time { return time.Date(2023, 10, 16, 12, 0, 0, 0, time.UTC) }
+	t.Cleanup(func() { timeNow = time.Now })
+
+	err := stateMachine.generateClassicSBOM()
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual("", openedLabel)
+
+	sbomData, err := os.ReadFile(filepath.Join(stateMachine.commonFlags.OutputDir, "pc.sbom.json"))
+	asserter.AssertErrNil(err, true)
+	var document map[string]interface{}
+	err = json.Unmarshal(sbomData, &document)
+	asserter.AssertErrNil(err, true)
+
+	asserter.AssertEqual("SPDX-2.3", document["spdxVersion"])
+	asserter.AssertEqual("ubuntu-server", document["name"])
+	creationInfo := document["creationInfo"].(map[string]interface{})
+	asserter.AssertEqual("2023-10-16T12:00:00Z", creationInfo["created"])
+	asserter.AssertEqual([]interface{}{"Tool: ubuntu-image-3.0+test"}, creationInfo["creators"])
+
+	packages := document["packages"]
+	asserter.AssertEqual(6, len(packages.([]interface{})))
+	foo := findByName(t, packages, "foo")
+	asserter.AssertEqual("1.2", foo["versionInfo"])
+	asserter.AssertEqual("GPL-2.0-or-later AND MIT", foo["licenseDeclared"])
+	asserter.AssertEqual("built from source package foo-src 1.2-1", foo["sourceInfo"])
+	purl := foo["externalRefs"].([]interface{})[0].(map[string]interface{})["referenceLocator"]
+	asserter.AssertEqual("pkg:deb/ubuntu/foo@1.2?arch=amd64&distro=jammy", purl)
+	bar := findByName(t, packages, "bar")
+	asserter.AssertEqual("NOASSERTION", bar["licenseDeclared"])
+	asserter.AssertEqual("Licenses declared in the copyright file: Bar-Custom", bar["licenseComments"])
+	libbaz := findByName(t, packages, "libbaz")
+	asserter.AssertEqual("NOASSERTION", libbaz["licenseDeclared"])
+	asserter.AssertEqual(nil, libbaz["licenseComments"])
+	core22 := findByName(t, packages, "core22")
+	asserter.AssertEqual("864", core22["versionInfo"])
+	asserter.AssertEqual("Organization: acme", core22["supplier"])
+	asserter.AssertEqual("channel: latest/stable", core22["comment"])
+	local := findByName(t, packages, "local")
+	asserter.AssertEqual("x1", local["versionInfo"])
+	asserter.AssertEqual("NOASSERTION", local["supplier"])
+
+	// the image describes everything it contains
+	asserter.AssertEqual(6, len(document["relationships"].([]interface{})))
+
+	// the same contents always get the same namespace
+	err = stateMachine.generateClassicSBOM()
+	asserter.AssertErrNil(err, true)
+	sbomData, err = os.ReadFile(filepath.Join(stateMachine.commonFlags.OutputDir, "pc.sbom.json"))
+	asserter.AssertErrNil(err, true)
+	var secondDocument map[string]interface{}
+	err = json.Unmarshal(sbomData, &secondDocument)
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual(document["documentNamespace"], secondDocument["documentNamespace"])
+}
+
+// TestGenerateCycloneDXSBOM tests that the CycloneDX SBOM lists the packages and the snaps of a classic image
+func TestGenerateCycloneDXSBOM(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	var openedLabel string
+	mockFakeSeedOpen(t, &openedLabel)
+
+	var stateMachine ClassicStateMachine
+	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+	stateMachine.parent = &stateMachine
+	stateMachine.commonFlags.OutputDir = t.TempDir()
+	stateMachine.tempDirs.rootfs = t.TempDir()
+	stateMachine.ImageDef = imagedefinition.ImageDefinition{
+		ImageName: "ubuntu-server",
+		Series:    "jammy",
+		Artifacts: &imagedefinition.Artifact{
+			SBOM: &imagedefinition.SBOM{SBOMName: "pc.sbom.json", Format: "cyclonedx"},
+		},
+	}
+	writeSBOMRootfs(t, stateMachine.tempDirs.rootfs)
+
+	testCaseName = "TestGenerateSBOM"
+	execCommand = fakeExecCommand
+	t.Cleanup(func() { execCommand = exec.Command })
+	timeNow = func() time.Time { return time.Date(2023, 10, 16, 12, 0, 0, 0, time.UTC) }
+	t.Cleanup(func() { timeNow = time.Now })
+
+	err := stateMachine.generateClassicSBOM()
+	asserter.AssertErrNil(err, true)
+
+	sbomData, err := os.ReadFile(filepath.Join(stateMachine.commonFlags.OutputDir, "pc.sbom.json"))
+	asserter.AssertErrNil(err, true)
+	var document map[string]interface{}
+	err = json.Unmarshal(sbomData, &document)
+	asserter.AssertErrNil(err, true)
+
+	asserter.AssertEqual("CycloneDX", document["bomFormat"])
+	asserter.AssertEqual("1.5", document["specVersion"])
+	metadata := document["metadata"].(map[string]interface{})
+	asserter.AssertEqual("2023-10-16T12:00:00Z", metadata["timestamp"])
+	asserter.AssertEqual("operating-system", metadata["component"].(map[string]interface{})["type"])
+
+	components := document["components"]
+	asserter.AssertEqual(5, len(components.([]interface{})))
+	foo := findByName(t, components, "foo")
+	asserter.AssertEqual("library", foo["type"])
+	asserter.AssertEqual("pkg:deb/ubuntu/foo@1.2?arch=amd64&distro=jammy", foo["purl"])
+	asserter.AssertEqual([]interface{}{
+		map[string]interface{}{"license": map[string]interface{}{"id": "GPL-2.0-or-later"}},
+		map[string]interface{}{"license": map[string]interface{}{"id": "MIT"}},
+	}, foo["licenses"])
+	asserter.AssertEqual([]interface{}{
+		map[string]interface{}{"name": "ubuntu-image:architecture", "value": "amd64"},
+		map[string]interface{}{"name": "ubuntu-image:source-package", "value": "foo-src"},
+		map[string]interface{}{"name": "ubuntu-image:source-version", "value": "1.2-1"},
+	}, foo["properties"])
+	bar := findByName(t, components, "bar")
+	asserter.AssertEqual([]interface{}{
+		map[string]interface{}{"license": map[string]interface{}{"name": "Bar-Custom"}},
+	}, bar["licenses"])
+	core22 := findByName(t, components, "core22")
+	asserter.AssertEqual("application", core22["type"])
+	asserter.AssertEqual("864", core22["version"])
+	asserter.AssertEqual(map[string]interface{}{"name": "acme"}, core22["supplier"])
+}
+
+// TestGenerateSnapSBOM tests that the SBOM of a snap based image lists the snaps of its seed
+func TestGenerateSnapSBOM(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	var openedLabel string
+	mockFakeSeedOpen(t, &openedLabel)
+
+	var stateMachine SnapStateMachine
+	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+	stateMachine.parent = &stateMachine
+	stateMachine.commonFlags.OutputDir = t.TempDir()
+	stateMachine.tempDirs.rootfs = t.TempDir()
+	stateMachine.IsSeeded = true
+	stateMachine.Args.ModelAssertion = filepath.Join("testdata", "modelAssertion20")
+	stateMachine.Opts.SBOM = "pc.cdx.json"
+	stateMachine.Opts.SBOMFormat = "cyclonedx"
+	writeSeedAssertions(t, stateMachine.tempDirs.rootfs)
+	err := os.MkdirAll(filepath.Join(stateMachine.tempDirs.rootfs, "systems", "20231016"), 0755)
+	asserter.AssertErrNil(err, true)
+
+	err = stateMachine.generateSnapSBOM()
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual("20231016", openedLabel)
+
+	sbomData, err := os.ReadFile(filepath.Join(stateMachine.commonFlags.OutputDir, "pc.cdx.json"))
+	asserter.AssertErrNil(err, true)
+	var document map[string]interface{}
+	err = json.Unmarshal(sbomData, &document)
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual("modelAssertion20", document["metadata"].(map[string]interface{})["component"].(map[string]interface{})["name"])
+	asserter.AssertEqual(2, len(document["components"].([]interface{})))
+	core22 := findByName(t, document["components"], "core22")
+	asserter.AssertEqual("acme", core22["publisher"])
+
+	// a seed with several systems can not be listed
+	err = os.MkdirAll(filepath.Join(stateMachine.tempDirs.rootfs, "systems", "20231017"), 0755)
+	asserter.AssertErrNil(err, true)
+	err = stateMachine.generateSnapSBOM()
+	asserter.AssertErrContains(err, "expected one system, found 2")
+
+	// images without a seed have no snaps
+	stateMachine.IsSeeded = false
+	err = stateMachine.generateSnapSBOM()
+	asserter.AssertErrNil(err, true)
+	sbomData, err = os.ReadFile(filepath.Join(stateMachine.commonFlags.OutputDir, "pc.cdx.json"))
+	asserter.AssertErrNil(err, true)
+	err = json.Unmarshal(sbomData, &document)
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual([]interface{}{}, document["components"])
+}
+
+// TestSnapSBOMStates tests that the SBOM of snap based images is generated only when requested
+func TestSnapSBOMStates(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	restoreCWD := helper.SaveCWD()
+	t.Cleanup(restoreCWD)
+
+	var stateMachine SnapStateMachine
+	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+	stateMachine.Args.ModelAssertion = filepath.Join("testdata", "modelAssertion20")
+	err := stateMachine.Setup()
+	asserter.AssertErrNil(err, true)
+	stateNames := stateMachine.stateNames()
+	asserter.AssertEqual([]string{"generate_manifest", "finish"}, stateNames[len(stateNames)-2:])
+
+	var sbomStateMachine SnapStateMachine
+	sbomStateMachine.commonFlags, sbomStateMachine.stateMachineFlags = helper.InitCommonOpts()
+	sbomStateMachine.Args.ModelAssertion = filepath.Join("testdata", "modelAssertion20")
+	sbomStateMachine.Opts.SBOM = "pc.spdx.json"
+	err = sbomStateMachine.Setup()
+	asserter.AssertErrNil(err, true)
+	stateNames = sbomStateMachine.stateNames()
+	asserter.AssertEqual([]string{"generate_manifest", "generate_sbom", "finish"}, stateNames[len(stateNames)-3:])
+
+	// the states of other builds are left untouched
+	stateNames = stateMachine.stateNames()
+	asserter.AssertEqual([]string{"generate_manifest", "finish"}, stateNames[len(stateNames)-2:])
+}
+
+// TestFailedGenerateSBOM tests the failures of generating the SBOM
+func TestFailedGenerateSBOM(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	var openedLabel string
+	mockFakeSeedOpen(t, &openedLabel)
+	var stateMachine ClassicStateMachine
+	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+	stateMachine.parent = &stateMachine
+	stateMachine.commonFlags.OutputDir = t.TempDir()
+	stateMachine.tempDirs.rootfs = t.TempDir()
+	stateMachine.ImageDef = imagedefinition.ImageDefinition{
+		ImageName: "ubuntu-server",
+		Series:    "jammy",
+		Artifacts: &imagedefinition.Artifact{
+			SBOM: &imagedefinition.SBOM{SBOMName: "pc.sbom.json", Format: "spdx"},
+		},
+	}
+	writeSBOMRootfs(t, stateMachine.tempDirs.rootfs)
+
+	testCaseName = "TestGenerateSBOM"
+	execCommand = fakeExecCommand
+	t.Cleanup(func() { execCommand = exec.Command })
+	timeNow = func() time.Time { return time.Date(2023, 10, 16, 12, 0, 0, 0, time.UTC) }
+	t.Cleanup(func() { timeNow = time.Now })
+
+	osWriteFile = mockWriteFile
+	t.Cleanup(func() { osWriteFile = os.WriteFile })
+	err := stateMachine.generateClassicSBOM()
+	asserter.AssertErrContains(err, "Error writing the SBOM")
+	osWriteFile = os.WriteFile
+
+	err = os.WriteFile(filepath.Join(stateMachine.tempDirs.rootfs, "var", "lib", "snapd", "seed", "assertions", "bad"),
+		[]byte("not an assertion"), 0644)
+	asserter.AssertErrNil(err, true)
+	err = stateMachine.generateClassicSBOM()
+	asserter.AssertErrContains(err, "Error reading the assertions of the seed")
+
+	seedOpen = mockSeedOpen
+	err = stateMachine.generateClassicSBOM()
+	asserter.AssertErrContains(err, "Error opening the seed")
+	seedOpen = seed.Open
+
+	osReadFile = mockReadFile
+	t.Cleanup(func() { osReadFile = os.ReadFile })
+	err = stateMachine.generateClassicSBOM()
+	asserter.AssertErrContains(err, "Error reading copyright file")
+	osReadFile = os.ReadFile
+
+	testCaseName = "TestFailedGenerateSBOM"
+	err = stateMachine.generateClassicSBOM()
+	asserter.AssertErrContains(err, "Error listing the packages")
+}
@@ -0,0 +1,198 @@
+package statemachine
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/canonical/ubuntu-image/internal/imagedefinition"
+)
+
+// sha256SumsName is the name of the file listing the SHA256 sums of the
+// artifacts of signed builds
+const sha256SumsName = "SHA256SUMS"
+
+// signatureExtensions are the extensions of the detached signatures
+// written by each signing method
+var signatureExtensions = map[string]string{
+	"gpg":      ".gpg",
+	"minisign": ".minisig",
+	"cosign":   ".sig",
+}
+
+// signing returns how the artifacts are signed, or nil if they are not
+func (stateMachine *StateMachine) signing() *imagedefinition.Signing {
+	var signing imagedefinition.Signing
+	switch parent := stateMachine.parent.(type) {
+	case *ClassicStateMachine:
+		if parent.ImageDef.Signing == nil {
+			return nil
+		}
+		signing = *parent.ImageDef.Signing
+		// the files of the image definition are relative to it
+		if signing.Key != "" && !filepath.IsAbs(signing.Key) {
+			signing.Key = filepath.Join(stateMachine.ConfDefPath, signing.Key)
+		}
+		if signing.PassphraseFile != "" && !filepath.IsAbs(signing.PassphraseFile) {
+			signing.PassphraseFile = filepath.Join(stateMachine.ConfDefPath, signing.PassphraseFile)
+		}
+	case *SnapStateMachine:
+		signing = imagedefinition.Signing{
+			Method:         parent.Opts.SignMethod,
+			Key:            parent.Opts.SignKey,
+			PassphraseFile: parent.Opts.SignPassphraseFile,
+		}
+	case *PackStateMachine:
+		signing = imagedefinition.Signing{
+			Method:         parent.Opts.SignMethod,
+			Key:            parent.Opts.SignKey,
+			PassphraseFile: parent.Opts.SignPassphraseFile,
+		}
+	default:
+		return nil
+	}
+	if signing.Key == "" {
+		return nil
+	}
+	if signing.Method == "" {
+		signing.Method = "gpg"
+	}
+	return &signing
+}
+
+// signatureArtifacts returns the paths of the SHA256SUMS file and of the
+// detached signatures written when signing the given artifacts
+func (stateMachine *StateMachine) signatureArtifacts(artifacts []string, method string) []string {
+	extension := signatureExtensions[method]
+	sumsPath := filepath.Join(stateMachine.commonFlags.OutputDir, sha256SumsName)
+	paths := []string{sumsPath, sumsPath + extension}
+	for _, artifact := range artifacts {
+		paths = append(paths, artifact+extension)
+	}
+	return paths
+}
+
+// signArtifacts writes the SHA256 sums of the artifacts generated by the
+// build to SHA256SUMS, and a detached signature of every artifact and of
+// SHA256SUMS, made with a local key
+func (stateMachine *StateMachine) signArtifacts() error {
+	signing := stateMachine.signing()
+
+	var signed []string
+	var sums strings.Builder
+	for _, artifact := range stateMachine.outputArtifacts() {
+		if _, err := os.Stat(artifact); err != nil {
+			continue
+		}
+		sum, err := fileSHA256(artifact)
+		if err != nil {
+			return fmt.Errorf("Error signing the artifacts: %s", err.Error())
+		}
+		// the format of sha256sum --binary, so that sha256sum --check can verify it
+		fmt.Fprintf(&sums, "%s *%s\n", sum, filepath.Base(artifact))
+		signed = append(signed, artifact)
+	}
+	sumsPath := filepath.Join(stateMachine.commonFlags.OutputDir, sha256SumsName)
+	if err := osWriteFile(sumsPath, []byte(sums.String()), 0644); err != nil {
+		return fmt.Errorf("Error writing %s: %s", sha256SumsName, err.Error())
+	}
+	signed = append(signed, sumsPath)
+
+	// gpg reads the passphrase file itself
+	passphrase := ""
+	if signing.PassphraseFile != "" && signing.Method != "gpg" {
+		passphraseBytes, err := osReadFile(signing.PassphraseFile)
+		if err != nil {
+			return fmt.Errorf("Error reading the passphrase of the signing key: %s", err.Error())
+		}
+		passphrase = strings.SplitN(string(passphraseBytes), "\n", 2)[0]
+	}
+
+	var sign func(path, signature string) error
+	switch signing.Method {
+	case "minisign":
+		sign = stateMachine.minisignSigner(signing.Key, passphrase)
+	case "cosign":
+		sign = stateMachine.cosignSigner(signing.Key, passphrase)
+	default:
+		homeDir := filepath.Join(stateMachine.tempDirs.scratch, "gnupg")
+		var err error
+		sign, err = stateMachine.gpgSigner(signing, homeDir)
+		if err != nil {
+			return err
+		}
+		// gpg starts an agent to use the secret key, which must not outlive the build
+		defer func() {
+			_ = execCommand("gpgconf", "--homedir", homeDir, "--kill", "gpg-agent").Run()
+		}()
+	}
+	for _, path := range signed {
+		if err := sign(path, path+signatureExtensions[signing.Method]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// gpgSigner imports the secret key in a new keyring in homeDir and returns
+// a function writing armored detached signatures with it
+func (stateMachine *StateMachine) gpgSigner(signing *imagedefinition.Signing, homeDir string) (func(string, string) error, error) {
+	if err := osMkdirAll(homeDir, 0700); err != nil {
+		return nil, fmt.Errorf("Error creating the signing keyring: %s", err.Error())
+	}
+	gpgArgs := []string{"--homedir", homeDir, "--batch", "--yes"}
+	if signing.PassphraseFile != "" {
+		gpgArgs = append(gpgArgs, "--pinentry-mode", "loopback", "--passphrase-file", signing.PassphraseFile)
+	}
+
+	importCmd := execCommand("gpg", append(gpgArgs, "--import", signing.Key)...)
+	if err := stateMachine.runSigningCommand(importCmd); err != nil {
+		return nil, err
+	}
+	return func(path, signature string) error {
+		signCmd := execCommand("gpg",
+			append(gpgArgs, "--armor", "--detach-sign", "--output", signature, path)...)
+		return stateMachine.runSigningCommand(signCmd)
+	}, nil
+}
+
+// minisignSigner returns a function writing minisign signatures. The
+// passphrase of the key is given on standard input
+func (stateMachine *StateMachine) minisignSigner(key, passphrase string) func(string, string) error {
+	return func(path, signature string) error {
+		signCmd := execCommand("minisign", "-S", "-s", key, "-m", path, "-x", signature)
+		if passphrase != "" {
+			signCmd.Stdin = strings.NewReader(passphrase + "\n")
+		}
+		return stateMachine.runSigningCommand(signCmd)
+	}
+}
+
+// cosignSigner returns a function writing cosign signatures of blobs.
+// Nothing is uploaded to a transparency log so that signing works offline
+func (stateMachine *StateMachine) cosignSigner(key, passphrase string) func(string, string) error {
+	return func(path, signature string) error {
+		signCmd := execCommand("cosign", "sign-blob", "--yes", "--key", key,
+			"--output-signature", signature, "--tlog-upload=false", path)
+		// Env is sometimes used for mocking command calls in tests,
+		// so only overwrite env if it is nil
+		if signCmd.Env == nil {
+			signCmd.Env = os.Environ()
+		}
+		// the password is set even when empty so that cosign does not prompt for it
+		signCmd.Env = append(signCmd.Env, "COSIGN_PASSWORD="+passphrase)
+		return stateMachine.runSigningCommand(signCmd)
+	}
+}
+
+// runSigningCommand runs a command of the signing tools
+func (stateMachine *StateMachine) runSigningCommand(cmd *exec.Cmd) error {
+	cmdOutput := setCommandOutput(cmd, stateMachine.commonFlags.Debug)
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("Error signing the artifacts with command \"%s\". Error is \"%s\". Full output below:\n%s",
+			cmd.String(), err.Error(), cmdOutput.String())
+	}
+	return nil
+}
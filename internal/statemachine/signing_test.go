@@ -0,0 +1,311 @@
+package statemachine
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/canonical/ubuntu-image/internal/helper"
+	"github.com/canonical/ubuntu-image/internal/imagedefinition"
+)
+
+// writePackArtifacts writes the disk image and the manifest generated by a
+// pack build in the output directory. The filelist was not generated
+func writePackArtifacts(t *testing.T, outputDir string) {
+	t.Helper()
+	for name, content := range map[string]string{"pc.img": "disk", "pc.manifest": "foo 1.2\n"} {
+		err := os.WriteFile(filepath.Join(outputDir, name), []byte(content), 0600)
+		if err != nil {
+			t.Fatalf("Error writing %s: %s", name, err.Error())
+		}
+	}
+}
+
+// newGPGKey creates a secret key and exports it to a key file. It returns
+// the path of the key file and the keyring holding the key
+func newGPGKey(t *testing.T, passphrase string) (string, string) {
+	t.Helper()
+	homeDir := t.TempDir()
+	t.Cleanup(func() {
+		_ = exec.Command("gpgconf", "--homedir", homeDir, "--kill", "gpg-agent").Run()
+	})
+	gpgArgs := []string{"--homedir", homeDir, "--batch", "--pinentry-mode", "loopback", "--passphrase", passphrase}
+	genCmd := exec.Command("gpg", append(gpgArgs, "--quick-gen-key", "Test <test@example.com>",
+		"ed25519", "sign", "never")...)
+	if output, err := genCmd.CombinedOutput(); err != nil {
+		t.Fatalf("Error generating a GPG key: %s\n%s", err.Error(), output)
+	}
+	keyFile := filepath.Join(t.TempDir(), "signing.asc")
+	exportCmd := exec.Command("gpg", append(gpgArgs, "--armor", "--output", keyFile, "--export-secret-keys")...)
+	if output, err := exportCmd.CombinedOutput(); err != nil {
+		t.Fatalf("Error exporting the GPG key: %s\n%s", err.Error(), output)
+	}
+	return keyFile, homeDir
+}
+
+// TestSignArtifactsGPG tests that every artifact and their sums are signed with gpg
+func TestSignArtifactsGPG(t *testing.T) {
+	for _, passphrase := range []string{"", "secret"} {
+		t.Run(fmt.Sprintf("passphrase=%q", passphrase), func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			keyFile, keyring := newGPGKey(t, passphrase)
+			var stateMachine PackStateMachine
+			stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+			stateMachine.parent = &stateMachine
+			stateMachine.commonFlags.OutputDir = t.TempDir()
+			stateMachine.tempDirs.scratch = t.TempDir()
+			stateMachine.Opts.ManifestName = "pc.manifest"
+			stateMachine.Opts.FilelistName = "pc.filelist"
+			stateMachine.Opts.SignKey = keyFile
+			stateMachine.Opts.SignMethod = "gpg"
+			stateMachine.VolumeNames = map[string]string{"pc": "pc.img"}
+			writePackArtifacts(t, stateMachine.commonFlags.OutputDir)
+			if passphrase != "" {
+				stateMachine.Opts.SignPassphraseFile = filepath.Join(t.TempDir(), "passphrase")
+				err := os.WriteFile(stateMachine.Opts.SignPassphraseFile, []byte(passphrase+"\n"), 0600)
+				asserter.AssertErrNil(err, true)
+			}
+
+			err := stateMachine.signArtifacts()
+			asserter.AssertErrNil(err, true)
+
+			outputDir := stateMachine.commonFlags.OutputDir
+			sums, err := os.ReadFile(filepath.Join(outputDir, "SHA256SUMS"))
+			asserter.AssertErrNil(err, true)
+			imgSum, err := fileSHA256(filepath.Join(outputDir, "pc.img"))
+			asserter.AssertErrNil(err, true)
+			manifestSum, err := fileSHA256(filepath.Join(outputDir, "pc.manifest"))
+			asserter.AssertErrNil(err, true)
+			asserter.AssertEqual(imgSum+" *pc.img\n"+manifestSum+" *pc.manifest\n", string(sums))
+
+			for _, name := range []string{"SHA256SUMS", "pc.img", "pc.manifest"} {
+				verifyCmd := exec.Command("gpg", "--homedir", keyring, "--batch", "--verify",
+					filepath.Join(outputDir, name+".gpg"), filepath.Join(outputDir, name))
+				if output, err := verifyCmd.CombinedOutput(); err != nil {
+					t.Errorf("Signature of %s does not verify: %s\n%s", name, err.Error(), output)
+				}
+			}
+			_, err = os.Stat(filepath.Join(outputDir, "pc.filelist.gpg"))
+			if !os.IsNotExist(err) {
+				t.Errorf("Artifacts that were not generated must not be signed")
+			}
+		})
+	}
+}
+
+// TestSignArtifactsMinisignCosign tests the commands signing the artifacts
+// with minisign and cosign
+func TestSignArtifactsMinisignCosign(t *testing.T) {
+	testCases := []struct {
+		name              string
+		method            string
+		passphrase        string
+		extension         string
+		expectedSignature string
+	}{
+		{"minisign", "minisign", "", ".minisig", "minisign "},
+		{"minisign_passphrase", "minisign", "secret\nignored", ".minisig", "minisign secret\n"},
+		{"cosign", "cosign", "", ".sig", "cosign "},
+		{"cosign_passphrase", "cosign", "secret\n", ".sig", "cosign secret"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			var stateMachine PackStateMachine
+			stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+			stateMachine.parent = &stateMachine
+			stateMachine.commonFlags.OutputDir = t.TempDir()
+			stateMachine.tempDirs.scratch = t.TempDir()
+			stateMachine.Opts.ManifestName = "pc.manifest"
+			stateMachine.Opts.FilelistName = "pc.filelist"
+			stateMachine.Opts.SignKey = "signing.key"
+			stateMachine.Opts.SignMethod = tc.method
+			stateMachine.VolumeNames = map[string]string{"pc": "pc.img"}
+			writePackArtifacts(t, stateMachine.commonFlags.OutputDir)
+			if tc.passphrase != "" {
+				stateMachine.Opts.SignPassphraseFile = filepath.Join(t.TempDir(), "passphrase")
+				err := os.WriteFile(stateMachine.Opts.SignPassphraseFile, []byte(tc.passphrase), 0600)
+				asserter.AssertErrNil(err, true)
+			}
+			testCaseName = "TestSignArtifacts"
+			execCommand = fakeExecCommand
+			t.Cleanup(func() { execCommand = exec.Command })
+
+			err := stateMachine.signArtifacts()
+			asserter.AssertErrNil(err, true)
+
+			outputDir := stateMachine.commonFlags.OutputDir
+			for _, name := range []string{"SHA256SUMS", "pc.img", "pc.manifest"} {
+				signature, err := os.ReadFile(filepath.Join(outputDir, name+tc.extension))
+				asserter.AssertErrNil(err, true)
+				asserter.AssertEqual(tc.expectedSignature, string(signature))
+			}
+		})
+	}
+}
+
+// TestSignClassicReport tests that the report of a classic build is signed
+// and listed in SHA256SUMS with the artifacts it describes
+func TestSignClassicReport(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	var stateMachine ClassicStateMachine
+	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+	stateMachine.parent = &stateMachine
+	stateMachine.commonFlags.OutputDir = t.TempDir()
+	stateMachine.tempDirs.scratch = t.TempDir()
+	stateMachine.Args.ImageDefinition = "pc.yaml"
+	stateMachine.VolumeNames = map[string]string{"pc": "pc.img"}
+	stateMachine.ImageDef = imagedefinition.ImageDefinition{
+		Series:       "jammy",
+		Architecture: "amd64",
+		Artifacts: &imagedefinition.Artifact{
+			Manifest: &imagedefinition.Manifest{ManifestName: "pc.manifest"},
+			Report:   &imagedefinition.Report{ReportName: "pc.report", Format: "json"},
+		},
+		Signing: &imagedefinition.Signing{Method: "minisign", Key: "signing.key"},
+	}
+	writePackArtifacts(t, stateMachine.commonFlags.OutputDir)
+	testCaseName = "TestSignArtifacts"
+	execCommand = fakeExecCommand
+	t.Cleanup(func() { execCommand = exec.Command })
+
+	err := stateMachine.generateReport()
+	asserter.AssertErrNil(err, true)
+	err = stateMachine.signArtifacts()
+	asserter.AssertErrNil(err, true)
+
+	outputDir := stateMachine.commonFlags.OutputDir
+	sums, err := os.ReadFile(filepath.Join(outputDir, "SHA256SUMS"))
+	asserter.AssertErrNil(err, true)
+	reportSum, err := fileSHA256(filepath.Join(outputDir, "pc.report"))
+	asserter.AssertErrNil(err, true)
+	if !strings.Contains(string(sums), reportSum+" *pc.report\n") {
+		t.Errorf("Expected the report in SHA256SUMS:\n%s", sums)
+	}
+	_, err = os.Stat(filepath.Join(outputDir, "pc.report.minisig"))
+	asserter.AssertErrNil(err, true)
+}
+
+// TestSigningArtifacts tests that the sums and the signatures are listed
+// in the artifacts of signed builds
+func TestSigningArtifacts(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	var stateMachine PackStateMachine
+	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+	stateMachine.parent = &stateMachine
+	stateMachine.commonFlags.OutputDir = t.TempDir()
+	stateMachine.tempDirs.scratch = t.TempDir()
+	stateMachine.Opts.ManifestName = "pc.manifest"
+	stateMachine.Opts.FilelistName = "pc.filelist"
+	stateMachine.Opts.SignKey = "signing.key"
+	stateMachine.Opts.SignMethod = "minisign"
+	stateMachine.VolumeNames = map[string]string{"pc": "pc.img"}
+	writePackArtifacts(t, stateMachine.commonFlags.OutputDir)
+	outputDir := stateMachine.commonFlags.OutputDir
+	var expected []string
+	for _, name := range []string{"pc.img", "pc.manifest", "pc.filelist", "SHA256SUMS", "SHA256SUMS.minisig",
+		"pc.img.minisig", "pc.manifest.minisig", "pc.filelist.minisig"} {
+		expected = append(expected, filepath.Join(outputDir, name))
+	}
+	asserter.AssertEqual(expected, stateMachine.artifacts())
+
+	stateMachine.Opts.SignKey = ""
+	asserter.AssertEqual(expected[:3], stateMachine.artifacts())
+}
+
+// TestClassicSigning tests that the key files of the image definition are
+// relative to it and that gpg is the default signing method
+func TestClassicSigning(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	restoreCWD := helper.SaveCWD()
+	t.Cleanup(restoreCWD)
+
+	var stateMachine ClassicStateMachine
+	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+	stateMachine.parent = &stateMachine
+	stateMachine.Args.ImageDefinition = filepath.Join("testdata", "image_definitions", "test_signing.yaml")
+	err := stateMachine.setConfDefDir(stateMachine.Args.ImageDefinition)
+	asserter.AssertErrNil(err, true)
+	err = stateMachine.parseImageDefinition()
+	asserter.AssertErrNil(err, true)
+
+	asserter.AssertEqual(&imagedefinition.Signing{
+		Method:         "gpg",
+		Key:            filepath.Join(stateMachine.ConfDefPath, "keys", "signing.asc"),
+		PassphraseFile: "/etc/ubuntu-image/passphrase",
+	}, stateMachine.signing())
+}
+
+// TestSigningStates tests that the artifacts of snap and pack images are
+// signed last when a key is given
+func TestSigningStates(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	restoreCWD := helper.SaveCWD()
+	t.Cleanup(restoreCWD)
+
+	var snapStateMachine SnapStateMachine
+	snapStateMachine.commonFlags, snapStateMachine.stateMachineFlags = helper.InitCommonOpts()
+	snapStateMachine.Args.ModelAssertion = filepath.Join("testdata", "modelAssertion20")
+	snapStateMachine.Opts.SBOM = "pc.spdx.json"
+	snapStateMachine.Opts.SignKey = "signing.asc"
+	err := snapStateMachine.Setup()
+	asserter.AssertErrNil(err, true)
+	stateNames := snapStateMachine.stateNames()
+	asserter.AssertEqual([]string{"generate_sbom", "sign_artifacts", "finish"}, stateNames[len(stateNames)-3:])
+
+	var packStateMachine PackStateMachine
+	packStateMachine.commonFlags, packStateMachine.stateMachineFlags = helper.InitCommonOpts()
+	packStateMachine.Opts.SignKey = "signing.asc"
+	err = packStateMachine.Setup()
+	asserter.AssertErrNil(err, true)
+	stateNames = packStateMachine.stateNames()
+	asserter.AssertEqual([]string{"update_bootloader", "sign_artifacts", "finish"}, stateNames[len(stateNames)-3:])
+}
+
+// TestFailedSignArtifacts tests the failures of signing the artifacts
+func TestFailedSignArtifacts(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	var stateMachine PackStateMachine
+	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+	stateMachine.parent = &stateMachine
+	stateMachine.commonFlags.OutputDir = t.TempDir()
+	stateMachine.tempDirs.scratch = t.TempDir()
+	stateMachine.Opts.ManifestName = "pc.manifest"
+	stateMachine.Opts.FilelistName = "pc.filelist"
+	stateMachine.Opts.SignKey = "signing.asc"
+	stateMachine.Opts.SignMethod = "gpg"
+	stateMachine.VolumeNames = map[string]string{"pc": "pc.img"}
+	writePackArtifacts(t, stateMachine.commonFlags.OutputDir)
+
+	osWriteFile = mockWriteFile
+	t.Cleanup(func() { osWriteFile = os.WriteFile })
+	err := stateMachine.signArtifacts()
+	asserter.AssertErrContains(err, "Error writing SHA256SUMS")
+	osWriteFile = os.WriteFile
+
+	osMkdirAll = mockMkdirAll
+	t.Cleanup(func() { osMkdirAll = os.MkdirAll })
+	err = stateMachine.signArtifacts()
+	asserter.AssertErrContains(err, "Error creating the signing keyring")
+	osMkdirAll = os.MkdirAll
+
+	testCaseName = "TestFailedSignArtifacts"
+	execCommand = fakeExecCommand
+	t.Cleanup(func() { execCommand = exec.Command })
+	err = stateMachine.signArtifacts()
+	asserter.AssertErrContains(err, "Error signing the artifacts with command")
+	if !strings.Contains(err.Error(), "--import") {
+		t.Errorf("Expected the key import to fail, got %s", err.Error())
+	}
+
+	stateMachine.Opts.SignMethod = "cosign"
+	err = stateMachine.signArtifacts()
+	asserter.AssertErrContains(err, "Error signing the artifacts with command")
+
+	stateMachine.Opts.SignPassphraseFile = filepath.Join(t.TempDir(), "missing")
+	err = stateMachine.signArtifacts()
+	asserter.AssertErrContains(err, "Error reading the passphrase of the signing key")
+}
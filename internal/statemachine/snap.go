@@ -18,7 +18,6 @@ var snapStates = []stateFunc{
 	{"populate_prepare_partitions", (*StateMachine).populatePreparePartitions},
 	{"make_disk", (*StateMachine).makeDisk},
 	{"generate_manifest", (*StateMachine).generateSnapManifest},
-	{"finish", (*StateMachine).finish},
 }
 
 // SnapStateMachine embeds StateMachine and adds the command line flags specific to snap images
@@ -34,8 +33,23 @@ func (snapStateMachine *SnapStateMachine) Setup() error {
 	// set the parent pointer of the embedded struct
 	snapStateMachine.parent = snapStateMachine
 
-	// set the states that will be used for this image type
-	snapStateMachine.states = snapStates
+	// set the states that will be used for this image type, followed
+	// by the states for the additional artifacts requested
+	snapStateMachine.states = make([]stateFunc, len(snapStates))
+	copy(snapStateMachine.states, snapStates)
+
+	if snapStateMachine.Opts.SBOM != "" {
+		snapStateMachine.states = append(snapStateMachine.states,
+			stateFunc{"generate_sbom", (*StateMachine).generateSnapSBOM})
+	}
+	if snapStateMachine.Opts.SignKey != "" {
+		snapStateMachine.states = append(snapStateMachine.states,
+			stateFunc{"sign_artifacts", (*StateMachine).signArtifacts})
+	}
+
+	// add the no-op "finish" state
+	snapStateMachine.states = append(snapStateMachine.states,
+		stateFunc{"finish", (*StateMachine).finish})
 
 	if err := snapStateMachine.setConfDefDir(snapStateMachine.parent.(*SnapStateMachine).Args.ModelAssertion); err != nil {
 		return err
@@ -34,7 +34,7 @@ func (stateMachine *StateMachine) prepareImage() error {
 	if len(snapStateMachine.Opts.Revisions) > 0 {
 		imageOpts.SeedManifest = seedwriter.NewManifest()
 		for snapName, snapRev := range snapStateMachine.Opts.Revisions {
-			fmt.Printf("WARNING: revision %d for snap %s may not be the latest available version!\n", snapRev, snapName)
+			stateMachine.warn("revision %d for snap %s may not be the latest available version!", snapRev, snapName)
 			err = imageOpts.SeedManifest.SetAllowedSnapRevision(snapName, snap.R(snapRev))
 			if err != nil {
 				return fmt.Errorf("Error preparing image: error dealing with snap revision %s: %w", snapName, err)
@@ -72,6 +72,12 @@ func (stateMachine *StateMachine) prepareImage() error {
 		}()
 	}
 
+	restoreStore, err := useSnapStore(snapStateMachine.snapStore())
+	if err != nil {
+		return err
+	}
+	defer restoreStore()
+
 	if err := imagePrepare(&imageOpts); err != nil {
 		return fmt.Errorf("Error preparing image: %s", err.Error())
 	}
@@ -7,10 +7,12 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"reflect"
 	"sort"
 	"strconv"
 	"strings"
@@ -26,11 +28,16 @@ import (
 	"github.com/xeipuuv/gojsonschema"
 
 	"github.com/canonical/ubuntu-image/internal/commands"
+	"github.com/canonical/ubuntu-image/internal/diskimage"
 	"github.com/canonical/ubuntu-image/internal/helper"
 )
 
 const (
 	metadataStateFile = "ubuntu-image.json"
+	// metadataVersion is the version of the format of metadataStateFile. It must
+	// be bumped whenever the format changes in a way that prevents resuming from
+	// files written by previous versions
+	metadataVersion = 1
 )
 
 var gadgetYamlPathInTree = filepath.Join("meta", "gadget.yaml")
@@ -56,6 +63,11 @@ var osOpenFile = os.OpenFile
 var osRemoveAll = os.RemoveAll
 var osRemove = os.Remove
 var osRename = os.Rename
+var osChmod = os.Chmod
+var osSymlink = os.Symlink
+var osStat = os.Stat
+var osLstat = os.Lstat
+var osReadlink = os.Readlink
 var osCreate = os.Create
 var osTruncate = os.Truncate
 var osutilCopyFile = osutil.CopyFile
@@ -64,16 +76,28 @@ var execCommand = exec.Command
 var mkfsMakeWithContent = mkfs.MakeWithContent
 var mkfsMake = mkfs.Make
 var diskfsCreate = diskfs.Create
+var diskimageConvertToQcow2 = diskimage.ConvertToQcow2
+var diskimageConvertToVMDK = diskimage.ConvertToVMDK
+var diskimageConvertToVHD = diskimage.ConvertToVHD
+var diskimageConvertToVHDX = diskimage.ConvertToVHDX
 var randRead = rand.Read
 var seedOpen = seed.Open
 var imagePrepare = image.Prepare
 var httpGet = http.Get
+var httpDo = (&http.Client{Timeout: tarballDownloadTimeout}).Do
+var netListen = net.Listen
 var jsonUnmarshal = json.Unmarshal
 var gojsonschemaValidate = gojsonschema.Validate
 var filepathRel = filepath.Rel
+var timeNow = time.Now
+var osGeteuid = os.Geteuid
 
 var mockableBlockSize string = "1" //used for mocking dd calls
 
+// locations used to run binaries of foreign architectures, can be mocked in tests
+var qemuStaticDir = "/usr/bin"
+var binfmtMiscDir = "/proc/sys/fs/binfmt_misc"
+
 // SmInterface allows different image types to implement their own setup/run/teardown functions
 type SmInterface interface {
 	Setup() error
@@ -88,6 +112,12 @@ type stateFunc struct {
 	function func(*StateMachine) error
 }
 
+// stateTiming records how long a state took to run
+type stateTiming struct {
+	Name     string
+	Duration time.Duration
+}
+
 // temporaryDirectories organizes the state machines, rootfs, unpack, and volumes dirs
 type temporaryDirectories struct {
 	rootfs  string
@@ -99,17 +129,24 @@ type temporaryDirectories struct {
 
 // StateMachine will hold the command line data, track the current state, and handle all function calls
 type StateMachine struct {
-	cleanWorkDir  bool          // whether or not to clean up the workDir
-	CurrentStep   string        // tracks the current progress of the state machine
-	StepsTaken    int           // counts the number of steps taken
-	ConfDefPath   string        // directory holding the model assertion / image definition file
-	YamlFilePath  string        // the location for the gadget yaml file
-	IsSeeded      bool          // core 20 images are seeded
-	rootfsVolName string        // volume on which the rootfs is located
-	rootfsPartNum int           // rootfs partition number
-	SectorSize    quantity.Size // parsed (converted) sector size
-	RootfsSize    quantity.Size
-	tempDirs      temporaryDirectories
+	MetadataVersion int           // version of the format of the metadata file
+	cleanWorkDir    bool          // whether or not to clean up the workDir
+	CurrentStep     string        // tracks the current progress of the state machine
+	StatesTaken     []string      // names of the states that have been run
+	StateNames      []string      // names of all the states, only used in the metadata file
+	StateTimings    []stateTiming // how long the states that have been run took
+	ConfDefPath     string        // directory holding the model assertion / image definition file
+	YamlFilePath    string        // the location for the gadget yaml file
+	IsSeeded        bool          // core 20 images are seeded
+	RootfsVolName   string        // volume on which the rootfs is located
+	RootfsPartNum   int           // rootfs partition number
+	SectorSize      quantity.Size // parsed (converted) sector size
+	RootfsSize      quantity.Size
+	tempDirs        temporaryDirectories
+
+	// the time and the seed of reproducible builds
+	sourceDateEpoch  time.Time
+	reproducibleSeed string
 
 	// The flags that were passed in on the command line
 	commonFlags       *commands.CommonOpts
@@ -244,11 +281,9 @@ func (stateMachine *StateMachine) postProcessGadgetYaml() error {
 		// look for the rootfs and check if the image is seeded
 		for ii, structure := range volume.Structure {
 			if structure.Role == "" && structure.Label == gadget.SystemBoot {
-				if !stateMachine.commonFlags.Quiet {
-					fmt.Printf("WARNING: volumes:%s:structure:%d:filesystem_label "+
-						"used for defining partition roles; use role instead\n",
-						volumeName, ii)
-				}
+				stateMachine.warn("volumes:%s:structure:%d:filesystem_label "+
+					"used for defining partition roles; use role instead",
+					volumeName, ii)
 			} else if structure.Role == gadget.SystemData {
 				rootfsSeen = true
 			} else if structure.Role == gadget.SystemSeed {
@@ -360,51 +395,107 @@ func (stateMachine *StateMachine) readMetadata(metadataFile string) error {
 		return fmt.Errorf("failed to parse metadata file: %s", err.Error())
 	}
 
-	return stateMachine.loadState(partialStateMachine)
-}
+	if partialStateMachine.MetadataVersion != metadataVersion {
+		return fmt.Errorf("metadata file was written with format version %d, but only version %d "+
+			"can be resumed. The build needs to be restarted without --resume",
+			partialStateMachine.MetadataVersion, metadataVersion)
+	}
 
-func (stateMachine *StateMachine) loadState(partialStateMachine *StateMachine) error {
-	stateMachine.StepsTaken = partialStateMachine.StepsTaken
+	stateMachine.loadState(partialStateMachine)
 
-	if stateMachine.StepsTaken > len(stateMachine.states) {
-		return fmt.Errorf("invalid steps taken count (%d). The state machine only have %d steps", stateMachine.StepsTaken, len(stateMachine.states))
+	// classic builds also need their image definition back, from which
+	// most of their states are calculated
+	if classicStateMachine, ok := stateMachine.parent.(*ClassicStateMachine); ok {
+		if err := classicStateMachine.loadClassicState(jsonfile, partialStateMachine.StatesTaken); err != nil {
+			return err
+		}
 	}
 
-	// delete all of the stateFuncs that have already run
-	stateMachine.states = stateMachine.states[stateMachine.StepsTaken:]
+	return stateMachine.skipStatesTaken(partialStateMachine)
+}
 
+// loadState restores the fields common to all image types from a partial state machine
+func (stateMachine *StateMachine) loadState(partialStateMachine *StateMachine) {
 	stateMachine.CurrentStep = partialStateMachine.CurrentStep
+	stateMachine.ConfDefPath = partialStateMachine.ConfDefPath
 	stateMachine.GadgetInfo = partialStateMachine.GadgetInfo
 	stateMachine.YamlFilePath = partialStateMachine.YamlFilePath
 	stateMachine.ImageSizes = partialStateMachine.ImageSizes
 	stateMachine.RootfsSize = partialStateMachine.RootfsSize
 	stateMachine.IsSeeded = partialStateMachine.IsSeeded
+	stateMachine.RootfsVolName = partialStateMachine.RootfsVolName
+	stateMachine.RootfsPartNum = partialStateMachine.RootfsPartNum
 	stateMachine.VolumeOrder = partialStateMachine.VolumeOrder
+	stateMachine.VolumeNames = partialStateMachine.VolumeNames
 	stateMachine.SectorSize = partialStateMachine.SectorSize
 	stateMachine.tempDirs.rootfs = filepath.Join(stateMachine.stateMachineFlags.WorkDir, "root")
 	stateMachine.tempDirs.unpack = filepath.Join(stateMachine.stateMachineFlags.WorkDir, "unpack")
 	stateMachine.tempDirs.volumes = filepath.Join(stateMachine.stateMachineFlags.WorkDir, "volumes")
+	stateMachine.tempDirs.chroot = filepath.Join(stateMachine.stateMachineFlags.WorkDir, "chroot")
+	stateMachine.tempDirs.scratch = filepath.Join(stateMachine.stateMachineFlags.WorkDir, "scratch")
 
 	// due to https://github.com/golang/go/issues/10415 we need to set back the volume
 	// structs we reset before encoding (see writeMetadata())
 	if stateMachine.GadgetInfo != nil {
 		gadget.SetEnclosingVolumeInStructs(stateMachine.GadgetInfo.Volumes)
 	}
+}
+
+// skipStatesTaken makes sure the states of the partial state machine are the
+// same as the current ones, so the build resumes exactly where it stopped.
+// The states that have already been run are then skipped by Run()
+func (stateMachine *StateMachine) skipStatesTaken(partialStateMachine *StateMachine) error {
+	if len(partialStateMachine.StatesTaken) > len(stateMachine.states) {
+		return fmt.Errorf("invalid steps taken count (%d). The state machine only have %d steps",
+			len(partialStateMachine.StatesTaken), len(stateMachine.states))
+	}
 
+	stateNames := stateMachine.stateNames()
+	if !reflect.DeepEqual(stateNames, partialStateMachine.StateNames) {
+		return fmt.Errorf("the states of the partial run (%s) do not match the states of "+
+			"this build (%s). The build needs to be restarted without --resume",
+			strings.Join(partialStateMachine.StateNames, ", "), strings.Join(stateNames, ", "))
+	}
+	for i, stateName := range partialStateMachine.StatesTaken {
+		if stateNames[i] != stateName {
+			return fmt.Errorf("state \"%s\" of the partial run does not match state \"%s\" "+
+				"of this build", stateName, stateNames[i])
+		}
+	}
+
+	stateMachine.StatesTaken = partialStateMachine.StatesTaken
+	stateMachine.StateTimings = partialStateMachine.StateTimings
 	return nil
 }
 
+// stateNames returns the names of all the states of the state machine
+func (stateMachine *StateMachine) stateNames() []string {
+	stateNames := make([]string, 0, len(stateMachine.states))
+	for _, state := range stateMachine.states {
+		stateNames = append(stateNames, state.name)
+	}
+	return stateNames
+}
+
 // writeMetadata writes the state machine info to disk, encoded as JSON. This will be used when resuming a
-// partial state machine run
+// partial state machine run. The image type specific state machine is written when
+// there is one, so that its context can be restored as well
 func (stateMachine *StateMachine) writeMetadata(metadataFile string) error {
 	jsonfilePath := filepath.Join(stateMachine.stateMachineFlags.WorkDir, metadataFile)
-	jsonfile, err := os.OpenFile(jsonfilePath, os.O_CREATE|os.O_WRONLY, 0644)
+	jsonfile, err := os.OpenFile(jsonfilePath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
 	if err != nil && !os.IsExist(err) {
 		return fmt.Errorf("error opening JSON metadata file for writing: %s", jsonfilePath)
 	}
 	defer jsonfile.Close()
 
-	b, err := json.Marshal(stateMachine)
+	stateMachine.MetadataVersion = metadataVersion
+	stateMachine.StateNames = stateMachine.stateNames()
+
+	var toEncode interface{} = stateMachine
+	if stateMachine.parent != nil {
+		toEncode = stateMachine.parent
+	}
+	b, err := json.Marshal(toEncode)
 	if err != nil {
 		return fmt.Errorf("failed to JSON encode metadata: %w", err)
 	}
@@ -427,8 +518,8 @@ func (stateMachine *StateMachine) handleContentSizes(farthestOffset quantity.Off
 		stateMachine.ImageSizes[volumeName] = calculated
 	} else {
 		if volumeSize < calculated {
-			fmt.Printf("WARNING: ignoring image size smaller than "+
-				"minimum required size: vol:%s %d < %d\n",
+			stateMachine.warn("ignoring image size smaller than "+
+				"minimum required size: vol:%s %d < %d",
 				volumeName, uint64(volumeSize), uint64(calculated))
 			stateMachine.ImageSizes[volumeName] = calculated
 		} else {
@@ -439,20 +530,50 @@ func (stateMachine *StateMachine) handleContentSizes(farthestOffset quantity.Off
 
 // Run iterates through the state functions, stopping when appropriate based on --until and --thru
 func (stateMachine *StateMachine) Run() error {
-	// iterate through the states
-	for i := 0; i < len(stateMachine.states); i++ {
+	if err := progress.start(stateMachine.commonFlags); err != nil {
+		return err
+	}
+	defer progress.stop()
+	progress.emit(progressEvent{Type: progressBuildStart, States: stateMachine.stateNames()})
+	buildStart := timeNow()
+
+	err := stateMachine.runStates()
+	if err == nil && stateMachine.stateMachineFlags.DryRun {
+		err = stateMachine.reportPlan()
+	} else if err == nil && len(stateMachine.StatesTaken) == len(stateMachine.states) {
+		err = stateMachine.reportArtifacts()
+	}
+
+	buildDuration := timeNow().Sub(buildStart).Seconds()
+	buildFinish := progressEvent{Type: progressBuildFinish, Duration: &buildDuration}
+	if err != nil {
+		buildFinish.Error = err.Error()
+	}
+	progress.emit(buildFinish)
+	return err
+}
+
+// runStates runs the states of the state machine, skipping the ones taken by a previous partial run
+func (stateMachine *StateMachine) runStates() error {
+	for i := len(stateMachine.StatesTaken); i < len(stateMachine.states); i++ {
 		stateFunc := stateMachine.states[i]
 		if stateFunc.name == stateMachine.stateMachineFlags.Until {
 			break
 		}
+		if stateMachine.skipState(stateFunc.name) {
+			continue
+		}
 		if !stateMachine.commonFlags.Quiet {
-			fmt.Printf("[%d] %s\n", stateMachine.StepsTaken, stateFunc.name)
+			stateMachine.printProgress("[%d] %s\n", i, stateFunc.name)
 		}
-		start := time.Now()
-		err := stateFunc.function(stateMachine)
+		progress.stateStarted(i, stateFunc.name)
+		start := timeNow()
+		err := stateMachine.runState(stateFunc)
+		duration := timeNow().Sub(start)
 		if stateMachine.commonFlags.Debug {
-			fmt.Printf("duration: %v\n", time.Since(start))
+			stateMachine.printProgress("duration: %v\n", duration)
 		}
+		progress.stateFinished(i, stateFunc.name, duration, err)
 		if err != nil {
 			// clean up work dir on error
 			cleanupErr := stateMachine.cleanup()
@@ -461,7 +582,8 @@ func (stateMachine *StateMachine) Run() error {
 			}
 			return err
 		}
-		stateMachine.StepsTaken++
+		stateMachine.StatesTaken = append(stateMachine.StatesTaken, stateFunc.name)
+		stateMachine.StateTimings = append(stateMachine.StateTimings, stateTiming{stateFunc.name, duration})
 		if stateFunc.name == stateMachine.stateMachineFlags.Thru {
 			break
 		}
@@ -471,7 +593,8 @@ func (stateMachine *StateMachine) Run() error {
 
 // Teardown handles anything else that needs to happen after the states have finished running
 func (stateMachine *StateMachine) Teardown() error {
-	if stateMachine.cleanWorkDir {
+	// the states skipped by --dry-run leave nothing to resume
+	if stateMachine.cleanWorkDir || stateMachine.stateMachineFlags.DryRun {
 		return stateMachine.cleanup()
 	}
 	return stateMachine.writeMetadata(metadataStateFile)
@@ -130,9 +130,15 @@ func mockOpenFileAppend(name string, flag int, perm os.FileMode) (*os.File, erro
 func mockRemoveAll(string) error {
 	return fmt.Errorf("Test error")
 }
+func mockRemove(string) error {
+	return fmt.Errorf("Test error")
+}
 func mockRename(string, string) error {
 	return fmt.Errorf("Test error")
 }
+func mockStat(string) (os.FileInfo, error) {
+	return nil, fmt.Errorf("Test error")
+}
 func mockTruncate(string, int64) error {
 	return fmt.Errorf("Test error")
 }
@@ -221,16 +227,52 @@ func TestExecHelperProcess(t *testing.T) {
 		fmt.Fprint(os.Stdout, "foo 1.2\nbar 1.4-1ubuntu4.1\nlibbaz 0.1.3ubuntu2\n")
 	case "TestGenerateFilelist":
 		fmt.Fprint(os.Stdout, "/root\n/home\n/var")
+	case "TestGenerateSBOM":
+		fmt.Fprint(os.Stdout, "installed\tfoo\t1.2\tamd64\tfoo-src\t1.2-1\n"+
+			"config-files\tgone\t0.1\tamd64\tgone\t0.1\n"+
+			"installed\tbar\t1.4-1ubuntu4.1\tall\tbar\t1.4-1ubuntu4.1\n"+
+			"installed\tlibbaz\t0.1.3ubuntu2\tamd64\tbaz\t0.1.3ubuntu2\n")
+	case "TestSignArtifacts":
+		// write the signing tool, its input and the cosign password as the signature
+		stdin, _ := io.ReadAll(os.Stdin)
+		for i, arg := range args {
+			if arg == "-x" || arg == "--output-signature" {
+				signature := fmt.Sprintf("%s %s%s", args[0], stdin, os.Getenv("COSIGN_PASSWORD"))
+				_ = os.WriteFile(args[i+1], []byte(signature), 0600)
+			}
+		}
+	case "TestUserHome":
+		fmt.Fprint(os.Stdout, "ubuntu:x:1000:1000:Ubuntu:/home/ubuntu:/bin/bash\n")
+	case "TestUserHomeBadEntry":
+		fmt.Fprint(os.Stdout, "ubuntu:x:1000\n")
 	case "TestFailedPreseedClassicImage":
 		fallthrough
 	case "TestFailedUpdateGrubLosetup":
 		fallthrough
-	case "TestFailedMakeQcow2Image":
+	case "TestFailedMakeSquashfsLayers":
+		fallthrough
+	case "TestFailedCopyQemuStatic":
+		fallthrough
+	case "TestFailedManualChown":
+		fallthrough
+	case "TestFailedUserHome":
+		fallthrough
+	case "TestFailedAddSudoRule":
+		fallthrough
+	case "TestFailedMakeISOBIOSImage":
+		fallthrough
+	case "TestFailedMakeISO":
 		fallthrough
 	case "TestFailedGeneratePackageManifest":
 		fallthrough
 	case "TestFailedGenerateFilelist":
 		fallthrough
+	case "TestFailedGenerateSBOM":
+		fallthrough
+	case "TestFailedReproducibleFilesystem":
+		fallthrough
+	case "TestFailedSignArtifacts":
+		fallthrough
 	case "TestFailedGerminate":
 		fallthrough
 	case "TestFailedSetupLiveBuildCommands":
@@ -826,12 +868,12 @@ func TestStateMachine_readMetadata(t *testing.T) {
 					WorkDir: filepath.Join(testDataDir, "metadata"),
 				},
 				CurrentStep:  "",
-				StepsTaken:   2,
+				StatesTaken:  []string{"make_temporary_directories", "prepare_gadget_tree"},
 				YamlFilePath: "/tmp/ubuntu-image-2329554237/unpack/gadget/meta/gadget.yaml",
 				IsSeeded:     true,
 				SectorSize:   quantity.Size(512),
 				RootfsSize:   quantity.Size(775915520),
-				states:       allTestStates[2:],
+				states:       allTestStates,
 				GadgetInfo: &gadget.Info{
 					Volumes: map[string]*gadget.Volume{
 						"pc": {
@@ -860,11 +902,13 @@ func TestStateMachine_readMetadata(t *testing.T) {
 				},
 				ImageSizes:  map[string]quantity.Size{"pc": 3155165184},
 				VolumeOrder: []string{"pc"},
-				VolumeNames: nil,
+				VolumeNames: map[string]string{"pc": "pc.img"},
 				tempDirs: temporaryDirectories{
 					rootfs:  filepath.Join(testDataDir, "metadata", "root"),
 					unpack:  filepath.Join(testDataDir, "metadata", "unpack"),
 					volumes: filepath.Join(testDataDir, "metadata", "volumes"),
+					chroot:  filepath.Join(testDataDir, "metadata", "chroot"),
+					scratch: filepath.Join(testDataDir, "metadata", "scratch"),
 				},
 			},
 			shouldPass: true,
@@ -915,6 +959,36 @@ func TestStateMachine_readMetadata(t *testing.T) {
 			shouldPass:       false,
 			expectedError:    "invalid steps taken count",
 		},
+		{
+			name: "state file with an older format version",
+			args: args{
+				metadataFile: "old_version.json",
+				resume:       true,
+			},
+			wantStateMachine: nil,
+			shouldPass:       false,
+			expectedError:    "metadata file was written with format version 0",
+		},
+		{
+			name: "state file with different states",
+			args: args{
+				metadataFile: "different_states.json",
+				resume:       true,
+			},
+			wantStateMachine: nil,
+			shouldPass:       false,
+			expectedError:    "do not match the states of this build",
+		},
+		{
+			name: "state file with different states taken",
+			args: args{
+				metadataFile: "different_states_taken.json",
+				resume:       true,
+			},
+			wantStateMachine: nil,
+			shouldPass:       false,
+			expectedError:    "state \"prepare_image\" of the partial run does not match",
+		},
 	}
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
@@ -952,12 +1026,12 @@ func TestStateMachine_writeMetadata(t *testing.T) {
 					WorkDir: filepath.Join(testDataDir, "metadata"),
 				},
 				CurrentStep:  "",
-				StepsTaken:   2,
+				StatesTaken:  []string{"make_temporary_directories", "prepare_gadget_tree"},
 				YamlFilePath: "/tmp/ubuntu-image-2329554237/unpack/gadget/meta/gadget.yaml",
 				IsSeeded:     true,
 				SectorSize:   quantity.Size(512),
 				RootfsSize:   quantity.Size(775915520),
-				states:       allTestStates[2:],
+				states:       allTestStates,
 				GadgetInfo: &gadget.Info{
 					Volumes: map[string]*gadget.Volume{
 						"pc": {
@@ -1010,7 +1084,7 @@ func TestStateMachine_writeMetadata(t *testing.T) {
 					},
 				},
 				CurrentStep:  "",
-				StepsTaken:   2,
+				StatesTaken:  []string{"make_temporary_directories", "prepare_gadget_tree"},
 				YamlFilePath: "/tmp/ubuntu-image-2329554237/unpack/gadget/meta/gadget.yaml",
 			},
 			shouldPass:    false,
@@ -1024,7 +1098,7 @@ func TestStateMachine_writeMetadata(t *testing.T) {
 					WorkDir: filepath.Join("non-existent", "metadata"),
 				},
 				CurrentStep:  "",
-				StepsTaken:   2,
+				StatesTaken:  []string{"make_temporary_directories", "prepare_gadget_tree"},
 				YamlFilePath: "/tmp/ubuntu-image-2329554237/unpack/gadget/meta/gadget.yaml",
 			},
 			shouldPass:    false,
@@ -0,0 +1,243 @@
+package statemachine
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/mvo5/goconfigparser"
+	"github.com/snapcore/snapd/asserts"
+	"github.com/snapcore/snapd/overlord/auth"
+	"github.com/snapcore/snapd/snapdenv"
+	"github.com/snapcore/snapd/store"
+	"github.com/snapcore/snapd/store/tooling"
+)
+
+// defaultSnapStoreID is the store of the snaps of image definitions which
+// do not name one
+const defaultSnapStoreID = "canonical"
+
+// snapStoreConfig is the snap store, or snap store proxy, the snaps of the
+// image are pulled from. Empty values mean the defaults of snapd
+type snapStoreConfig struct {
+	URL      string
+	ID       string
+	AuthFile string
+}
+
+// snapStore returns the store of classic images. The store of every extra
+// snap naming one must be the store of the image, as all the snaps are
+// pulled from the same store
+func (classicStateMachine *ClassicStateMachine) snapStore() (snapStoreConfig, error) {
+	var storeConfig snapStoreConfig
+	if imageStore := classicStateMachine.ImageDef.Store; imageStore != nil {
+		storeConfig = snapStoreConfig{URL: imageStore.StoreURL, ID: imageStore.StoreID, AuthFile: imageStore.AuthFile}
+		if storeConfig.AuthFile != "" && !filepath.IsAbs(storeConfig.AuthFile) {
+			storeConfig.AuthFile = filepath.Join(classicStateMachine.ConfDefPath, storeConfig.AuthFile)
+		}
+	}
+	if classicStateMachine.ImageDef.Customization == nil {
+		return storeConfig, nil
+	}
+	for _, extraSnap := range classicStateMachine.ImageDef.Customization.ExtraSnaps {
+		if extraSnap.Store == "" || extraSnap.Store == defaultSnapStoreID || extraSnap.Store == storeConfig.ID {
+			continue
+		}
+		if storeConfig.ID != "" {
+			return storeConfig, fmt.Errorf("Snap %s is from store \"%s\" but the other snaps of the image are "+
+				"from store \"%s\". The snaps of an image must all come from the same store",
+				extraSnap.SnapName, extraSnap.Store, storeConfig.ID)
+		}
+		storeConfig.ID = extraSnap.Store
+	}
+	return storeConfig, nil
+}
+
+// snapStore returns the store of snap images given on the command line. The
+// store ID of snap images is the one of their model assertion
+func (snapStateMachine *SnapStateMachine) snapStore() snapStoreConfig {
+	return snapStoreConfig{URL: snapStateMachine.Opts.StoreURL, AuthFile: snapStateMachine.Opts.StoreAuthFile}
+}
+
+// storeSnapBase gets the base of a snap from the store
+func (storeConfig snapStoreConfig) storeSnapBase(name string) (string, error) {
+	cfg := store.DefaultConfig()
+	cfg.StoreID = storeConfig.ID
+	if storeConfig.URL != "" {
+		storeURL, err := url.Parse(storeConfig.URL)
+		if err != nil {
+			return "", fmt.Errorf("invalid store URL \"%s\": %s", storeConfig.URL, err.Error())
+		}
+		cfg.StoreBaseURL = storeURL
+	}
+	if storeConfig.AuthFile != "" {
+		authorizer, err := storeAuthorizer(storeConfig.AuthFile)
+		if err != nil {
+			return "", err
+		}
+		cfg.Authorizer = authorizer
+	}
+	snapInfo, err := store.New(cfg, nil).SnapInfo(context.Background(), store.SnapSpec{Name: name}, nil)
+	if err != nil {
+		return "", err
+	}
+	return snapInfo.Base, nil
+}
+
+// storeAuthorizer returns the authorizer of the requests to the store made
+// with the credentials of authFile. It reads the formats read by the tooling
+// store of snapd: the base64 encoded credentials exported by snapcraft 7 and
+// later, the JSON credentials and the login files of older snapcraft
+func storeAuthorizer(authFile string) (store.Authorizer, error) {
+	data, err := osReadFile(authFile)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading store credentials: %s", err.Error())
+	}
+	data = bytes.TrimSpace(data)
+	if len(data) == 0 {
+		return nil, fmt.Errorf("Error reading store credentials: %s is empty", authFile)
+	}
+
+	// base64 encoded JSON of snapcraft 7 and later
+	if decoded, err := base64.StdEncoding.DecodeString(string(data)); err == nil {
+		var creds struct {
+			Type  string          `json:"t"`
+			Value json.RawMessage `json:"v"`
+			R     string          `json:"r"`
+			D     string          `json:"d"`
+		}
+		if err := json.Unmarshal(decoded, &creds); err == nil {
+			var value string
+			switch creds.Type {
+			case "u1-macaroon":
+				var u1Creds struct {
+					R string `json:"r"`
+					D string `json:"d"`
+				}
+				if json.Unmarshal(creds.Value, &u1Creds) == nil && u1Creds.R != "" && u1Creds.D != "" {
+					return ubuntuOneAuthorizer(u1Creds.R, []string{u1Creds.D}), nil
+				}
+			case "macaroon", "bearer":
+				if json.Unmarshal(creds.Value, &value) == nil && value != "" {
+					scheme := strings.ToUpper(creds.Type[:1]) + creds.Type[1:]
+					return &tooling.SimpleCreds{Scheme: scheme, Value: value}, nil
+				}
+			default:
+				if creds.R != "" && creds.D != "" {
+					return ubuntuOneAuthorizer(creds.R, []string{creds.D}), nil
+				}
+			}
+		}
+	}
+
+	// JSON credentials
+	var jsonCreds struct {
+		Macaroon   string   `json:"macaroon"`
+		Discharges []string `json:"discharges"`
+	}
+	if json.Unmarshal(data, &jsonCreds) == nil && jsonCreds.Macaroon != "" && len(jsonCreds.Discharges) > 0 {
+		return ubuntuOneAuthorizer(jsonCreds.Macaroon, jsonCreds.Discharges), nil
+	}
+
+	// login files of snapcraft before version 7
+	loginFile := goconfigparser.New()
+	if loginFile.ReadString(string(data)) == nil {
+		section := "login.ubuntu.com"
+		if snapdenv.UseStagingStore() {
+			section = "login.staging.ubuntu.com"
+		}
+		macaroon, macaroonErr := loginFile.Get(section, "macaroon")
+		discharge, dischargeErr := loginFile.Get(section, "unbound_discharge")
+		if macaroonErr == nil && dischargeErr == nil && macaroon != "" && discharge != "" {
+			return ubuntuOneAuthorizer(macaroon, []string{discharge}), nil
+		}
+	}
+
+	return nil, fmt.Errorf("Error reading store credentials: %s is not in a known format", authFile)
+}
+
+// ubuntuOneAuthorizer returns the authorizer of Ubuntu One credentials
+func ubuntuOneAuthorizer(macaroon string, discharges []string) store.Authorizer {
+	return &tooling.UbuntuOneCreds{User: auth.UserState{
+		StoreMacaroon:   macaroon,
+		StoreDischarges: discharges,
+	}}
+}
+
+// checkModelStore checks that the model assertion of the image is for the
+// store of its snaps. image.Prepare stages the snaps from the store of the
+// model assertion, and from the Snap Store without one
+func checkModelStore(storeConfig snapStoreConfig, modelFile string) error {
+	if storeConfig.ID == "" || storeConfig.ID == defaultSnapStoreID {
+		return nil
+	}
+	if modelFile == "" {
+		return fmt.Errorf("The snaps of the image are from store \"%s\", which requires a model "+
+			"assertion for this store", storeConfig.ID)
+	}
+	modelData, err := osReadFile(modelFile)
+	if err != nil {
+		return fmt.Errorf("Error reading model assertion: %s", err.Error())
+	}
+	assertion, err := asserts.Decode(modelData)
+	if err != nil {
+		return fmt.Errorf("Error decoding model assertion: %s", err.Error())
+	}
+	model, ok := assertion.(*asserts.Model)
+	if !ok {
+		return fmt.Errorf("%s is not a model assertion", modelFile)
+	}
+	if model.Store() != storeConfig.ID {
+		return fmt.Errorf("The snaps of the image are from store \"%s\" but the model assertion "+
+			"is for store \"%s\"", storeConfig.ID, model.Store())
+	}
+	return nil
+}
+
+// setStoreEnv sets the variables of the environment configuring the store
+// used by image.Prepare, as its tooling store is only configured through
+// them and the model assertion. Empty values leave a variable untouched. It
+// returns a function restoring the previous values
+func setStoreEnv(storeURL string, authFile string) func() {
+	var restoreFuncs []func()
+	for name, value := range map[string]string{
+		"UBUNTU_STORE_URL":                storeURL,
+		"UBUNTU_STORE_AUTH_DATA_FILENAME": authFile,
+	} {
+		if value == "" {
+			continue
+		}
+		name := name
+		oldValue, hadValue := os.LookupEnv(name)
+		os.Setenv(name, value)
+		restoreFuncs = append(restoreFuncs, func() {
+			if hadValue {
+				os.Setenv(name, oldValue)
+			} else {
+				os.Unsetenv(name)
+			}
+		})
+	}
+	return func() {
+		for _, restoreFunc := range restoreFuncs {
+			restoreFunc()
+		}
+	}
+}
+
+// useSnapStore points image.Prepare to the URL and credentials of the store.
+// It returns a function restoring the previous configuration
+func useSnapStore(storeConfig snapStoreConfig) (func(), error) {
+	if storeConfig.AuthFile != "" {
+		if _, err := os.Stat(storeConfig.AuthFile); err != nil {
+			return nil, fmt.Errorf("Error reading store credentials: %s", err.Error())
+		}
+	}
+	return setStoreEnv(storeConfig.URL, storeConfig.AuthFile), nil
+}
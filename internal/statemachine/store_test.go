@@ -0,0 +1,239 @@
+package statemachine
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/snapcore/snapd/overlord/auth"
+	"github.com/snapcore/snapd/store/tooling"
+
+	"github.com/canonical/ubuntu-image/internal/helper"
+	"github.com/canonical/ubuntu-image/internal/imagedefinition"
+)
+
+// TestClassicSnapStore tests that the store of classic images is the one of
+// the image definition or of its extra snaps
+func TestClassicSnapStore(t *testing.T) {
+	testCases := []struct {
+		name          string
+		store         *imagedefinition.Store
+		snapStores    []string
+		expected      snapStoreConfig
+		expectedError string
+	}{
+		{"default", nil, []string{"canonical", ""}, snapStoreConfig{}, ""},
+		{
+			"image_store",
+			&imagedefinition.Store{StoreURL: "https://proxy.example.com/", StoreID: "brand", AuthFile: "store.auth"},
+			[]string{"canonical", "brand"},
+			snapStoreConfig{URL: "https://proxy.example.com/", ID: "brand", AuthFile: "/images/store.auth"},
+			"",
+		},
+		{"snap_store", nil, []string{"canonical", "brand", "brand"}, snapStoreConfig{ID: "brand"}, ""},
+		{
+			"absolute_auth_file",
+			&imagedefinition.Store{AuthFile: "/etc/store.auth"},
+			nil,
+			snapStoreConfig{AuthFile: "/etc/store.auth"},
+			"",
+		},
+		{"several_snap_stores", nil, []string{"brand", "other"}, snapStoreConfig{},
+			"Snap snap1 is from store \"other\" but the other snaps of the image are from store \"brand\""},
+		{"snap_and_image_stores", &imagedefinition.Store{StoreID: "brand"}, []string{"other"}, snapStoreConfig{},
+			"Snap snap0 is from store \"other\""},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			var stateMachine ClassicStateMachine
+			stateMachine.ConfDefPath = "/images"
+			stateMachine.ImageDef = imagedefinition.ImageDefinition{
+				Store:         tc.store,
+				Customization: &imagedefinition.Customization{},
+			}
+			for i, snapStore := range tc.snapStores {
+				stateMachine.ImageDef.Customization.ExtraSnaps = append(stateMachine.ImageDef.Customization.ExtraSnaps,
+					&imagedefinition.Snap{SnapName: fmt.Sprintf("snap%d", i), Store: snapStore})
+			}
+
+			storeConfig, err := stateMachine.snapStore()
+			if tc.expectedError != "" {
+				asserter.AssertErrContains(err, tc.expectedError)
+				return
+			}
+			asserter.AssertErrNil(err, true)
+			asserter.AssertEqual(tc.expected, storeConfig)
+		})
+	}
+}
+
+// TestUseSnapStore tests that the store is configured in the environment of
+// image.Prepare and restored afterwards
+func TestUseSnapStore(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	authFile := filepath.Join(t.TempDir(), "store.auth")
+	err := os.WriteFile(authFile, []byte("credentials"), 0600)
+	asserter.AssertErrNil(err, true)
+	t.Setenv("UBUNTU_STORE_URL", "https://store.example.com/")
+	// the variable is restored by t.Setenv once unset
+	t.Setenv("UBUNTU_STORE_AUTH_DATA_FILENAME", "")
+	os.Unsetenv("UBUNTU_STORE_AUTH_DATA_FILENAME")
+
+	restore, err := useSnapStore(snapStoreConfig{URL: "https://proxy.example.com/", AuthFile: authFile})
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual("https://proxy.example.com/", os.Getenv("UBUNTU_STORE_URL"))
+	asserter.AssertEqual(authFile, os.Getenv("UBUNTU_STORE_AUTH_DATA_FILENAME"))
+	restore()
+	asserter.AssertEqual("https://store.example.com/", os.Getenv("UBUNTU_STORE_URL"))
+	if _, ok := os.LookupEnv("UBUNTU_STORE_AUTH_DATA_FILENAME"); ok {
+		t.Errorf("Expected UBUNTU_STORE_AUTH_DATA_FILENAME to be unset")
+	}
+
+	// without a store configuration the environment is left untouched
+	restore, err = useSnapStore(snapStoreConfig{})
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual("https://store.example.com/", os.Getenv("UBUNTU_STORE_URL"))
+	restore()
+	asserter.AssertEqual("https://store.example.com/", os.Getenv("UBUNTU_STORE_URL"))
+}
+
+// TestCheckModelStore tests that snaps from another store than the Snap
+// Store require a model assertion for their store
+func TestCheckModelStore(t *testing.T) {
+	modelData, err := os.ReadFile(filepath.Join("testdata", "modelAssertionClassic"))
+	if err != nil {
+		t.Fatalf("Error reading model assertion: %s", err.Error())
+	}
+	brandModel := filepath.Join(t.TempDir(), "brand.model")
+	err = os.WriteFile(brandModel, bytes.Replace(modelData, []byte("classic: true\n"),
+		[]byte("classic: true\nstore: brand\n"), 1), 0644)
+	if err != nil {
+		t.Fatalf("Error writing model assertion: %s", err.Error())
+	}
+
+	testCases := []struct {
+		name          string
+		storeID       string
+		modelFile     string
+		expectedError string
+	}{
+		{"snap_store", "", "", ""},
+		{"canonical", "canonical", "", ""},
+		{"brand_store", "brand", brandModel, ""},
+		{"without_model", "brand", "", "which requires a model assertion for this store"},
+		{"other_store", "other", brandModel, "but the model assertion is for store \"brand\""},
+		{"missing_model", "brand", "/nonexistent/brand.model", "Error reading model assertion"},
+		{"not_an_assertion", "brand", filepath.Join("testdata", "image_definitions", "test_amd64.yaml"),
+			"Error decoding model assertion"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			err := checkModelStore(snapStoreConfig{ID: tc.storeID}, tc.modelFile)
+			if tc.expectedError != "" {
+				asserter.AssertErrContains(err, tc.expectedError)
+				return
+			}
+			asserter.AssertErrNil(err, true)
+		})
+	}
+}
+
+// TestStoreAuthorizer tests that the store credentials are read in the
+// formats snapcraft exports them
+func TestStoreAuthorizer(t *testing.T) {
+	testCases := []struct {
+		name           string
+		credentials    string
+		expectedHeader string
+		expectedUser   *auth.UserState
+	}{
+		{"bearer", base64.StdEncoding.EncodeToString([]byte(`{"t": "bearer", "v": "secret"}`)), "Bearer secret", nil},
+		{"macaroon", base64.StdEncoding.EncodeToString([]byte(`{"t": "macaroon", "v": "secret"}`)) + "\n", "Macaroon secret", nil},
+		{"u1_macaroon", base64.StdEncoding.EncodeToString([]byte(`{"t": "u1-macaroon", "v": {"r": "root", "d": "discharge"}}`)), "",
+			&auth.UserState{StoreMacaroon: "root", StoreDischarges: []string{"discharge"}}},
+		{"json", `{"macaroon": "root", "discharges": ["discharge"]}`, "",
+			&auth.UserState{StoreMacaroon: "root", StoreDischarges: []string{"discharge"}}},
+		{"snapcraft_login", "[login.ubuntu.com]\nmacaroon = root\nunbound_discharge = discharge\n", "",
+			&auth.UserState{StoreMacaroon: "root", StoreDischarges: []string{"discharge"}}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			authFile := filepath.Join(t.TempDir(), "store.auth")
+			err := os.WriteFile(authFile, []byte(tc.credentials), 0600)
+			asserter.AssertErrNil(err, true)
+
+			authorizer, err := storeAuthorizer(authFile)
+			asserter.AssertErrNil(err, true)
+			if tc.expectedUser != nil {
+				asserter.AssertEqual(&tooling.UbuntuOneCreds{User: *tc.expectedUser}, authorizer)
+				return
+			}
+			req, err := http.NewRequest(http.MethodGet, "https://store.example.com/", nil)
+			asserter.AssertErrNil(err, true)
+			err = authorizer.Authorize(req, nil, nil, nil)
+			asserter.AssertErrNil(err, true)
+			asserter.AssertEqual(tc.expectedHeader, req.Header.Get("Authorization"))
+		})
+	}
+}
+
+// TestFailedStoreAuthorizer tests the failures of reading the store credentials
+func TestFailedStoreAuthorizer(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	_, err := storeAuthorizer("/nonexistent/store.auth")
+	asserter.AssertErrContains(err, "Error reading store credentials")
+
+	for _, credentials := range []string{"", "not credentials", `{"macaroon": "root"}`} {
+		authFile := filepath.Join(t.TempDir(), "store.auth")
+		err = os.WriteFile(authFile, []byte(credentials), 0600)
+		asserter.AssertErrNil(err, true)
+		_, err = storeAuthorizer(authFile)
+		asserter.AssertErrContains(err, "Error reading store credentials")
+	}
+}
+
+// TestStoreSnapBaseAuth tests that the base of the snaps is looked up with
+// the store credentials
+func TestStoreSnapBaseAuth(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"name": "hello", "snap-id": "hello-id", ` +
+			`"channel-map": [{"channel": {"name": "stable", "track": "latest", "risk": "stable", "architecture": "amd64"}, ` +
+			`"revision": 1, "version": "1.0", "type": "app"}], ` +
+			`"snap": {"name": "hello", "snap-id": "hello-id", "base": "core22"}}`))
+	}))
+	t.Cleanup(server.Close)
+
+	authFile := filepath.Join(t.TempDir(), "store.auth")
+	err := os.WriteFile(authFile, []byte(base64.StdEncoding.EncodeToString([]byte(`{"t": "bearer", "v": "secret"}`))), 0600)
+	asserter.AssertErrNil(err, true)
+
+	base, err := snapStoreConfig{URL: server.URL + "/", AuthFile: authFile}.storeSnapBase("hello")
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual("core22", base)
+
+	_, err = snapStoreConfig{URL: server.URL + "/"}.storeSnapBase("hello")
+	if err == nil {
+		t.Errorf("Expected the lookup without credentials to fail")
+	}
+}
+
+// TestFailedUseSnapStore tests the failures of configuring the store
+func TestFailedUseSnapStore(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	_, err := useSnapStore(snapStoreConfig{AuthFile: "/nonexistent/store.auth"})
+	asserter.AssertErrContains(err, "Error reading store credentials")
+}
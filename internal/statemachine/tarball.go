@@ -0,0 +1,177 @@
+package statemachine
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// how many times downloading a tarball is attempted, and how long to wait
+// before the first retry. The delay doubles with every retry
+var tarballDownloadAttempts = 3
+var tarballRetryDelay = 2 * time.Second
+
+// how long a download attempt may take. An attempt interrupted by the
+// timeout is resumed by the next one
+var tarballDownloadTimeout = 30 * time.Minute
+
+// isHTTPURL checks whether a URL has to be downloaded
+func isHTTPURL(url string) bool {
+	return strings.HasPrefix(url, "http://") || strings.HasPrefix(url, "https://")
+}
+
+// localTarballFile returns the local path of a file of the tarball section of
+// the image definition. http(s) URLs are downloaded into the tarball
+// directory of the workdir, named after a hash of the URL, other paths are
+// relative to the image definition. A file downloaded by a previous run is
+// only reused when its sha256 sum matches sha256sum
+func (stateMachine *StateMachine) localTarballFile(url string, sha256sum string) (string, error) {
+	if !isHTTPURL(url) {
+		localPath := strings.TrimPrefix(url, "file://")
+		if !filepath.IsAbs(localPath) {
+			localPath = filepath.Join(stateMachine.ConfDefPath, localPath)
+		}
+		return localPath, nil
+	}
+
+	tarballDir := filepath.Join(stateMachine.stateMachineFlags.WorkDir, "tarball")
+	if err := osMkdirAll(tarballDir, 0755); err != nil {
+		return "", fmt.Errorf("Error creating tarball directory: %s", err.Error())
+	}
+	// the name is unique to the whole URL, so that files with the same
+	// name at different URLs are not mistaken for one another. It ends
+	// with the name of the file for readability
+	localName := fmt.Sprintf("%x-%s", sha256.Sum256([]byte(url)), path.Base(strings.SplitN(url, "?", 2)[0]))
+	localPath := filepath.Join(tarballDir, localName)
+	// a previous run of the state, interrupted after the download, is
+	// resumed when the downloaded file is known to be the expected one.
+	// Otherwise the file may have changed at the URL since, and it is
+	// downloaded again
+	if _, err := os.Stat(localPath); err == nil {
+		if sha256sum != "" {
+			localSHA256, err := fileSHA256(localPath)
+			if err != nil {
+				return "", err
+			}
+			if strings.EqualFold(localSHA256, sha256sum) {
+				return localPath, nil
+			}
+		}
+		if err := osRemove(localPath); err != nil {
+			return "", fmt.Errorf("Error removing previously downloaded file \"%s\": %s",
+				localPath, err.Error())
+		}
+	}
+	if err := stateMachine.downloadFile(url, localPath); err != nil {
+		return "", err
+	}
+	return localPath, nil
+}
+
+// downloadFile downloads url to localPath, retrying on network and server
+// errors. The data is written to localPath.part first, so that a failed
+// download is resumed from where it stopped
+func (stateMachine *StateMachine) downloadFile(url string, localPath string) error {
+	partPath := localPath + ".part"
+	delay := tarballRetryDelay
+	var err error
+	for attempt := 1; attempt <= tarballDownloadAttempts; attempt++ {
+		if attempt > 1 {
+			stateMachine.warn("Error downloading %s, retrying in %s: %s", url, delay, err.Error())
+			time.Sleep(delay)
+			delay *= 2
+		}
+		var retry bool
+		retry, err = downloadAttempt(url, partPath)
+		if err == nil {
+			break
+		}
+		if !retry {
+			return fmt.Errorf("Error downloading %s: %s", url, err.Error())
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("Error downloading %s after %d attempts: %s", url, tarballDownloadAttempts, err.Error())
+	}
+	if err := osRename(partPath, localPath); err != nil {
+		return fmt.Errorf("Error moving downloaded file to %s: %s", localPath, err.Error())
+	}
+	return nil
+}
+
+// downloadAttempt downloads url to partPath, resuming from the data already
+// in partPath if the server supports it. It returns whether the download is
+// worth retrying when it fails
+func downloadAttempt(url string, partPath string) (bool, error) {
+	var offset int64
+	if info, err := os.Stat(partPath); err == nil {
+		offset = info.Size()
+	}
+
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return false, err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	resp, err := httpDo(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+
+	flags := os.O_CREATE | os.O_WRONLY
+	switch {
+	case resp.StatusCode == http.StatusPartialContent:
+		flags |= os.O_APPEND
+	case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable && offset > 0:
+		// the whole file was downloaded already
+		return false, nil
+	case resp.StatusCode == http.StatusOK:
+		// the server ignored the range, start over
+		flags |= os.O_TRUNC
+	case resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests:
+		return true, fmt.Errorf("server returned %s", resp.Status)
+	default:
+		return false, fmt.Errorf("server returned %s", resp.Status)
+	}
+
+	partFile, err := osOpenFile(partPath, flags, 0644)
+	if err != nil {
+		return false, err
+	}
+	defer partFile.Close()
+	if _, err := io.Copy(partFile, resp.Body); err != nil {
+		return true, err
+	}
+	return false, nil
+}
+
+// verifyTarballSignature verifies the detached GPG signature of the tarball
+// with the keys of keyring. Without a keyring, gpgv uses its default
+// trustedkeys.gpg keyring
+func (stateMachine *StateMachine) verifyTarballSignature(tarPath string, signaturePath string, keyring string) error {
+	gpgvArgs := []string{}
+	if keyring != "" {
+		// gpgv looks for keyrings without a slash in its home directory
+		keyring, err := filepath.Abs(keyring)
+		if err != nil {
+			return fmt.Errorf("Error getting absolute path of keyring: %s", err.Error())
+		}
+		gpgvArgs = append(gpgvArgs, "--keyring", keyring)
+	}
+	gpgvCmd := execCommand("gpgv", append(gpgvArgs, signaturePath, tarPath)...)
+	gpgvOutput := setCommandOutput(gpgvCmd, stateMachine.commonFlags.Debug)
+	if err := gpgvCmd.Run(); err != nil {
+		return fmt.Errorf("Error verifying the GPG signature of rootfs tarball \"%s\": %s. Output is:\n%s",
+			tarPath, err.Error(), gpgvOutput.String())
+	}
+	return nil
+}
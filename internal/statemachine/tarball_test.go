@@ -0,0 +1,267 @@
+package statemachine
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/canonical/ubuntu-image/internal/helper"
+	"github.com/canonical/ubuntu-image/internal/imagedefinition"
+)
+
+// signTarball signs the tarball with a new GPG key. It returns the detached
+// signature and a keyring holding the public key
+func signTarball(t *testing.T, tarPath string) (string, string) {
+	t.Helper()
+	_, homeDir := newGPGKey(t, "")
+	gpgArgs := []string{"--homedir", homeDir, "--batch", "--pinentry-mode", "loopback", "--passphrase", ""}
+	signature := filepath.Join(t.TempDir(), "rootfs.tar.gpg")
+	signCmd := exec.Command("gpg", append(gpgArgs, "--output", signature, "--detach-sign", tarPath)...)
+	if output, err := signCmd.CombinedOutput(); err != nil {
+		t.Fatalf("Error signing the tarball: %s\n%s", err.Error(), output)
+	}
+	keyring := filepath.Join(t.TempDir(), "keyring.gpg")
+	exportCmd := exec.Command("gpg", append(gpgArgs, "--output", keyring, "--export")...)
+	if output, err := exportCmd.CombinedOutput(); err != nil {
+		t.Fatalf("Error exporting the public key: %s\n%s", err.Error(), output)
+	}
+	return signature, keyring
+}
+
+// TestExtractRootfsTarHTTP tests that tarballs and their signature are
+// downloaded, resuming interrupted downloads, and verified
+func TestExtractRootfsTarHTTP(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	saveDelay := tarballRetryDelay
+	tarballRetryDelay = 0
+	t.Cleanup(func() { tarballRetryDelay = saveDelay })
+
+	tarPath, err := filepath.Abs(filepath.Join("testdata", "rootfs_tarballs", "rootfs.tar"))
+	asserter.AssertErrNil(err, true)
+	tarData, err := os.ReadFile(tarPath)
+	asserter.AssertErrNil(err, true)
+	signature, keyring := signTarball(t, tarPath)
+
+	// the first download of the tarball is interrupted halfway
+	var lock sync.Mutex
+	var ranges []string
+	interrupted := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/rootfs.tar":
+			lock.Lock()
+			ranges = append(ranges, r.Header.Get("Range"))
+			interrupt := !interrupted
+			interrupted = true
+			lock.Unlock()
+			if interrupt {
+				w.Header().Set("Content-Length", strconv.Itoa(len(tarData)))
+				_, _ = w.Write(tarData[:len(tarData)/2])
+				panic(http.ErrAbortHandler)
+			}
+			http.ServeContent(w, r, "rootfs.tar", time.Time{}, strings.NewReader(string(tarData)))
+		case "/rootfs.tar.gpg":
+			http.ServeFile(w, r, signature)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	var stateMachine ClassicStateMachine
+	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+	stateMachine.parent = &stateMachine
+	stateMachine.commonFlags.Quiet = true
+	stateMachine.ConfDefPath = t.TempDir()
+	stateMachine.ImageDef = imagedefinition.ImageDefinition{
+		Rootfs: &imagedefinition.Rootfs{Tarball: &imagedefinition.Tarball{
+			TarballURL: server.URL + "/rootfs.tar",
+			GPG:        server.URL + "/rootfs.tar.gpg",
+			Keyring:    keyring,
+			SHA256sum:  "EC01FD8488B0F35D2CA69E6F82EDFAECEF5725DA70913BAB61240419CE574918",
+		}},
+	}
+	err = stateMachine.makeTemporaryDirectories()
+	asserter.AssertErrNil(err, true)
+	t.Cleanup(func() { os.RemoveAll(stateMachine.stateMachineFlags.WorkDir) })
+	err = stateMachine.extractRootfsTar()
+	asserter.AssertErrNil(err, true)
+
+	asserter.AssertEqual([]string{"", "bytes=" + strconv.Itoa(len(tarData)/2) + "-"}, ranges)
+	for _, testFile := range []string{"test_tar1", "test_tar2"} {
+		if _, err := os.Stat(filepath.Join(stateMachine.tempDirs.chroot, testFile)); err != nil {
+			t.Errorf("File %s should be in chroot, but is missing", testFile)
+		}
+	}
+	tarballName := fmt.Sprintf("%x-rootfs.tar", sha256.Sum256([]byte(server.URL+"/rootfs.tar")))
+	downloaded, err := os.ReadFile(filepath.Join(stateMachine.stateMachineFlags.WorkDir, "tarball", tarballName))
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual(tarData, downloaded)
+
+	// a signature made with another key is rejected, and the keyring is
+	// relative to the image definition
+	_, otherKeyring := signTarball(t, tarPath)
+	otherKeyringData, err := os.ReadFile(otherKeyring)
+	asserter.AssertErrNil(err, true)
+	var otherStateMachine ClassicStateMachine
+	otherStateMachine.commonFlags, otherStateMachine.stateMachineFlags = helper.InitCommonOpts()
+	otherStateMachine.parent = &otherStateMachine
+	otherStateMachine.commonFlags.Quiet = true
+	otherStateMachine.ConfDefPath = t.TempDir()
+	otherStateMachine.ImageDef = imagedefinition.ImageDefinition{
+		Rootfs: &imagedefinition.Rootfs{Tarball: &imagedefinition.Tarball{
+			TarballURL: "file://" + tarPath,
+			GPG:        server.URL + "/rootfs.tar.gpg",
+			Keyring:    "keyring.gpg",
+		}},
+	}
+	err = otherStateMachine.makeTemporaryDirectories()
+	asserter.AssertErrNil(err, true)
+	t.Cleanup(func() { os.RemoveAll(otherStateMachine.stateMachineFlags.WorkDir) })
+	err = os.WriteFile(filepath.Join(otherStateMachine.ConfDefPath, "keyring.gpg"), otherKeyringData, 0644)
+	asserter.AssertErrNil(err, true)
+	err = otherStateMachine.extractRootfsTar()
+	asserter.AssertErrContains(err, "Error verifying the GPG signature of rootfs tarball")
+}
+
+// TestLocalTarballFile tests that files with the same name at different
+// URLs are downloaded to different files
+func TestLocalTarballFile(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.URL.String()))
+	}))
+	t.Cleanup(server.Close)
+
+	var stateMachine StateMachine
+	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+	stateMachine.commonFlags.Quiet = true
+	stateMachine.stateMachineFlags.WorkDir = t.TempDir()
+
+	downloaded := make(map[string]string)
+	for _, url := range []string{"/jammy/rootfs.tar", "/noble/rootfs.tar", "/rootfs.tar?release=jammy", "/rootfs.tar?release=noble"} {
+		localPath, err := stateMachine.localTarballFile(server.URL+url, "")
+		asserter.AssertErrNil(err, true)
+		if _, found := downloaded[localPath]; found {
+			t.Errorf("%s and %s are downloaded to the same file", downloaded[localPath], url)
+		}
+		downloaded[localPath] = url
+		asserter.AssertEqual(true, strings.HasSuffix(localPath, "-rootfs.tar"))
+		content, err := os.ReadFile(localPath)
+		asserter.AssertErrNil(err, true)
+		asserter.AssertEqual(url, string(content))
+	}
+}
+
+// TestLocalTarballFileReuse tests that a file downloaded by a previous run is
+// only reused when its sha256 sum matches the declared one
+func TestLocalTarballFileReuse(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	var lock sync.Mutex
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		requests++
+		content := fmt.Sprintf("version %d", requests)
+		lock.Unlock()
+		http.ServeContent(w, r, "rootfs.tar", time.Time{}, strings.NewReader(content))
+	}))
+	t.Cleanup(server.Close)
+
+	var stateMachine StateMachine
+	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+	stateMachine.commonFlags.Quiet = true
+	stateMachine.stateMachineFlags.WorkDir = t.TempDir()
+
+	testCases := []struct {
+		name             string
+		sha256sum        string
+		expectedContent  string
+		expectedRequests int
+	}{
+		{"first_download", "", "version 1", 1},
+		{"no_sha256sum", "", "version 2", 2},
+		{"matching_sha256sum", fmt.Sprintf("%X", sha256.Sum256([]byte("version 2"))), "version 2", 2},
+		{"other_sha256sum", fmt.Sprintf("%x", sha256.Sum256([]byte("version 1"))), "version 3", 3},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			localPath, err := stateMachine.localTarballFile(server.URL+"/rootfs.tar", tc.sha256sum)
+			asserter.AssertErrNil(err, true)
+			content, err := os.ReadFile(localPath)
+			asserter.AssertErrNil(err, true)
+			asserter.AssertEqual(tc.expectedContent, string(content))
+			asserter.AssertEqual(tc.expectedRequests, requests)
+		})
+	}
+}
+
+// TestFailedDownloadTarball tests that server errors are retried, unlike
+// client errors
+func TestFailedDownloadTarball(t *testing.T) {
+	saveDelay := tarballRetryDelay
+	tarballRetryDelay = 0
+	t.Cleanup(func() { tarballRetryDelay = saveDelay })
+	httpDo = (&http.Client{Timeout: 100 * time.Millisecond}).Do
+	t.Cleanup(func() { httpDo = (&http.Client{Timeout: tarballDownloadTimeout}).Do })
+
+	var lock sync.Mutex
+	requests := map[string]int{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		requests[r.URL.Path]++
+		lock.Unlock()
+		switch r.URL.Path {
+		case "/unavailable.tar":
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case "/stalled.tar":
+			// the server never answers
+			select {
+			case <-r.Context().Done():
+			case <-time.After(5 * time.Second):
+			}
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	testCases := []struct {
+		name             string
+		path             string
+		expectedError    string
+		expectedRequests int
+	}{
+		{"not_found", "/missing.tar", "Error downloading " + server.URL + "/missing.tar: server returned 404", 1},
+		{"unavailable", "/unavailable.tar", "after 3 attempts: server returned 503", 3},
+		{"stalled", "/stalled.tar", "Client.Timeout exceeded", 3},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			var stateMachine ClassicStateMachine
+			stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+			stateMachine.parent = &stateMachine
+			stateMachine.commonFlags.Quiet = true
+			stateMachine.ConfDefPath = t.TempDir()
+			stateMachine.ImageDef = imagedefinition.ImageDefinition{
+				Rootfs: &imagedefinition.Rootfs{Tarball: &imagedefinition.Tarball{TarballURL: server.URL + tc.path}},
+			}
+			err := stateMachine.makeTemporaryDirectories()
+			asserter.AssertErrNil(err, true)
+			t.Cleanup(func() { os.RemoveAll(stateMachine.stateMachineFlags.WorkDir) })
+			err = stateMachine.extractRootfsTar()
+			asserter.AssertErrContains(err, tc.expectedError)
+			asserter.AssertEqual(tc.expectedRequests, requests[tc.path])
+		})
+	}
+}
@@ -0,0 +1,432 @@
+package statemachine
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/snapcore/snapd/gadget"
+	"github.com/xeipuuv/gojsonschema"
+	yamlv3 "gopkg.in/yaml.v3"
+
+	"github.com/canonical/ubuntu-image/internal/helper"
+	"github.com/canonical/ubuntu-image/internal/imagedefinition"
+)
+
+// yamlLineRegex matches the line numbers given in the errors of the YAML parsers
+var yamlLineRegex = regexp.MustCompile(`line (\d+)`)
+
+// ValidationError is a problem found in an image definition or in its
+// gadget.yaml, located at a line of one of their files when possible
+type ValidationError struct {
+	File    string
+	Line    int
+	Message string
+}
+
+func (validationError ValidationError) Error() string {
+	if validationError.Line > 0 {
+		return fmt.Sprintf("%s:%d: %s", validationError.File, validationError.Line, validationError.Message)
+	}
+	return fmt.Sprintf("%s: %s", validationError.File, validationError.Message)
+}
+
+// ValidateImageDefinition checks an image definition without building the
+// image: it is validated against its schema, the local files it references
+// must exist and its gadget.yaml, or the one given, must be valid. Every
+// problem found is returned. The error is only set when the image
+// definition can not be read at all
+func ValidateImageDefinition(imageDefinitionPath string, set []string, gadgetYamlPath string) ([]ValidationError, error) {
+	var classicStateMachine ClassicStateMachine
+	classicStateMachine.parent = &classicStateMachine
+	classicStateMachine.Args.ImageDefinition = imageDefinitionPath
+	classicStateMachine.Opts.Set = set
+	if err := classicStateMachine.setConfDefDir(imageDefinitionPath); err != nil {
+		return nil, err
+	}
+
+	imageDefinition, merger, result, err := classicStateMachine.readImageDefinition()
+	if err != nil {
+		return nil, err
+	}
+	locator := newYAMLLocator(merger.files)
+
+	var validationErrors []ValidationError
+	for _, resultError := range result.Errors() {
+		yamlPath, value := resultErrorPath(resultError)
+		file, line := locator.locate(yamlPath, value)
+		message := resultError.Description()
+		if len(yamlPath) > 0 && !isCustomError(resultError) {
+			message = formatYAMLPath(yamlPath) + ": " + message
+		}
+		validationErrors = append(validationErrors, ValidationError{File: file, Line: line, Message: message})
+	}
+
+	for _, missing := range classicStateMachine.missingLocalFiles(&imageDefinition) {
+		file, line := locator.locate(missing.yamlPath, missing.value)
+		validationErrors = append(validationErrors, ValidationError{File: file, Line: line, Message: missing.message})
+	}
+
+	// the schema errors are not reported in a stable order
+	fileIndexes := make(map[string]int)
+	for i, file := range merger.files {
+		fileIndexes[file] = i
+	}
+	sort.SliceStable(validationErrors, func(i, j int) bool {
+		if validationErrors[i].File != validationErrors[j].File {
+			return fileIndexes[validationErrors[i].File] < fileIndexes[validationErrors[j].File]
+		}
+		return validationErrors[i].Line < validationErrors[j].Line
+	})
+
+	if gadgetYamlPath == "" {
+		gadgetYamlPath = classicStateMachine.localGadgetYaml(&imageDefinition)
+	}
+	if gadgetYamlPath != "" {
+		validationErrors = append(validationErrors, validateGadgetYaml(gadgetYamlPath)...)
+	}
+	return validationErrors, nil
+}
+
+// isCustomError returns whether a validation error was added by the checks
+// that the schema can not express. Their messages already name their keys
+func isCustomError(resultError gojsonschema.ResultError) bool {
+	switch resultError.(type) {
+	case *imagedefinition.MissingURLError, *imagedefinition.InvalidPPAError,
+		*imagedefinition.PathNotAbsoluteError, *imagedefinition.DependentKeyError, *helper.MissingFieldError:
+		return true
+	}
+	return false
+}
+
+// resultErrorPath returns the keys of the image definition a validation
+// error is about, and the value it is about when it is known
+func resultErrorPath(resultError gojsonschema.ResultError) ([]interface{}, string) {
+	details := resultError.Details()
+	detail := func(name string) string {
+		value, _ := details[name].(string)
+		return value
+	}
+	switch resultError.(type) {
+	case *imagedefinition.MissingURLError:
+		return splitKeys(detail("key")), ""
+	case *imagedefinition.PathNotAbsoluteError:
+		return splitKeys(detail("key")), detail("value")
+	case *imagedefinition.InvalidPPAError:
+		return []interface{}{"customization", "extra-ppas"}, detail("ppaName")
+	case *imagedefinition.DependentKeyError:
+		// disk artifacts used without a gadget are named after their key
+		if detail("key2") == "gadget:" {
+			return []interface{}{"artifacts", strings.TrimSuffix(detail("key1"), ":")}, ""
+		}
+		return splitKeys(detail("key1")), ""
+	case *helper.MissingFieldError:
+		return nil, ""
+	}
+	return jsonFieldToYAMLPath(resultError.Field())
+}
+
+// splitKeys splits the keys written as key:subkey: in the custom validation errors
+func splitKeys(keys string) []interface{} {
+	var yamlPath []interface{}
+	for _, key := range strings.Split(keys, ":") {
+		if key != "" {
+			yamlPath = append(yamlPath, key)
+		}
+	}
+	return yamlPath
+}
+
+// jsonFieldToYAMLPath converts the field of a schema validation error, named
+// after the JSON names of the image definition structs, to YAML keys
+func jsonFieldToYAMLPath(field string) ([]interface{}, string) {
+	var yamlPath []interface{}
+	if field == "(root)" || field == "" {
+		return yamlPath, ""
+	}
+	fieldType := reflect.TypeOf(imagedefinition.ImageDefinition{})
+	for _, name := range strings.Split(field, ".") {
+		for fieldType.Kind() == reflect.Ptr {
+			fieldType = fieldType.Elem()
+		}
+		if index, err := strconv.Atoi(name); err == nil && fieldType.Kind() == reflect.Slice {
+			yamlPath = append(yamlPath, index)
+			fieldType = fieldType.Elem()
+			continue
+		}
+		if fieldType.Kind() != reflect.Struct {
+			break
+		}
+		found := false
+		for i := 0; i < fieldType.NumField(); i++ {
+			structField := fieldType.Field(i)
+			if strings.Split(structField.Tag.Get("json"), ",")[0] == name {
+				yamlPath = append(yamlPath, strings.Split(structField.Tag.Get("yaml"), ",")[0])
+				fieldType = structField.Type
+				found = true
+				break
+			}
+		}
+		if !found {
+			break
+		}
+	}
+	return yamlPath, ""
+}
+
+// formatYAMLPath writes YAML keys the way they are written in messages
+func formatYAMLPath(yamlPath []interface{}) string {
+	var keys []string
+	for _, key := range yamlPath {
+		keys = append(keys, fmt.Sprint(key))
+	}
+	return strings.Join(keys, ":")
+}
+
+// missingLocalFile is a local file referenced by an image definition that does not exist
+type missingLocalFile struct {
+	yamlPath []interface{}
+	value    string
+	message  string
+}
+
+// missingLocalFiles checks that the local files referenced by an image
+// definition exist. The scripts of execute customizations are run from the
+// rootfs, so they are only checked through the copy-file customizations
+// copying them there
+func (classicStateMachine *ClassicStateMachine) missingLocalFiles(imageDefinition *imagedefinition.ImageDefinition) []missingLocalFile {
+	var missing []missingLocalFile
+	check := func(yamlPath []interface{}, value string, localPath string, description string) {
+		if _, err := os.Stat(localPath); err != nil {
+			missing = append(missing, missingLocalFile{
+				yamlPath: yamlPath,
+				value:    value,
+				message:  fmt.Sprintf("%s \"%s\" does not exist", description, localPath),
+			})
+		}
+	}
+	// paths are relative to the image definition, and may be file:// URLs
+	checkPath := func(yamlPath []interface{}, path string, description string) {
+		localPath := strings.TrimPrefix(path, "file://")
+		if !filepath.IsAbs(localPath) {
+			localPath = filepath.Join(classicStateMachine.ConfDefPath, localPath)
+		}
+		check(yamlPath, path, localPath, description)
+	}
+
+	if gadgetDir := classicStateMachine.localGadgetDir(imageDefinition); gadgetDir != "" {
+		check([]interface{}{"gadget", "url"}, imageDefinition.Gadget.GadgetURL, gadgetDir, "Gadget directory")
+	}
+	if imageDefinition.Gadget != nil && imageDefinition.Gadget.Auth != nil {
+		auth := imageDefinition.Gadget.Auth
+		if auth.SSHKey != "" {
+			checkPath([]interface{}{"gadget", "auth", "ssh-key"}, auth.SSHKey, "SSH key")
+		}
+		if auth.PassphraseFile != "" {
+			checkPath([]interface{}{"gadget", "auth", "passphrase-file"}, auth.PassphraseFile, "Passphrase file")
+		}
+		if auth.TokenFile != "" {
+			checkPath([]interface{}{"gadget", "auth", "token-file"}, auth.TokenFile, "Token file")
+		}
+	}
+	if imageDefinition.ModelAssertion != "" {
+		checkPath([]interface{}{"model-assertion"}, imageDefinition.ModelAssertion, "Model assertion")
+	}
+	if imageDefinition.Rootfs != nil && imageDefinition.Rootfs.Tarball != nil {
+		tarball := imageDefinition.Rootfs.Tarball
+		if strings.HasPrefix(tarball.TarballURL, "file://") {
+			checkPath([]interface{}{"rootfs", "tarball", "url"}, tarball.TarballURL, "Tarball")
+		}
+		if tarball.GPG != "" && !isHTTPURL(tarball.GPG) {
+			checkPath([]interface{}{"rootfs", "tarball", "gpg"}, tarball.GPG, "Tarball signature")
+		}
+		if tarball.Keyring != "" {
+			checkPath([]interface{}{"rootfs", "tarball", "keyring"}, tarball.Keyring, "Keyring")
+		}
+	}
+	if customization := imageDefinition.Customization; customization != nil {
+		if customization.Installer != nil {
+			for i, preseed := range customization.Installer.Preseeds {
+				checkPath([]interface{}{"customization", "installer", "preseeds", i}, preseed, "Preseed file")
+			}
+		}
+		// the sources of copies are always below the directory of the image definition
+		if manual := customization.Manual; manual != nil {
+			for i, copyFile := range manual.CopyFile {
+				check([]interface{}{"customization", "manual", "copy-file", i, "source"}, copyFile.Source,
+					filepath.Join(classicStateMachine.ConfDefPath, copyFile.Source), "copy-file source")
+			}
+			for i, copyTree := range manual.CopyTree {
+				check([]interface{}{"customization", "manual", "copy-tree", i, "source"}, copyTree.Source,
+					filepath.Join(classicStateMachine.ConfDefPath, copyTree.Source), "copy-tree source")
+			}
+		}
+	}
+	if imageDefinition.Store != nil && imageDefinition.Store.AuthFile != "" {
+		checkPath([]interface{}{"store", "auth-file"}, imageDefinition.Store.AuthFile, "Store credentials")
+	}
+	for i, hooksDir := range imageDefinition.Hooks {
+		checkPath([]interface{}{"hooks", i}, hooksDir, "Hooks directory")
+	}
+	if imageDefinition.Signing != nil {
+		checkPath([]interface{}{"signing", "key"}, imageDefinition.Signing.Key, "Signing key")
+		if imageDefinition.Signing.PassphraseFile != "" {
+			checkPath([]interface{}{"signing", "passphrase-file"}, imageDefinition.Signing.PassphraseFile,
+				"Passphrase file")
+		}
+	}
+	return missing
+}
+
+// localGadgetDir returns the directory of gadgets that are local directories,
+// resolved the way the build resolves it: source trees are relative to the
+// image definition and prebuilt gadgets to the current directory. Git
+// gadgets can not be checked without cloning them
+func (classicStateMachine *ClassicStateMachine) localGadgetDir(imageDefinition *imagedefinition.ImageDefinition) string {
+	if imageDefinition.Gadget == nil || imageDefinition.Gadget.GadgetType == "git" ||
+		imageDefinition.Gadget.GadgetURL == "" {
+		return ""
+	}
+	gadgetDir := strings.TrimPrefix(imageDefinition.Gadget.GadgetURL, "file://")
+	if filepath.IsAbs(gadgetDir) {
+		return gadgetDir
+	}
+	if imageDefinition.Gadget.GadgetType == "prebuilt" {
+		gadgetDir, _ = filepath.Abs(gadgetDir)
+		return gadgetDir
+	}
+	return filepath.Join(classicStateMachine.ConfDefPath, gadgetDir)
+}
+
+// localGadgetYaml returns the path of the gadget.yaml of gadgets that are
+// local directories, if it exists
+func (classicStateMachine *ClassicStateMachine) localGadgetYaml(imageDefinition *imagedefinition.ImageDefinition) string {
+	gadgetDir := classicStateMachine.localGadgetDir(imageDefinition)
+	if gadgetDir == "" {
+		return ""
+	}
+	gadgetYamlPath := filepath.Join(gadgetDir, gadgetYamlPathInTree)
+	if _, err := os.Stat(gadgetYamlPath); err != nil {
+		return ""
+	}
+	return gadgetYamlPath
+}
+
+// validateGadgetYaml checks a gadget.yaml with the gadget package of snapd
+func validateGadgetYaml(gadgetYamlPath string) []ValidationError {
+	gadgetYaml, err := osReadFile(gadgetYamlPath)
+	if err != nil {
+		return []ValidationError{{File: gadgetYamlPath, Message: fmt.Sprintf("Error reading gadget.yaml: %s", err.Error())}}
+	}
+	info, err := gadget.InfoFromGadgetYaml(gadgetYaml, nil)
+	if err == nil {
+		err = gadget.Validate(info, nil, nil)
+	}
+	if err != nil {
+		line := 0
+		if matches := yamlLineRegex.FindStringSubmatch(err.Error()); matches != nil {
+			line, _ = strconv.Atoi(matches[1])
+		}
+		return []ValidationError{{File: gadgetYamlPath, Line: line, Message: err.Error()}}
+	}
+	return nil
+}
+
+// yamlLocator finds the lines of the keys of an image definition in the
+// files it was merged from
+type yamlLocator struct {
+	files     []string
+	documents []*yamlv3.Node
+}
+
+// newYAMLLocator parses the files an image definition was merged from.
+// Files that can not be parsed are ignored, as their errors were already reported
+func newYAMLLocator(files []string) *yamlLocator {
+	locator := &yamlLocator{files: files, documents: make([]*yamlv3.Node, len(files))}
+	for i, file := range files {
+		data, err := osReadFile(file)
+		if err != nil {
+			continue
+		}
+		var document yamlv3.Node
+		if err := yamlv3.Unmarshal(data, &document); err == nil {
+			locator.documents[i] = &document
+		}
+	}
+	return locator
+}
+
+// locate returns the file and the line of the given keys, or of the given
+// value below them when it is set. When no file has all the keys, the line
+// of the deepest key found is returned
+func (locator *yamlLocator) locate(yamlPath []interface{}, value string) (string, int) {
+	bestFile, bestLine, bestDepth := "", 0, -1
+	if len(locator.files) > 0 {
+		bestFile = locator.files[0]
+	}
+	for i, document := range locator.documents {
+		if document == nil || len(document.Content) == 0 {
+			continue
+		}
+		node, line, depth := walkYAML(document.Content[0], yamlPath)
+		if value != "" {
+			if valueNode := findYAMLValue(node, value); valueNode != nil {
+				return locator.files[i], valueNode.Line
+			}
+		} else if depth == len(yamlPath) {
+			return locator.files[i], line
+		}
+		if depth > bestDepth {
+			bestFile, bestLine, bestDepth = locator.files[i], line, depth
+		}
+	}
+	return bestFile, bestLine
+}
+
+// walkYAML follows keys and list indexes from a node. It returns the deepest
+// node found, the line where it starts, which is the line of its key for the
+// values of mappings, and the number of keys followed
+func walkYAML(node *yamlv3.Node, yamlPath []interface{}) (*yamlv3.Node, int, int) {
+	line := node.Line
+	for depth, key := range yamlPath {
+		var next *yamlv3.Node
+		nextLine := 0
+		switch node.Kind {
+		case yamlv3.MappingNode:
+			for i := 0; i+1 < len(node.Content); i += 2 {
+				if node.Content[i].Value == fmt.Sprint(key) {
+					next, nextLine = node.Content[i+1], node.Content[i].Line
+					break
+				}
+			}
+		case yamlv3.SequenceNode:
+			if index, ok := key.(int); ok && index < len(node.Content) {
+				next = node.Content[index]
+				nextLine = next.Line
+			}
+		}
+		if next == nil {
+			return node, line, depth
+		}
+		node, line = next, nextLine
+	}
+	return node, line, len(yamlPath)
+}
+
+// findYAMLValue returns the first scalar holding value below a node
+func findYAMLValue(node *yamlv3.Node, value string) *yamlv3.Node {
+	if node.Kind == yamlv3.ScalarNode && node.Value == value {
+		return node
+	}
+	for _, child := range node.Content {
+		if found := findYAMLValue(child, value); found != nil {
+			return found
+		}
+	}
+	return nil
+}
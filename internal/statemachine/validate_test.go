@@ -0,0 +1,120 @@
+package statemachine
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/canonical/ubuntu-image/internal/helper"
+)
+
+// TestValidateImageDefinition tests that every problem of an image definition
+// and of its gadget.yaml is found and located in the files it comes from
+func TestValidateImageDefinition(t *testing.T) {
+	restoreCWD := helper.SaveCWD()
+	t.Cleanup(restoreCWD)
+	validateDir := filepath.Join("testdata", "image_definitions", "validate")
+	absValidateDir, err := filepath.Abs(validateDir)
+	if err != nil {
+		t.Fatalf("Error getting the absolute path of the test data: %s", err.Error())
+	}
+	absTestdataDir := filepath.Dir(filepath.Dir(absValidateDir))
+
+	testCases := []struct {
+		name            string
+		imageDefinition string
+		gadgetYaml      string
+		expectedErrors  []ValidationError // the messages are only expected to start with the given ones
+	}{
+		{"valid", "valid.yaml", "", nil},
+		{"invalid", "invalid.yaml", "", []ValidationError{
+			{filepath.Join(validateDir, "invalid.yaml"), 8, "class: Class must be one of the following"},
+			{filepath.Join(validateDir, "invalid.yaml"), 27,
+				"copy-file source \"" + filepath.Join(absValidateDir, "files", "missing.sh") + "\" does not exist"},
+			{filepath.Join(validateDir, "common.yaml"), 4, "customization:extra-ppas:0:name: Does not match pattern"},
+			{filepath.Join(absTestdataDir, "gadget_tree_invalid", "meta", "gadget.yaml"), 1,
+				"cannot parse gadget metadata"},
+		}},
+		{"gadget_yaml", "valid.yaml", filepath.Join(validateDir, "gadget.yaml"), []ValidationError{
+			{filepath.Join(validateDir, "gadget.yaml"), 0, "invalid volume \"pc\": invalid structure #1 (\"ubuntu-boot\")"},
+		}},
+		{"missing_gadget_yaml", "valid.yaml", filepath.Join(validateDir, "missing.yaml"), []ValidationError{
+			{filepath.Join(validateDir, "missing.yaml"), 0, "Error reading gadget.yaml"},
+		}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			validationErrors, err := ValidateImageDefinition(filepath.Join(validateDir, tc.imageDefinition),
+				nil, tc.gadgetYaml)
+			asserter.AssertErrNil(err, true)
+			if len(validationErrors) != len(tc.expectedErrors) {
+				t.Fatalf("Expected %d problems, got %v", len(tc.expectedErrors), validationErrors)
+			}
+			for i, expected := range tc.expectedErrors {
+				got := validationErrors[i]
+				if got.File != expected.File || got.Line != expected.Line ||
+					!strings.HasPrefix(got.Message, expected.Message) {
+					t.Errorf("Expected problem %q, got %q", expected.Error(), got.Error())
+				}
+			}
+		})
+	}
+}
+
+// TestFailedValidateImageDefinition tests that image definitions that can
+// not be read are not validated
+func TestFailedValidateImageDefinition(t *testing.T) {
+	restoreCWD := helper.SaveCWD()
+	t.Cleanup(restoreCWD)
+	testCases := []struct {
+		name            string
+		imageDefinition string
+		set             []string
+		expectedError   string
+	}{
+		{"missing_image_definition", filepath.Join("validate", "missing.yaml"), nil,
+			"Error opening image definition file"},
+		{"invalid_yaml", "test_invalid_yaml.yaml", nil, "yaml:"},
+		{"invalid_set", filepath.Join("validate", "valid.yaml"), []string{"SERIES"}, "Invalid --set \"SERIES\""},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			_, err := ValidateImageDefinition(filepath.Join("testdata", "image_definitions", tc.imageDefinition),
+				tc.set, "")
+			asserter.AssertErrContains(err, tc.expectedError)
+		})
+	}
+}
+
+// TestValidationErrorLocation tests that the problems of image definitions are
+// located at their values or, when the keys are missing, at their parent keys
+func TestValidationErrorLocation(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	restoreCWD := helper.SaveCWD()
+	t.Cleanup(restoreCWD)
+	validateDir := filepath.Join("testdata", "image_definitions", "validate")
+	locator := newYAMLLocator([]string{filepath.Join(validateDir, "invalid.yaml"), filepath.Join(validateDir, "common.yaml")})
+
+	testCases := []struct {
+		name         string
+		yamlPath     []interface{}
+		value        string
+		expectedFile string
+		expectedLine int
+	}{
+		{"key", []interface{}{"rootfs", "seed", "branch"}, "", "invalid.yaml", 17},
+		{"list_item", []interface{}{"customization", "manual", "copy-file", 1, "source"}, "", "invalid.yaml", 27},
+		{"value", []interface{}{"customization", "extra-ppas"}, "not-a-ppa", "common.yaml", 4},
+		{"missing_key", []interface{}{"rootfs", "tarball", "url"}, "", "invalid.yaml", 13},
+		{"root", nil, "", "invalid.yaml", 1},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			file, line := locator.locate(tc.yamlPath, tc.value)
+			asserter.AssertEqual(filepath.Join(validateDir, tc.expectedFile), file)
+			asserter.AssertEqual(tc.expectedLine, line)
+		})
+	}
+}